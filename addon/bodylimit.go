@@ -0,0 +1,72 @@
+package addon
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// reject request body larger than MaxSize with 413
+// 与 Options.StreamLargeBodies 不同，超过限制时直接拒绝，而不是转为 stream 模式:
+//   1. Content-Length 超过限制时，不读取 body 直接响应 413
+//   2. chunked 等未知长度的请求，读取 body 时超过限制即中止
+
+type RequestBodyLimit struct {
+	proxy.BaseAddon
+	MaxSize int64 // 请求 body 最大字节数，0 表示不限制
+}
+
+func NewRequestBodyLimit(maxSize int64) *RequestBodyLimit {
+	return &RequestBodyLimit{MaxSize: maxSize}
+}
+
+func (l *RequestBodyLimit) Requestheaders(f *proxy.Flow) {
+	if l.MaxSize <= 0 {
+		return
+	}
+	raw := f.Request.Raw()
+	if raw == nil || raw.Body == nil || raw.Body == http.NoBody {
+		return
+	}
+
+	if raw.ContentLength > l.MaxSize {
+		log.Warnf("request body limit: %v Content-Length %v > %v", f.Request.URL.String(), raw.ContentLength, l.MaxSize)
+		body := []byte(proxy.ErrRequestBodyTooLarge.Error())
+		f.Response = &proxy.Response{
+			StatusCode: http.StatusRequestEntityTooLarge,
+			Header: http.Header{
+				"Content-Type":   []string{"text/plain; charset=utf-8"},
+				"Content-Length": []string{strconv.Itoa(len(body))},
+				"Connection":     []string{"close"},
+			},
+			Body: body,
+		}
+		return
+	}
+
+	// Content-Length 已知且未超过限制时，body 长度由 http server 保证
+	if raw.ContentLength < 0 {
+		raw.Body = &limitedBody{ReadCloser: raw.Body, remaining: l.MaxSize}
+	}
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		b.remaining = 0
+		return 0, proxy.ErrRequestBodyTooLarge
+	}
+	b.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,125 @@
+package addon
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+)
+
+type streamPathAddon struct {
+	proxy.BaseAddon
+}
+
+func (a *streamPathAddon) Requestheaders(f *proxy.Flow) {
+	if f.Request.URL.Path == "/stream" {
+		f.Stream = true
+	}
+}
+
+func TestRequestBodyLimit(t *testing.T) {
+	var upstreamHits int64
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&upstreamHits, 1)
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Write([]byte(strconv.Itoa(len(body))))
+		}),
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go server.Serve(ln)
+
+	testProxy, err := proxy.NewProxy(&proxy.Options{
+		HttpAddr: ":29095",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testProxy.AddAddon(&streamPathAddon{})
+	testProxy.AddAddon(NewRequestBodyLimit(100))
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29095")
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	post := func(body io.Reader, path ...string) int {
+		endpoint := "http://" + ln.Addr().String() + "/upload"
+		if len(path) > 0 {
+			endpoint = "http://" + ln.Addr().String() + path[0]
+		}
+		res, err := proxyClient.Post(endpoint, "text/plain", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		return res.StatusCode
+	}
+	// io.MultiReader hides length, client sends chunked body
+	chunked := func(size int) io.Reader {
+		return io.MultiReader(strings.NewReader(strings.Repeat("a", size)))
+	}
+
+	t.Run("content-length within limit", func(t *testing.T) {
+		if code := post(bytes.NewReader(make([]byte, 100))); code != 200 {
+			t.Fatalf("expected 200, but got %v", code)
+		}
+	})
+
+	t.Run("content-length over limit", func(t *testing.T) {
+		hits := atomic.LoadInt64(&upstreamHits)
+		if code := post(bytes.NewReader(make([]byte, 101))); code != 413 {
+			t.Fatalf("expected 413, but got %v", code)
+		}
+		if atomic.LoadInt64(&upstreamHits) != hits {
+			t.Fatal("should not reach upstream")
+		}
+	})
+
+	t.Run("chunked within limit", func(t *testing.T) {
+		if code := post(chunked(100)); code != 200 {
+			t.Fatalf("expected 200, but got %v", code)
+		}
+	})
+
+	t.Run("chunked over limit", func(t *testing.T) {
+		hits := atomic.LoadInt64(&upstreamHits)
+		if code := post(chunked(500)); code != 413 {
+			t.Fatalf("expected 413, but got %v", code)
+		}
+		if atomic.LoadInt64(&upstreamHits) != hits {
+			t.Fatal("should not reach upstream")
+		}
+	})
+
+	t.Run("chunked within limit in stream mode", func(t *testing.T) {
+		if code := post(chunked(100), "/stream"); code != 200 {
+			t.Fatalf("expected 200, but got %v", code)
+		}
+	})
+
+	t.Run("chunked over limit in stream mode", func(t *testing.T) {
+		if code := post(chunked(4096), "/stream"); code != 413 {
+			t.Fatalf("expected 413, but got %v", code)
+		}
+	})
+}
@@ -0,0 +1,166 @@
+package addon
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+)
+
+// 复现包，zip 格式，便于分享给他人复现问题:
+//   README.md             说明
+//   replay.sh             使用 curl 重放请求的脚本
+//   ca.pem                代理根证书，可选
+//   flows/<id>.json       flow 的完整内容，同 JSONFlowCodec，body 为 base64
+//   flows/<id>.req        请求 body 原始内容，供 replay.sh 使用
+
+const bundleReadme = `# go-mitmproxy replay bundle
+
+Files:
+
+- flows/<id>.json: captured flows, including headers and bodies (base64)
+- flows/<id>.req: raw request bodies used by replay.sh
+- ca.pem: root certificate of the proxy that captured the flows, if included
+- replay.sh: replays every request with curl
+
+Replay directly against the original servers:
+
+    sh replay.sh
+
+Replay through a go-mitmproxy started with the same CA:
+
+    PROXY=http://127.0.0.1:9080 sh replay.sh
+`
+
+// 重放时不发送的 header，由 curl 自行生成
+var bundleSkipHeaders = map[string]bool{
+	"Content-Length":    true,
+	"Connection":        true,
+	"Proxy-Connection":  true,
+	"Keep-Alive":        true,
+	"Transfer-Encoding": true,
+}
+
+// 将 flow 导出为复现包，ca 为 nil 时不包含根证书
+func ExportBundle(w io.Writer, flows []*CapturedFlow, ca *x509.Certificate) error {
+	zw := zip.NewWriter(w)
+	codec := JSONFlowCodec{}
+
+	if err := writeZipFile(zw, "README.md", []byte(bundleReadme)); err != nil {
+		return err
+	}
+	if err := writeZipFile(zw, "replay.sh", bundleScript(flows, ca != nil)); err != nil {
+		return err
+	}
+	if ca != nil {
+		data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+		if err := writeZipFile(zw, "ca.pem", data); err != nil {
+			return err
+		}
+	}
+	for i, f := range flows {
+		name := bundleEntryName(f.Id, i)
+		data, err := codec.Marshal(f)
+		if err != nil {
+			return err
+		}
+		if err := writeZipFile(zw, "flows/"+name+".json", data); err != nil {
+			return err
+		}
+		if len(f.RequestBody) > 0 {
+			if err := writeZipFile(zw, "flows/"+name+".req", f.RequestBody); err != nil {
+				return err
+			}
+		}
+	}
+	return zw.Close()
+}
+
+// 导出单个 flow
+func ExportFlowBundle(w io.Writer, f *proxy.Flow, ca *x509.Certificate) error {
+	return ExportBundle(w, []*CapturedFlow{NewCapturedFlow(f)}, ca)
+}
+
+// 导出为文件
+func ExportBundleFile(filename string, flows []*CapturedFlow, ca *x509.Certificate) error {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := ExportBundle(file, flows, ca); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// zip 中的文件名及 replay.sh 中引用的文件名，id 来自外部存储时可能包含路径分隔符或 shell 特殊字符
+// 仅保留字母、数字、- 及 _，为空时使用序号
+func bundleEntryName(id string, i int) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return -1
+	}, id)
+	if name == "" {
+		name = fmt.Sprintf("flow-%d", i)
+	}
+	return name
+}
+
+func writeZipFile(zw *zip.Writer, name string, data []byte) error {
+	fw, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = fw.Write(data)
+	return err
+}
+
+func bundleScript(flows []*CapturedFlow, withCA bool) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("#!/bin/sh\n")
+	buf.WriteString("# replay captured requests, set PROXY to send them through go-mitmproxy\n")
+	buf.WriteString("cd \"$(dirname \"$0\")\"\n\n")
+	if withCA {
+		buf.WriteString("CURL_OPTS=\"${PROXY:+--proxy $PROXY --cacert ca.pem}\"\n\n")
+	} else {
+		buf.WriteString("CURL_OPTS=\"${PROXY:+--proxy $PROXY}\"\n\n")
+	}
+
+	for i, f := range flows {
+		name := bundleEntryName(f.Id, i)
+		fmt.Fprintf(buf, "# %v\n", name)
+		fmt.Fprintf(buf, "curl $CURL_OPTS -sS -i -X %v", shellQuote(f.Method))
+
+		keys := make([]string, 0, len(f.RequestHeader))
+		for key := range f.RequestHeader {
+			if !bundleSkipHeaders[key] {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			for _, value := range f.RequestHeader[key] {
+				fmt.Fprintf(buf, " \\\n  -H %v", shellQuote(key+": "+value))
+			}
+		}
+		if len(f.RequestBody) > 0 {
+			fmt.Fprintf(buf, " \\\n  --data-binary @flows/%v.req", name)
+		}
+		fmt.Fprintf(buf, " \\\n  %v\n\n", shellQuote(f.Url))
+	}
+	return buf.Bytes()
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
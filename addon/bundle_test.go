@@ -0,0 +1,133 @@
+package addon
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/lqqyt2423/go-mitmproxy/cert"
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestExportBundle(t *testing.T) {
+	ca, err := cert.NewCAMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &proxy.Flow{
+		Id: uuid.NewV4(),
+		Request: &proxy.Request{
+			Method: "POST",
+			URL:    &url.URL{Scheme: "https", Host: "example.com", Path: "/api"},
+			Proto:  "HTTP/1.1",
+			Header: http.Header{
+				"Content-Type":   []string{"application/json"},
+				"Content-Length": []string{"11"},
+				"X-Note":         []string{"it's"},
+			},
+			Body: []byte(`{"a":"b c"}`),
+		},
+		Response: &proxy.Response{
+			StatusCode: 201,
+			Header:     http.Header{"Content-Type": []string{"text/plain"}},
+			Body:       []byte("created"),
+		},
+	}
+
+	buf := new(bytes.Buffer)
+	if err := ExportFlowBundle(buf, f, &ca.RootCert); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte)
+	for _, zf := range zr.File {
+		rc, err := zf.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[zf.Name] = data
+	}
+
+	id := f.Id.String()
+	for _, name := range []string{"README.md", "replay.sh", "ca.pem", "flows/" + id + ".json", "flows/" + id + ".req"} {
+		if _, ok := files[name]; !ok {
+			t.Fatalf("bundle missing %v", name)
+		}
+	}
+
+	block, _ := pem.Decode(files["ca.pem"])
+	if block == nil {
+		t.Fatal("ca.pem is not pem")
+	}
+	caCert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !caCert.Equal(&ca.RootCert) {
+		t.Fatal("ca.pem does not match root cert")
+	}
+
+	captured := new(CapturedFlow)
+	if err := (JSONFlowCodec{}).Unmarshal(files["flows/"+id+".json"], captured); err != nil {
+		t.Fatal(err)
+	}
+	if captured.Id != id || captured.Method != "POST" || captured.Url != f.Request.URL.String() {
+		t.Fatalf("unexpected flow: %+v", captured)
+	}
+	if captured.StatusCode != 201 || string(captured.ResponseBody) != "created" {
+		t.Fatalf("unexpected response: %+v", captured)
+	}
+	if string(files["flows/"+id+".req"]) != `{"a":"b c"}` {
+		t.Fatalf("unexpected request body: %s", files["flows/"+id+".req"])
+	}
+
+	script := string(files["replay.sh"])
+	if !strings.Contains(script, `-X 'POST'`) || !strings.Contains(script, `-H 'X-Note: it'\''s'`) {
+		t.Fatalf("unexpected script:\n%v", script)
+	}
+	if !strings.Contains(script, "--data-binary @flows/"+id+".req") || strings.Contains(script, "Content-Length") {
+		t.Fatalf("unexpected script:\n%v", script)
+	}
+}
+
+func TestExportBundleEntryName(t *testing.T) {
+	flows := []*CapturedFlow{
+		{Id: "../../etc/x; rm -rf /", Method: "POST", Url: "http://example.com/", RequestBody: []byte("a")},
+		{Id: "/..", Method: "GET", Url: "http://example.com/"},
+	}
+	buf := new(bytes.Buffer)
+	if err := ExportBundle(buf, flows, nil); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, zf := range zr.File {
+		names[zf.Name] = true
+	}
+	for _, name := range []string{"flows/etcxrm-rf.json", "flows/etcxrm-rf.req", "flows/flow-1.json"} {
+		if !names[name] {
+			t.Fatalf("bundle missing %v, got %v", name, names)
+		}
+	}
+	if script := string(bundleScript(flows, false)); strings.Contains(script, "rm -rf") || !strings.Contains(script, "@flows/etcxrm-rf.req") {
+		t.Fatalf("unexpected script:\n%v", script)
+	}
+}
@@ -0,0 +1,348 @@
+package addon
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/groupcache/lru"
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// 在内存中缓存 GET 请求的响应，按 Cache-Control、Expires 判断是否新鲜，过期后通过 ETag、Last-Modified 向上游验证
+// 命中时在 Requestheaders 中设置 f.Response，不请求上游，之后的 addon 仍会收到 Response 事件
+// 命中及验证后使用缓存的 flow 可通过 f.Metadata(CacheMetadataKey) 获取 CacheHit、CacheRevalidated
+// 上游返回 304 时在 Response 中替换为缓存的响应，需将 Cache 添加在其他 addon 之前，之后的 addon 才能看到替换后的响应
+// 作为共享缓存，不缓存 no-store、private、带 Authorization 的请求的响应，stream 模式的响应及超过 MaxBodySize 的响应
+// 例如:
+//
+//	p.AddAddon(addon.NewCache(10*1024*1024, 1000))
+
+const CacheMetadataKey = "cache"
+
+const (
+	CacheHit         = "hit"         // 新鲜的缓存，未请求上游
+	CacheRevalidated = "revalidated" // 上游返回 304，使用缓存的响应
+)
+
+// 验证过期缓存时，Requestheaders 记录的 *cacheEntry
+const cacheRevalidateMetadataKey = "cache.revalidate"
+
+const defaultCacheMaxBodySize = 5 * 1024 * 1024
+
+type Cache struct {
+	proxy.BaseAddon
+	MaxBodySize int64 // 大于此字节的响应不缓存
+
+	mu      sync.Mutex
+	entries *lru.Cache // key 为 method + url，value 为 []*cacheEntry，按 Vary 区分
+}
+
+// maxBodySize 小于等于 0 时为 5mb，maxEntries 为缓存的 url 数量上限，为 0 时不限制
+func NewCache(maxBodySize int64, maxEntries int) *Cache {
+	if maxBodySize <= 0 {
+		maxBodySize = defaultCacheMaxBodySize
+	}
+	return &Cache{
+		MaxBodySize: maxBodySize,
+		entries:     lru.New(maxEntries),
+	}
+}
+
+type cacheEntry struct {
+	vary       http.Header // Vary 中的请求 header 及缓存时请求中的值
+	response   *proxy.Response
+	stored     time.Time
+	initialAge time.Duration // 缓存时响应的 Age header
+	lifetime   time.Duration // 新鲜的时长，no-cache 时为 0
+}
+
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	return e.initialAge + now.Sub(e.stored)
+}
+
+func (e *cacheEntry) fresh(now time.Time) bool {
+	return e.age(now) < e.lifetime
+}
+
+func (e *cacheEntry) matchVary(req *proxy.Request) bool {
+	for name, values := range e.vary {
+		if strings.Join(req.Header.Values(name), ",") != strings.Join(values, ",") {
+			return false
+		}
+	}
+	return true
+}
+
+func cacheKey(req *proxy.Request) string {
+	return req.Method + " " + req.URL.String()
+}
+
+// directive 名称转为小写，值去除引号，如 max-age=60 为 {"max-age": "60"}，no-cache 为 {"no-cache": ""}
+func parseCacheControl(header http.Header) map[string]string {
+	cc := make(map[string]string)
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, val, _ := strings.Cut(directive, "=")
+			cc[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(val), `"`)
+		}
+	}
+	return cc
+}
+
+func parseSeconds(s string) (time.Duration, bool) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// 需持有 c.mu，兼容未通过 NewCache 创建的 Cache
+func (c *Cache) lru() *lru.Cache {
+	if c.entries == nil {
+		c.entries = lru.New(0)
+	}
+	return c.entries
+}
+
+func (c *Cache) lookup(req *proxy.Request) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, ok := c.lru().Get(cacheKey(req))
+	if !ok {
+		return nil
+	}
+	for _, entry := range value.([]*cacheEntry) {
+		if entry.matchVary(req) {
+			return entry
+		}
+	}
+	return nil
+}
+
+func (c *Cache) store(req *proxy.Request, entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := cacheKey(req)
+	var entries []*cacheEntry
+	if value, ok := c.lru().Get(key); ok {
+		for _, e := range value.([]*cacheEntry) {
+			if !e.matchVary(req) {
+				entries = append(entries, e)
+			}
+		}
+	}
+	c.lru().Add(key, append(entries, entry))
+}
+
+func (c *Cache) Requestheaders(f *proxy.Flow) {
+	if f.Request.Method != "GET" {
+		return
+	}
+	reqCC := parseCacheControl(f.Request.Header)
+	if _, ok := reqCC["no-store"]; ok {
+		return
+	}
+	entry := c.lookup(f.Request)
+	if entry == nil {
+		return
+	}
+
+	_, noCache := reqCC["no-cache"]
+	if f.Request.Header.Get("Pragma") == "no-cache" {
+		noCache = true
+	}
+	if maxAge, ok := parseSeconds(reqCC["max-age"]); ok && entry.age(time.Now()) >= maxAge {
+		noCache = true
+	}
+	if !noCache && entry.fresh(time.Now()) {
+		log.Debugf("cache hit %v", f.Request.URL.String())
+		f.Response = entry.serve(time.Now())
+		f.SetMetadata(CacheMetadataKey, CacheHit)
+		return
+	}
+
+	// 客户端自己发起的条件请求不处理，由上游响应
+	if f.Request.Header.Get("If-None-Match") != "" || f.Request.Header.Get("If-Modified-Since") != "" {
+		return
+	}
+	etag := entry.response.Header.Get("Etag")
+	lastModified := entry.response.Header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return
+	}
+	if etag != "" {
+		f.Request.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		f.Request.Header.Set("If-Modified-Since", lastModified)
+	}
+	f.SetMetadata(cacheRevalidateMetadataKey, entry)
+}
+
+// 每次返回副本，之后的 addon 可能修改 header 及 body
+func (e *cacheEntry) serve(now time.Time) *proxy.Response {
+	res := &proxy.Response{
+		StatusCode: e.response.StatusCode,
+		Header:     e.response.Header.Clone(),
+		Body:       append([]byte{}, e.response.Body...),
+	}
+	res.Header.Set("Age", strconv.Itoa(int(e.age(now)/time.Second)))
+	return res
+}
+
+func (c *Cache) Response(f *proxy.Flow) {
+	if f.Request.Method != "GET" || f.Response == nil {
+		return
+	}
+	if _, ok := f.Metadata(CacheMetadataKey); ok {
+		return
+	}
+	if value, ok := f.Metadata(cacheRevalidateMetadataKey); ok && f.Response.StatusCode == http.StatusNotModified {
+		c.revalidated(f, value.(*cacheEntry))
+		return
+	}
+
+	entry := c.newEntry(f, time.Now())
+	if entry == nil {
+		return
+	}
+	c.store(f.Request, entry)
+	log.Debugf("cache store %v", f.Request.URL.String())
+}
+
+// 以 304 中的 header 更新缓存，并替换为缓存的响应
+func (c *Cache) revalidated(f *proxy.Flow, entry *cacheEntry) {
+	now := time.Now()
+	response := &proxy.Response{
+		StatusCode: entry.response.StatusCode,
+		Header:     entry.response.Header.Clone(),
+		Body:       entry.response.Body,
+	}
+	for name, values := range f.Response.Header {
+		switch http.CanonicalHeaderKey(name) {
+		case "Content-Length", "Content-Encoding", "Transfer-Encoding", "Content-Type":
+			continue
+		}
+		response.Header[name] = values
+	}
+	updated := &cacheEntry{
+		vary:     entry.vary,
+		response: response,
+		stored:   now,
+		lifetime: freshnessLifetime(response.Header, now),
+	}
+	if age, ok := parseSeconds(f.Response.Header.Get("Age")); ok {
+		updated.initialAge = age
+	}
+	if _, noCache := parseCacheControl(response.Header)["no-cache"]; noCache {
+		updated.lifetime = 0
+	}
+	c.store(f.Request, updated)
+
+	log.Debugf("cache revalidated %v", f.Request.URL.String())
+	served := updated.serve(now)
+	f.Response.StatusCode = served.StatusCode
+	f.Response.Header = served.Header
+	f.Response.Body = served.Body
+	f.SetMetadata(CacheMetadataKey, CacheRevalidated)
+}
+
+// 不可缓存时返回 nil
+func (c *Cache) newEntry(f *proxy.Flow, now time.Time) *cacheEntry {
+	req, res := f.Request, f.Response
+	maxBodySize := c.MaxBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = defaultCacheMaxBodySize
+	}
+	if f.Stream || res.BodyReader != nil || int64(len(res.Body)) > maxBodySize {
+		return nil
+	}
+	switch res.StatusCode {
+	case 200, 203, 300, 301, 404, 410:
+	default:
+		return nil
+	}
+	reqCC := parseCacheControl(req.Header)
+	resCC := parseCacheControl(res.Header)
+	if _, ok := reqCC["no-store"]; ok {
+		return nil
+	}
+	if _, ok := resCC["no-store"]; ok {
+		return nil
+	}
+	if _, ok := resCC["private"]; ok {
+		return nil
+	}
+	if req.Header.Get("Authorization") != "" {
+		return nil
+	}
+
+	vary := make(http.Header)
+	for _, value := range res.Header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil
+			}
+			if name != "" {
+				vary[http.CanonicalHeaderKey(name)] = req.Header.Values(name)
+			}
+		}
+	}
+
+	entry := &cacheEntry{
+		vary: vary,
+		response: &proxy.Response{
+			StatusCode: res.StatusCode,
+			Header:     res.Header.Clone(),
+			Body:       append([]byte{}, res.Body...),
+		},
+		stored:   now,
+		lifetime: freshnessLifetime(res.Header, now),
+	}
+	if age, ok := parseSeconds(res.Header.Get("Age")); ok {
+		entry.initialAge = age
+	}
+	if _, ok := resCC["no-cache"]; ok {
+		entry.lifetime = 0
+	}
+	// 既不新鲜也无法验证的响应没有缓存的意义
+	if entry.lifetime <= entry.initialAge && res.Header.Get("Etag") == "" && res.Header.Get("Last-Modified") == "" {
+		return nil
+	}
+	return entry
+}
+
+// 优先级: s-maxage、max-age、Expires - Date，都没有时为 0
+func freshnessLifetime(header http.Header, now time.Time) time.Duration {
+	cc := parseCacheControl(header)
+	if d, ok := parseSeconds(cc["s-maxage"]); ok {
+		return d
+	}
+	if d, ok := parseSeconds(cc["max-age"]); ok {
+		return d
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return 0 // 无效的 Expires 视为已过期
+		}
+		date := now
+		if d, err := http.ParseTime(header.Get("Date")); err == nil {
+			date = d
+		}
+		if lifetime := t.Sub(date); lifetime > 0 {
+			return lifetime
+		}
+	}
+	return 0
+}
@@ -0,0 +1,171 @@
+package addon
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+)
+
+type cacheRecorder struct {
+	proxy.BaseAddon
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *cacheRecorder) Response(f *proxy.Flow) {
+	status, _ := f.Metadata(CacheMetadataKey)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, f.Request.URL.Path+" "+http.StatusText(f.Response.StatusCode)+" "+cacheStatusString(status))
+}
+
+func cacheStatusString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return "-"
+}
+
+func TestCache(t *testing.T) {
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("Cache-Control", "public, max-age=60")
+			w.Write([]byte("fresh"))
+		case "/expires":
+			w.Header().Set("Expires", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+			w.Write([]byte("expires"))
+		case "/etag":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("Etag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Write([]byte("etag body"))
+		case "/nostore":
+			w.Header().Set("Cache-Control", "no-store")
+			w.Write([]byte("nostore"))
+		case "/large":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte(strings.Repeat("x", 200)))
+		case "/vary":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+			w.Write([]byte(r.Header.Get("Accept-Language")))
+		}
+	}))
+	defer origin.Close()
+
+	testProxy, err := proxy.NewProxy(&proxy.Options{
+		HttpAddr:          ":29153",
+		StreamLargeBodies: 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &cacheRecorder{}
+	testProxy.AddAddon(NewCache(100, 0))
+	testProxy.AddAddon(recorder)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29153")
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	get := func(path string, header http.Header) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest("GET", origin.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, string(body)
+	}
+	expectHits := func(path string, n int) {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		if hits[path] != n {
+			t.Fatalf("expected %v upstream requests for %v, got %v", n, path, hits[path])
+		}
+	}
+
+	for _, path := range []string{"/fresh", "/expires", "/etag", "/nostore", "/large"} {
+		for i := 0; i < 2; i++ {
+			if status, body := get(path, nil); status != 200 || body == "" {
+				t.Fatalf("unexpected response %v %v for %v", status, body, path)
+			}
+		}
+	}
+	expectHits("/fresh", 1)
+	expectHits("/expires", 1)
+	expectHits("/etag", 2)
+	expectHits("/nostore", 2)
+	expectHits("/large", 2)
+
+	// 客户端要求不使用缓存
+	get("/fresh", http.Header{"Cache-Control": {"no-cache"}})
+	expectHits("/fresh", 2)
+
+	// 客户端自己的条件请求直接发往上游
+	if status, _ := get("/etag", http.Header{"If-None-Match": {`"v1"`}}); status != http.StatusNotModified {
+		t.Fatalf("expected 304 for client conditional request, got %v", status)
+	}
+
+	if _, body := get("/vary", http.Header{"Accept-Language": {"en"}}); body != "en" {
+		t.Fatalf("unexpected vary body %v", body)
+	}
+	if _, body := get("/vary", http.Header{"Accept-Language": {"zh"}}); body != "zh" {
+		t.Fatalf("unexpected vary body %v", body)
+	}
+	if _, body := get("/vary", http.Header{"Accept-Language": {"en"}}); body != "en" {
+		t.Fatalf("unexpected vary body %v", body)
+	}
+	expectHits("/vary", 2)
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	expected := []string{
+		"/fresh OK -", "/fresh OK hit",
+		"/expires OK -", "/expires OK hit",
+		"/etag OK -", "/etag OK revalidated",
+		"/nostore OK -", "/nostore OK -",
+		"/large OK -", "/large OK -",
+		"/fresh OK -",
+		"/etag Not Modified -",
+		"/vary OK -", "/vary OK -", "/vary OK hit",
+	}
+	if strings.Join(recorder.events, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected events %v, got %v", expected, recorder.events)
+	}
+}
@@ -0,0 +1,311 @@
+package addon
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+	"github.com/samber/lo"
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/match"
+)
+
+// weighted canary routing with response comparison
+// 按比例将请求同时发送至 canary，客户端收到的始终是 primary 的响应，记录两者之间的差异
+
+// 比较时默认忽略的 header
+var defaultCanaryIgnoreHeaders = []string{"Date", "Content-Length", "Set-Cookie"}
+
+// 一次比较中发现的差异
+type CanaryDiff struct {
+	Url     string
+	Status  string   // 为空时表示 status 一致
+	Headers []string // 不一致的 header
+	Body    string   // 为空时表示 body 一致
+}
+
+// CanaryStats 差异统计
+type CanaryStats struct {
+	Total        int64 // 完成比较的请求数
+	Diffs        int64 // 存在差异的请求数
+	StatusDiffs  int64
+	HeaderDiffs  int64
+	BodyDiffs    int64
+	CanaryErrors int64 // 请求 canary 失败数
+}
+
+type canaryResult struct {
+	statusCode int
+	header     http.Header
+	body       []byte
+	err        error
+}
+
+type Canary struct {
+	proxy.BaseAddon
+	Target        string       // canary 地址，如 http://127.0.0.1:8080，替换原请求的 scheme 及 host
+	Percent       float64      // 0 - 100，发送至 canary 的请求比例
+	Hosts         []string     // 匹配原请求 host，支持通配符，为空时匹配全部
+	IgnoreHeaders []string     // 比较时忽略的 header，为空时使用 defaultCanaryIgnoreHeaders
+	MaxDiffs      int          // 最多保留的差异记录数，0 表示 100
+	Client        *http.Client // 为 nil 时使用超时 30s 且不跟随重定向的 client
+
+	initOnce sync.Once
+	target   *url.URL
+	client   *http.Client
+	pending  sync.Map // flow id => chan *canaryResult
+
+	mu    sync.Mutex
+	stats CanaryStats
+	diffs []*CanaryDiff
+}
+
+func NewCanary(target string, percent float64) (*Canary, error) {
+	if _, err := parseCanaryTarget(target); err != nil {
+		return nil, err
+	}
+	if percent < 0 || percent > 100 {
+		return nil, fmt.Errorf("invalid canary percent %v", percent)
+	}
+	return &Canary{
+		Target:  target,
+		Percent: percent,
+	}, nil
+}
+
+func parseCanaryTarget(target string) (*url.URL, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid canary target %v", target)
+	}
+	return u, nil
+}
+
+// 首次使用时解析 Target，直接构造的 Canary{Target: ...} 同样生效
+func (c *Canary) init() {
+	c.initOnce.Do(func() {
+		u, err := parseCanaryTarget(c.Target)
+		if err != nil {
+			log.Warnf("canary disabled: %v", err)
+		} else {
+			c.target = u
+		}
+		c.client = c.Client
+		if c.client == nil {
+			c.client = &http.Client{
+				Timeout: 30 * time.Second,
+				CheckRedirect: func(req *http.Request, via []*http.Request) error {
+					return http.ErrUseLastResponse
+				},
+			}
+		}
+	})
+}
+
+func (c *Canary) match(f *proxy.Flow) bool {
+	c.init()
+	if c.target == nil || c.Percent <= 0 {
+		return false
+	}
+	// stream 模式下请求 body 无法复制
+	if f.Stream {
+		return false
+	}
+	if len(c.Hosts) > 0 && !lo.ContainsBy(c.Hosts, func(host string) bool {
+		return match.Match(f.Request.URL.Hostname(), host)
+	}) {
+		return false
+	}
+	return c.Percent >= 100 || rand.Float64()*100 < c.Percent
+}
+
+func (c *Canary) Request(f *proxy.Flow) {
+	if !c.match(f) {
+		return
+	}
+
+	req, err := c.newCanaryRequest(f.Request)
+	if err != nil {
+		log.Warnf("canary new request %v error: %v", f.Request.URL.String(), err)
+		return
+	}
+
+	ch := make(chan *canaryResult, 1)
+	c.pending.Store(f.Id, ch)
+	go func() {
+		ch <- c.do(req)
+	}()
+
+	// flow 结束时清理，如 primary 请求失败未触发 Response
+	go func(id uuid.UUID) {
+		<-f.Done()
+		c.pending.Delete(id)
+	}(f.Id)
+}
+
+// 不等待 canary 的响应，primary 的响应不受 canary 耗时影响，在后台比较
+func (c *Canary) Response(f *proxy.Flow) {
+	v, ok := c.pending.LoadAndDelete(f.Id)
+	if !ok {
+		return
+	}
+	// 之后的 addon 可能修改 f.Response，比较时使用此时的副本
+	rawUrl := f.Request.URL.String()
+	primary := &proxy.Response{
+		StatusCode: f.Response.StatusCode,
+		Header:     f.Response.Header.Clone(),
+		Body:       f.Response.Body,
+		BodyReader: f.Response.BodyReader,
+	}
+	go func() {
+		result := <-v.(chan *canaryResult)
+		if result.err != nil {
+			log.Warnf("canary request %v error: %v", rawUrl, result.err)
+			c.mu.Lock()
+			c.stats.CanaryErrors++
+			c.mu.Unlock()
+			return
+		}
+		c.record(c.compare(rawUrl, primary, result))
+	}()
+}
+
+func (c *Canary) newCanaryRequest(r *proxy.Request) (*http.Request, error) {
+	u := *r.URL
+	u.Scheme = c.target.Scheme
+	u.Host = c.target.Host
+
+	req, err := http.NewRequest(r.Method, u.String(), bytes.NewReader(r.Body))
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range r.Header {
+		if key == "Connection" || key == "Proxy-Connection" || key == "Proxy-Authorization" {
+			continue
+		}
+		req.Header[key] = append([]string{}, value...)
+	}
+	// 保持与 primary 一致的 Host，便于 canary 按 virtual host 路由
+	req.Host = r.URL.Host
+	return req, nil
+}
+
+func (c *Canary) do(req *http.Request) *canaryResult {
+	res, err := c.client.Do(req)
+	if err != nil {
+		return &canaryResult{err: err}
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return &canaryResult{err: err}
+	}
+	return &canaryResult{
+		statusCode: res.StatusCode,
+		header:     res.Header,
+		body:       body,
+	}
+}
+
+func (c *Canary) compare(rawUrl string, primary *proxy.Response, result *canaryResult) *CanaryDiff {
+	diff := &CanaryDiff{Url: rawUrl}
+
+	if primary.StatusCode != result.statusCode {
+		diff.Status = fmt.Sprintf("%v != %v", primary.StatusCode, result.statusCode)
+	}
+
+	ignore := c.IgnoreHeaders
+	if len(ignore) == 0 {
+		ignore = defaultCanaryIgnoreHeaders
+	}
+	keys := make(map[string]bool)
+	for key := range primary.Header {
+		keys[key] = true
+	}
+	for key := range result.header {
+		keys[key] = true
+	}
+	for key := range keys {
+		if containsHeader(ignore, key) {
+			continue
+		}
+		a, b := strings.Join(primary.Header[key], ", "), strings.Join(result.header[key], ", ")
+		if a != b {
+			diff.Headers = append(diff.Headers, fmt.Sprintf("%v: %q != %q", key, a, b))
+		}
+	}
+	sort.Strings(diff.Headers)
+
+	// primary 为 stream 模式时无法比较 body
+	if primary.BodyReader == nil && !bytes.Equal(primary.Body, result.body) {
+		diff.Body = fmt.Sprintf("%v bytes != %v bytes", len(primary.Body), len(result.body))
+	}
+
+	return diff
+}
+
+func (c *Canary) record(diff *CanaryDiff) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stats.Total++
+	if diff.Status == "" && len(diff.Headers) == 0 && diff.Body == "" {
+		return
+	}
+	c.stats.Diffs++
+	if diff.Status != "" {
+		c.stats.StatusDiffs++
+	}
+	if len(diff.Headers) > 0 {
+		c.stats.HeaderDiffs++
+	}
+	if diff.Body != "" {
+		c.stats.BodyDiffs++
+	}
+
+	maxDiffs := c.MaxDiffs
+	if maxDiffs <= 0 {
+		maxDiffs = 100
+	}
+	if len(c.diffs) >= maxDiffs {
+		c.diffs = c.diffs[1:]
+	}
+	c.diffs = append(c.diffs, diff)
+
+	log.Infof("canary diff %v status: %q headers: %v body: %q", diff.Url, diff.Status, diff.Headers, diff.Body)
+}
+
+// 比较在后台进行，刚收到 primary 响应的请求可能尚未计入
+func (c *Canary) Stats() CanaryStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// 最近的差异记录
+func (c *Canary) Diffs() []*CanaryDiff {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*CanaryDiff{}, c.diffs...)
+}
+
+func containsHeader(headers []string, key string) bool {
+	for _, h := range headers {
+		if strings.EqualFold(h, key) {
+			return true
+		}
+	}
+	return false
+}
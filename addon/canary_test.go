@@ -0,0 +1,137 @@
+package addon
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+)
+
+func TestCanaryRecordDiffs(t *testing.T) {
+	canaryServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "primary.example.com" {
+			t.Errorf("expected host primary.example.com, but got %v", r.Host)
+		}
+		if r.URL.Path == "/same" {
+			w.Header().Set("X-Version", "1")
+			w.Write([]byte("hello"))
+			return
+		}
+		w.Header().Set("X-Version", "2")
+		w.WriteHeader(500)
+		w.Write([]byte("canary"))
+	}))
+	defer canaryServer.Close()
+
+	c, err := NewCanary(canaryServer.URL, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(path string) {
+		f := &proxy.Flow{
+			Request: &proxy.Request{
+				Method: "GET",
+				URL:    &url.URL{Scheme: "http", Host: "primary.example.com", Path: path},
+				Header: http.Header{},
+			},
+		}
+		c.Request(f)
+		f.Response = &proxy.Response{
+			StatusCode: 200,
+			Header: http.Header{
+				"Content-Type": []string{"text/plain; charset=utf-8"},
+				"X-Version":    []string{"1"},
+				"Date":         []string{"now"},
+			},
+			Body: []byte("hello"),
+		}
+		c.Response(f)
+	}
+
+	run("/same")
+	run("/diff")
+
+	stats := waitCanaryStats(t, c, 2)
+	if stats.Total != 2 {
+		t.Fatalf("expected 2 compared, but got %v", stats.Total)
+	}
+	if stats.Diffs != 1 || stats.StatusDiffs != 1 || stats.HeaderDiffs != 1 || stats.BodyDiffs != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	diffs := c.Diffs()
+	if len(diffs) != 1 {
+		t.Fatalf("expected 1 diff, but got %v", len(diffs))
+	}
+	diff := diffs[0]
+	if diff.Url != "http://primary.example.com/diff" {
+		t.Errorf("unexpected diff url %v", diff.Url)
+	}
+	if diff.Status != "200 != 500" {
+		t.Errorf("unexpected diff status %v", diff.Status)
+	}
+	if len(diff.Headers) != 1 || diff.Headers[0] != `X-Version: "1" != "2"` {
+		t.Errorf("unexpected diff headers %v", diff.Headers)
+	}
+	if diff.Body != "5 bytes != 6 bytes" {
+		t.Errorf("unexpected diff body %v", diff.Body)
+	}
+}
+
+// 比较在后台进行，等待 total 个请求完成比较
+func waitCanaryStats(t *testing.T, c *Canary, total int64) CanaryStats {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		if stats := c.Stats(); stats.Total+stats.CanaryErrors >= total {
+			return stats
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("expected %v compared, but got %+v", total, c.Stats())
+	return CanaryStats{}
+}
+
+func TestCanaryAsync(t *testing.T) {
+	release := make(chan struct{})
+	canaryServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("canary"))
+	}))
+	defer canaryServer.Close()
+
+	// 未使用 NewCanary 构造时 Target 同样生效
+	c := &Canary{Target: canaryServer.URL, Percent: 100}
+	f := &proxy.Flow{
+		Request: &proxy.Request{
+			Method: "GET",
+			URL:    &url.URL{Scheme: "http", Host: "primary.example.com", Path: "/"},
+			Header: http.Header{},
+		},
+	}
+	c.Request(f)
+	f.Response = &proxy.Response{StatusCode: 200, Header: http.Header{}, Body: []byte("hello")}
+
+	// canary 未响应时 Response 不阻塞
+	done := make(chan struct{})
+	go func() {
+		c.Response(f)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected Response not to wait for canary")
+	}
+	// 之后修改 f.Response 不影响比较
+	f.Response.Body = []byte("canary")
+	close(release)
+
+	stats := waitCanaryStats(t, c, 1)
+	if stats.Total != 1 || stats.BodyDiffs != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
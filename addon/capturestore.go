@@ -0,0 +1,324 @@
+package addon
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// 将完成的 flow 保存至目录，每个 flow 包含:
+//   <id>.json     请求及响应的元数据，后缀及格式由 Codec 决定
+//   <id>.req      请求 body
+//   <id>.res      响应 body
+// 设置 key 后 body 使用 AES-GCM 加密存储（nonce + ciphertext），读取时自动解密
+// 加密时以 flow id 作为附加数据，密文被替换为其他 flow 的密文时解密失败
+
+var errCaptureKeyRequired = errors.New("capture is encrypted, key required")
+var errInvalidCaptureId = errors.New("invalid capture id")
+
+type CapturedFlow struct {
+	Id               string      `json:"id"`
+	Method           string      `json:"method"`
+	Url              string      `json:"url"`
+	Proto            string      `json:"proto"`
+	RequestHeader    http.Header `json:"requestHeader"`
+	StatusCode       int         `json:"statusCode,omitempty"`
+	ResponseHeader   http.Header `json:"responseHeader,omitempty"`
+	Encrypted        bool        `json:"encrypted"`
+	EncryptedHeaders []string    `json:"encryptedHeaders,omitempty"`
+
+	ResponseProto   string            `json:"responseProto,omitempty"`
+	ResponseTrailer http.Header       `json:"responseTrailer,omitempty"`
+	Err             string            `json:"error,omitempty"`
+	Stream          bool              `json:"stream,omitempty"` // stream 模式未缓冲 body，仅有元数据
+	Tags            map[string]string `json:"tags,omitempty"`
+	Stats           CapturedFlowStats `json:"stats"`
+
+	RequestBody         []byte `json:"requestBody,omitempty"`
+	ResponseBody        []byte `json:"responseBody,omitempty"`
+	DecodedResponseBody []byte `json:"decodedResponseBody,omitempty"` // 按 Content-Encoding 解压后的响应 body，仅 FileFlowStore 保存
+}
+
+type CapturedFlowStats struct {
+	Start         time.Time     `json:"start"`
+	RequestBytes  int64         `json:"requestBytes"`
+	ResponseBytes int64         `json:"responseBytes"`
+	Connect       time.Duration `json:"connect"`
+	TTFB          time.Duration `json:"ttfb"`
+	Total         time.Duration `json:"total"`
+}
+
+type CaptureStore struct {
+	proxy.BaseAddon
+	Dir            string
+	EncryptHeaders []string  // 需要加密的 header，如 Authorization、Cookie，仅当设置 key 时生效
+	Codec          FlowCodec // 元数据的序列化格式，默认 json
+
+	aead cipher.AEAD
+}
+
+// key 为空时明文存储，否则长度需为 16、24 或 32 字节
+func NewCaptureStore(dir string, key []byte) (*CaptureStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	store := &CaptureStore{Dir: dir, Codec: JSONFlowCodec{}}
+	if len(key) > 0 {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		store.aead = aead
+	}
+	return store, nil
+}
+
+func (s *CaptureStore) Requestheaders(f *proxy.Flow) {
+	go func() {
+		<-f.Done()
+		if err := s.Save(f); err != nil {
+			log.Errorf("capture store save %v error: %v", f.Id, err)
+		}
+	}()
+}
+
+func NewCapturedFlow(f *proxy.Flow) *CapturedFlow {
+	captured := &CapturedFlow{
+		Id:            f.Id.String(),
+		Method:        f.Request.Method,
+		Url:           f.Request.URL.String(),
+		Proto:         f.Request.Proto,
+		RequestHeader: f.Request.Header.Clone(),
+		Stream:        f.Stream,
+		Tags:          copyTags(f.Tags),
+		Stats: CapturedFlowStats{
+			Start:         f.Stats.Start,
+			RequestBytes:  f.Stats.RequestBytes,
+			ResponseBytes: f.Stats.ResponseBytes,
+			Connect:       f.Stats.Connect,
+			TTFB:          f.Stats.TTFB,
+			Total:         f.Stats.Total,
+		},
+		RequestBody: f.Request.Body,
+	}
+	if f.Err != nil {
+		captured.Err = f.Err.Error()
+	}
+	if f.Response != nil {
+		captured.StatusCode = f.Response.StatusCode
+		captured.ResponseProto = f.Response.Proto
+		captured.ResponseHeader = f.Response.Header.Clone()
+		captured.ResponseTrailer = f.Response.Trailer.Clone()
+		captured.ResponseBody = f.Response.Body
+	}
+	return captured
+}
+
+func (s *CaptureStore) Save(f *proxy.Flow) error {
+	captured := NewCapturedFlow(f)
+	captured.Encrypted = s.aead != nil
+
+	if s.aead != nil {
+		captured.EncryptedHeaders = s.EncryptHeaders
+		if err := s.encryptHeader(captured.Id, captured.RequestHeader, captured.EncryptedHeaders); err != nil {
+			return err
+		}
+		if err := s.encryptHeader(captured.Id, captured.ResponseHeader, captured.EncryptedHeaders); err != nil {
+			return err
+		}
+		if err := s.encryptHeader(captured.Id, captured.ResponseTrailer, captured.EncryptedHeaders); err != nil {
+			return err
+		}
+	}
+
+	if err := s.writeBlob(captured.Id, ".req", captured.RequestBody); err != nil {
+		return err
+	}
+	if err := s.writeBlob(captured.Id, ".res", captured.ResponseBody); err != nil {
+		return err
+	}
+	// body 单独存储
+	meta := *captured
+	meta.RequestBody, meta.ResponseBody = nil, nil
+	data, err := s.codec().Marshal(&meta)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.metaFile(captured.Id), data, 0600)
+}
+
+func (s *CaptureStore) codec() FlowCodec {
+	if s.Codec == nil {
+		return JSONFlowCodec{}
+	}
+	return s.Codec
+}
+
+func (s *CaptureStore) metaFile(id string) string {
+	return filepath.Join(s.Dir, id+"."+s.codec().Name())
+}
+
+// id 需为 uuid，避免读取 Dir 以外的文件
+func (s *CaptureStore) Load(id string) (*CapturedFlow, error) {
+	if _, err := uuid.FromString(id); err != nil {
+		return nil, errInvalidCaptureId
+	}
+	data, err := ioutil.ReadFile(s.metaFile(id))
+	if err != nil {
+		return nil, err
+	}
+	captured := new(CapturedFlow)
+	if err := s.codec().Unmarshal(data, captured); err != nil {
+		return nil, err
+	}
+	if captured.Id != id {
+		return nil, fmt.Errorf("capture id mismatch: %v", captured.Id)
+	}
+	if captured.Encrypted && s.aead == nil {
+		return nil, errCaptureKeyRequired
+	}
+
+	if captured.Encrypted {
+		if err := s.decryptHeader(id, captured.RequestHeader, captured.EncryptedHeaders); err != nil {
+			return nil, err
+		}
+		if err := s.decryptHeader(id, captured.ResponseHeader, captured.EncryptedHeaders); err != nil {
+			return nil, err
+		}
+		if err := s.decryptHeader(id, captured.ResponseTrailer, captured.EncryptedHeaders); err != nil {
+			return nil, err
+		}
+	}
+	if captured.RequestBody, err = s.readBlob(id, ".req", captured.Encrypted); err != nil {
+		return nil, err
+	}
+	if captured.ResponseBody, err = s.readBlob(id, ".res", captured.Encrypted); err != nil {
+		return nil, err
+	}
+	return captured, nil
+}
+
+// 最近保存的 n 个 flow，按保存时间从旧到新排列
+func (s *CaptureStore) Recent(n int) ([]*CapturedFlow, error) {
+	ext := "." + s.codec().Name()
+	entries, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+	metas := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() && filepath.Ext(entry.Name()) == ext {
+			metas = append(metas, entry)
+		}
+	}
+	sort.SliceStable(metas, func(i, j int) bool {
+		return metas[i].ModTime().Before(metas[j].ModTime())
+	})
+	if n > 0 && len(metas) > n {
+		metas = metas[len(metas)-n:]
+	}
+
+	flows := make([]*CapturedFlow, 0, len(metas))
+	for _, meta := range metas {
+		captured, err := s.Load(strings.TrimSuffix(meta.Name(), ext))
+		if err != nil {
+			return nil, err
+		}
+		flows = append(flows, captured)
+	}
+	return flows, nil
+}
+
+func (s *CaptureStore) writeBlob(id, ext string, body []byte) error {
+	if len(body) == 0 {
+		return nil
+	}
+	if s.aead != nil {
+		var err error
+		if body, err = s.seal(id, body); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(filepath.Join(s.Dir, id+ext), body, 0600)
+}
+
+func (s *CaptureStore) readBlob(id, ext string, encrypted bool) ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.Dir, id+ext))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if !encrypted {
+		return data, nil
+	}
+	return s.open(id, data)
+}
+
+func (s *CaptureStore) seal(id string, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, plaintext, []byte(id)), nil
+}
+
+func (s *CaptureStore) open(id string, data []byte) ([]byte, error) {
+	nonceSize := s.aead.NonceSize()
+	if len(data) < nonceSize {
+		return nil, fmt.Errorf("capture blob too short")
+	}
+	return s.aead.Open(nil, data[:nonceSize], data[nonceSize:], []byte(id))
+}
+
+func (s *CaptureStore) encryptHeader(id string, header http.Header, keys []string) error {
+	for _, key := range keys {
+		values := header[http.CanonicalHeaderKey(key)]
+		for i, value := range values {
+			sealed, err := s.seal(id, []byte(value))
+			if err != nil {
+				return err
+			}
+			values[i] = base64.StdEncoding.EncodeToString(sealed)
+		}
+	}
+	return nil
+}
+
+func (s *CaptureStore) decryptHeader(id string, header http.Header, keys []string) error {
+	for _, key := range keys {
+		values := header[http.CanonicalHeaderKey(key)]
+		for i, value := range values {
+			sealed, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				return err
+			}
+			plaintext, err := s.open(id, sealed)
+			if err != nil {
+				return err
+			}
+			values[i] = string(plaintext)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package addon
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestCaptureStoreEncrypt(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{1}, 32)
+	store, err := NewCaptureStore(dir, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.EncryptHeaders = []string{"authorization"}
+
+	f := &proxy.Flow{
+		Id: uuid.NewV4(),
+		Request: &proxy.Request{
+			Method: "POST",
+			URL:    &url.URL{Scheme: "https", Host: "example.com", Path: "/login"},
+			Proto:  "HTTP/1.1",
+			Header: http.Header{
+				"Authorization": []string{"Bearer secret-token"},
+				"Content-Type":  []string{"application/json"},
+			},
+			Body: []byte(`{"password":"hunter2"}`),
+		},
+		Response: &proxy.Response{
+			StatusCode: 200,
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+			Body:       []byte(`{"session":"s3cr3t"}`),
+		},
+	}
+	if err := store.Save(f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Request.Header.Get("Authorization") != "Bearer secret-token" {
+		t.Fatal("should not modify flow header")
+	}
+
+	id := f.Id.String()
+	for name, plaintext := range map[string]string{
+		id + ".req":  "hunter2",
+		id + ".res":  "s3cr3t",
+		id + ".json": "secret-token",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), plaintext) {
+			t.Errorf("%v should not contain plaintext %v", name, plaintext)
+		}
+	}
+
+	captured, err := store.Load(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(captured.RequestBody) != string(f.Request.Body) {
+		t.Errorf("unexpected request body %s", captured.RequestBody)
+	}
+	if string(captured.ResponseBody) != string(f.Response.Body) {
+		t.Errorf("unexpected response body %s", captured.ResponseBody)
+	}
+	if got := captured.RequestHeader.Get("Authorization"); got != "Bearer secret-token" {
+		t.Errorf("unexpected authorization header %v", got)
+	}
+	if captured.Url != "https://example.com/login" || captured.StatusCode != 200 {
+		t.Errorf("unexpected captured flow %+v", captured)
+	}
+
+	// without key
+	plainStore, err := NewCaptureStore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plainStore.Load(id); err != errCaptureKeyRequired {
+		t.Errorf("expected errCaptureKeyRequired, but got %v", err)
+	}
+
+	for _, bad := range []string{"../" + id, id + "/x", ""} {
+		if _, err := store.Load(bad); err != errInvalidCaptureId {
+			t.Errorf("%q: expected errInvalidCaptureId, but got %v", bad, err)
+		}
+	}
+
+	// 其他 flow 的密文不能替换本 flow 的 body
+	other := *f
+	other.Id = uuid.NewV4()
+	if err := store.Save(&other); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, id+".res"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, other.Id.String()+".res"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(other.Id.String()); err == nil {
+		t.Error("expected decrypt error for swapped ciphertext")
+	}
+}
@@ -0,0 +1,104 @@
+package addon
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// verify response body sha256 checksum declared by upstream header
+// on mismatch the flow is aborted via Flow.AbortWithError, Addon.Error receives a *proxy.AbortError matching ErrChecksumMismatch:
+// buffered body responds 502, stream body disconnects the client as the header has been sent
+
+var ErrChecksumMismatch = errors.New("response body checksum mismatch")
+
+type ChecksumVerifier struct {
+	proxy.BaseAddon
+	Header string // default: X-Checksum-Sha256, value is hex or base64 encoded
+}
+
+func NewChecksumVerifier() *ChecksumVerifier {
+	return &ChecksumVerifier{Header: "X-Checksum-Sha256"}
+}
+
+func (c *ChecksumVerifier) expected(f *proxy.Flow) []byte {
+	if f.Response == nil || f.Response.Header == nil {
+		return nil
+	}
+	val := strings.TrimSpace(f.Response.Header.Get(c.Header))
+	if val == "" {
+		return nil
+	}
+	if sum, err := hex.DecodeString(val); err == nil && len(sum) == sha256.Size {
+		return sum
+	}
+	if sum, err := base64.StdEncoding.DecodeString(val); err == nil && len(sum) == sha256.Size {
+		return sum
+	}
+	log.Warnf("invalid %v header: %v", c.Header, val)
+	return nil
+}
+
+func (c *ChecksumVerifier) mismatch(f *proxy.Flow, expected, actual []byte) error {
+	err := fmt.Errorf("%w: %v expected %x, got %x", ErrChecksumMismatch, f.Request.URL, expected, actual)
+	f.AbortWithError(502, err)
+	return err
+}
+
+// buffered body
+func (c *ChecksumVerifier) Response(f *proxy.Flow) {
+	expected := c.expected(f)
+	if expected == nil || f.Response.Body == nil {
+		return
+	}
+	sum := sha256.Sum256(f.Response.Body)
+	if !bytes.Equal(sum[:], expected) {
+		c.mismatch(f, expected, sum[:])
+	}
+}
+
+// stream body
+func (c *ChecksumVerifier) StreamResponseModifier(f *proxy.Flow, in io.Reader) io.Reader {
+	if in == nil {
+		return in
+	}
+	expected := c.expected(f)
+	if expected == nil {
+		return in
+	}
+	return &checksumReader{r: in, h: sha256.New(), expected: expected, verifier: c, f: f}
+}
+
+// 读取至 EOF 时校验，不一致时中止 flow 并返回 ErrChecksumMismatch，proxy 会中断与客户端的连接
+type checksumReader struct {
+	r        io.Reader
+	h        hash.Hash
+	expected []byte
+	verifier *ChecksumVerifier
+	f        *proxy.Flow
+	err      error
+}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.r.Read(p)
+	r.h.Write(p[:n])
+	if err == io.EOF {
+		if sum := r.h.Sum(nil); !bytes.Equal(sum, r.expected) {
+			r.err = r.verifier.mismatch(r.f, r.expected, sum)
+			return n, r.err
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,188 @@
+package addon
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+)
+
+func TestChecksumVerifier(t *testing.T) {
+	body := []byte("hello world")
+	sum := sha256.Sum256(body)
+
+	newFlow := func() *proxy.Flow {
+		header := make(http.Header)
+		header.Set("X-Checksum-Sha256", hex.EncodeToString(sum[:]))
+		return &proxy.Flow{
+			Request:  &proxy.Request{Method: "GET", URL: &url.URL{Scheme: "http", Host: "example.com", Path: "/file"}},
+			Response: &proxy.Response{StatusCode: 200, Header: header},
+			Stream:   true,
+		}
+	}
+
+	verifier := NewChecksumVerifier()
+
+	// stream ok
+	f := newFlow()
+	r := verifier.StreamResponseModifier(f, bytes.NewReader(body))
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("expected no error, but got %v", err)
+	}
+	if !bytes.Equal(data, body) {
+		t.Fatalf("expected %s, but got %s", body, data)
+	}
+	if f.Aborted() {
+		t.Fatal("expected flow not aborted")
+	}
+
+	// stream corrupted
+	f = newFlow()
+	r = verifier.StreamResponseModifier(f, bytes.NewReader([]byte("hello w0rld")))
+	_, err = io.ReadAll(r)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch, but got %v", err)
+	}
+	if !f.Aborted() {
+		t.Fatal("expected flow aborted")
+	}
+
+	// buffered corrupted
+	f = newFlow()
+	f.Stream = false
+	f.Response.Body = []byte("hello w0rld")
+	verifier.Response(f)
+	if !f.Aborted() {
+		t.Fatal("expected flow aborted")
+	}
+}
+
+// 记录 Addon.Error 收到的错误，/stream/ 开头的请求使用 stream 模式
+type checksumErrorAddon struct {
+	proxy.BaseAddon
+	mu   sync.Mutex
+	errs map[string]error
+}
+
+func (a *checksumErrorAddon) Requestheaders(f *proxy.Flow) {
+	if strings.HasPrefix(f.Request.URL.Path, "/stream/") {
+		f.Stream = true
+	}
+}
+
+func (a *checksumErrorAddon) Error(f *proxy.Flow, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.errs[f.Request.URL.Path] = err
+}
+
+func (a *checksumErrorAddon) err(path string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.errs[path]
+}
+
+func TestChecksumVerifierProxy(t *testing.T) {
+	body := "hello world"
+	sum := sha256.Sum256([]byte(body))
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Checksum-Sha256", hex.EncodeToString(sum[:]))
+			if strings.HasSuffix(r.URL.Path, "/corrupt") {
+				w.Write([]byte("hello w0rld"))
+				return
+			}
+			w.Write([]byte(body))
+		}),
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go server.Serve(ln)
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	testProxy, err := proxy.NewProxy(&proxy.Options{
+		HttpAddr: ":29165",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errAddon := &checksumErrorAddon{errs: make(map[string]error)}
+	testProxy.AddAddon(errAddon)
+	testProxy.AddAddon(NewChecksumVerifier())
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29165")
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	get := func(path string) (int, string, error) {
+		res, err := proxyClient.Get("http://localhost:" + port + path)
+		if err != nil {
+			return 0, "", err
+		}
+		defer res.Body.Close()
+		b, err := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(b), err
+	}
+	expectMismatch := func(t *testing.T, path string) {
+		t.Helper()
+		err := errAddon.err(path)
+		var abortErr *proxy.AbortError
+		if !errors.As(err, &abortErr) || !errors.Is(err, ErrChecksumMismatch) {
+			t.Fatalf("expected Error with AbortError of ErrChecksumMismatch, but got %v", err)
+		}
+	}
+
+	for _, path := range []string{"/ok", "/stream/ok"} {
+		code, got, err := get(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != 200 || got != body {
+			t.Fatalf("%v: expected 200 %v, but got %v %v", path, body, code, got)
+		}
+		if err := errAddon.err(path); err != nil {
+			t.Fatalf("%v: expected no Error, but got %v", path, err)
+		}
+	}
+
+	t.Run("buffered corrupted", func(t *testing.T) {
+		code, _, err := get("/corrupt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != 502 {
+			t.Fatalf("expected 502, but got %v", code)
+		}
+		expectMismatch(t, "/corrupt")
+	})
+
+	t.Run("stream corrupted", func(t *testing.T) {
+		code, _, err := get("/stream/corrupt")
+		if code != 200 || err == nil {
+			t.Fatalf("expected 200 with truncated body, but got %v %v", code, err)
+		}
+		expectMismatch(t, "/stream/corrupt")
+	})
+}
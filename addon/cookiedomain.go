@@ -0,0 +1,133 @@
+package addon
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/match"
+)
+
+// rewrite Set-Cookie attributes to match the client-facing host
+// 例如通过 MapRemote 将 example.com 映射至 staging.example.net 时，将 Domain=staging.example.net 重写为 example.com
+
+type cookieDomainItem struct {
+	Host        string // 匹配上游 host，支持通配符，为空时匹配全部
+	Domain      string // 重写后的 Domain，为空时使用客户端请求的 host
+	Path        string // 重写后的 Path，为空时不修改
+	StripSecure bool   // 移除 Secure 属性，用于 http 测试
+	Enable      bool
+}
+
+func (item *cookieDomainItem) match(req *proxy.Request) bool {
+	if !item.Enable {
+		return false
+	}
+	return item.Host == "" || match.Match(req.URL.Hostname(), item.Host)
+}
+
+// 重写单个 Set-Cookie，保留其余属性原样
+func (item *cookieDomainItem) rewrite(setCookie string, clientHost string) string {
+	parts := strings.Split(setCookie, ";")
+	result := make([]string, 0, len(parts)+1)
+	result = append(result, strings.TrimSpace(parts[0]))
+
+	hasPath := false
+	for _, part := range parts[1:] {
+		attr := strings.TrimSpace(part)
+		name, value, _ := strings.Cut(attr, "=")
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "domain":
+			domain := item.Domain
+			if domain == "" {
+				domain = clientHost
+			}
+			attr = "Domain=" + domain
+		case "path":
+			hasPath = true
+			if item.Path != "" {
+				attr = "Path=" + item.Path
+			}
+		case "secure":
+			if item.StripSecure {
+				continue
+			}
+		case "samesite":
+			// SameSite=None 必须与 Secure 同时存在，否则浏览器会拒绝该 cookie
+			if item.StripSecure && strings.EqualFold(strings.TrimSpace(value), "none") {
+				attr = "SameSite=Lax"
+			}
+		}
+		result = append(result, attr)
+	}
+	if !hasPath && item.Path != "" {
+		result = append(result, "Path="+item.Path)
+	}
+
+	return strings.Join(result, "; ")
+}
+
+type CookieDomain struct {
+	proxy.BaseAddon
+	Items  []*cookieDomainItem
+	Enable bool
+}
+
+// 客户端请求的 host，不受 MapRemote 等修改 f.Request.URL 的影响
+func clientHostname(f *proxy.Flow) string {
+	host := f.Request.URL.Host
+	if raw := f.Request.Raw(); raw != nil && raw.Host != "" {
+		host = raw.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+func (cd *CookieDomain) Responseheaders(f *proxy.Flow) {
+	if !cd.Enable || f.Response == nil || f.Response.Header == nil {
+		return
+	}
+	setCookies := f.Response.Header.Values("Set-Cookie")
+	if len(setCookies) == 0 {
+		return
+	}
+	for _, item := range cd.Items {
+		if item.match(f.Request) {
+			clientHost := clientHostname(f)
+			rewrited := make([]string, 0, len(setCookies))
+			for _, setCookie := range setCookies {
+				rewrited = append(rewrited, item.rewrite(setCookie, clientHost))
+			}
+			f.Response.Header["Set-Cookie"] = rewrited
+			log.Debugf("cookie domain rewrite %v Set-Cookie for %v", len(rewrited), f.Request.URL.String())
+			return
+		}
+	}
+}
+
+func (cd *CookieDomain) validate() error {
+	for i, item := range cd.Items {
+		if strings.ContainsAny(item.Domain, "; ") {
+			return fmt.Errorf("%v invalid item.Domain %v", i, item.Domain)
+		}
+		if strings.ContainsAny(item.Path, "; ") {
+			return fmt.Errorf("%v invalid item.Path %v", i, item.Path)
+		}
+	}
+	return nil
+}
+
+func NewCookieDomainFromFile(filename string) (*CookieDomain, error) {
+	cookieDomain, err := proxy.NewStructFromFile[CookieDomain](filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := cookieDomain.validate(); err != nil {
+		return nil, err
+	}
+	return cookieDomain, nil
+}
@@ -0,0 +1,74 @@
+package addon
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+)
+
+func TestCookieDomainRewrite(t *testing.T) {
+	u := &url.URL{Scheme: "https", Host: "staging.example.net", Path: "/login"}
+	f := &proxy.Flow{
+		Request: &proxy.Request{
+			Method: "GET",
+			URL:    u,
+		},
+		Response: &proxy.Response{
+			StatusCode: 200,
+			Header: http.Header{
+				"Set-Cookie": []string{
+					"session=abc; Domain=staging.example.net; Path=/; Secure; HttpOnly",
+					"theme=dark; domain=.staging.example.net; SameSite=None; Secure",
+					"hostonly=1; Path=/app",
+				},
+			},
+		},
+	}
+
+	cd := &CookieDomain{
+		Enable: true,
+		Items: []*cookieDomainItem{
+			{
+				Host:   "other.com",
+				Domain: "wrong.com",
+				Enable: true,
+			},
+			{
+				Host:        "*.example.net",
+				Domain:      "example.com",
+				StripSecure: true,
+				Enable:      true,
+			},
+		},
+	}
+	cd.Responseheaders(f)
+
+	want := []string{
+		"session=abc; Domain=example.com; Path=/; HttpOnly",
+		"theme=dark; Domain=example.com; SameSite=Lax",
+		"hostonly=1; Path=/app",
+	}
+	got := f.Response.Header.Values("Set-Cookie")
+	if len(got) != len(want) {
+		t.Fatalf("expected %v Set-Cookie, but got %v", len(want), len(got))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("expected %v, but got %v", want[i], got[i])
+		}
+	}
+
+	// empty Domain use client host, keep Secure
+	f.Response.Header = http.Header{
+		"Set-Cookie": []string{"session=abc; Domain=staging.example.net; Secure"},
+	}
+	cd.Items = []*cookieDomainItem{{Path: "/", Enable: true}}
+	u.Host = "localhost:8080"
+	cd.Responseheaders(f)
+	should := "session=abc; Domain=localhost; Secure; Path=/"
+	if got := f.Response.Header.Get("Set-Cookie"); got != should {
+		t.Errorf("expected %v, but got %v", should, got)
+	}
+}
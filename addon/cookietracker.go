@@ -0,0 +1,271 @@
+package addon
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/publicsuffix"
+)
+
+// 按客户端连接（ConnContext）记录上游设置的 cookie，仅观察，不修改请求及响应
+// 按浏览器的规则（RFC 6265）处理 Set-Cookie，记录以下事件:
+//   cookie set        新的 cookie
+//   cookie changed    值或属性改变
+//   cookie deleted    过期或 Max-Age<=0
+//   cookie rejected   浏览器会拒绝的 cookie，如 Domain 与 host 不匹配、http 响应设置 Secure、SameSite=None 但没有 Secure
+//   cookie sent cross-domain  请求携带的 cookie 由其他 host 设置（如 Domain=example.com 由 login.example.com 设置，发送至 api.example.com）
+// 客户端断开后丢弃该连接的 cookie
+
+type CookieTracker struct {
+	proxy.BaseAddon
+
+	mu   sync.Mutex
+	jars map[uuid.UUID]*cookieJar // key 为 ConnContext.Id()
+}
+
+func NewCookieTracker() *CookieTracker {
+	return &CookieTracker{jars: make(map[uuid.UUID]*cookieJar)}
+}
+
+type trackedCookie struct {
+	cookie   *http.Cookie // Domain 不含前导 .，Path 已补全，Expires 为计算后的过期时间，会话 cookie 为零值
+	hostOnly bool         // 没有 Domain 属性，仅发送至设置的 host
+	setBy    string       // 设置该 cookie 的 host
+}
+
+type cookieJar struct {
+	mu      sync.Mutex
+	cookies map[string]*trackedCookie // key 为 domain;path;name
+}
+
+func cookieKey(c *http.Cookie) string {
+	return c.Domain + ";" + c.Path + ";" + c.Name
+}
+
+func (t *CookieTracker) jar(connCtx *proxy.ConnContext, create bool) *cookieJar {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.jars == nil {
+		t.jars = make(map[uuid.UUID]*cookieJar)
+	}
+	jar := t.jars[connCtx.Id()]
+	if jar == nil && create {
+		jar = &cookieJar{cookies: make(map[string]*trackedCookie)}
+		t.jars[connCtx.Id()] = jar
+	}
+	return jar
+}
+
+func (t *CookieTracker) ClientDisconnected(client *proxy.ClientConn) {
+	t.mu.Lock()
+	delete(t.jars, client.Id)
+	t.mu.Unlock()
+}
+
+// 该连接中会发送至 host 的 cookie（不考虑 Path 及 Secure），按 Name、Path 排序
+// 返回的 cookie 为副本，Domain 为设置时的 Domain 属性，host-only 的 cookie 为设置的 host
+func (t *CookieTracker) Cookies(connCtx *proxy.ConnContext, host string) []*http.Cookie {
+	jar := t.jar(connCtx, false)
+	if jar == nil {
+		return nil
+	}
+	host = cookieHost(host)
+	now := time.Now()
+
+	jar.mu.Lock()
+	defer jar.mu.Unlock()
+	cookies := make([]*http.Cookie, 0)
+	for key, tc := range jar.cookies {
+		if !tc.cookie.Expires.IsZero() && !tc.cookie.Expires.After(now) {
+			delete(jar.cookies, key)
+			continue
+		}
+		if tc.match(host) {
+			c := *tc.cookie
+			cookies = append(cookies, &c)
+		}
+	}
+	sort.Slice(cookies, func(i, j int) bool {
+		if cookies[i].Name != cookies[j].Name {
+			return cookies[i].Name < cookies[j].Name
+		}
+		return cookies[i].Path < cookies[j].Path
+	})
+	return cookies
+}
+
+func (tc *trackedCookie) match(host string) bool {
+	if tc.hostOnly {
+		return host == tc.cookie.Domain
+	}
+	return domainMatch(host, tc.cookie.Domain)
+}
+
+// RFC 6265 5.1.3
+func domainMatch(host, domain string) bool {
+	if host == domain {
+		return true
+	}
+	return strings.HasSuffix(host, "."+domain) && net.ParseIP(host) == nil
+}
+
+// 去除端口，转为小写
+func cookieHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.Trim(host, "[]"))
+}
+
+// RFC 6265 5.1.4
+func defaultCookiePath(path string) string {
+	if path == "" || path[0] != '/' {
+		return "/"
+	}
+	i := strings.LastIndex(path, "/")
+	if i == 0 {
+		return "/"
+	}
+	return path[:i]
+}
+
+func (t *CookieTracker) Requestheaders(f *proxy.Flow) {
+	if f.Request.Method == "CONNECT" || f.ConnContext == nil {
+		return
+	}
+	cookies := f.Request.Cookies()
+	if len(cookies) == 0 {
+		return
+	}
+	jar := t.jar(f.ConnContext, false)
+	if jar == nil {
+		return
+	}
+	host := cookieHost(clientHostname(f))
+
+	jar.mu.Lock()
+	defer jar.mu.Unlock()
+	for _, c := range cookies {
+		for _, tc := range jar.cookies {
+			if tc.cookie.Name != c.Name || tc.cookie.Value != c.Value || tc.setBy == host || !tc.match(host) {
+				continue
+			}
+			log.WithFields(log.Fields{
+				"in":     "CookieTracker",
+				"conn":   f.ConnContext.Id(),
+				"name":   c.Name,
+				"domain": tc.cookie.Domain,
+				"setBy":  tc.setBy,
+				"host":   host,
+			}).Info("cookie sent cross-domain")
+			break
+		}
+	}
+}
+
+func (t *CookieTracker) Responseheaders(f *proxy.Flow) {
+	if f.Request.Method == "CONNECT" || f.ConnContext == nil || f.Response == nil {
+		return
+	}
+	cookies := f.Response.Cookies()
+	if len(cookies) == 0 {
+		return
+	}
+	host := cookieHost(clientHostname(f))
+	secure := f.Request.URL.Scheme == "https"
+	now := time.Now()
+	jar := t.jar(f.ConnContext, true)
+
+	jar.mu.Lock()
+	defer jar.mu.Unlock()
+	for _, c := range cookies {
+		tc, reason := newTrackedCookie(c, host, f.Request.URL.Path, secure, now)
+		entry := log.WithFields(log.Fields{
+			"in":   "CookieTracker",
+			"conn": f.ConnContext.Id(),
+			"name": c.Name,
+			"host": host,
+		})
+		if reason != "" {
+			entry.WithField("reason", reason).Info("cookie rejected")
+			continue
+		}
+		entry = entry.WithField("domain", tc.cookie.Domain).WithField("path", tc.cookie.Path)
+
+		key := cookieKey(tc.cookie)
+		old := jar.cookies[key]
+		if !tc.cookie.Expires.IsZero() && !tc.cookie.Expires.After(now) {
+			if old != nil {
+				delete(jar.cookies, key)
+				entry.Info("cookie deleted")
+			}
+			continue
+		}
+		jar.cookies[key] = tc
+		switch {
+		case old == nil:
+			entry.Info("cookie set")
+		case cookieAttrs(old.cookie) != cookieAttrs(tc.cookie):
+			entry.Info("cookie changed")
+		}
+	}
+}
+
+// 值及属性，不比较 Max-Age 计算的过期时间，仅比较是否为会话 cookie
+func cookieAttrs(c *http.Cookie) string {
+	return fmt.Sprintf("%v|%v|%v|%v|%v", c.Value, c.Secure, c.HttpOnly, c.SameSite, c.Expires.IsZero())
+}
+
+// 按浏览器的规则处理 Set-Cookie，浏览器会拒绝时返回原因
+func newTrackedCookie(c *http.Cookie, host string, path string, secure bool, now time.Time) (*trackedCookie, string) {
+	if c.Secure && !secure {
+		return nil, "secure cookie over http"
+	}
+	if c.SameSite == http.SameSiteNoneMode && !c.Secure {
+		return nil, "SameSite=None without Secure"
+	}
+
+	cookie := *c
+	tc := &trackedCookie{cookie: &cookie, setBy: host}
+
+	domain := strings.ToLower(strings.TrimPrefix(c.Domain, "."))
+	if domain == "" || net.ParseIP(host) != nil && domain == host {
+		tc.hostOnly = true
+		domain = host
+	} else {
+		if !domainMatch(host, domain) {
+			return nil, "domain " + domain + " does not match host"
+		}
+		if suffix, _ := publicsuffix.PublicSuffix(domain); suffix == domain {
+			if host != domain {
+				return nil, "domain " + domain + " is a public suffix"
+			}
+			tc.hostOnly = true
+		}
+	}
+	cookie.Domain = domain
+
+	if cookie.Path == "" || cookie.Path[0] != '/' {
+		cookie.Path = defaultCookiePath(path)
+	}
+
+	// Max-Age 优先于 Expires
+	switch {
+	case c.MaxAge < 0:
+		cookie.Expires = time.Unix(1, 0)
+	case c.MaxAge > 0:
+		cookie.Expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+	}
+	cookie.MaxAge = 0
+	cookie.Raw = ""
+	cookie.RawExpires = ""
+	return tc, ""
+}
@@ -0,0 +1,125 @@
+package addon
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+	uuid "github.com/satori/go.uuid"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func cookieFlow(connCtx *proxy.ConnContext, rawurl string, cookie string, setCookies ...string) *proxy.Flow {
+	u, _ := url.Parse(rawurl)
+	f := &proxy.Flow{
+		ConnContext: connCtx,
+		Request: &proxy.Request{
+			Method: "GET",
+			URL:    u,
+			Header: http.Header{},
+		},
+		Response: &proxy.Response{
+			StatusCode: 200,
+			Header:     http.Header{},
+		},
+	}
+	if cookie != "" {
+		f.Request.Header.Set("Cookie", cookie)
+	}
+	for _, setCookie := range setCookies {
+		f.Response.Header.Add("Set-Cookie", setCookie)
+	}
+	return f
+}
+
+func TestCookieTracker(t *testing.T) {
+	logHook := logtest.NewGlobal()
+	defer logHook.Reset()
+	messages := func() string {
+		var msgs []string
+		for _, entry := range logHook.AllEntries() {
+			if entry.Data["in"] != "CookieTracker" {
+				continue
+			}
+			msg := entry.Message + " " + entry.Data["name"].(string)
+			if reason, ok := entry.Data["reason"]; ok {
+				msg += " (" + reason.(string) + ")"
+			}
+			msgs = append(msgs, msg)
+		}
+		logHook.Reset()
+		return strings.Join(msgs, ",")
+	}
+
+	tracker := NewCookieTracker()
+	connCtx := &proxy.ConnContext{ClientConn: &proxy.ClientConn{Id: uuid.NewV4()}}
+	other := &proxy.ConnContext{ClientConn: &proxy.ClientConn{Id: uuid.NewV4()}}
+
+	f := cookieFlow(connCtx, "https://login.example.com/auth/login", "",
+		"session=abc; Domain=example.com; Path=/; Secure; HttpOnly; SameSite=Lax",
+		"csrf=1",
+		"evil=1; Domain=other.com",
+		"tld=1; Domain=com",
+		"none=1; SameSite=None",
+		"old=1; Expires=Thu, 01 Jan 1970 00:00:00 GMT",
+	)
+	tracker.Responseheaders(f)
+	expected := "cookie set session,cookie set csrf," +
+		"cookie rejected evil (domain other.com does not match host)," +
+		"cookie rejected tld (domain com is a public suffix)," +
+		"cookie rejected none (SameSite=None without Secure)"
+	if got := messages(); got != expected {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	if f.Response.Header.Values("Set-Cookie")[0] != "session=abc; Domain=example.com; Path=/; Secure; HttpOnly; SameSite=Lax" {
+		t.Fatal("should not modify response")
+	}
+
+	cookies := tracker.Cookies(connCtx, "api.example.com:443")
+	if len(cookies) != 1 || cookies[0].Name != "session" || cookies[0].Domain != "example.com" ||
+		!cookies[0].Secure || !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteLaxMode {
+		t.Fatalf("unexpected cookies for api.example.com %v", cookies)
+	}
+	cookies = tracker.Cookies(connCtx, "login.example.com")
+	if len(cookies) != 2 || cookies[0].Name != "csrf" || cookies[0].Path != "/auth" || cookies[0].Domain != "login.example.com" {
+		t.Fatalf("unexpected cookies for login.example.com %v", cookies)
+	}
+	if cookies := tracker.Cookies(other, "login.example.com"); len(cookies) != 0 {
+		t.Fatalf("jar should be per connection, got %v", cookies)
+	}
+
+	// 由 login.example.com 设置，发送至 api.example.com
+	tracker.Requestheaders(cookieFlow(connCtx, "https://api.example.com/me", "session=abc; unknown=1"))
+	tracker.Requestheaders(cookieFlow(connCtx, "https://login.example.com/", "session=abc; csrf=1"))
+	if got := messages(); got != "cookie sent cross-domain session" {
+		t.Fatalf("unexpected events %v", got)
+	}
+
+	tracker.Responseheaders(cookieFlow(connCtx, "https://login.example.com/auth/refresh", "",
+		"session=abc; Domain=example.com; Path=/; Secure; HttpOnly; SameSite=Lax",
+		"csrf=2; Max-Age=3600",
+	))
+	tracker.Responseheaders(cookieFlow(connCtx, "http://login.example.com/", "",
+		"session=; Domain=example.com; Path=/; Secure; Max-Age=0",
+	))
+	tracker.Responseheaders(cookieFlow(connCtx, "https://login.example.com/", "",
+		"session=; Domain=example.com; Path=/; Secure; Max-Age=0",
+	))
+	expected = "cookie changed csrf," +
+		"cookie rejected session (secure cookie over http)," +
+		"cookie deleted session"
+	if got := messages(); got != expected {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	cookies = tracker.Cookies(connCtx, "login.example.com")
+	if len(cookies) != 1 || cookies[0].Value != "2" || cookies[0].Expires.IsZero() {
+		t.Fatalf("unexpected cookies %v", cookies)
+	}
+
+	tracker.ClientDisconnected(connCtx.ClientConn)
+	if cookies := tracker.Cookies(connCtx, "login.example.com"); len(cookies) != 0 {
+		t.Fatalf("jar should be dropped after disconnect, got %v", cookies)
+	}
+}
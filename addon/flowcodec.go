@@ -0,0 +1,333 @@
+package addon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// CapturedFlow 的序列化格式，用于 CaptureStore、FileFlowStore
+// 大量抓包时 protobuf/msgpack 相比 json 体积更小、编解码更快
+
+type FlowCodec interface {
+	Name() string // 同时作为文件后缀
+	Marshal(f *CapturedFlow) ([]byte, error)
+	Unmarshal(data []byte, f *CapturedFlow) error
+}
+
+// name: json, protobuf, msgpack
+func FlowCodecByName(name string) (FlowCodec, error) {
+	switch name {
+	case "", "json":
+		return JSONFlowCodec{}, nil
+	case "protobuf", "pb":
+		return ProtobufFlowCodec{}, nil
+	case "msgpack":
+		return MsgpackFlowCodec{}, nil
+	}
+	return nil, fmt.Errorf("unknown flow codec %v", name)
+}
+
+type JSONFlowCodec struct{}
+
+func (JSONFlowCodec) Name() string { return "json" }
+
+func (JSONFlowCodec) Marshal(f *CapturedFlow) ([]byte, error) {
+	return json.Marshal(f)
+}
+
+func (JSONFlowCodec) Unmarshal(data []byte, f *CapturedFlow) error {
+	return json.Unmarshal(data, f)
+}
+
+type MsgpackFlowCodec struct{}
+
+func (MsgpackFlowCodec) Name() string { return "msgpack" }
+
+func (MsgpackFlowCodec) Marshal(f *CapturedFlow) ([]byte, error) {
+	return msgpack.Marshal(f)
+}
+
+func (MsgpackFlowCodec) Unmarshal(data []byte, f *CapturedFlow) error {
+	return msgpack.Unmarshal(data, f)
+}
+
+// protobuf wire format, 对应的 message 定义:
+//
+//	message Header {
+//	  string key = 1;
+//	  repeated string values = 2;
+//	}
+//	message CapturedFlow {
+//	  string id = 1;
+//	  string method = 2;
+//	  string url = 3;
+//	  string proto = 4;
+//	  repeated Header request_header = 5;
+//	  int64 status_code = 6;
+//	  repeated Header response_header = 7;
+//	  bool encrypted = 8;
+//	  repeated string encrypted_headers = 9;
+//	  bytes request_body = 10;
+//	  bytes response_body = 11;
+//	  string response_proto = 12;
+//	  repeated Header response_trailer = 13;
+//	  string error = 14;
+//	  bool stream = 15;
+//	  repeated Header tags = 16; // 每个 tag 仅一个 value
+//	  int64 start = 17;          // unix 纳秒
+//	  int64 request_bytes = 18;
+//	  int64 response_bytes = 19;
+//	  int64 connect = 20;        // 纳秒，下同
+//	  int64 ttfb = 21;
+//	  int64 total = 22;
+//	  bytes decoded_response_body = 23;
+//	}
+type ProtobufFlowCodec struct{}
+
+func (ProtobufFlowCodec) Name() string { return "pb" }
+
+func (ProtobufFlowCodec) Marshal(f *CapturedFlow) ([]byte, error) {
+	var b []byte
+	appendString := func(num protowire.Number, s string) {
+		if s == "" {
+			return
+		}
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendString(b, s)
+	}
+	appendBytes := func(num protowire.Number, v []byte) {
+		if v == nil {
+			return
+		}
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, v)
+	}
+	appendInt := func(num protowire.Number, v int64) {
+		if v == 0 {
+			return
+		}
+		b = protowire.AppendTag(b, num, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(v))
+	}
+
+	appendString(1, f.Id)
+	appendString(2, f.Method)
+	appendString(3, f.Url)
+	appendString(4, f.Proto)
+	for _, h := range marshalProtoHeader(f.RequestHeader) {
+		appendBytes(5, h)
+	}
+	if f.StatusCode != 0 {
+		b = protowire.AppendTag(b, 6, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(f.StatusCode))
+	}
+	for _, h := range marshalProtoHeader(f.ResponseHeader) {
+		appendBytes(7, h)
+	}
+	if f.Encrypted {
+		b = protowire.AppendTag(b, 8, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(true))
+	}
+	for _, key := range f.EncryptedHeaders {
+		b = protowire.AppendTag(b, 9, protowire.BytesType)
+		b = protowire.AppendString(b, key)
+	}
+	appendBytes(10, f.RequestBody)
+	appendBytes(11, f.ResponseBody)
+	appendString(12, f.ResponseProto)
+	for _, h := range marshalProtoHeader(f.ResponseTrailer) {
+		appendBytes(13, h)
+	}
+	appendString(14, f.Err)
+	if f.Stream {
+		b = protowire.AppendTag(b, 15, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(true))
+	}
+	tags := make(http.Header, len(f.Tags))
+	for k, v := range f.Tags {
+		tags[k] = []string{v}
+	}
+	for _, h := range marshalProtoHeader(tags) {
+		appendBytes(16, h)
+	}
+	if !f.Stats.Start.IsZero() {
+		appendInt(17, f.Stats.Start.UnixNano())
+	}
+	appendInt(18, f.Stats.RequestBytes)
+	appendInt(19, f.Stats.ResponseBytes)
+	appendInt(20, int64(f.Stats.Connect))
+	appendInt(21, int64(f.Stats.TTFB))
+	appendInt(22, int64(f.Stats.Total))
+	appendBytes(23, f.DecodedResponseBody)
+	return b, nil
+}
+
+func (ProtobufFlowCodec) Unmarshal(data []byte, f *CapturedFlow) error {
+	*f = CapturedFlow{}
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		switch {
+		case typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+			switch num {
+			case 1:
+				f.Id = string(v)
+			case 2:
+				f.Method = string(v)
+			case 3:
+				f.Url = string(v)
+			case 4:
+				f.Proto = string(v)
+			case 5:
+				if f.RequestHeader == nil {
+					f.RequestHeader = make(http.Header)
+				}
+				if err := unmarshalProtoHeader(v, f.RequestHeader); err != nil {
+					return err
+				}
+			case 7:
+				if f.ResponseHeader == nil {
+					f.ResponseHeader = make(http.Header)
+				}
+				if err := unmarshalProtoHeader(v, f.ResponseHeader); err != nil {
+					return err
+				}
+			case 9:
+				f.EncryptedHeaders = append(f.EncryptedHeaders, string(v))
+			case 10:
+				f.RequestBody = append([]byte{}, v...)
+			case 11:
+				f.ResponseBody = append([]byte{}, v...)
+			case 12:
+				f.ResponseProto = string(v)
+			case 13:
+				if f.ResponseTrailer == nil {
+					f.ResponseTrailer = make(http.Header)
+				}
+				if err := unmarshalProtoHeader(v, f.ResponseTrailer); err != nil {
+					return err
+				}
+			case 14:
+				f.Err = string(v)
+			case 16:
+				tag := make(http.Header)
+				if err := unmarshalProtoHeader(v, tag); err != nil {
+					return err
+				}
+				if f.Tags == nil {
+					f.Tags = make(map[string]string)
+				}
+				for k, values := range tag {
+					if len(values) > 0 {
+						f.Tags[k] = values[0]
+					}
+				}
+			case 23:
+				f.DecodedResponseBody = append([]byte{}, v...)
+			}
+		case typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+			switch num {
+			case 6:
+				f.StatusCode = int(v)
+			case 8:
+				f.Encrypted = protowire.DecodeBool(v)
+			case 15:
+				f.Stream = protowire.DecodeBool(v)
+			case 17:
+				f.Stats.Start = time.Unix(0, int64(v)).UTC()
+			case 18:
+				f.Stats.RequestBytes = int64(v)
+			case 19:
+				f.Stats.ResponseBytes = int64(v)
+			case 20:
+				f.Stats.Connect = time.Duration(v)
+			case 21:
+				f.Stats.TTFB = time.Duration(v)
+			case 22:
+				f.Stats.Total = time.Duration(v)
+			}
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+		}
+	}
+	return nil
+}
+
+// 按 key 排序，保证输出稳定
+func marshalProtoHeader(header http.Header) [][]byte {
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	msgs := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		var b []byte
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, key)
+		for _, value := range header[key] {
+			b = protowire.AppendTag(b, 2, protowire.BytesType)
+			b = protowire.AppendString(b, value)
+		}
+		msgs = append(msgs, b)
+	}
+	return msgs
+}
+
+func unmarshalProtoHeader(data []byte, header http.Header) error {
+	var key string
+	var values []string
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		if typ != protowire.BytesType {
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			data = data[n:]
+			continue
+		}
+		v, n := protowire.ConsumeString(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		switch num {
+		case 1:
+			key = v
+		case 2:
+			values = append(values, v)
+		}
+	}
+	header[key] = append(header[key], values...)
+	return nil
+}
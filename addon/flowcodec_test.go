@@ -0,0 +1,112 @@
+package addon
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+	uuid "github.com/satori/go.uuid"
+)
+
+func TestFlowCodecRoundTrip(t *testing.T) {
+	flow := &CapturedFlow{
+		Id:     uuid.NewV4().String(),
+		Method: "POST",
+		Url:    "https://example.com/api?q=1",
+		Proto:  "HTTP/1.1",
+		RequestHeader: http.Header{
+			"Content-Type": []string{"application/json"},
+			"Cookie":       []string{"a=1", "b=2"},
+		},
+		StatusCode: 201,
+		ResponseHeader: http.Header{
+			"Set-Cookie": []string{"session=abc"},
+		},
+		Encrypted:        true,
+		EncryptedHeaders: []string{"Cookie"},
+		ResponseProto:    "HTTP/2.0",
+		ResponseTrailer: http.Header{
+			"Grpc-Status": []string{"0"},
+		},
+		Err:    "upstream timeout",
+		Stream: true,
+		Tags:   map[string]string{"type": "api", "empty": ""},
+		Stats: CapturedFlowStats{
+			Start:         time.Unix(1700000000, 123).UTC(),
+			RequestBytes:  17,
+			ResponseBytes: 4,
+			Connect:       3 * time.Millisecond,
+			TTFB:          15 * time.Millisecond,
+			Total:         20 * time.Millisecond,
+		},
+		RequestBody:         []byte(`{"hello":"world"}`),
+		ResponseBody:        []byte{0, 1, 2, 0xff},
+		DecodedResponseBody: []byte("decoded"),
+	}
+
+	for _, name := range []string{"json", "protobuf", "msgpack"} {
+		t.Run(name, func(t *testing.T) {
+			codec, err := FlowCodecByName(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := codec.Marshal(flow)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded := new(CapturedFlow)
+			if err := codec.Unmarshal(data, decoded); err != nil {
+				t.Fatal(err)
+			}
+			// 各格式还原的 time.Location 不同，单独比较
+			if !decoded.Stats.Start.Equal(flow.Stats.Start) {
+				t.Fatalf("expected start %v, but got %v", flow.Stats.Start, decoded.Stats.Start)
+			}
+			decoded.Stats.Start = flow.Stats.Start
+			if !reflect.DeepEqual(flow, decoded) {
+				t.Fatalf("expected %+v, but got %+v", flow, decoded)
+			}
+		})
+	}
+
+	if _, err := FlowCodecByName("xml"); err == nil {
+		t.Fatal("expected unknown codec error")
+	}
+}
+
+func TestCaptureStoreCodec(t *testing.T) {
+	store, err := NewCaptureStore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Codec = ProtobufFlowCodec{}
+
+	f := &proxy.Flow{
+		Id: uuid.NewV4(),
+		Request: &proxy.Request{
+			Method: "GET",
+			URL:    &url.URL{Scheme: "http", Host: "example.com", Path: "/"},
+			Proto:  "HTTP/1.1",
+			Header: http.Header{"Accept": []string{"*/*"}},
+		},
+		Response: &proxy.Response{
+			StatusCode: 200,
+			Header:     http.Header{"Content-Type": []string{"text/plain"}},
+			Body:       []byte("hello"),
+		},
+	}
+	if err := store.Save(f); err != nil {
+		t.Fatal(err)
+	}
+	captured, err := store.Load(f.Id.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(captured.ResponseBody, []byte("hello")) || captured.RequestHeader.Get("Accept") != "*/*" {
+		t.Fatalf("unexpected captured flow %+v", captured)
+	}
+}
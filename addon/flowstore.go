@@ -0,0 +1,224 @@
+package addon
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// flow 的持久化存储，可实现为 S3、数据库等，StorageAddon 将完成的 flow 保存至 FlowStore
+// Load、List 返回的 flow 未关联客户端连接，ConnContext 为 nil，可修改后通过 proxy 重新发送
+type FlowStore interface {
+	Save(f *proxy.Flow) error
+	Load(id string) (*proxy.Flow, error)
+	List(filter FlowFilter) ([]*proxy.Flow, error)
+}
+
+var ErrFlowNotFound = errors.New("flow not found")
+
+// FlowStore.List 的过滤条件，零值的字段不过滤
+type FlowFilter struct {
+	Host   string    // 请求的 host，不含端口
+	Method string    // 请求方法
+	Since  time.Time // 不早于此时间开始的 flow
+	Limit  int       // 最多返回最近的 n 个
+}
+
+func (filter FlowFilter) Match(f *proxy.Flow) bool {
+	if filter.Host != "" && !strings.EqualFold(f.Request.URL.Hostname(), filter.Host) {
+		return false
+	}
+	if filter.Method != "" && !strings.EqualFold(f.Request.Method, filter.Method) {
+		return false
+	}
+	if !filter.Since.IsZero() && f.Stats.Start.Before(filter.Since) {
+		return false
+	}
+	return true
+}
+
+// 在 Addon.FlowDone 中保存 flow，此时 stream 模式的 body 已传输完成，CONNECT 隧道不保存
+// Save 在处理 flow 的 goroutine 中同步调用，不影响已发送的响应，较慢的存储可在 Save 中自行异步处理
+type StorageAddon struct {
+	proxy.BaseAddon
+	Store FlowStore
+}
+
+func NewStorageAddon(store FlowStore) *StorageAddon {
+	return &StorageAddon{Store: store}
+}
+
+func (s *StorageAddon) FlowDone(f *proxy.Flow) {
+	if f.Request.Method == "CONNECT" {
+		return
+	}
+	if err := s.Store.Save(f); err != nil {
+		log.Errorf("flow store save %v error: %v", f.Id, err)
+	}
+}
+
+// 还原为 flow，Err 还原为仅包含错误信息的 error，StatusCode 为 0 时没有 Response
+func (captured *CapturedFlow) Flow() (*proxy.Flow, error) {
+	id, err := uuid.FromString(captured.Id)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(captured.Url)
+	if err != nil {
+		return nil, err
+	}
+	f := &proxy.Flow{
+		Id: id,
+		Request: &proxy.Request{
+			Method: captured.Method,
+			URL:    u,
+			Proto:  captured.Proto,
+			Header: captured.RequestHeader,
+			Body:   captured.RequestBody,
+		},
+		Stream: captured.Stream,
+		Tags:   copyTags(captured.Tags),
+		Stats: proxy.FlowStats{
+			Start:         captured.Stats.Start,
+			RequestBytes:  captured.Stats.RequestBytes,
+			ResponseBytes: captured.Stats.ResponseBytes,
+			Connect:       captured.Stats.Connect,
+			TTFB:          captured.Stats.TTFB,
+			Total:         captured.Stats.Total,
+		},
+	}
+	if f.Request.Header == nil {
+		f.Request.Header = make(http.Header)
+	}
+	if captured.Err != "" {
+		f.Err = errors.New(captured.Err)
+	}
+	if captured.StatusCode != 0 {
+		f.Response = &proxy.Response{
+			StatusCode: captured.StatusCode,
+			Proto:      captured.ResponseProto,
+			Header:     captured.ResponseHeader,
+			Trailer:    captured.ResponseTrailer,
+			Body:       captured.ResponseBody,
+		}
+		if f.Response.Header == nil {
+			f.Response.Header = make(http.Header)
+		}
+	}
+	return f, nil
+}
+
+func copyTags(tags map[string]string) map[string]string {
+	if len(tags) == 0 {
+		return nil
+	}
+	copied := make(map[string]string, len(tags))
+	for k, v := range tags {
+		copied[k] = v
+	}
+	return copied
+}
+
+// 每个 flow 序列化为 CapturedFlow 保存至 Dir 中的 <id>.<Codec.Name()>，body 与元数据在同一文件中
+// 压缩的响应同时保存解压后的 body
+type FileFlowStore struct {
+	Dir   string
+	Codec FlowCodec // 默认 json
+}
+
+func NewFileFlowStore(dir string) (*FileFlowStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileFlowStore{Dir: dir, Codec: JSONFlowCodec{}}, nil
+}
+
+func (s *FileFlowStore) codec() FlowCodec {
+	if s.Codec == nil {
+		return JSONFlowCodec{}
+	}
+	return s.Codec
+}
+
+func (s *FileFlowStore) file(id string) string {
+	return filepath.Join(s.Dir, id+"."+s.codec().Name())
+}
+
+func (s *FileFlowStore) Save(f *proxy.Flow) error {
+	captured := NewCapturedFlow(f)
+	if f.Response != nil && len(f.Response.Body) > 0 && f.Response.Header.Get("Content-Encoding") != "" {
+		if decoded, err := f.Response.DecodedBody(); err == nil {
+			captured.DecodedResponseBody = decoded
+		}
+	}
+	data, err := s.codec().Marshal(captured)
+	if err != nil {
+		return err
+	}
+	// 先写入临时文件再重命名，List 不会读取到写入中的文件
+	tmp := s.file(f.Id.String()) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file(f.Id.String()))
+}
+
+func (s *FileFlowStore) Load(id string) (*proxy.Flow, error) {
+	if _, err := uuid.FromString(id); err != nil {
+		return nil, ErrFlowNotFound
+	}
+	data, err := ioutil.ReadFile(s.file(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrFlowNotFound
+		}
+		return nil, err
+	}
+	captured := new(CapturedFlow)
+	if err := s.codec().Unmarshal(data, captured); err != nil {
+		return nil, err
+	}
+	return captured.Flow()
+}
+
+// 按 flow 开始时间从旧到新排列
+func (s *FileFlowStore) List(filter FlowFilter) ([]*proxy.Flow, error) {
+	ext := "." + s.codec().Name()
+	entries, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+	flows := make([]*proxy.Flow, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ext {
+			continue
+		}
+		f, err := s.Load(strings.TrimSuffix(entry.Name(), ext))
+		if err != nil {
+			if err == ErrFlowNotFound {
+				continue
+			}
+			return nil, err
+		}
+		if filter.Match(f) {
+			flows = append(flows, f)
+		}
+	}
+	sort.SliceStable(flows, func(i, j int) bool {
+		return flows[i].Stats.Start.Before(flows[j].Stats.Start)
+	})
+	if filter.Limit > 0 && len(flows) > filter.Limit {
+		flows = flows[len(flows)-filter.Limit:]
+	}
+	return flows, nil
+}
@@ -0,0 +1,197 @@
+package addon
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+	uuid "github.com/satori/go.uuid"
+)
+
+func newStoreTestFlow(method, rawurl string, start time.Time) *proxy.Flow {
+	u, _ := url.Parse(rawurl)
+	return &proxy.Flow{
+		Id: uuid.NewV4(),
+		Request: &proxy.Request{
+			Method: method,
+			URL:    u,
+			Proto:  "HTTP/1.1",
+			Header: http.Header{"Accept": []string{"*/*"}},
+		},
+		Stats: proxy.FlowStats{Start: start},
+	}
+}
+
+func TestFileFlowStore(t *testing.T) {
+	store, err := NewFileFlowStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := NewStorageAddon(store)
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte("hello gzip"))
+	w.Close()
+
+	start := time.Now().Add(-time.Minute).Round(0)
+	f := newStoreTestFlow("POST", "https://api.example.com/login?a=1", start)
+	f.Request.Header.Add("Cookie", "a=1")
+	f.Request.Header.Add("Cookie", "b=2")
+	f.Request.Body = []byte(`{"user":"a"}`)
+	f.Response = &proxy.Response{
+		StatusCode: 200,
+		Proto:      "HTTP/1.1",
+		Header: http.Header{
+			"Set-Cookie":       []string{"x=1", "y=2"},
+			"Content-Encoding": []string{"gzip"},
+		},
+		Body: gz.Bytes(),
+	}
+	f.Stats.ResponseBytes = int64(gz.Len())
+	f.Stats.TTFB = 15 * time.Millisecond
+	f.Stats.Total = 20 * time.Millisecond
+	f.SetTag("type", "api")
+	storage.FlowDone(f)
+
+	// stream 模式未缓冲 body，仅保存元数据
+	streamed := newStoreTestFlow("GET", "http://static.example.com/big.bin", start.Add(time.Second))
+	streamed.Stream = true
+	streamed.Response = &proxy.Response{StatusCode: 200, Header: http.Header{"Content-Length": []string{"10485760"}}}
+	streamed.Stats.ResponseBytes = 10485760
+	storage.FlowDone(streamed)
+
+	failed := newStoreTestFlow("GET", "http://api.example.com/timeout", start.Add(2*time.Second))
+	failed.Err = proxy.ErrUpstreamTimeout
+	storage.FlowDone(failed)
+
+	// CONNECT 隧道不保存
+	tunnel := newStoreTestFlow("CONNECT", "http://api.example.com:443", start.Add(3*time.Second))
+	storage.FlowDone(tunnel)
+
+	loaded, err := store.Load(f.Id.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Id != f.Id || loaded.Request.URL.String() != f.Request.URL.String() || string(loaded.Request.Body) != `{"user":"a"}` {
+		t.Fatalf("unexpected request %+v", loaded.Request)
+	}
+	if loaded.Tag("type") != "api" {
+		t.Fatalf("unexpected tags %v", loaded.Tags)
+	}
+	if !reflect.DeepEqual(loaded.Request.Header["Cookie"], []string{"a=1", "b=2"}) ||
+		!reflect.DeepEqual(loaded.Response.Header["Set-Cookie"], []string{"x=1", "y=2"}) {
+		t.Fatalf("multi-valued headers lost: %v %v", loaded.Request.Header, loaded.Response.Header)
+	}
+	if !bytes.Equal(loaded.Response.Body, gz.Bytes()) {
+		t.Fatal("response body should be stored as received")
+	}
+	if body, err := loaded.Response.DecodedBody(); err != nil || string(body) != "hello gzip" {
+		t.Fatalf("unexpected decoded body %q %v", body, err)
+	}
+	if !loaded.Stats.Start.Equal(start) || loaded.Stats.TTFB != f.Stats.TTFB || loaded.Stats.Total != f.Stats.Total {
+		t.Fatalf("unexpected stats %+v", loaded.Stats)
+	}
+	data, err := ioutil.ReadFile(store.file(f.Id.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	captured := new(CapturedFlow)
+	if err := store.codec().Unmarshal(data, captured); err != nil {
+		t.Fatal(err)
+	}
+	if string(captured.DecodedResponseBody) != "hello gzip" {
+		t.Fatalf("expected decoded body stored, but got %q", captured.DecodedResponseBody)
+	}
+
+	loaded, err = store.Load(streamed.Id.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.Stream || loaded.Response.Body != nil || loaded.Stats.ResponseBytes != 10485760 {
+		t.Fatalf("unexpected streamed flow %+v", loaded)
+	}
+	loaded, err = store.Load(failed.Id.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Response != nil || loaded.Err == nil || loaded.Err.Error() != proxy.ErrUpstreamTimeout.Error() {
+		t.Fatalf("unexpected failed flow %+v", loaded)
+	}
+
+	if _, err := store.Load(uuid.NewV4().String()); err != ErrFlowNotFound {
+		t.Fatalf("expected ErrFlowNotFound, but got %v", err)
+	}
+	if _, err := store.Load(tunnel.Id.String()); err != ErrFlowNotFound {
+		t.Fatalf("expected CONNECT flow not stored, but got %v", err)
+	}
+	if _, err := store.Load("../secret"); err != ErrFlowNotFound {
+		t.Fatalf("expected ErrFlowNotFound, but got %v", err)
+	}
+
+	listIds := func(filter FlowFilter) []uuid.UUID {
+		flows, err := store.List(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]uuid.UUID, 0, len(flows))
+		for _, f := range flows {
+			ids = append(ids, f.Id)
+		}
+		return ids
+	}
+	cases := []struct {
+		filter   FlowFilter
+		expected []uuid.UUID
+	}{
+		{FlowFilter{}, []uuid.UUID{f.Id, streamed.Id, failed.Id}},
+		{FlowFilter{Host: "API.example.com"}, []uuid.UUID{f.Id, failed.Id}},
+		{FlowFilter{Method: "get"}, []uuid.UUID{streamed.Id, failed.Id}},
+		{FlowFilter{Since: start.Add(time.Second)}, []uuid.UUID{streamed.Id, failed.Id}},
+		{FlowFilter{Limit: 1}, []uuid.UUID{failed.Id}},
+	}
+	for _, c := range cases {
+		if got := listIds(c.filter); !reflect.DeepEqual(got, c.expected) {
+			t.Fatalf("%+v: expected %v, but got %v", c.filter, c.expected, got)
+		}
+	}
+}
+
+func TestFileFlowStoreCodec(t *testing.T) {
+	store, err := NewFileFlowStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Codec = ProtobufFlowCodec{}
+
+	f := newStoreTestFlow("GET", "http://example.com/", time.Now().Round(0))
+	f.Response = &proxy.Response{
+		StatusCode: 200,
+		Proto:      "HTTP/1.1",
+		Header:     http.Header{"Content-Type": []string{"text/plain"}},
+		Trailer:    http.Header{"X-Checksum": []string{"abc"}},
+		Body:       []byte("hello"),
+	}
+	f.SetTag("type", "static")
+	if err := store.Save(f); err != nil {
+		t.Fatal(err)
+	}
+	flows, err := store.List(FlowFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flows) != 1 {
+		t.Fatalf("expected 1 flow, but got %v", len(flows))
+	}
+	loaded := flows[0]
+	if loaded.Id != f.Id || string(loaded.Response.Body) != "hello" || loaded.Response.Trailer.Get("X-Checksum") != "abc" ||
+		loaded.Tag("type") != "static" || !loaded.Stats.Start.Equal(f.Stats.Start) {
+		t.Fatalf("unexpected loaded flow %+v", loaded)
+	}
+}
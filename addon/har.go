@@ -0,0 +1,352 @@
+package addon
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// 将完成的 flow 记录为 HAR 1.2，调用 Close 时写入文件
+// http://www.softwareishard.com/blog/har-12-spec/
+// Stream 的 flow 未缓存 body，content 为空，CONNECT 隧道不记录
+
+type HarDumper struct {
+	proxy.BaseAddon
+	path string
+
+	mu      sync.Mutex
+	entries []*harEntry
+	timings map[*proxy.Flow]*harTiming
+}
+
+// 各阶段的时间点
+type harTiming struct {
+	start           time.Time
+	requestDone     time.Time
+	responseHeaders time.Time
+}
+
+func NewHarDumper(path string) *HarDumper {
+	return &HarDumper{
+		path:    path,
+		entries: make([]*harEntry, 0),
+		timings: make(map[*proxy.Flow]*harTiming),
+	}
+}
+
+func (h *HarDumper) Requestheaders(f *proxy.Flow) {
+	if f.Request.Method == "CONNECT" {
+		return
+	}
+	timing := &harTiming{start: time.Now()}
+	h.mu.Lock()
+	h.timings[f] = timing
+	h.mu.Unlock()
+
+	go func() {
+		<-f.Done()
+		done := time.Now()
+		h.mu.Lock()
+		delete(h.timings, f)
+		h.mu.Unlock()
+		entry := newHarEntry(f, timing, done)
+		h.mu.Lock()
+		h.entries = append(h.entries, entry)
+		h.mu.Unlock()
+	}()
+}
+
+func (h *HarDumper) Request(f *proxy.Flow) {
+	if timing := h.timing(f); timing != nil {
+		timing.requestDone = time.Now()
+	}
+}
+
+func (h *HarDumper) Responseheaders(f *proxy.Flow) {
+	if timing := h.timing(f); timing != nil {
+		timing.responseHeaders = time.Now()
+	}
+}
+
+func (h *HarDumper) timing(f *proxy.Flow) *harTiming {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.timings[f]
+}
+
+// 写入已完成的 flow，进行中的 flow 不包含在内
+func (h *HarDumper) Close() error {
+	h.mu.Lock()
+	har := &harFile{
+		Log: &harLog{
+			Version: "1.2",
+			Creator: &harCreator{Name: "go-mitmproxy"},
+			Entries: h.entries,
+		},
+	}
+	data, err := json.MarshalIndent(har, "", "  ")
+	h.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(h.path, data, 0644)
+}
+
+type harFile struct {
+	Log *harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string      `json:"version"`
+	Creator *harCreator `json:"creator"`
+	Entries []*harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string       `json:"startedDateTime"`
+	Time            float64      `json:"time"`
+	Request         *harRequest  `json:"request"`
+	Response        *harResponse `json:"response"`
+	Cache           struct{}     `json:"cache"`
+	Timings         *harTimings  `json:"timings"`
+	ServerIPAddress string       `json:"serverIPAddress,omitempty"`
+}
+
+type harRequest struct {
+	Method      string          `json:"method"`
+	Url         string          `json:"url"`
+	HttpVersion string          `json:"httpVersion"`
+	Cookies     []*harCookie    `json:"cookies"`
+	Headers     []*harNameValue `json:"headers"`
+	QueryString []*harNameValue `json:"queryString"`
+	PostData    *harPostData    `json:"postData,omitempty"`
+	HeadersSize int             `json:"headersSize"`
+	BodySize    int             `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int             `json:"status"`
+	StatusText  string          `json:"statusText"`
+	HttpVersion string          `json:"httpVersion"`
+	Cookies     []*harCookie    `json:"cookies"`
+	Headers     []*harNameValue `json:"headers"`
+	Content     *harContent     `json:"content"`
+	RedirectURL string          `json:"redirectURL"`
+	HeadersSize int             `json:"headersSize"`
+	BodySize    int             `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harCookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+	HttpOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"` // 非标准字段，二进制内容为 base64
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// 单位 ms，不适用的阶段为 -1
+type harTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+func newHarEntry(f *proxy.Flow, timing *harTiming, done time.Time) *harEntry {
+	entry := &harEntry{
+		StartedDateTime: timing.start.UTC().Format("2006-01-02T15:04:05.000Z"),
+		Time:            durationMs(done.Sub(timing.start)),
+		Request:         newHarRequest(f),
+		Response:        newHarResponse(f),
+		Timings:         newHarTimings(timing, done),
+	}
+	if f.ConnContext != nil && f.ConnContext.ServerConn != nil {
+		if addr := f.ConnContext.ServerConn.RemoteAddr(); addr != nil {
+			if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+				entry.ServerIPAddress = host
+			}
+		}
+	}
+	return entry
+}
+
+func newHarTimings(timing *harTiming, done time.Time) *harTimings {
+	// Stream 时不经过 Addon.Request，无法区分发送请求的时间
+	requestDone := timing.requestDone
+	if requestDone.IsZero() {
+		requestDone = timing.start
+	}
+	responseHeaders := timing.responseHeaders
+	if responseHeaders.IsZero() {
+		responseHeaders = done
+	}
+	return &harTimings{
+		Blocked: -1,
+		DNS:     -1,
+		Connect: -1,
+		Send:    durationMs(requestDone.Sub(timing.start)),
+		Wait:    durationMs(responseHeaders.Sub(requestDone)),
+		Receive: durationMs(done.Sub(responseHeaders)),
+		SSL:     -1,
+	}
+}
+
+func newHarRequest(f *proxy.Flow) *harRequest {
+	req := f.Request
+	har := &harRequest{
+		Method:      req.Method,
+		Url:         req.URL.String(),
+		HttpVersion: req.Proto,
+		Cookies:     make([]*harCookie, 0),
+		Headers:     harHeaders(req.Header),
+		QueryString: make([]*harNameValue, 0),
+		HeadersSize: -1,
+		BodySize:    len(req.Body),
+	}
+	for _, c := range (&http.Request{Header: req.Header}).Cookies() {
+		har.Cookies = append(har.Cookies, &harCookie{Name: c.Name, Value: c.Value})
+	}
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range query[key] {
+			har.QueryString = append(har.QueryString, &harNameValue{Name: key, Value: value})
+		}
+	}
+
+	if f.Stream && req.Body == nil {
+		har.BodySize = -1
+	}
+	if len(req.Body) > 0 {
+		postData := &harPostData{MimeType: req.Header.Get("Content-Type")}
+		body, err := req.DecodedBody()
+		if err != nil {
+			body = req.Body
+		}
+		if canPrint(body) {
+			postData.Text = string(body)
+		} else {
+			postData.Text = base64.StdEncoding.EncodeToString(body)
+			postData.Encoding = "base64"
+		}
+		har.PostData = postData
+	}
+	return har
+}
+
+func newHarResponse(f *proxy.Flow) *harResponse {
+	har := &harResponse{
+		Cookies:     make([]*harCookie, 0),
+		Headers:     make([]*harNameValue, 0),
+		Content:     &harContent{},
+		HeadersSize: -1,
+		BodySize:    -1,
+	}
+	res := f.Response
+	if res == nil {
+		return har
+	}
+
+	har.Status = res.StatusCode
+	har.StatusText = http.StatusText(res.StatusCode)
+	har.HttpVersion = res.Proto
+	har.Headers = harHeaders(res.Header)
+	har.RedirectURL = res.Header.Get("Location")
+	for _, c := range (&http.Response{Header: res.Header}).Cookies() {
+		cookie := &harCookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			HttpOnly: c.HttpOnly,
+			Secure:   c.Secure,
+		}
+		if !c.Expires.IsZero() {
+			cookie.Expires = c.Expires.UTC().Format(time.RFC3339)
+		}
+		har.Cookies = append(har.Cookies, cookie)
+	}
+	har.Content.MimeType = res.Header.Get("Content-Type")
+
+	// Stream 的 flow 未缓存 body
+	if res.Body == nil {
+		return har
+	}
+	har.BodySize = len(res.Body)
+	body, err := res.DecodedBody()
+	if err != nil {
+		log.Debugf("har %v decode body error: %v", f.Id, err)
+		body = res.Body
+	}
+	har.Content.Size = len(body)
+	if len(body) == 0 {
+		return har
+	}
+	if res.IsTextContentType() {
+		har.Content.Text = string(body)
+	} else {
+		har.Content.Text = base64.StdEncoding.EncodeToString(body)
+		har.Content.Encoding = "base64"
+	}
+	return har
+}
+
+func harHeaders(header http.Header) []*harNameValue {
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := make([]*harNameValue, 0, len(keys))
+	for _, key := range keys {
+		for _, value := range header[key] {
+			values = append(values, &harNameValue{Name: key, Value: value})
+		}
+	}
+	return values
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
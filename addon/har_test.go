@@ -0,0 +1,188 @@
+package addon
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+)
+
+func TestHarDumper(t *testing.T) {
+	binary := []byte{0x89, 'P', 'N', 'G', 0x00, 0xff}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/image":
+				w.Header().Set("Content-Type", "image/png")
+				w.Write(binary)
+			default:
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write([]byte("hello " + r.URL.Query().Get("name")))
+			}
+		}),
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go server.Serve(ln)
+	tlsServer := httptest.NewTLSServer(server.Handler)
+	defer tlsServer.Close()
+	// 以 HTTP/1.0 响应的上游
+	ln10, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln10.Close()
+	go func() {
+		for {
+			conn, err := ln10.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				conn.Write([]byte("HTTP/1.0 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 2\r\n\r\nok"))
+			}()
+		}
+	}()
+
+	testProxy, err := proxy.NewProxy(&proxy.Options{
+		HttpAddr:    ":29105",
+		SslInsecure: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "dump.har")
+	har := NewHarDumper(path)
+	testProxy.AddAddon(&streamPathAddon{})
+	testProxy.AddAddon(har)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29105")
+			},
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	paths := []string{"/text?name=go&a=1", "/image", "/stream"}
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		for _, p := range paths {
+			wg.Add(1)
+			go func(p string) {
+				defer wg.Done()
+				res, err := proxyClient.Get("http://" + ln.Addr().String() + p)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				ioutil.ReadAll(res.Body)
+				res.Body.Close()
+			}(p)
+		}
+	}
+	wg.Wait()
+	// https 请求的 CONNECT 隧道不记录
+	for _, u := range []string{tlsServer.URL + "/tls", "http://" + ln10.Addr().String() + "/http10"} {
+		res, err := proxyClient.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	proxyClient.CloseIdleConnections()
+
+	// flow 结束后异步记录
+	for i := 0; i < 100; i++ {
+		har.mu.Lock()
+		n := len(har.entries)
+		har.mu.Unlock()
+		if n == 11 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	time.Sleep(time.Millisecond * 50) // wait for CONNECT flow done
+	if err := har.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := new(harFile)
+	if err := json.Unmarshal(data, file); err != nil {
+		t.Fatal(err)
+	}
+	if file.Log.Version != "1.2" || len(file.Log.Entries) != 11 {
+		t.Fatalf("expected 11 entries, got %v", len(file.Log.Entries))
+	}
+
+	for _, entry := range file.Log.Entries {
+		u, _ := url.Parse(entry.Request.Url)
+		if entry.Response.Status != 200 || entry.Timings == nil || entry.StartedDateTime == "" {
+			t.Fatalf("unexpected entry: %+v", entry)
+		}
+		content := entry.Response.Content
+		switch u.Path {
+		case "/tls":
+			continue
+		case "/http10":
+			// 响应的 httpVersion 取自上游响应，与客户端请求的协议无关
+			if entry.Request.HttpVersion != "HTTP/1.1" || entry.Response.HttpVersion != "HTTP/1.0" {
+				t.Fatalf("unexpected http version: %v %v", entry.Request.HttpVersion, entry.Response.HttpVersion)
+			}
+			continue
+		case "/text":
+			if content.Text != "hello go" || content.Encoding != "" {
+				t.Fatalf("unexpected text content: %+v", content)
+			}
+			if len(entry.Request.QueryString) != 2 || entry.Request.QueryString[0].Name != "a" || entry.Request.QueryString[1].Value != "go" {
+				t.Fatalf("unexpected query string: %+v", entry.Request.QueryString)
+			}
+		case "/image":
+			if content.Encoding != "base64" || content.Text != base64.StdEncoding.EncodeToString(binary) || content.Size != len(binary) {
+				t.Fatalf("unexpected binary content: %+v", content)
+			}
+		case "/stream":
+			if content.Text != "" || content.Size != 0 || entry.Response.BodySize != -1 {
+				t.Fatalf("unexpected stream content: %+v", content)
+			}
+		default:
+			t.Fatalf("unexpected url: %v", entry.Request.Url)
+		}
+
+		found := false
+		for _, h := range entry.Response.Headers {
+			if h.Name == "Content-Type" {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("response headers missing content-type: %+v", entry.Response.Headers)
+		}
+	}
+}
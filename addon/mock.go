@@ -0,0 +1,124 @@
+package addon
+
+import (
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// 对匹配的请求直接返回预设的响应，不请求上游
+// 在 Requestheaders 中设置 f.Response，之后的 addon 仍会收到 Response 事件
+// 例如:
+//
+//	mock := NewMock()
+//	mock.AddURL("GET", "https://api.example.com/user", MockResponse(200, http.Header{"Content-Type": {"application/json"}}, []byte(`{"id":1}`)))
+//	resp, _ := MockFile(200, nil, "testdata/list.json")
+//	mock.AddRule(func(req *proxy.Request) bool { return req.URL.Path == "/list" }, resp)
+
+type mockRule struct {
+	match    func(*proxy.Request) bool
+	response *proxy.Response
+}
+
+type Mock struct {
+	proxy.BaseAddon
+
+	mu    sync.RWMutex
+	rules []*mockRule
+}
+
+func NewMock() *Mock {
+	return &Mock{}
+}
+
+// 按添加顺序匹配，使用首个匹配规则的响应，每次返回 response 的副本
+func (m *Mock) AddRule(matcher func(*proxy.Request) bool, response *proxy.Response) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rules = append(m.rules, &mockRule{match: matcher, response: response})
+}
+
+// method 为空时匹配所有方法，rawURL 中未设置 query 时忽略请求的 query
+func (m *Mock) AddURL(method string, rawURL string, response *proxy.Response) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	m.AddRule(func(req *proxy.Request) bool {
+		if method != "" && req.Method != method {
+			return false
+		}
+		if u.Scheme != "" && req.URL.Scheme != u.Scheme {
+			return false
+		}
+		if req.URL.Host != u.Host || req.URL.Path != u.Path {
+			return false
+		}
+		return u.RawQuery == "" || req.URL.RawQuery == u.RawQuery
+	}, response)
+	return nil
+}
+
+func (m *Mock) Requestheaders(f *proxy.Flow) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, rule := range m.rules {
+		if rule.match(f.Request) {
+			log.Infof("mock %v %v", f.Request.Method, f.Request.URL.String())
+			f.Response = cloneMockResponse(rule.response)
+			return
+		}
+	}
+}
+
+// 规则中的响应可能被多个 flow 使用，header 及 body 可能被之后的 addon 修改
+func cloneMockResponse(response *proxy.Response) *proxy.Response {
+	res := &proxy.Response{
+		StatusCode: response.StatusCode,
+		Header:     response.Header.Clone(),
+		Body:       append([]byte{}, response.Body...),
+	}
+	if res.StatusCode == 0 {
+		res.StatusCode = 200
+	}
+	if res.Header == nil {
+		res.Header = make(http.Header)
+	}
+	return res
+}
+
+func MockResponse(statusCode int, header http.Header, body []byte) *proxy.Response {
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	return &proxy.Response{
+		StatusCode: statusCode,
+		Header:     header,
+		Body:       body,
+	}
+}
+
+// 读取文件作为响应 body，header 中未设置 Content-Type 时按扩展名推断
+func MockFile(statusCode int, header http.Header, filename string) (*proxy.Response, error) {
+	body, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if header == nil {
+		header = make(http.Header)
+	}
+	if header.Get("Content-Type") == "" {
+		if contentType := mime.TypeByExtension(filepath.Ext(filename)); contentType != "" {
+			header.Set("Content-Type", contentType)
+		}
+	}
+	return MockResponse(statusCode, header, body), nil
+}
@@ -0,0 +1,81 @@
+package addon
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+	"github.com/lqqyt2423/go-mitmproxy/proxy/proxytest"
+)
+
+type responseCounter struct {
+	proxy.BaseAddon
+	responses int32
+}
+
+func (c *responseCounter) Response(f *proxy.Flow) {
+	atomic.AddInt32(&c.responses, 1)
+}
+
+func TestMock(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "list.json")
+	if err := ioutil.WriteFile(filename, []byte(`[1,2]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fileResp, err := MockFile(200, nil, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock := NewMock()
+	if err := mock.AddURL("GET", "http://example.com/user", MockResponse(201, http.Header{"X-Mock": []string{"1"}}, []byte(`{"id":1}`))); err != nil {
+		t.Fatal(err)
+	}
+	mock.AddRule(func(req *proxy.Request) bool { return strings.HasPrefix(req.URL.Path, "/list") }, fileResp)
+
+	var upstreamHits int32
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upstreamHits, 1)
+		io.WriteString(w, "upstream")
+	})
+	run := func(method, rawURL string) (*proxy.Flow, int, http.Header, string, *responseCounter) {
+		counter := &responseCounter{}
+		req, _ := http.NewRequest(method, rawURL, nil)
+		f, res := proxytest.RunAddons([]proxy.Addon{mock, counter}, req, upstream)
+		if res == nil {
+			t.Fatalf("%v %v: no response", method, rawURL)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return f, res.StatusCode, res.Header, string(body), counter
+	}
+
+	_, code, header, body, counter := run("GET", "http://example.com/user?x=1")
+	if code != 201 || header.Get("X-Mock") != "1" || body != `{"id":1}` {
+		t.Fatalf("unexpected mock response %v %v %q", code, header, body)
+	}
+	if atomic.LoadInt32(&counter.responses) != 1 {
+		t.Fatal("expected Response hook fired for mocked flow")
+	}
+
+	_, code, header, body, _ = run("GET", "https://api.test/list/all")
+	if code != 200 || header.Get("Content-Type") != "application/json" || body != `[1,2]` {
+		t.Fatalf("unexpected file mock response %v %v %q", code, header, body)
+	}
+
+	if atomic.LoadInt32(&upstreamHits) != 0 {
+		t.Fatal("expected mocked requests not reach upstream")
+	}
+	if _, _, _, body, _ = run("POST", "http://example.com/user"); body != "upstream" {
+		t.Fatalf("expected unmatched method go upstream, but got %q", body)
+	}
+	if atomic.LoadInt32(&upstreamHits) != 1 {
+		t.Fatal("expected unmatched request reach upstream")
+	}
+}
@@ -0,0 +1,214 @@
+package addon
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+	"github.com/tidwall/match"
+)
+
+// 按目标 host（f.Request.URL.Host）以令牌桶限制每秒的请求数，避免压垮脆弱的上游
+// 在 Requestheaders 中等待令牌，同一 host 等待的请求数达到 MaxQueue 时直接响应 429
+// CONNECT 请求不限制，拦截的 https 请求同样按 host 限制
+// 例如:
+//   limiter := NewRateLimit(10, 20, 100)
+//   limiter.SetHost("*.fragile.example.com", 1, 1)
+
+type rateLimitRule struct {
+	Host  string  // 支持通配符，不含端口
+	Rate  float64 // 每秒请求数，小于等于 0 时不限制
+	Burst int     // 突发请求数，小于 1 时为 1
+}
+
+type RateLimit struct {
+	proxy.BaseAddon
+	Rate     float64 // 默认每个 host 每秒的请求数，小于等于 0 时不限制
+	Burst    int
+	MaxQueue int // 每个 host 同时等待令牌的请求数上限，为 0 时不等待，没有令牌时直接响应 429
+
+	rules  []*rateLimitRule
+	shards [rateLimitShards]rateLimitShard
+}
+
+// 按 host 分片，避免所有请求竞争同一把锁
+const rateLimitShards = 32
+
+// 分片中的 host 数超过此值时清理空闲的令牌桶
+const maxRateLimitHostsPerShard = 1024
+
+type rateLimitShard struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func NewRateLimit(rate float64, burst int, maxQueue int) *RateLimit {
+	return &RateLimit{Rate: rate, Burst: burst, MaxQueue: maxQueue}
+}
+
+// 为匹配 host 的请求设置单独的限制，按添加顺序匹配，先于默认设置，需在启动 proxy 前设置
+func (l *RateLimit) SetHost(host string, rate float64, burst int) {
+	l.rules = append(l.rules, &rateLimitRule{Host: host, Rate: rate, Burst: burst})
+}
+
+func (l *RateLimit) limit(hostname string) (float64, int) {
+	for _, rule := range l.rules {
+		if match.Match(hostname, rule.Host) {
+			return rule.Rate, rule.Burst
+		}
+	}
+	return l.Rate, l.Burst
+}
+
+func (l *RateLimit) Requestheaders(f *proxy.Flow) {
+	if f.Request.Method == "CONNECT" {
+		return
+	}
+	bucket := l.bucket(f.Request.URL)
+	if bucket == nil {
+		return
+	}
+
+	wait, ok := bucket.reserve(time.Now(), l.MaxQueue)
+	if !ok {
+		f.Response = tooManyRequests(bucket.retryAfter())
+		return
+	}
+	if wait <= 0 {
+		return
+	}
+	defer bucket.done()
+
+	ctx := context.Background()
+	if raw := f.Request.Raw(); raw != nil {
+		ctx = raw.Context()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		// 客户端已断开，归还令牌
+		bucket.cancel()
+	}
+}
+
+// 不限制时返回 nil
+func (l *RateLimit) bucket(u *url.URL) *tokenBucket {
+	rate, burst := l.limit(u.Hostname())
+	if rate <= 0 {
+		return nil
+	}
+	host := u.Host
+
+	h := fnv.New32a()
+	h.Write([]byte(host))
+	shard := &l.shards[h.Sum32()%rateLimitShards]
+
+	now := time.Now()
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if shard.buckets == nil {
+		shard.buckets = make(map[string]*tokenBucket)
+	}
+	bucket, ok := shard.buckets[host]
+	if !ok {
+		if len(shard.buckets) >= maxRateLimitHostsPerShard {
+			for key, b := range shard.buckets {
+				if b.idle(now) {
+					delete(shard.buckets, key)
+				}
+			}
+		}
+		bucket = newTokenBucket(rate, burst, now)
+		shard.buckets[host] = bucket
+	}
+	return bucket
+}
+
+func tooManyRequests(retryAfter time.Duration) *proxy.Response {
+	return &proxy.Response{
+		StatusCode: http.StatusTooManyRequests,
+		Header: http.Header{
+			"Content-Type": []string{"text/plain; charset=utf-8"},
+			"Retry-After":  []string{strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))},
+		},
+		Body: []byte("rate limit exceeded\n"),
+	}
+}
+
+// 令牌可以为负数，表示已预约的请求
+type tokenBucket struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	tokens  float64
+	last    time.Time
+	waiting int
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+func (b *tokenBucket) advance(now time.Time) {
+	if now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// 预约一个令牌，返回需要等待的时间，等待的请求数已达 maxQueue 时返回 false
+func (b *tokenBucket) reserve(now time.Time, maxQueue int) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	if b.waiting >= maxQueue {
+		return 0, false
+	}
+	b.tokens--
+	b.waiting++
+	return time.Duration((-b.tokens) / b.rate * float64(time.Second)), true
+}
+
+// 等待结束
+func (b *tokenBucket) done() {
+	b.mu.Lock()
+	b.waiting--
+	b.mu.Unlock()
+}
+
+func (b *tokenBucket) cancel() {
+	b.mu.Lock()
+	b.tokens = math.Min(b.burst, b.tokens+1)
+	b.mu.Unlock()
+}
+
+// 下一个令牌可用的时间
+func (b *tokenBucket) retryAfter() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// 令牌已满且没有等待的请求，与新建的令牌桶等价
+func (b *tokenBucket) idle(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance(now)
+	return b.waiting == 0 && b.tokens >= b.burst
+}
@@ -0,0 +1,130 @@
+package addon
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+)
+
+func durationNear(a, b time.Duration) bool {
+	d := a - b
+	return d < time.Millisecond && d > -time.Millisecond
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(10, 2, now)
+
+	for i, expected := range []time.Duration{0, 0, 100 * time.Millisecond, 200 * time.Millisecond} {
+		wait, ok := b.reserve(now, 2)
+		if !ok || !durationNear(wait, expected) {
+			t.Fatalf("reserve %v: expected wait %v, but got %v %v", i, expected, wait, ok)
+		}
+	}
+	if _, ok := b.reserve(now, 2); ok {
+		t.Fatal("expected queue full")
+	}
+	if d := b.retryAfter(); !durationNear(d, 300*time.Millisecond) {
+		t.Fatalf("unexpected retry after %v", d)
+	}
+
+	b.done()
+	b.done()
+	// 500ms 后补充 5 个令牌，最多 2 个
+	now = now.Add(500 * time.Millisecond)
+	if !b.idle(now) {
+		t.Fatal("expected idle bucket")
+	}
+	if wait, ok := b.reserve(now, 0); !ok || wait != 0 {
+		t.Fatalf("expected token available, but got %v %v", wait, ok)
+	}
+}
+
+func newRateLimitFlow(rawurl string) *proxy.Flow {
+	u, _ := url.Parse(rawurl)
+	return &proxy.Flow{
+		Request: &proxy.Request{Method: "GET", URL: u, Header: make(http.Header)},
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	limiter := NewRateLimit(20, 1, 1)
+	limiter.SetHost("*.unlimited.example.com", 0, 0)
+
+	// 第二个请求等待约 50ms，第三个请求超出等待队列
+	start := time.Now()
+	f := newRateLimitFlow("http://api.example.com/1")
+	limiter.Requestheaders(f)
+	if f.Response != nil {
+		t.Fatal("first request should pass")
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	var waited time.Duration
+	go func() {
+		defer wg.Done()
+		f := newRateLimitFlow("http://api.example.com/2")
+		limiter.Requestheaders(f)
+		waited = time.Since(start)
+		if f.Response != nil {
+			t.Error("queued request should pass")
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	f = newRateLimitFlow("http://api.example.com/3")
+	limiter.Requestheaders(f)
+	if f.Response == nil || f.Response.StatusCode != 429 || f.Response.Header.Get("Retry-After") != "1" {
+		t.Fatalf("expected 429, but got %+v", f.Response)
+	}
+	wg.Wait()
+	if waited < 40*time.Millisecond {
+		t.Fatalf("queued request should wait for token, but waited %v", waited)
+	}
+
+	// 不同 host 及端口单独计算，不限制的 host 及 CONNECT 不受影响
+	for _, rawurl := range []string{"http://api.example.com:8080/", "http://other.example.com/", "http://a.unlimited.example.com/", "http://a.unlimited.example.com/"} {
+		f := newRateLimitFlow(rawurl)
+		limiter.Requestheaders(f)
+		if f.Response != nil {
+			t.Fatalf("%v should pass", rawurl)
+		}
+	}
+	f = newRateLimitFlow("http://api.example.com/")
+	f.Request.Method = "CONNECT"
+	limiter.Requestheaders(f)
+	if f.Response != nil {
+		t.Fatal("CONNECT should pass")
+	}
+}
+
+func TestRateLimitConcurrent(t *testing.T) {
+	limiter := NewRateLimit(1, 5, 0)
+	var passed, limited int64
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 10; j++ {
+			wg.Add(1)
+			go func(host int) {
+				defer wg.Done()
+				f := newRateLimitFlow(fmt.Sprintf("http://host%v.example.com/", host))
+				limiter.Requestheaders(f)
+				if f.Response == nil {
+					atomic.AddInt64(&passed, 1)
+				} else {
+					atomic.AddInt64(&limited, 1)
+				}
+			}(i)
+		}
+	}
+	wg.Wait()
+	// 每个 host 仅突发的 5 个请求通过
+	if passed != 50 || limited != 50 {
+		t.Fatalf("expected 50 passed and 50 limited, but got %v %v", passed, limited)
+	}
+}
@@ -0,0 +1,157 @@
+package addon
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/match"
+)
+
+// cap response body of matched hosts at MaxSize bytes, deliver the partial body instead of rejecting
+// 超过限制的响应转为 stream 模式，仅向客户端发送前 MaxSize 字节:
+//   1. 文本类型且设置了 Notice 时，在截断处追加 Notice 作为完整的响应返回
+//   2. 其他情况记录警告后中断连接，客户端可感知响应不完整
+// 例如:
+//   {"Items": [{"Host": "*.example.com", "MaxSize": 1048576, "Notice": "\n[truncated by go-mitmproxy]", "Enable": true}], "Enable": true}
+
+var errResponseBodyCapped = errors.New("response body capped")
+
+const responseCapMetadataKey = "responseBodyCap"
+
+type responseCapItem struct {
+	Host    string // 支持通配符，不含端口
+	MaxSize int64
+	Notice  string
+	Enable  bool
+}
+
+func (item *responseCapItem) match(req *proxy.Request) bool {
+	return item.Enable && match.Match(req.URL.Hostname(), item.Host)
+}
+
+type ResponseBodyCap struct {
+	proxy.BaseAddon
+	Items  []*responseCapItem
+	Enable bool
+}
+
+func (rc *ResponseBodyCap) item(f *proxy.Flow) *responseCapItem {
+	if !rc.Enable {
+		return nil
+	}
+	for _, item := range rc.Items {
+		if item.match(f.Request) {
+			return item
+		}
+	}
+	return nil
+}
+
+func (rc *ResponseBodyCap) Requestheaders(f *proxy.Flow) {
+	// 获取未压缩的响应，截断后仍可追加 Notice
+	if item := rc.item(f); item != nil && item.Notice != "" {
+		f.Request.Header.Del("Accept-Encoding")
+	}
+}
+
+func (rc *ResponseBodyCap) Responseheaders(f *proxy.Flow) {
+	item := rc.item(f)
+	if item == nil || f.Response == nil {
+		return
+	}
+	if size, err := strconv.ParseInt(f.Response.Header.Get("Content-Length"), 10, 64); err == nil && size <= item.MaxSize {
+		return
+	}
+
+	body := &cappedBody{
+		url:       f.Request.URL.String(),
+		limit:     item.MaxSize,
+		remaining: item.MaxSize,
+	}
+	if f.Response.IsTextContentType() && f.Response.Header.Get("Content-Encoding") == "" {
+		body.notice = item.Notice
+	}
+	if body.notice != "" {
+		f.Response.Header.Del("Content-Length")
+	}
+	f.Stream = true
+	f.SetMetadata(responseCapMetadataKey, body)
+}
+
+func (rc *ResponseBodyCap) StreamResponseModifier(f *proxy.Flow, in io.Reader) io.Reader {
+	v, ok := f.Metadata(responseCapMetadataKey)
+	if !ok {
+		return in
+	}
+	body := v.(*cappedBody)
+	body.Reader = in
+	return body
+}
+
+func (rc *ResponseBodyCap) validate() error {
+	for i, item := range rc.Items {
+		if item.Host == "" {
+			return fmt.Errorf("%v empty item.Host", i)
+		}
+		if item.MaxSize <= 0 {
+			return fmt.Errorf("%v invalid item.MaxSize %v", i, item.MaxSize)
+		}
+	}
+	return nil
+}
+
+func NewResponseBodyCapFromFile(filename string) (*ResponseBodyCap, error) {
+	rc, err := proxy.NewStructFromFile[ResponseBodyCap](filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := rc.validate(); err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+type cappedBody struct {
+	io.Reader
+	url       string
+	limit     int64
+	remaining int64
+	notice    string // 为空时截断处中断连接
+	truncated bool
+}
+
+func (b *cappedBody) Read(p []byte) (int, error) {
+	if b.truncated {
+		if b.notice == "" {
+			return 0, io.EOF
+		}
+		n := copy(p, b.notice)
+		b.notice = b.notice[n:]
+		return n, nil
+	}
+
+	if b.remaining > 0 {
+		if int64(len(p)) > b.remaining {
+			p = p[:b.remaining]
+		}
+		n, err := b.Reader.Read(p)
+		b.remaining -= int64(n)
+		return n, err
+	}
+
+	// 已达到上限，恰好读完时不截断
+	var one [1]byte
+	if n, err := b.Reader.Read(one[:]); n == 0 {
+		return 0, err
+	}
+	log.Warnf("response body cap: %v truncated at %v bytes", b.url, b.limit)
+	if b.notice == "" {
+		return 0, errResponseBodyCapped
+	}
+	b.truncated = true
+	return b.Read(p)
+}
@@ -0,0 +1,113 @@
+package addon
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+)
+
+func TestResponseBodyCap(t *testing.T) {
+	body := strings.Repeat("a", 1000)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/bin":
+				w.Header().Set("Content-Type", "application/octet-stream")
+			case "/small":
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write([]byte(body[:100]))
+				return
+			default:
+				w.Header().Set("Content-Type", "text/plain")
+			}
+			w.Write([]byte(body))
+		}),
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go server.Serve(ln)
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	testProxy, err := proxy.NewProxy(&proxy.Options{
+		HttpAddr: ":29110",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testProxy.AddAddon(&ResponseBodyCap{
+		Enable: true,
+		Items: []*responseCapItem{
+			{Host: "local*", MaxSize: 100, Notice: "\n[truncated]", Enable: true},
+		},
+	})
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29110")
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	get := func(endpoint string) (string, error) {
+		res, err := proxyClient.Get(endpoint)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		b, err := ioutil.ReadAll(res.Body)
+		return string(b), err
+	}
+
+	t.Run("text truncated with notice", func(t *testing.T) {
+		got, err := get("http://localhost:" + port + "/text")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != body[:100]+"\n[truncated]" {
+			t.Fatalf("unexpected body %q", got)
+		}
+	})
+
+	t.Run("binary truncated and closed", func(t *testing.T) {
+		got, err := get("http://localhost:" + port + "/bin")
+		if err == nil {
+			t.Fatal("expected incomplete body error")
+		}
+		if len(got) > 100 {
+			t.Fatalf("expected at most 100 bytes, but got %v", len(got))
+		}
+	})
+
+	t.Run("at limit not truncated", func(t *testing.T) {
+		got, err := get("http://localhost:" + port + "/small")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != body[:100] {
+			t.Fatalf("unexpected body %q", got)
+		}
+	})
+
+	t.Run("other host not capped", func(t *testing.T) {
+		got, err := get("http://127.0.0.1:" + port + "/text")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != body {
+			t.Fatalf("expected full body, but got %v bytes", len(got))
+		}
+	})
+}
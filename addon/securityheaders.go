@@ -0,0 +1,154 @@
+package addon
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/match"
+)
+
+// detect security header downgrade of intercepted responses
+// 与 baseline 比较，当响应移除或弱化安全相关 header 时（如去除 HSTS），记录至 flow，供之后的 addon 通过 SecurityDowngrades 获取
+
+const securityDowngradesKey = "security_downgrades"
+
+var securityHeaders = []string{
+	"Strict-Transport-Security",
+	"Content-Security-Policy",
+	"X-Frame-Options",
+	"X-Content-Type-Options",
+	"Referrer-Policy",
+}
+
+type SecurityDowngrade struct {
+	Header string
+	Reason string
+}
+
+func (d *SecurityDowngrade) String() string {
+	return d.Header + ": " + d.Reason
+}
+
+type securityBaselineItem struct {
+	Host                  string   // 支持通配符
+	Headers               []string // 必须存在的 header
+	HstsMaxAge            int64    // Strict-Transport-Security max-age 下限，0 表示不检查
+	HstsIncludeSubDomains bool     // Strict-Transport-Security 必须包含 includeSubDomains
+	Enable                bool
+}
+
+type SecurityHeaders struct {
+	proxy.BaseAddon
+	Items  []*securityBaselineItem
+	Learn  bool // 未配置 baseline 的 host，以首次响应中出现的安全 header 作为 baseline
+	Enable bool
+
+	learned sync.Map // host => *securityBaselineItem
+}
+
+// 获取 SecurityHeaders 记录的降级信息，需在 SecurityHeaders 之后的 addon 中调用
+func SecurityDowngrades(f *proxy.Flow) []*SecurityDowngrade {
+	if value, ok := f.Metadata(securityDowngradesKey); ok {
+		return value.([]*SecurityDowngrade)
+	}
+	return nil
+}
+
+func (sh *SecurityHeaders) baseline(host string) *securityBaselineItem {
+	for _, item := range sh.Items {
+		if item.Enable && match.Match(host, item.Host) {
+			return item
+		}
+	}
+	if value, ok := sh.learned.Load(host); ok {
+		return value.(*securityBaselineItem)
+	}
+	return nil
+}
+
+func (sh *SecurityHeaders) learn(host string, header http.Header) {
+	item := &securityBaselineItem{Host: host, Enable: true}
+	for _, key := range securityHeaders {
+		if header.Get(key) != "" {
+			item.Headers = append(item.Headers, key)
+		}
+	}
+	if len(item.Headers) == 0 {
+		return
+	}
+	if hsts := header.Get("Strict-Transport-Security"); hsts != "" {
+		item.HstsMaxAge, item.HstsIncludeSubDomains = parseHsts(hsts)
+	}
+	sh.learned.LoadOrStore(host, item)
+}
+
+func (sh *SecurityHeaders) Responseheaders(f *proxy.Flow) {
+	if !sh.Enable || f.Response == nil {
+		return
+	}
+	host := f.Request.URL.Hostname()
+	item := sh.baseline(host)
+	if item == nil {
+		if sh.Learn {
+			sh.learn(host, f.Response.Header)
+		}
+		return
+	}
+
+	downgrades := item.check(f.Response.Header)
+	if len(downgrades) == 0 {
+		return
+	}
+	f.SetMetadata(securityDowngradesKey, downgrades)
+	log.Warnf("security headers downgrade %v: %v", f.Request.URL.String(), downgrades)
+}
+
+func (item *securityBaselineItem) check(header http.Header) []*SecurityDowngrade {
+	downgrades := make([]*SecurityDowngrade, 0)
+	for _, key := range item.Headers {
+		if header.Get(key) == "" {
+			downgrades = append(downgrades, &SecurityDowngrade{Header: http.CanonicalHeaderKey(key), Reason: "missing"})
+		}
+	}
+
+	hsts := header.Get("Strict-Transport-Security")
+	if hsts == "" || (item.HstsMaxAge == 0 && !item.HstsIncludeSubDomains) {
+		return downgrades
+	}
+	maxAge, includeSubDomains := parseHsts(hsts)
+	if maxAge < item.HstsMaxAge {
+		downgrades = append(downgrades, &SecurityDowngrade{
+			Header: "Strict-Transport-Security",
+			Reason: fmt.Sprintf("max-age %v < %v", maxAge, item.HstsMaxAge),
+		})
+	}
+	if item.HstsIncludeSubDomains && !includeSubDomains {
+		downgrades = append(downgrades, &SecurityDowngrade{
+			Header: "Strict-Transport-Security",
+			Reason: "includeSubDomains removed",
+		})
+	}
+	return downgrades
+}
+
+func parseHsts(value string) (maxAge int64, includeSubDomains bool) {
+	for _, directive := range strings.Split(value, ";") {
+		name, v, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "max-age":
+			maxAge, _ = strconv.ParseInt(strings.Trim(v, `"`), 10, 64)
+		case "includesubdomains":
+			includeSubDomains = true
+		}
+	}
+	return
+}
+
+func NewSecurityHeadersFromFile(filename string) (*SecurityHeaders, error) {
+	return proxy.NewStructFromFile[SecurityHeaders](filename)
+}
@@ -0,0 +1,72 @@
+package addon
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+)
+
+func TestSecurityHeadersDowngrade(t *testing.T) {
+	sh := &SecurityHeaders{
+		Enable: true,
+		Items: []*securityBaselineItem{
+			{
+				Host:                  "*.example.com",
+				Headers:               []string{"Strict-Transport-Security"},
+				HstsMaxAge:            31536000,
+				HstsIncludeSubDomains: true,
+				Enable:                true,
+			},
+		},
+	}
+	newFlow := func(host string, header http.Header) *proxy.Flow {
+		return &proxy.Flow{
+			Request: &proxy.Request{
+				Method: "GET",
+				URL:    &url.URL{Scheme: "https", Host: host, Path: "/"},
+			},
+			Response: &proxy.Response{StatusCode: 200, Header: header},
+		}
+	}
+
+	// hsts missing
+	f := newFlow("www.example.com", http.Header{})
+	sh.Responseheaders(f)
+	downgrades := SecurityDowngrades(f)
+	if len(downgrades) != 1 || downgrades[0].String() != "Strict-Transport-Security: missing" {
+		t.Fatalf("unexpected downgrades %v", downgrades)
+	}
+
+	// hsts weakened
+	f = newFlow("www.example.com", http.Header{"Strict-Transport-Security": []string{"max-age=60"}})
+	sh.Responseheaders(f)
+	if downgrades := SecurityDowngrades(f); len(downgrades) != 2 {
+		t.Fatalf("unexpected downgrades %v", downgrades)
+	}
+
+	// hsts ok
+	f = newFlow("www.example.com", http.Header{"Strict-Transport-Security": []string{"max-age=63072000; includeSubDomains; preload"}})
+	sh.Responseheaders(f)
+	if downgrades := SecurityDowngrades(f); downgrades != nil {
+		t.Fatalf("unexpected downgrades %v", downgrades)
+	}
+
+	// no baseline
+	f = newFlow("other.com", http.Header{})
+	sh.Responseheaders(f)
+	if downgrades := SecurityDowngrades(f); downgrades != nil {
+		t.Fatalf("unexpected downgrades %v", downgrades)
+	}
+
+	// learn baseline from first response
+	sh.Learn = true
+	sh.Responseheaders(newFlow("learn.com", http.Header{"X-Frame-Options": []string{"DENY"}}))
+	f = newFlow("learn.com", http.Header{})
+	sh.Responseheaders(f)
+	downgrades = SecurityDowngrades(f)
+	if len(downgrades) != 1 || downgrades[0].Header != "X-Frame-Options" {
+		t.Fatalf("unexpected downgrades %v", downgrades)
+	}
+}
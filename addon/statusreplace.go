@@ -0,0 +1,106 @@
+package addon
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+	"github.com/samber/lo"
+	log "github.com/sirupsen/logrus"
+)
+
+// replace upstream response body and headers by status code, the status code is preserved
+// Body 中可使用变量: ${status} ${method} ${url}
+// 例如将所有 429 响应替换为统一的 json 错误:
+//   {"Status": [429], "Header": {"Content-Type": "application/json"}, "Body": "{\"error\":\"rate limited\",\"status\":${status}}", "Enable": true}
+
+type statusReplaceItem struct {
+	From   *mapFrom // 为空时匹配全部请求
+	Status []int
+	Header map[string]string // 设置的 header，值为空时删除该 header
+	Body   string
+	Enable bool
+}
+
+func (item *statusReplaceItem) match(f *proxy.Flow) bool {
+	if !item.Enable {
+		return false
+	}
+	if !lo.Contains(item.Status, f.Response.StatusCode) {
+		return false
+	}
+	return item.From == nil || item.From.match(f.Request)
+}
+
+func (item *statusReplaceItem) replace(f *proxy.Flow) {
+	body := strings.NewReplacer(
+		"${status}", strconv.Itoa(f.Response.StatusCode),
+		"${method}", f.Request.Method,
+		"${url}", f.Request.URL.String(),
+	).Replace(item.Body)
+
+	header := f.Response.Header
+	if header == nil {
+		header = make(http.Header)
+		f.Response.Header = header
+	}
+	for key, value := range item.Header {
+		if value == "" {
+			header.Del(key)
+		} else {
+			header.Set(key, value)
+		}
+	}
+	// 原响应 body 已被替换
+	header.Del("Content-Encoding")
+	header.Del("Transfer-Encoding")
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	f.Response.Body = []byte(body)
+}
+
+type StatusReplace struct {
+	proxy.BaseAddon
+	Items  []*statusReplaceItem
+	Enable bool
+}
+
+func (sr *StatusReplace) Responseheaders(f *proxy.Flow) {
+	if !sr.Enable || f.Response == nil {
+		return
+	}
+	for _, item := range sr.Items {
+		if item.match(f) {
+			log.Infof("status replace %v %v", f.Response.StatusCode, f.Request.URL.String())
+			item.replace(f)
+			return
+		}
+	}
+}
+
+func (sr *StatusReplace) validate() error {
+	for i, item := range sr.Items {
+		if len(item.Status) == 0 {
+			return fmt.Errorf("%v empty item.Status", i)
+		}
+		for _, status := range item.Status {
+			if status < 100 || status > 999 {
+				return fmt.Errorf("%v invalid item.Status %v", i, status)
+			}
+		}
+	}
+	return nil
+}
+
+func NewStatusReplaceFromFile(filename string) (*StatusReplace, error) {
+	statusReplace, err := proxy.NewStructFromFile[StatusReplace](filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := statusReplace.validate(); err != nil {
+		return nil, err
+	}
+	return statusReplace, nil
+}
@@ -0,0 +1,65 @@
+package addon
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+)
+
+func TestStatusReplace(t *testing.T) {
+	sr := &StatusReplace{
+		Enable: true,
+		Items: []*statusReplaceItem{
+			{
+				Status: []int{429},
+				Header: map[string]string{"Content-Type": "application/json", "Retry-After": ""},
+				Body:   `{"error":"rate limited","status":${status}}`,
+				Enable: true,
+			},
+		},
+	}
+	newFlow := func(status int) *proxy.Flow {
+		return &proxy.Flow{
+			Request: &proxy.Request{
+				Method: "GET",
+				URL:    &url.URL{Scheme: "https", Host: "example.com", Path: "/api"},
+			},
+			Response: &proxy.Response{
+				StatusCode: status,
+				Header: http.Header{
+					"Content-Type":     []string{"text/html"},
+					"Content-Encoding": []string{"gzip"},
+					"Content-Length":   []string{"1234"},
+					"Retry-After":      []string{"10"},
+				},
+			},
+		}
+	}
+
+	f := newFlow(429)
+	sr.Responseheaders(f)
+	should := `{"error":"rate limited","status":429}`
+	if string(f.Response.Body) != should {
+		t.Fatalf("expected body %v, but got %s", should, f.Response.Body)
+	}
+	if f.Response.StatusCode != 429 {
+		t.Fatalf("expected status preserved, but got %v", f.Response.StatusCode)
+	}
+	if f.Response.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected Content-Type %v", f.Response.Header.Get("Content-Type"))
+	}
+	if f.Response.Header.Get("Content-Length") != "37" {
+		t.Errorf("unexpected Content-Length %v", f.Response.Header.Get("Content-Length"))
+	}
+	if f.Response.Header.Get("Content-Encoding") != "" || f.Response.Header.Get("Retry-After") != "" {
+		t.Errorf("unexpected header %v", f.Response.Header)
+	}
+
+	f = newFlow(200)
+	sr.Responseheaders(f)
+	if f.Response.Body != nil || f.Response.Header.Get("Content-Type") != "text/html" {
+		t.Fatal("should not replace 200 response")
+	}
+}
@@ -0,0 +1,145 @@
+package addon
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// aggregate http2 stream stats per client connection, for debugging multiplexing
+// 仅统计 http2 客户端连接上的 flow，客户端连接断开时记录汇总日志并移除该连接的统计
+// 同一连接上的 stream 以 Flow.StreamId 区分，字节数取自 proxy 记录的 Flow.Stats，stream 模式的 body 转发过程中也可获取
+// proxy/metrics 中有对应的 prometheus 指标
+// 每个连接最多保留 MaxFinishedStreams 个已结束的 stream，超出时移除最早结束的，Total 仍包括已移除的
+
+// 每个连接保留的已结束 stream 数
+const MaxFinishedStreams = 100
+
+type StreamStat struct {
+	StreamId      uint32 // Flow.StreamId
+	FlowId        uuid.UUID
+	Url           string
+	RequestBytes  int64
+	ResponseBytes int64
+	Done          bool
+
+	f *proxy.Flow // 结束后置为 nil，字节数固定在 RequestBytes、ResponseBytes
+}
+
+type ConnStreamStats struct {
+	ConnId        uuid.UUID // ConnContext.ClientConn.Id
+	Streams       []*StreamStat
+	Total         int // stream 总数，包括已移除的
+	Active        int // 进行中的 stream 数
+	MaxConcurrent int // 同时进行的 stream 数峰值
+
+	finished int
+}
+
+type StreamStats struct {
+	proxy.BaseAddon
+	mu    sync.Mutex
+	conns map[uuid.UUID]*ConnStreamStats
+}
+
+func NewStreamStats() *StreamStats {
+	return &StreamStats{conns: make(map[uuid.UUID]*ConnStreamStats)}
+}
+
+// 当前所有客户端连接的统计快照
+func (s *StreamStats) Stats() []*ConnStreamStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make([]*ConnStreamStats, 0, len(s.conns))
+	for _, conn := range s.conns {
+		stats = append(stats, conn.snapshot())
+	}
+	return stats
+}
+
+// 指定客户端连接的统计快照，不存在时返回 nil
+func (s *StreamStats) Conn(id uuid.UUID) *ConnStreamStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if conn, ok := s.conns[id]; ok {
+		return conn.snapshot()
+	}
+	return nil
+}
+
+func (s *StreamStats) Requestheaders(f *proxy.Flow) {
+	if f.Request.Proto != "HTTP/2.0" {
+		return
+	}
+	id := f.ConnContext.ClientConn.Id
+	stat := &StreamStat{StreamId: f.StreamId, FlowId: f.Id, Url: f.Request.URL.String(), f: f}
+
+	s.mu.Lock()
+	conn, ok := s.conns[id]
+	if !ok {
+		conn = &ConnStreamStats{ConnId: id}
+		s.conns[id] = conn
+	}
+	conn.Streams = append(conn.Streams, stat)
+	conn.Total++
+	conn.Active++
+	if conn.Active > conn.MaxConcurrent {
+		conn.MaxConcurrent = conn.Active
+	}
+	s.mu.Unlock()
+
+	go func() {
+		<-f.Done()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		stat.RequestBytes = atomic.LoadInt64(&f.Stats.RequestBytes)
+		stat.ResponseBytes = atomic.LoadInt64(&f.Stats.ResponseBytes)
+		stat.Done = true
+		stat.f = nil
+		conn.Active--
+		conn.finished++
+		if conn.finished > MaxFinishedStreams {
+			conn.dropFinished()
+		}
+	}()
+}
+
+func (s *StreamStats) ClientDisconnected(client *proxy.ClientConn) {
+	s.mu.Lock()
+	conn, ok := s.conns[client.Id]
+	delete(s.conns, client.Id)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	log.Infof("%v h2 connection closed, %v streams, max concurrent %v\n", client.Conn.RemoteAddr(), conn.Total, conn.MaxConcurrent)
+}
+
+// 移除最早结束的 stream
+func (c *ConnStreamStats) dropFinished() {
+	for i, stat := range c.Streams {
+		if stat.Done {
+			c.Streams = append(c.Streams[:i], c.Streams[i+1:]...)
+			c.finished--
+			return
+		}
+	}
+}
+
+func (c *ConnStreamStats) snapshot() *ConnStreamStats {
+	cp := *c
+	cp.Streams = make([]*StreamStat, len(c.Streams))
+	for i, stat := range c.Streams {
+		scp := *stat
+		if stat.f != nil {
+			scp.RequestBytes = atomic.LoadInt64(&stat.f.Stats.RequestBytes)
+			scp.ResponseBytes = atomic.LoadInt64(&stat.f.Stats.ResponseBytes)
+		}
+		scp.f = nil
+		cp.Streams[i] = &scp
+	}
+	return &cp
+}
@@ -0,0 +1,159 @@
+package addon
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lqqyt2423/go-mitmproxy/cert"
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+	uuid "github.com/satori/go.uuid"
+	"golang.org/x/net/http2"
+)
+
+type streamIdAddon struct {
+	proxy.BaseAddon
+	mu      sync.Mutex
+	conns   map[uuid.UUID]bool
+	streams map[uint32]bool
+}
+
+func (a *streamIdAddon) Requestheaders(f *proxy.Flow) {
+	if f.Request.Method == "CONNECT" {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.conns[f.ConnContext.ClientConn.Id] = true
+	a.streams[f.StreamId] = true
+}
+
+func TestStreamStats(t *testing.T) {
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hello"))
+		}),
+	}
+	if err := http2.ConfigureServer(server, nil); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	ca, err := cert.NewCAMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := ca.GetCert("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(tls.NewListener(ln, &tls.Config{
+		Certificates: []tls.Certificate{*serverCert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}))
+	endpoint := "https://localhost:" + strconv.Itoa(ln.Addr().(*net.TCPAddr).Port) + "/"
+
+	testProxy, err := proxy.NewProxy(&proxy.Options{
+		HttpAddr:    ":29120",
+		SslInsecure: true,
+		EnableHTTP2: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := &streamIdAddon{conns: make(map[uuid.UUID]bool), streams: make(map[uint32]bool)}
+	stats := NewStreamStats()
+	testProxy.AddAddon(ids)
+	testProxy.AddAddon(stats)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			ForceAttemptHTTP2: true,
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29120")
+			},
+		},
+	}
+	get := func() {
+		resp, err := proxyClient.Get(endpoint)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer resp.Body.Close()
+		if _, err := ioutil.ReadAll(resp.Body); err != nil {
+			t.Error(err)
+		}
+		if resp.Proto != "HTTP/2.0" {
+			t.Errorf("expected HTTP/2.0, but got %v", resp.Proto)
+		}
+	}
+
+	// 首个请求建立连接，之后的请求复用同一 tls 连接
+	get()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			get()
+		}()
+	}
+	wg.Wait()
+	time.Sleep(time.Millisecond * 10) // wait for flows done
+
+	ids.mu.Lock()
+	if len(ids.conns) != 1 {
+		t.Fatalf("expected flows share 1 connection, but got %v", len(ids.conns))
+	}
+	// 客户端发起的 stream id 为奇数
+	if len(ids.streams) != 6 {
+		t.Fatalf("expected 6 distinct stream ids, but got %v", ids.streams)
+	}
+	for id := range ids.streams {
+		if id%2 != 1 {
+			t.Fatalf("unexpected stream id %v", id)
+		}
+	}
+	ids.mu.Unlock()
+
+	all := stats.Stats()
+	if len(all) != 1 {
+		t.Fatalf("expected stats of 1 connection, but got %v", len(all))
+	}
+	conn := all[0]
+	if len(conn.Streams) != 6 || conn.Total != 6 || conn.Active != 0 || conn.MaxConcurrent < 1 {
+		t.Fatalf("unexpected stats %+v", conn)
+	}
+	for _, stat := range conn.Streams {
+		if !stat.Done || stat.ResponseBytes != 5 || !ids.streams[stat.StreamId] {
+			t.Fatalf("unexpected stream stat %+v", stat)
+		}
+	}
+
+	// 已结束的 stream 超出 MaxFinishedStreams 时移除最早的
+	for i := 0; i < MaxFinishedStreams; i++ {
+		get()
+	}
+	time.Sleep(time.Millisecond * 10) // wait for flows done
+	conn = stats.Conn(conn.ConnId)
+	if len(conn.Streams) != MaxFinishedStreams || conn.Total != MaxFinishedStreams+6 {
+		t.Fatalf("expected %v streams of %v, but got %v of %v", MaxFinishedStreams, MaxFinishedStreams+6, len(conn.Streams), conn.Total)
+	}
+	if last := conn.Streams[len(conn.Streams)-1]; last.StreamId != uint32(MaxFinishedStreams+6)*2-1 {
+		t.Fatalf("expected latest stream kept, but got %+v", last)
+	}
+}
@@ -0,0 +1,119 @@
+package addon
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+	"github.com/tidwall/match"
+)
+
+// limit response body bandwidth, for testing clients on slow networks
+// 以令牌桶限制响应 body 的发送速率，并可在发送第一个字节前增加固定延迟:
+//   1. stream 模式的 body 边读边限速，不会读取至内存
+//   2. 已读取至 Response.Body 的 body 按同样的速率发送
+// 例如:
+//   throttle := NewThrottle(64*1024, 200*time.Millisecond)
+//   throttle.SetHost("*.cdn.example.com", 16*1024, time.Second)
+
+type throttleRule struct {
+	Host        string // 支持通配符，不含端口
+	BytesPerSec int64  // 小于等于 0 时不限速
+	Latency     time.Duration
+}
+
+type Throttle struct {
+	proxy.BaseAddon
+	BytesPerSec int64 // 默认的限速，小于等于 0 时不限速
+	Latency     time.Duration
+
+	rules []*throttleRule
+}
+
+func NewThrottle(bytesPerSec int64, latency time.Duration) *Throttle {
+	return &Throttle{BytesPerSec: bytesPerSec, Latency: latency}
+}
+
+// 为匹配 host 的请求设置单独的限速及延迟，按添加顺序匹配，先于默认设置
+func (t *Throttle) SetHost(host string, bytesPerSec int64, latency time.Duration) {
+	t.rules = append(t.rules, &throttleRule{Host: host, BytesPerSec: bytesPerSec, Latency: latency})
+}
+
+func (t *Throttle) limit(f *proxy.Flow) (int64, time.Duration) {
+	host := f.Request.URL.Hostname()
+	for _, rule := range t.rules {
+		if match.Match(host, rule.Host) {
+			return rule.BytesPerSec, rule.Latency
+		}
+	}
+	return t.BytesPerSec, t.Latency
+}
+
+func (t *Throttle) StreamResponseModifier(f *proxy.Flow, in io.Reader) io.Reader {
+	bytesPerSec, latency := t.limit(f)
+	if bytesPerSec <= 0 && latency <= 0 {
+		return in
+	}
+	if in == nil {
+		if f.Response == nil || len(f.Response.Body) == 0 {
+			return in
+		}
+		in = bytes.NewReader(f.Response.Body)
+	}
+	return newThrottledReader(in, bytesPerSec, latency)
+}
+
+// 令牌桶，容量为 100ms 的流量
+type throttledReader struct {
+	r       io.Reader
+	rate    int64
+	latency time.Duration
+	burst   int64
+	tokens  int64
+	last    time.Time
+}
+
+func newThrottledReader(r io.Reader, bytesPerSec int64, latency time.Duration) *throttledReader {
+	burst := bytesPerSec / 10
+	if burst < 1 {
+		burst = 1
+	}
+	return &throttledReader{r: r, rate: bytesPerSec, latency: latency, burst: burst}
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if r.last.IsZero() {
+		if r.latency > 0 {
+			time.Sleep(r.latency)
+		}
+		r.last = time.Now()
+	}
+	if r.rate <= 0 {
+		return r.r.Read(p)
+	}
+
+	if int64(len(p)) > r.burst {
+		p = p[:r.burst]
+	}
+	n, err := r.r.Read(p)
+
+	now := time.Now()
+	elapsed := now.Sub(r.last)
+	if elapsed > time.Second {
+		elapsed = time.Second // 已足够填满令牌桶，避免溢出
+	}
+	r.tokens += int64(elapsed) * r.rate / int64(time.Second)
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+	r.last = now
+	r.tokens -= int64(n)
+	if r.tokens < 0 {
+		wait := time.Duration(-r.tokens * int64(time.Second) / r.rate)
+		time.Sleep(wait)
+		r.tokens = 0
+		r.last = r.last.Add(wait)
+	}
+	return n, err
+}
@@ -0,0 +1,90 @@
+package addon
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+)
+
+func TestThrottle(t *testing.T) {
+	large := strings.Repeat("a", 3000)
+	small := strings.Repeat("b", 50)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/large" {
+				w.Write([]byte(large))
+				return
+			}
+			w.Write([]byte(small))
+		}),
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go server.Serve(ln)
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	testProxy, err := proxy.NewProxy(&proxy.Options{
+		HttpAddr:          ":29119",
+		StreamLargeBodies: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	throttle := NewThrottle(10000, 0)
+	throttle.SetHost("localhost", 100, 100*time.Millisecond)
+	testProxy.AddAddon(throttle)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29119")
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	get := func(endpoint string) (string, time.Duration) {
+		start := time.Now()
+		res, err := proxyClient.Get(endpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b), time.Since(start)
+	}
+
+	t.Run("stream body throttled", func(t *testing.T) {
+		got, elapsed := get("http://127.0.0.1:" + port + "/large")
+		if got != large {
+			t.Fatalf("unexpected body of %v bytes", len(got))
+		}
+		if elapsed < 250*time.Millisecond {
+			t.Fatalf("expected throttled to about 300ms, but took %v", elapsed)
+		}
+	})
+
+	t.Run("buffered body throttled by host", func(t *testing.T) {
+		got, elapsed := get("http://localhost:" + port + "/small")
+		if got != small {
+			t.Fatalf("unexpected body %q", got)
+		}
+		if elapsed < 500*time.Millisecond {
+			t.Fatalf("expected throttled to about 600ms, but took %v", elapsed)
+		}
+	})
+}
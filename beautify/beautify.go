@@ -0,0 +1,114 @@
+package beautify
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"strconv"
+	"strings"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/match"
+)
+
+// 将 JSON、XML、HTML 响应格式化后再发送给客户端，便于在浏览器中调试
+// 仅调整空白字符，不改变内容:
+//   JSON  使用 json.Indent 缩进，解析失败时不处理
+//   XML   相邻的标签之间换行缩进，包含文本的元素保持原样
+//   HTML  仅替换标签之间已有的空白，不新增空白；script、style、pre、textarea 的内容保持原样
+// JavaScript、CSS 等其他类型不处理
+
+type Addon struct {
+	proxy.BaseAddon
+	Hosts  []string // 需要格式化的 host，支持通配符，为空时匹配全部
+	Indent string   // 缩进，默认两个空格
+}
+
+func NewAddon(hosts ...string) *Addon {
+	return &Addon{Hosts: hosts, Indent: "  "}
+}
+
+func (addon *Addon) matchHost(host string) bool {
+	if len(addon.Hosts) == 0 {
+		return true
+	}
+	for _, pattern := range addon.Hosts {
+		if match.Match(host, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+func (addon *Addon) Response(f *proxy.Flow) {
+	if f.Response == nil || len(f.Response.Body) == 0 || !addon.matchHost(f.Request.URL.Hostname()) {
+		return
+	}
+	format := formatFunc(f.Response.Header.Get("Content-Type"))
+	if format == nil {
+		return
+	}
+
+	body, err := f.Response.DecodedBody()
+	if err != nil {
+		log.Debugf("beautify %v decode body error: %v", f.Request.URL, err)
+		return
+	}
+	indent := addon.Indent
+	if indent == "" {
+		indent = "  "
+	}
+	formatted, ok := format(body, indent)
+	if !ok || bytes.Equal(formatted, body) {
+		return
+	}
+
+	f.Response.Body = formatted
+	f.Response.Header.Del("Content-Encoding")
+	f.Response.Header.Del("Transfer-Encoding")
+	f.Response.Header.Set("Content-Length", strconv.Itoa(len(formatted)))
+}
+
+func formatFunc(contentType string) func(body []byte, indent string) ([]byte, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		return formatJSON
+	case mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml"):
+		return formatXML
+	case mediaType == "text/html":
+		return formatHTML
+	}
+	return nil
+}
+
+func formatJSON(body []byte, indent string) ([]byte, bool) {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, body, "", indent); err != nil {
+		return nil, false
+	}
+	if bytes.HasSuffix(body, []byte("\n")) {
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), true
+}
+
+func formatXML(body []byte, indent string) ([]byte, bool) {
+	tokens, ok := tokenizeMarkup(body, false)
+	if !ok {
+		return nil, false
+	}
+	return writeMarkup(tokens, indent, false), true
+}
+
+func formatHTML(body []byte, indent string) ([]byte, bool) {
+	tokens, ok := tokenizeMarkup(body, true)
+	if !ok {
+		return nil, false
+	}
+	return writeMarkup(tokens, indent, true), true
+}
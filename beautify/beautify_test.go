@@ -0,0 +1,101 @@
+package beautify
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+)
+
+func newFlow(host, contentType string, body []byte) *proxy.Flow {
+	return &proxy.Flow{
+		Request: &proxy.Request{
+			Method: "GET",
+			URL:    &url.URL{Scheme: "https", Host: host, Path: "/"},
+		},
+		Response: &proxy.Response{
+			StatusCode: 200,
+			Header: http.Header{
+				"Content-Type":   []string{contentType},
+				"Content-Length": []string{"0"},
+			},
+			Body: body,
+		},
+	}
+}
+
+func TestBeautifyJSON(t *testing.T) {
+	addon := NewAddon("*.example.com")
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(`{"a":1,"b":[true,"x y"]}`))
+	w.Close()
+	f := newFlow("api.example.com", "application/json; charset=utf-8", gz.Bytes())
+	f.Response.Header.Set("Content-Encoding", "gzip")
+	addon.Response(f)
+
+	expected := "{\n  \"a\": 1,\n  \"b\": [\n    true,\n    \"x y\"\n  ]\n}"
+	if string(f.Response.Body) != expected {
+		t.Fatalf("unexpected body:\n%s", f.Response.Body)
+	}
+	if f.Response.Header.Get("Content-Encoding") != "" {
+		t.Fatal("expected Content-Encoding removed")
+	}
+	if f.Response.Header.Get("Content-Length") != strconv.Itoa(len(expected)) {
+		t.Fatalf("unexpected Content-Length %v", f.Response.Header.Get("Content-Length"))
+	}
+
+	// 非法 json 及未匹配的 host 不处理
+	f = newFlow("api.example.com", "application/json", []byte(`{"a":`))
+	addon.Response(f)
+	if string(f.Response.Body) != `{"a":` {
+		t.Fatalf("unexpected body %s", f.Response.Body)
+	}
+	f = newFlow("other.com", "application/json", []byte(`{"a":1}`))
+	addon.Response(f)
+	if string(f.Response.Body) != `{"a":1}` {
+		t.Fatalf("unexpected body %s", f.Response.Body)
+	}
+}
+
+func TestBeautifyXML(t *testing.T) {
+	addon := NewAddon()
+	body := `<?xml version="1.0"?><root a="x>y"><!-- c --><item id="1">text &amp; more</item><empty/><p>mixed <b>bold</b> tail</p><![CDATA[<raw>]]></root>`
+	f := newFlow("example.com", "application/xml", []byte(body))
+	addon.Response(f)
+
+	expected := `<?xml version="1.0"?>
+<root a="x>y">
+  <!-- c -->
+  <item id="1">text &amp; more</item>
+  <empty/>
+  <p>mixed <b>bold</b> tail</p><![CDATA[<raw>]]></root>`
+	if string(f.Response.Body) != expected {
+		t.Fatalf("unexpected body:\n%s", f.Response.Body)
+	}
+}
+
+func TestBeautifyHTML(t *testing.T) {
+	addon := NewAddon()
+	body := "<html> <body> <div><b>a</b><i>b</i></div> <pre>  keep\n  this </pre> <script>if(a<b){x()}</script> </body> </html>"
+	f := newFlow("example.com", "text/html", []byte(body))
+	addon.Response(f)
+
+	// 不在原本没有空白的位置插入空白
+	expected := "<html>\n  <body>\n    <div><b>a</b><i>b</i></div>\n    <pre>  keep\n  this </pre>\n    <script>if(a<b){x()}</script>\n  </body>\n</html>"
+	if string(f.Response.Body) != expected {
+		t.Fatalf("unexpected body:\n%s", f.Response.Body)
+	}
+
+	// javascript 不处理
+	f = newFlow("example.com", "application/javascript", []byte("function a(){return 1}"))
+	addon.Response(f)
+	if string(f.Response.Body) != "function a(){return 1}" {
+		t.Fatalf("unexpected body %s", f.Response.Body)
+	}
+}
@@ -0,0 +1,219 @@
+package beautify
+
+import (
+	"bytes"
+	"strings"
+)
+
+// 简单的 XML/HTML 标签切分，仅用于调整标签之间的空白，不校验文档结构
+
+type tokenKind int
+
+const (
+	tokenText  tokenKind = iota
+	tokenOpen            // <a>
+	tokenClose           // </a>
+	tokenEmpty           // <a/>、<br>、<!-- -->、<?xml ?>、<!DOCTYPE>
+	tokenRaw             // script、style 等元素的内容，原样输出
+)
+
+type token struct {
+	kind tokenKind
+	data []byte
+}
+
+func (t *token) isTag() bool {
+	return t.kind == tokenOpen || t.kind == tokenClose || t.kind == tokenEmpty
+}
+
+func (t *token) isSpace() bool {
+	return t.kind == tokenText && len(bytes.TrimSpace(t.data)) == 0
+}
+
+var htmlVoidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true,
+	"input": true, "link": true, "meta": true, "param": true, "source": true, "track": true, "wbr": true,
+}
+
+// 内容中的空白有意义或不是 html 的元素
+var htmlRawElements = map[string]bool{
+	"script": true, "style": true, "pre": true, "textarea": true,
+}
+
+func tokenizeMarkup(body []byte, html bool) ([]*token, bool) {
+	tokens := make([]*token, 0)
+	text := func(data []byte) {
+		if len(data) == 0 {
+			return
+		}
+		if n := len(tokens); n > 0 && tokens[n-1].kind == tokenText {
+			tokens[n-1].data = append(tokens[n-1].data, data...)
+			return
+		}
+		tokens = append(tokens, &token{kind: tokenText, data: append([]byte(nil), data...)})
+	}
+
+	for i := 0; i < len(body); {
+		if body[i] != '<' {
+			j := bytes.IndexByte(body[i:], '<')
+			if j < 0 {
+				j = len(body) - i
+			}
+			text(body[i : i+j])
+			i += j
+			continue
+		}
+
+		rest := body[i:]
+		var end int
+		kind := tokenEmpty
+		switch {
+		case bytes.HasPrefix(rest, []byte("<!--")):
+			end = indexEnd(rest, "-->")
+		case bytes.HasPrefix(rest, []byte("<![CDATA[")):
+			// CDATA 为元素的文本内容
+			end = indexEnd(rest, "]]>")
+			if end < 0 {
+				return nil, false
+			}
+			text(rest[:end])
+			i += end
+			continue
+		case bytes.HasPrefix(rest, []byte("<?")):
+			end = indexEnd(rest, "?>")
+		case bytes.HasPrefix(rest, []byte("<!")):
+			end = tagEnd(rest)
+		case bytes.HasPrefix(rest, []byte("</")):
+			end = tagEnd(rest)
+			kind = tokenClose
+		case len(rest) > 1 && isNameStart(rest[1]):
+			end = tagEnd(rest)
+			if end > 0 && !bytes.HasSuffix(rest[:end], []byte("/>")) {
+				kind = tokenOpen
+			}
+		default:
+			// html 文本中的 <
+			text(rest[:1])
+			i++
+			continue
+		}
+		if end < 0 {
+			return nil, false
+		}
+
+		tag := rest[:end]
+		name := strings.ToLower(tagName(tag))
+		if html && kind == tokenOpen && htmlVoidElements[name] {
+			kind = tokenEmpty
+		}
+		tokens = append(tokens, &token{kind: kind, data: tag})
+		i += end
+
+		if html && kind == tokenOpen && htmlRawElements[name] {
+			closeAt := indexFold(body[i:], "</"+name)
+			if closeAt < 0 {
+				return nil, false
+			}
+			if closeAt > 0 {
+				tokens = append(tokens, &token{kind: tokenRaw, data: body[i : i+closeAt]})
+			}
+			i += closeAt
+		}
+	}
+	return tokens, true
+}
+
+// 返回 sep 结束后的位置，未找到时返回 -1
+func indexEnd(data []byte, sep string) int {
+	i := bytes.Index(data, []byte(sep))
+	if i < 0 {
+		return -1
+	}
+	return i + len(sep)
+}
+
+// 标签结束的位置，忽略引号中的 >
+func tagEnd(data []byte) int {
+	var quote byte
+	for i := 1; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '>':
+			return i + 1
+		}
+	}
+	return -1
+}
+
+func tagName(tag []byte) string {
+	tag = bytes.TrimLeft(tag, "</")
+	end := bytes.IndexAny(tag, " \t\r\n/>")
+	if end < 0 {
+		return string(tag)
+	}
+	return string(tag[:end])
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func indexFold(data []byte, sep string) int {
+	return bytes.Index(bytes.ToLower(data), []byte(sep))
+}
+
+// xml 在相邻的标签之间换行缩进，html 仅替换标签之间已有的空白
+func writeMarkup(tokens []*token, indent string, html bool) []byte {
+	var buf bytes.Buffer
+	depth := 0
+	newline := func(d int) {
+		if d < 0 {
+			d = 0
+		}
+		buf.WriteByte('\n')
+		buf.WriteString(strings.Repeat(indent, d))
+	}
+
+	var prev *token
+	for i, t := range tokens {
+		var next *token
+		if i+1 < len(tokens) {
+			next = tokens[i+1]
+		}
+
+		switch {
+		case t.isSpace() && prev != nil && prev.isTag() && next != nil && next.isTag():
+			// 标签之间的空白由下一个标签前的换行替代
+			if html {
+				d := depth
+				if next.kind == tokenClose {
+					d--
+				}
+				newline(d)
+			}
+			continue
+		case t.kind == tokenClose:
+			depth--
+			if !html && prev != nil && prev.isTag() && prev.kind != tokenOpen {
+				newline(depth)
+			}
+		case t.isTag():
+			if !html && prev != nil && prev.isTag() {
+				newline(depth)
+			}
+		}
+
+		buf.Write(t.data)
+		if t.kind == tokenOpen {
+			depth++
+		}
+		prev = t
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,172 @@
+package cert
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 签发的证书持久化至磁盘，重启后复用，避免客户端重新信任
+// rsa ca 签发的 rsa 证书的私钥即 ca 私钥，仅保存证书本身，其他证书同时保存私钥
+// 同一 host 的并发签发由 CA.group 合并，仅签发及写入一次
+
+// 证书剩余有效期不足此时间时重新签发，包括内存及磁盘中的证书
+const certRenewBefore = time.Hour * 24 * 30
+
+func certExpiringSoon(x509Cert *x509.Certificate) bool {
+	return time.Now().Add(certRenewBefore).After(x509Cert.NotAfter)
+}
+
+// 设置证书持久化目录，并加载其中仍有效的证书
+func (ca *CA) SetCertCacheDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	ca.certCacheDir = dir
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	loaded := 0
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".pem") {
+			continue
+		}
+		x509Cert, cert := ca.readCachedCert(filepath.Join(dir, entry.Name()))
+		if cert == nil {
+			continue
+		}
+		ca.cacheMu.Lock()
+		ca.cache.Add(certCacheKey(x509Cert.Subject.CommonName, keyTypeOf(x509Cert.PublicKey)), cert)
+		ca.cacheMu.Unlock()
+		loaded++
+	}
+	log.Debugf("ca load %v certs from %v", loaded, dir)
+	return nil
+}
+
+// rsa 证书的文件名不含类型，兼容之前保存的证书
+func (ca *CA) cachedCertFile(commonName string, keyType KeyType) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, commonName)
+	if keyType != KeyTypeRSA {
+		name += "." + string(keyType)
+	}
+	return filepath.Join(ca.certCacheDir, name+".pem")
+}
+
+func (ca *CA) loadCachedCert(commonName string, keyType KeyType) *tls.Certificate {
+	if ca.certCacheDir == "" {
+		return nil
+	}
+	x509Cert, cert := ca.readCachedCert(ca.cachedCertFile(commonName, keyType))
+	if cert == nil || x509Cert.Subject.CommonName != commonName || keyTypeOf(x509Cert.PublicKey) != keyType {
+		return nil
+	}
+	log.Debugf("ca load cached cert: %v", commonName)
+	return cert
+}
+
+// 证书无效（不在有效期内或非当前 ca 签发）时返回 nil
+func (ca *CA) readCachedCert(filename string) (*x509.Certificate, *tls.Certificate) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("ca read cached cert %v error: %v", filename, err)
+		}
+		return nil, nil
+	}
+	block, rest := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		log.Debugf("ca ignore cached cert %v: invalid pem", filename)
+		return nil, nil
+	}
+	x509Cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		log.Debugf("ca ignore cached cert %v: %v", filename, err)
+		return nil, nil
+	}
+	key := ca.Signer()
+	if keyBlock, _ := pem.Decode(rest); keyBlock != nil {
+		if key, err = parsePrivateKey(keyBlock.Bytes); err != nil {
+			log.Debugf("ca ignore cached cert %v: %v", filename, err)
+			return nil, nil
+		}
+	}
+	if err := ca.validateCachedCert(x509Cert, key); err != nil {
+		log.Debugf("ca ignore cached cert %v: %v", filename, err)
+		return nil, nil
+	}
+	return x509Cert, &tls.Certificate{
+		Certificate: [][]byte{x509Cert.Raw},
+		PrivateKey:  key,
+		Leaf:        x509Cert,
+	}
+}
+
+func (ca *CA) validateCachedCert(x509Cert *x509.Certificate, key crypto.Signer) error {
+	now := time.Now()
+	if now.Before(x509Cert.NotBefore) || now.After(x509Cert.NotAfter) {
+		return fmt.Errorf("not within validity window %v - %v", x509Cert.NotBefore, x509Cert.NotAfter)
+	}
+	if certExpiringSoon(x509Cert) {
+		return fmt.Errorf("expires soon at %v", x509Cert.NotAfter)
+	}
+	if err := x509Cert.CheckSignatureFrom(&ca.RootCert); err != nil {
+		return fmt.Errorf("not signed by current ca: %w", err)
+	}
+	if !publicKeyEqual(key.Public(), x509Cert.PublicKey) {
+		return fmt.Errorf("public key not match private key")
+	}
+	return nil
+}
+
+func (ca *CA) saveCachedCert(commonName string, keyType KeyType, cert *tls.Certificate) {
+	if ca.certCacheDir == "" {
+		return
+	}
+	filename := ca.cachedCertFile(commonName, keyType)
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	// ed25519.PrivateKey 不可比较，不能直接与 ca.Signer() 比较
+	if key, ok := cert.PrivateKey.(*rsa.PrivateKey); !ok || key != &ca.PrivateKey {
+		keyBytes, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+		if err != nil {
+			log.Warnf("ca save cached cert %v error: %v", commonName, err)
+			return
+		}
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})...)
+	}
+
+	// 先写入临时文件再重命名，避免写入中断时留下不完整的文件
+	tmp, err := ioutil.TempFile(ca.certCacheDir, ".tmp-*")
+	if err != nil {
+		log.Warnf("ca save cached cert %v error: %v", commonName, err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Warnf("ca save cached cert %v error: %v", commonName, err)
+	}
+}
@@ -1,6 +1,7 @@
 package cert
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
@@ -31,14 +32,22 @@ import (
 var errCaNotFound = errors.New("ca not found")
 
 type CA struct {
-	rsa.PrivateKey
-	RootCert  x509.Certificate
-	StorePath string
+	rsa.PrivateKey // rsa ca 的私钥，ecdsa、ed25519 ca 时为空
+	RootCert       x509.Certificate
+	StorePath      string
+
+	signer crypto.Signer // ecdsa、ed25519 ca 的私钥
 
 	cache *lru.Cache
 	group *singleflight.Group
 
 	cacheMu sync.Mutex
+
+	certCacheDir string  // 签发的证书持久化目录，为空时仅保存在内存中
+	certKeyType  KeyType // 签发证书的密钥类型，为空时为 rsa
+
+	leafKeysMu sync.Mutex
+	leafKeys   map[KeyType]crypto.Signer // 签发证书共用的私钥，进程内每种类型生成一次
 }
 
 func createCert() (*rsa.PrivateKey, *x509.Certificate, error) {
@@ -127,6 +136,59 @@ func NewCA(path string) (*CA, error) {
 	return ca, nil
 }
 
+// Load ca from pem encoded certificate and private key, nothing is read from or written to disk
+func NewCAFromPEM(certPEM, keyPEM []byte) (*CA, error) {
+	certDERBlock, _ := pem.Decode(certPEM)
+	if certDERBlock == nil || certDERBlock.Type != "CERTIFICATE" {
+		return nil, errors.New("ca cert: no CERTIFICATE pem block found")
+	}
+	x509Cert, err := x509.ParseCertificate(certDERBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("ca cert: %w", err)
+	}
+	if !x509Cert.IsCA {
+		return nil, errors.New("ca cert: not a ca certificate")
+	}
+
+	keyDERBlock, _ := pem.Decode(keyPEM)
+	if keyDERBlock == nil || !strings.HasSuffix(keyDERBlock.Type, "PRIVATE KEY") {
+		return nil, errors.New("ca key: no PRIVATE KEY pem block found")
+	}
+	privateKey, err := parsePrivateKey(keyDERBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("ca key: %w", err)
+	}
+	if !publicKeyEqual(privateKey.Public(), x509Cert.PublicKey) {
+		return nil, errors.New("ca key: private key does not match certificate")
+	}
+
+	ca := &CA{
+		RootCert:  *x509Cert,
+		StorePath: "",
+		cache:     lru.New(100),
+		group:     new(singleflight.Group),
+	}
+	ca.setKey(privateKey)
+	return ca, nil
+}
+
+func (ca *CA) setKey(key crypto.Signer) {
+	if rsaKey, ok := key.(*rsa.PrivateKey); ok {
+		ca.PrivateKey = *rsaKey
+		ca.signer = nil
+		return
+	}
+	ca.signer = key
+}
+
+// ca 的私钥，用于签发证书
+func (ca *CA) Signer() crypto.Signer {
+	if ca.signer != nil {
+		return ca.signer
+	}
+	return &ca.PrivateKey
+}
+
 func getStorePath(path string) (string, error) {
 	if path == "" {
 		homeDir, err := os.UserHomeDir()
@@ -205,26 +267,11 @@ func (ca *CA) load() error {
 		return fmt.Errorf("%v 中不存在 CERTIFICATE", caFile)
 	}
 
-	var privateKey *rsa.PrivateKey
-	key, err := x509.ParsePKCS8PrivateKey(keyDERBlock.Bytes)
+	privateKey, err := parsePrivateKey(keyDERBlock.Bytes)
 	if err != nil {
-		// fix #14
-		if strings.Contains(err.Error(), "use ParsePKCS1PrivateKey instead") {
-			privateKey, err = x509.ParsePKCS1PrivateKey(keyDERBlock.Bytes)
-			if err != nil {
-				return err
-			}
-		} else {
-			return err
-		}
-	} else {
-		if v, ok := key.(*rsa.PrivateKey); ok {
-			privateKey = v
-		} else {
-			return errors.New("found unknown rsa private key type in PKCS#8 wrapping")
-		}
+		return err
 	}
-	ca.PrivateKey = *privateKey
+	ca.setKey(privateKey)
 
 	x509Cert, err := x509.ParseCertificate(certDERBlock.Bytes)
 	if err != nil {
@@ -251,7 +298,7 @@ func (ca *CA) create() error {
 }
 
 func (ca *CA) saveTo(out io.Writer) error {
-	keyBytes, err := x509.MarshalPKCS8PrivateKey(&ca.PrivateKey)
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(ca.Signer())
 	if err != nil {
 		return err
 	}
@@ -299,21 +346,81 @@ func (ca *CA) saveCert() error {
 	return err
 }
 
+// 设置签发证书的密钥类型，需在签发证书前调用
+func (ca *CA) SetCertKeyType(keyType KeyType) {
+	ca.certKeyType = keyType
+}
+
+func (ca *CA) CertKeyType() KeyType {
+	if ca.certKeyType == "" {
+		return KeyTypeRSA
+	}
+	return ca.certKeyType
+}
+
+// 签发证书共用的私钥，rsa 证书且 ca 为 rsa 时即 ca 私钥
+func (ca *CA) leafKey(keyType KeyType) (crypto.Signer, error) {
+	if keyType == KeyTypeRSA && ca.signer == nil {
+		return &ca.PrivateKey, nil
+	}
+	ca.leafKeysMu.Lock()
+	defer ca.leafKeysMu.Unlock()
+	if key, ok := ca.leafKeys[keyType]; ok {
+		return key, nil
+	}
+	key, err := generateKey(keyType)
+	if err != nil {
+		return nil, err
+	}
+	if ca.leafKeys == nil {
+		ca.leafKeys = make(map[KeyType]crypto.Signer)
+	}
+	ca.leafKeys[keyType] = key
+	return key, nil
+}
+
+// 内存缓存的 key，rsa 证书保持为 commonName
+func certCacheKey(commonName string, keyType KeyType) string {
+	if keyType == KeyTypeRSA {
+		return commonName
+	}
+	return string(keyType) + "/" + commonName
+}
+
+// 签发 CA.CertKeyType 类型的证书
 func (ca *CA) GetCert(commonName string) (*tls.Certificate, error) {
+	return ca.GetCertOfType(commonName, ca.CertKeyType())
+}
+
+func (ca *CA) GetCertOfType(commonName string, keyType KeyType) (*tls.Certificate, error) {
+	cacheKey := certCacheKey(commonName, keyType)
 	ca.cacheMu.Lock()
-	if val, ok := ca.cache.Get(commonName); ok {
-		ca.cacheMu.Unlock()
-		log.Debugf("ca GetCert: %v", commonName)
-		return val.(*tls.Certificate), nil
+	if val, ok := ca.cache.Get(cacheKey); ok {
+		cert := val.(*tls.Certificate)
+		// 长时间运行时内存中的证书也可能即将过期
+		if cert.Leaf == nil || !certExpiringSoon(cert.Leaf) {
+			ca.cacheMu.Unlock()
+			log.Debugf("ca GetCert: %v", commonName)
+			return cert, nil
+		}
+		ca.cache.Remove(cacheKey)
 	}
 	ca.cacheMu.Unlock()
 
-	val, err := ca.group.Do(commonName, func() (interface{}, error) {
-		cert, err := ca.DummyCert(commonName)
+	val, err := ca.group.Do(cacheKey, func() (interface{}, error) {
+		if cert := ca.loadCachedCert(commonName, keyType); cert != nil {
+			ca.cacheMu.Lock()
+			ca.cache.Add(cacheKey, cert)
+			ca.cacheMu.Unlock()
+			return cert, nil
+		}
+
+		cert, err := ca.dummyCert(commonName, keyType)
 		if err == nil {
 			ca.cacheMu.Lock()
-			ca.cache.Add(commonName, cert)
+			ca.cache.Add(cacheKey, cert)
 			ca.cacheMu.Unlock()
+			ca.saveCachedCert(commonName, keyType, cert)
 		}
 		return cert, err
 	})
@@ -327,17 +434,24 @@ func (ca *CA) GetCert(commonName string) (*tls.Certificate, error) {
 
 // TODO: 是否应该支持多个 SubjectAltName
 func (ca *CA) DummyCert(commonName string) (*tls.Certificate, error) {
-	log.Debugf("ca DummyCert: %v", commonName)
+	return ca.dummyCert(commonName, ca.CertKeyType())
+}
+
+func (ca *CA) dummyCert(commonName string, keyType KeyType) (*tls.Certificate, error) {
+	log.Debugf("ca DummyCert: %v %v", commonName, keyType)
+	key, err := ca.leafKey(keyType)
+	if err != nil {
+		return nil, err
+	}
 	template := &x509.Certificate{
 		SerialNumber: big.NewInt(time.Now().UnixNano() / 100000),
 		Subject: pkix.Name{
 			CommonName:   commonName,
 			Organization: []string{"mitmproxy"},
 		},
-		NotBefore:          time.Now().Add(-time.Hour * 48),
-		NotAfter:           time.Now().Add(time.Hour * 24 * 365),
-		SignatureAlgorithm: x509.SHA256WithRSA,
-		ExtKeyUsage:        []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		NotBefore:   time.Now().Add(-time.Hour * 48),
+		NotAfter:    time.Now().Add(time.Hour * 24 * 365),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
 	}
 
 	ip := net.ParseIP(commonName)
@@ -347,14 +461,20 @@ func (ca *CA) DummyCert(commonName string) (*tls.Certificate, error) {
 		template.DNSNames = []string{commonName}
 	}
 
-	certBytes, err := x509.CreateCertificate(rand.Reader, template, &ca.RootCert, &ca.PrivateKey.PublicKey, &ca.PrivateKey)
+	// 签名算法由 ca 私钥决定
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, &ca.RootCert, key.Public(), ca.Signer())
 	if err != nil {
 		return nil, err
 	}
 
+	leaf, err := x509.ParseCertificate(certBytes)
+	if err != nil {
+		return nil, err
+	}
 	cert := &tls.Certificate{
 		Certificate: [][]byte{certBytes},
-		PrivateKey:  &ca.PrivateKey,
+		PrivateKey:  key,
+		Leaf:        leaf,
 	}
 
 	return cert, nil
@@ -2,9 +2,23 @@ package cert
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestGetStorePath(t *testing.T) {
@@ -40,3 +54,430 @@ func TestNewCA(t *testing.T) {
 		t.Fatal("pem content should equal")
 	}
 }
+
+func TestCertCacheDir(t *testing.T) {
+	caPath := t.TempDir()
+	cacheDir := t.TempDir()
+
+	ca, err := NewCA(caPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.SetCertCacheDir(cacheDir); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ca.GetCert("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// restart with the same ca
+	ca, err = NewCA(caPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.SetCertCacheDir(cacheDir); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := ca.GetCert("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cert.Certificate[0], reloaded.Certificate[0]) {
+		t.Fatal("should reuse cert from disk")
+	}
+
+	// cert not signed by a new ca should be ignored
+	otherCa, err := NewCA(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := otherCa.SetCertCacheDir(cacheDir); err != nil {
+		t.Fatal(err)
+	}
+	minted, err := otherCa.GetCert("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(cert.Certificate[0], minted.Certificate[0]) {
+		t.Fatal("should not reuse cert signed by another ca")
+	}
+}
+
+func TestCertCacheDirConcurrent(t *testing.T) {
+	cacheDir := t.TempDir()
+	ca, err := NewCAMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.SetCertCacheDir(cacheDir); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	certs := make([][]byte, 10)
+	for i := range certs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cert, err := ca.GetCert("example.com")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			certs[i] = cert.Certificate[0]
+		}(i)
+	}
+	wg.Wait()
+	for _, c := range certs[1:] {
+		if !bytes.Equal(c, certs[0]) {
+			t.Fatal("concurrent requests should share one cert")
+		}
+	}
+
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "example.com.pem" {
+		names := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Fatalf("expected only example.com.pem, but got %v", strings.Join(names, ", "))
+	}
+}
+
+func TestCertCacheDirRenew(t *testing.T) {
+	cacheDir := t.TempDir()
+	ca, err := NewCAMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 即将过期的证书
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		NotBefore:    time.Now().Add(-time.Hour * 24 * 360),
+		NotAfter:     time.Now().Add(time.Hour * 24),
+		DNSNames:     []string{"example.com"},
+	}
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, &ca.RootCert, &ca.PrivateKey.PublicKey, &ca.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.certCacheDir = cacheDir
+	if err := ioutil.WriteFile(ca.cachedCertFile("example.com", KeyTypeRSA), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ca.SetCertCacheDir(cacheDir); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := ca.GetCert("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(cert.Certificate[0], certBytes) {
+		t.Fatal("should renew cert which expires soon")
+	}
+	if cert.Leaf.NotAfter.Before(time.Now().Add(certRenewBefore)) {
+		t.Fatalf("unexpected renewed cert not after %v", cert.Leaf.NotAfter)
+	}
+
+	// 重启后加载新签发的证书
+	ca.cache.Clear()
+	reloaded, err := ca.GetCert("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cert.Certificate[0], reloaded.Certificate[0]) {
+		t.Fatal("should persist renewed cert")
+	}
+
+	// 内存中即将过期的证书同样重新签发
+	expiring := *reloaded
+	expiring.Leaf = template
+	ca.cache.Add("example.com", &expiring)
+	renewed, err := ca.GetCert("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed == &expiring {
+		t.Fatal("should renew in-memory cert which expires soon")
+	}
+}
+
+func TestNewCAFromPEM(t *testing.T) {
+	memCA, err := NewCAMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := new(bytes.Buffer)
+	if err := memCA.saveCertTo(certPEM); err != nil {
+		t.Fatal(err)
+	}
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(&memCA.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})
+
+	ca, err := NewCAFromPEM(certPEM.Bytes(), keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ca.StorePath != "" {
+		t.Fatal("should not have store path")
+	}
+	cert, err := ca.GetCert("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(&memCA.RootCert)
+	if _, err := leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: roots}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewCAFromPEM([]byte("not pem"), keyPEM); err == nil {
+		t.Fatal("should fail with malformed cert")
+	}
+	if _, err := NewCAFromPEM(certPEM.Bytes(), certPEM.Bytes()); err == nil {
+		t.Fatal("should fail with malformed key")
+	}
+	otherCA, err := NewCAMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, _ := x509.MarshalPKCS8PrivateKey(&otherCA.PrivateKey)
+	if _, err := NewCAFromPEM(certPEM.Bytes(), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: otherKey})); err == nil {
+		t.Fatal("should fail with mismatched key")
+	}
+}
+
+func verifyLeaf(t testing.TB, ca *CA, commonName string, c *x509.Certificate) {
+	roots := x509.NewCertPool()
+	roots.AddCert(&ca.RootCert)
+	if _, err := c.Verify(x509.VerifyOptions{DNSName: commonName, Roots: roots}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertKeyType(t *testing.T) {
+	ca, err := NewCAMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheDir := t.TempDir()
+	if err := ca.SetCertCacheDir(cacheDir); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, keyType := range []KeyType{KeyTypeRSA, KeyTypeECDSAP256, KeyTypeEd25519} {
+		ca.SetCertKeyType(keyType)
+		cert, err := ca.GetCert("example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := keyTypeOf(cert.Leaf.PublicKey); got != keyType {
+			t.Fatalf("expected %v cert, but got %v", keyType, got)
+		}
+		if !publicKeyEqual(cert.PrivateKey.(crypto.Signer).Public(), cert.Leaf.PublicKey) {
+			t.Fatalf("%v: private key not match cert", keyType)
+		}
+		verifyLeaf(t, ca, "example.com", cert.Leaf)
+	}
+
+	// 不同类型的证书分别保存，重启后加载证书及私钥
+	reloaded, err := NewCAFromPEM(pemOf(t, ca))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reloaded.SetCertCacheDir(cacheDir); err != nil {
+		t.Fatal(err)
+	}
+	for _, keyType := range []KeyType{KeyTypeRSA, KeyTypeECDSAP256, KeyTypeEd25519} {
+		cert, err := ca.GetCertOfType("example.com", keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cached, err := reloaded.GetCertOfType("example.com", keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(cert.Certificate[0], cached.Certificate[0]) {
+			t.Fatalf("%v: should reuse cert from disk", keyType)
+		}
+		if !publicKeyEqual(cached.PrivateKey.(crypto.Signer).Public(), cached.Leaf.PublicKey) {
+			t.Fatalf("%v: cached private key not match cert", keyType)
+		}
+	}
+
+	if _, err := ParseKeyType("dsa"); err == nil {
+		t.Fatal("should fail with unknown key type")
+	}
+}
+
+func pemOf(t testing.TB, ca *CA) ([]byte, []byte) {
+	certPEM := new(bytes.Buffer)
+	if err := ca.saveCertTo(certPEM); err != nil {
+		t.Fatal(err)
+	}
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(ca.Signer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certPEM.Bytes(), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})
+}
+
+func newTestRootCert(t testing.TB, key crypto.Signer) []byte {
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour * 24 * 365),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	certBytes, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
+}
+
+func TestNonRSACA(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		key     crypto.Signer
+		keyPEM  []byte
+		keyType KeyType
+	}{
+		{"ecdsa sec1", ecKey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}), KeyTypeECDSAP256},
+		{"ed25519 pkcs8", edKey, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: edDER}), KeyTypeEd25519},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			certPEM := newTestRootCert(t, c.key)
+			ca, err := NewCAFromPEM(certPEM, c.keyPEM)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keyTypeOf(ca.Signer().Public()) != c.keyType {
+				t.Fatalf("expected %v ca", c.keyType)
+			}
+			for _, keyType := range []KeyType{KeyTypeRSA, KeyTypeECDSAP256, KeyTypeEd25519} {
+				cert, err := ca.GetCertOfType("example.com", keyType)
+				if err != nil {
+					t.Fatal(err)
+				}
+				verifyLeaf(t, ca, "example.com", cert.Leaf)
+			}
+
+			// 通过 CaRootPath 加载
+			dir := t.TempDir()
+			if err := ioutil.WriteFile(filepath.Join(dir, "mitmproxy-ca.pem"), append(c.keyPEM, certPEM...), 0600); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := NewCA(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !publicKeyEqual(loaded.Signer().Public(), c.key.Public()) {
+				t.Fatal("should load ca key from store path")
+			}
+			cert, err := loaded.GetCert("example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			verifyLeaf(t, loaded, "example.com", cert.Leaf)
+		})
+	}
+}
+
+// 签发证书的速度，签名由 ca 私钥完成，每次签发新证书
+func BenchmarkDummyCert(b *testing.B) {
+	rsaCA, err := NewCAMemory()
+	if err != nil {
+		b.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		b.Fatal(err)
+	}
+	ecCA, err := NewCAFromPEM(newTestRootCert(b, ecKey), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, ca := range []*CA{rsaCA, ecCA} {
+		for _, keyType := range []KeyType{KeyTypeRSA, KeyTypeECDSAP256, KeyTypeEd25519} {
+			b.Run("ca="+string(keyTypeOf(ca.Signer().Public()))+"/leaf="+string(keyType), func(b *testing.B) {
+				if _, err := ca.leafKey(keyType); err != nil {
+					b.Fatal(err)
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := ca.dummyCert("example.com", keyType); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// tls 握手时使用证书私钥签名的速度
+func BenchmarkLeafKeySign(b *testing.B) {
+	ca, err := NewCAMemory()
+	if err != nil {
+		b.Fatal(err)
+	}
+	digest := make([]byte, 32)
+	for _, keyType := range []KeyType{KeyTypeRSA, KeyTypeECDSAP256, KeyTypeEd25519} {
+		b.Run(string(keyType), func(b *testing.B) {
+			key, err := ca.leafKey(keyType)
+			if err != nil {
+				b.Fatal(err)
+			}
+			var opts crypto.SignerOpts = crypto.SHA256
+			if keyType == KeyTypeEd25519 {
+				opts = crypto.Hash(0)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := key.Sign(rand.Reader, digest, opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package cert
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// 签发证书使用的密钥类型，默认 rsa 以兼容所有客户端
+// 证书私钥用于每次 tls 握手的签名，ecdsa-p256 及 ed25519 远快于 rsa，参考 BenchmarkLeafKeySign
+// 签发证书的速度由 ca 私钥决定，ecdsa ca 远快于 rsa ca，参考 BenchmarkDummyCert
+type KeyType string
+
+const (
+	KeyTypeRSA       KeyType = "rsa"
+	KeyTypeECDSAP256 KeyType = "ecdsa-p256"
+	KeyTypeEd25519   KeyType = "ed25519"
+)
+
+// 为空时为 rsa
+func ParseKeyType(s string) (KeyType, error) {
+	switch KeyType(strings.ToLower(s)) {
+	case "", KeyTypeRSA:
+		return KeyTypeRSA, nil
+	case KeyTypeECDSAP256:
+		return KeyTypeECDSAP256, nil
+	case KeyTypeEd25519:
+		return KeyTypeEd25519, nil
+	}
+	return "", fmt.Errorf("unknown cert key type: %v, should be one of rsa, ecdsa-p256, ed25519", s)
+}
+
+func generateKey(keyType KeyType) (crypto.Signer, error) {
+	switch keyType {
+	case KeyTypeECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	}
+}
+
+// 不支持的公钥返回空字符串
+func keyTypeOf(pub crypto.PublicKey) KeyType {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return KeyTypeRSA
+	case *ecdsa.PublicKey:
+		if pub.Curve == elliptic.P256() {
+			return KeyTypeECDSAP256
+		}
+	case ed25519.PublicKey:
+		return KeyTypeEd25519
+	}
+	return ""
+}
+
+func publicKeyEqual(a, b crypto.PublicKey) bool {
+	pub, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && pub.Equal(b)
+}
+
+// 支持 PKCS#8、PKCS#1 及 SEC 1 格式的 rsa、ecdsa、ed25519 私钥
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		// fix #14
+		if strings.Contains(err.Error(), "use ParsePKCS1PrivateKey instead") {
+			return x509.ParsePKCS1PrivateKey(der)
+		}
+		if strings.Contains(err.Error(), "use ParseECPrivateKey instead") {
+			return x509.ParseECPrivateKey(der)
+		}
+		return nil, err
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	}
+	return nil, errors.New("found unknown private key type in PKCS#8 wrapping")
+}
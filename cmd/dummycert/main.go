@@ -54,7 +54,7 @@ func main() {
 	}
 	os.Stdout.WriteString(fmt.Sprintf("\n%v-key.pem\n", config.commonName))
 
-	keyBytes, err := x509.MarshalPKCS8PrivateKey(&ca.PrivateKey)
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
 	if err != nil {
 		panic(err)
 	}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	rawLog "log"
 	"net/http"
@@ -16,19 +17,33 @@ import (
 type Config struct {
 	version bool // show go-mitmproxy version
 
-	HttpAddr    string   // proxy listen addr
-	SocksAddr   string   // socks proxy listen addr
-	WebAddr     string   // web interface listen addr
-	SslInsecure bool     // not verify upstream server SSL/TLS certificates.
-	IgnoreHosts []string // a list of ignore hosts
-	AllowHosts  []string // a list of allow hosts
-	CertPath    string   // path of generate cert files
-	Debug       int      // debug mode: 1 - print debug log, 2 - show debug from
-	Dump        string   // dump filename
-	DumpLevel   int      // dump level: 0 - header, 1 - header + body
-	Upstream    string   // upstream proxy
-	MapRemote   string   // map remote config filename
-	MapLocal    string   // map local config filename
+	HttpAddr        string   // proxy listen addr
+	SocksAddr       string   // socks proxy listen addr
+	WebAddr         string   // web interface listen addr
+	SslInsecure     bool     // not verify upstream server SSL/TLS certificates.
+	Http2           bool     // enable http2 for client and upstream connections
+	InsecureHosts   []string // a list of hosts not verify upstream server SSL/TLS certificates
+	IgnoreHosts     []string // a list of ignore hosts
+	AllowHosts      []string // a list of allow hosts
+	BlockHosts      []string // a list of hosts to refuse with 403
+	CertPath        string   // path of generate cert files
+	CertCacheDir    string   // path of persist minted leaf certs
+	CertKeyType     string   // key type of minted leaf certs: rsa, ecdsa-p256 or ed25519
+	MaxConns        int      // max concurrent client connections, 0 means unlimited
+	Debug           int      // debug mode: 1 - print debug log, 2 - show debug from
+	Dump            string   // dump filename
+	DumpLevel       int      // dump level: 0 - header, 1 - header + body
+	Upstream        string   // upstream proxy
+	PacUrl          string   // pac file url or path, select upstream proxy by FindProxyForURL
+	NoProxy         []string // a list of hosts to connect directly without upstream proxy
+	MapRemote       string   // map remote config filename
+	MapLocal        string   // map local config filename
+	StatusReplace   string   // status replace config filename
+	ResponseCap     string   // response body cap config filename
+	DryRun          bool     // log addon modifications without applying them
+	AccessLog       bool     // log one line per completed flow
+	AccessLogFormat string   // access log format: text or json
+	AccessLogLevel  string   // access log level
 
 	filename string // read config from the filename
 }
@@ -56,8 +71,20 @@ func main() {
 		SocksAddr:         config.SocksAddr,
 		StreamLargeBodies: 1024 * 1024 * 5,
 		SslInsecure:       config.SslInsecure,
+		EnableHTTP2:       config.Http2,
+		InsecureHosts:     config.InsecureHosts,
+		BlockHosts:        config.BlockHosts,
 		CaRootPath:        config.CertPath,
+		CertCacheDir:      config.CertCacheDir,
+		CertKeyType:       config.CertKeyType,
+		MaxConnections:    config.MaxConns,
 		Upstream:          config.Upstream,
+		PacUrl:            config.PacUrl,
+		NoProxy:           config.NoProxy,
+		DryRun:            config.DryRun,
+		AccessLog:         config.AccessLog,
+		AccessLogFormat:   config.AccessLogFormat,
+		AccessLogLevel:    config.AccessLogLevel,
 	}
 
 	p, err := proxy.NewProxy(opts)
@@ -104,12 +131,32 @@ func main() {
 		}
 	}
 
+	if config.StatusReplace != "" {
+		statusReplace, err := addon.NewStatusReplaceFromFile(config.StatusReplace)
+		if err != nil {
+			log.Warnf("load status replace error: %v", err)
+		} else {
+			p.AddAddon(statusReplace)
+		}
+	}
+
+	if config.ResponseCap != "" {
+		responseCap, err := addon.NewResponseBodyCapFromFile(config.ResponseCap)
+		if err != nil {
+			log.Warnf("load response cap error: %v", err)
+		} else {
+			p.AddAddon(responseCap)
+		}
+	}
+
 	if config.Dump != "" {
 		dumper := addon.NewDumperWithFilename(config.Dump, config.DumpLevel)
 		p.AddAddon(dumper)
 	}
 
-	log.Fatal(p.Start())
+	if err := p.RunWithSignals(context.Background()); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func matchHost(address string, hosts []string) bool {
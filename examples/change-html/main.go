@@ -2,7 +2,6 @@ package main
 
 import (
 	"regexp"
-	"strconv"
 	"strings"
 
 	"github.com/lqqyt2423/go-mitmproxy/proxy"
@@ -22,9 +21,13 @@ func (c *ChangeHtml) Response(f *proxy.Flow) {
 	}
 
 	// change html <title> end with: " - go-mitmproxy"
-	f.Response.ReplaceToDecodedBody()
-	f.Response.Body = titleRegexp.ReplaceAll(f.Response.Body, []byte("${1}${2} - go-mitmproxy${3}"))
-	f.Response.Header.Set("Content-Length", strconv.Itoa(len(f.Response.Body)))
+	// 按原有的 Content-Encoding 重新压缩，并更新 Content-Length
+	err := f.Response.DecodeAndReplace(func(body []byte) []byte {
+		return titleRegexp.ReplaceAll(body, []byte("${1}${2} - go-mitmproxy${3}"))
+	})
+	if err != nil {
+		log.Warnf("change html: %v", err)
+	}
 }
 
 func main() {
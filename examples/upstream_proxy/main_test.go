@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy/proxytest"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestListeningRequest(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/json" {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"ok":true}`)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, "<html></html>")
+	})
+
+	req, _ := http.NewRequest("GET", "http://example.com/html", nil)
+	proxytest.RunAddon(&ListeningRequest{}, req, upstream)
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "<html></html>" {
+			t.Fatal("expected non json response not logged")
+		}
+	}
+
+	hook.Reset()
+	req, _ = http.NewRequest("GET", "http://example.com/json", nil)
+	f, res := proxytest.RunAddon(&ListeningRequest{}, req, upstream)
+	if res == nil || res.StatusCode != 200 {
+		t.Fatalf("unexpected response %v", res)
+	}
+	var loggedURL, loggedBody bool
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == f.Request.URL.String() {
+			loggedURL = true
+		}
+		if entry.Message == `{"ok":true}` {
+			loggedBody = true
+		}
+	}
+	if !loggedURL || !loggedBody {
+		t.Fatal("expected json request url and body logged")
+	}
+}
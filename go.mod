@@ -8,15 +8,32 @@ require (
 	github.com/golang/groupcache v0.0.0-20210331224755-41bb18bfe9da
 	github.com/gorilla/websocket v1.5.0
 	github.com/haxii/fastproxy v0.5.37
+	github.com/klauspost/compress v1.16.7
+	github.com/oschwald/maxminddb-golang v1.10.0
+	github.com/prometheus/client_golang v1.14.0
+	github.com/robertkrimen/otto v0.2.1
 	github.com/samber/lo v1.37.0
 	github.com/satori/go.uuid v1.2.0
 	github.com/sirupsen/logrus v1.8.1
 	github.com/tidwall/match v1.1.1
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	go.starlark.net v0.0.0-20230525235612-a134d8f9ddca
 	golang.org/x/net v0.17.0
+	google.golang.org/protobuf v1.28.1
 )
 
 require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/client_model v0.3.0 // indirect
+	github.com/prometheus/common v0.37.0 // indirect
+	github.com/prometheus/procfs v0.8.0 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
 	golang.org/x/exp v0.0.0-20220303212507-bbda1eaf7a17 // indirect
 	golang.org/x/sys v0.13.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
+	gopkg.in/sourcemap.v1 v1.0.5 // indirect
 )
@@ -0,0 +1,345 @@
+// Package pac 解析并执行 PAC（proxy auto-config）文件
+// 使用 otto 执行脚本，支持完整的 ES5 语法，并提供标准的 PAC 函数
+package pac
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robertkrimen/otto"
+)
+
+// 单次执行的默认超时时间，避免脚本中的死循环阻塞请求
+const defaultTimeout = time.Second
+
+// 函数调用的最大嵌套层数，避免无限递归耗尽内存
+const stackDepthLimit = 1000
+
+var errTimeout = errors.New("pac script timeout")
+
+// 解析后的 PAC 脚本，可并发调用 FindProxyForURL
+type Script struct {
+	// dnsResolve、isResolvable、isInNet 解析 host 时使用，为 nil 时使用 net.LookupIP
+	LookupIP func(host string) ([]net.IP, error)
+	// 当前时间，weekdayRange、timeRange 使用，为 nil 时使用 time.Now
+	Now func() time.Time
+	// alert 的输出，为 nil 时忽略
+	Alert func(msg string)
+	// 单次执行 FindProxyForURL 的超时时间，为 0 时为 1s
+	Timeout time.Duration
+
+	mu sync.Mutex // otto.Otto 不能并发使用，复制时加锁
+	vm *otto.Otto
+}
+
+// 解析脚本并执行顶层语句，脚本需定义 FindProxyForURL 函数
+func Parse(src string) (*Script, error) {
+	s := &Script{}
+	vm := otto.New()
+	vm.SetStackDepthLimit(stackDepthLimit)
+	for name, fn := range s.builtins() {
+		if err := vm.Set(name, fn); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := s.run(vm, func() (otto.Value, error) { return vm.Run(src) }); err != nil {
+		return nil, err
+	}
+	fn, err := vm.Get("FindProxyForURL")
+	if err != nil {
+		return nil, err
+	}
+	if !fn.IsFunction() {
+		return nil, errors.New("FindProxyForURL is not defined")
+	}
+	s.vm = vm
+	return s, nil
+}
+
+// 返回 PAC 的结果，如 "PROXY proxy:8080; DIRECT"
+func (s *Script) FindProxyForURL(url, host string) (string, error) {
+	// 每次调用使用运行时的副本，脚本修改全局变量不影响其他调用
+	s.mu.Lock()
+	vm := s.vm.Copy()
+	s.mu.Unlock()
+
+	v, err := s.run(vm, func() (otto.Value, error) {
+		return vm.Call("FindProxyForURL", nil, url, host)
+	})
+	if err != nil {
+		return "", err
+	}
+	if !v.IsString() {
+		return "", fmt.Errorf("FindProxyForURL returned %v, expected string", v.Class())
+	}
+	return v.String(), nil
+}
+
+// 超过 Timeout 时中断执行
+func (s *Script) run(vm *otto.Otto, fn func() (otto.Value, error)) (v otto.Value, err error) {
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	vm.Interrupt = make(chan func(), 1)
+	timer := time.AfterFunc(timeout, func() {
+		vm.Interrupt <- func() { panic(errTimeout) }
+	})
+	defer timer.Stop()
+	defer func() {
+		if caught := recover(); caught != nil {
+			if caught != errTimeout {
+				panic(caught)
+			}
+			err = errTimeout
+		}
+	}()
+	return fn()
+}
+
+func (s *Script) lookupIP(host string) net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip
+	}
+	lookup := s.LookupIP
+	if lookup == nil {
+		lookup = net.LookupIP
+	}
+	ips, err := lookup(host)
+	if err != nil || len(ips) == 0 {
+		return nil
+	}
+	// 与浏览器的实现相同，优先返回 ipv4
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip
+		}
+	}
+	return ips[0]
+}
+
+func (s *Script) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+// 脚本中调用时抛出 Error
+func throw(call otto.FunctionCall, msg string) {
+	panic(call.Otto.MakeCustomError("Error", msg))
+}
+
+func value(call otto.FunctionCall, v interface{}) otto.Value {
+	result, err := call.Otto.ToValue(v)
+	if err != nil {
+		throw(call, err.Error())
+	}
+	return result
+}
+
+func (s *Script) builtins() map[string]func(call otto.FunctionCall) otto.Value {
+	str := func(call otto.FunctionCall, i int) string {
+		return call.Argument(i).String()
+	}
+	return map[string]func(call otto.FunctionCall) otto.Value{
+		"isPlainHostName": func(call otto.FunctionCall) otto.Value {
+			return value(call, !strings.Contains(str(call, 0), "."))
+		},
+		"dnsDomainIs": func(call otto.FunctionCall) otto.Value {
+			return value(call, strings.HasSuffix(strings.ToLower(str(call, 0)), strings.ToLower(str(call, 1))))
+		},
+		"localHostOrDomainIs": func(call otto.FunctionCall) otto.Value {
+			host, hostdom := strings.ToLower(str(call, 0)), strings.ToLower(str(call, 1))
+			if host == hostdom {
+				return otto.TrueValue()
+			}
+			return value(call, !strings.Contains(host, ".") && strings.HasPrefix(hostdom, host+"."))
+		},
+		"isResolvable": func(call otto.FunctionCall) otto.Value {
+			return value(call, s.lookupIP(str(call, 0)) != nil)
+		},
+		"isInNet": func(call otto.FunctionCall) otto.Value {
+			ip := s.lookupIP(str(call, 0))
+			pattern := net.ParseIP(str(call, 1))
+			mask := net.ParseIP(str(call, 2))
+			if ip == nil || pattern == nil || mask == nil || ip.To4() == nil || pattern.To4() == nil || mask.To4() == nil {
+				return otto.FalseValue()
+			}
+			m := net.IPMask(mask.To4())
+			return value(call, ip.To4().Mask(m).Equal(pattern.To4().Mask(m)))
+		},
+		"dnsResolve": func(call otto.FunctionCall) otto.Value {
+			if ip := s.lookupIP(str(call, 0)); ip != nil {
+				return value(call, ip.String())
+			}
+			return otto.NullValue()
+		},
+		"convert_addr": func(call otto.FunctionCall) otto.Value {
+			ip := net.ParseIP(str(call, 0)).To4()
+			if ip == nil {
+				return value(call, 0)
+			}
+			return value(call, float64(uint32(ip[0])<<24|uint32(ip[1])<<16|uint32(ip[2])<<8|uint32(ip[3])))
+		},
+		"myIpAddress": func(call otto.FunctionCall) otto.Value {
+			return value(call, myIpAddress())
+		},
+		"dnsDomainLevels": func(call otto.FunctionCall) otto.Value {
+			return value(call, strings.Count(str(call, 0), "."))
+		},
+		"shExpMatch": func(call otto.FunctionCall) otto.Value {
+			re, err := shExpRegexp(str(call, 1))
+			if err != nil {
+				throw(call, err.Error())
+			}
+			return value(call, re.MatchString(str(call, 0)))
+		},
+		"weekdayRange": func(call otto.FunctionCall) otto.Value {
+			result, err := s.weekdayRange(call.ArgumentList)
+			if err != nil {
+				throw(call, err.Error())
+			}
+			return value(call, result)
+		},
+		"timeRange": func(call otto.FunctionCall) otto.Value {
+			result, err := s.timeRange(call.ArgumentList)
+			if err != nil {
+				throw(call, err.Error())
+			}
+			return value(call, result)
+		},
+		"dateRange": func(call otto.FunctionCall) otto.Value {
+			throw(call, "dateRange not supported")
+			return otto.UndefinedValue()
+		},
+		"alert": func(call otto.FunctionCall) otto.Value {
+			if s.Alert != nil {
+				s.Alert(str(call, 0))
+			}
+			return otto.UndefinedValue()
+		},
+	}
+}
+
+// 首个非 loopback 的 ipv4 地址
+func myIpAddress() string {
+	addrs, err := net.InterfaceAddrs()
+	if err == nil {
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+				return ipnet.IP.String()
+			}
+		}
+	}
+	return "127.0.0.1"
+}
+
+var shExpCache sync.Map // pattern => *regexp.Regexp
+
+// shell 风格的通配符: * 匹配任意字符，? 匹配单个字符
+func shExpRegexp(pattern string) (*regexp.Regexp, error) {
+	if re, ok := shExpCache.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	var b strings.Builder
+	b.WriteString("^")
+	for _, c := range pattern {
+		switch c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, err
+	}
+	shExpCache.Store(pattern, re)
+	return re, nil
+}
+
+var weekdays = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+
+// 最后一个参数为 "GMT" 时使用 UTC
+func (s *Script) timeArgs(args []otto.Value) (time.Time, []otto.Value) {
+	now := s.now()
+	if n := len(args); n > 0 {
+		if last := args[n-1]; last.IsString() && strings.EqualFold(last.String(), "GMT") {
+			return now.UTC(), args[:n-1]
+		}
+	}
+	return now.Local(), args
+}
+
+// weekdayRange(wd1 [, wd2] [, "GMT"])
+func (s *Script) weekdayRange(args []otto.Value) (bool, error) {
+	now, args := s.timeArgs(args)
+	if len(args) == 0 || len(args) > 2 {
+		return false, errors.New("invalid arguments")
+	}
+	days := make([]int, len(args))
+	for i, a := range args {
+		days[i] = -1
+		for d, name := range weekdays {
+			if strings.EqualFold(a.String(), name) {
+				days[i] = d
+			}
+		}
+		if days[i] < 0 {
+			return false, fmt.Errorf("invalid weekday %v", a.String())
+		}
+	}
+	today := int(now.Weekday())
+	if len(days) == 1 {
+		return today == days[0], nil
+	}
+	return inRange(today, days[0], days[1]), nil
+}
+
+// timeRange(hour)、timeRange(h1, h2)、timeRange(h1, m1, h2, m2)、timeRange(h1, m1, s1, h2, m2, s2)，均可附加 "GMT"
+func (s *Script) timeRange(args []otto.Value) (bool, error) {
+	now, args := s.timeArgs(args)
+	nums := make([]int, len(args))
+	for i, a := range args {
+		f, err := a.ToFloat()
+		if err != nil || math.IsNaN(f) {
+			return false, fmt.Errorf("invalid argument %v", a.String())
+		}
+		nums[i] = int(f)
+	}
+	sec := now.Hour()*3600 + now.Minute()*60 + now.Second()
+	switch len(nums) {
+	case 1:
+		return now.Hour() == nums[0], nil
+	case 2:
+		// 不包含结束的小时，如 timeRange(8, 18) 为 8:00 至 17:59
+		if nums[0] == nums[1] {
+			return now.Hour() == nums[0], nil
+		}
+		return inRange(now.Hour(), nums[0], (nums[1]+23)%24), nil
+	case 4:
+		return inRange(sec, nums[0]*3600+nums[1]*60, nums[2]*3600+nums[3]*60+59), nil
+	case 6:
+		return inRange(sec, nums[0]*3600+nums[1]*60+nums[2], nums[3]*3600+nums[4]*60+nums[5]), nil
+	}
+	return false, errors.New("invalid arguments")
+}
+
+// 包含两端，start > end 时跨越边界，如 FRI 至 MON
+func inRange(v, start, end int) bool {
+	if start <= end {
+		return v >= start && v <= end
+	}
+	return v >= start || v <= end
+}
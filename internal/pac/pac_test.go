@@ -0,0 +1,197 @@
+package pac
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const corpPac = `
+/* corporate proxy config */
+var proxy = "PROXY proxy.corp.example.com:8080; DIRECT";
+var bypass = ["*.internal.example.com", "intranet", "*.local"];
+
+function isBypassed(host) {
+	for (var i = 0; i < bypass.length; i++) {
+		if (shExpMatch(host, bypass[i])) return true;
+	}
+	return false;
+}
+
+function FindProxyForURL(url, host) {
+	host = host.toLowerCase();
+	if (isPlainHostName(host) || isBypassed(host))
+		return "DIRECT";
+	if (isInNet(dnsResolve(host), "10.0.0.0", "255.0.0.0") ||
+		isInNet(host, "192.168.0.0", "255.255.0.0")) {
+		return "DIRECT";
+	}
+	if (url.substring(0, 6) == "https:" && dnsDomainIs(host, ".secure.example.com"))
+		return 'HTTPS secure-proxy.example.com:443';
+	else if (localHostOrDomainIs(host, "socks.example.com"))
+		return "SOCKS5 127.0.0.1:1080";
+	var level = dnsDomainLevels(host) > 2 ? "deep" : "shallow"
+	if (level === "deep") return "PROXY deep.example.com:3128"
+	return proxy;
+}
+`
+
+func newTestScript(t *testing.T, src string) *Script {
+	t.Helper()
+	s, err := Parse(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.LookupIP = func(host string) ([]net.IP, error) {
+		switch host {
+		case "db.example.com":
+			return []net.IP{net.ParseIP("::1"), net.ParseIP("10.1.2.3")}, nil
+		case "www.example.com":
+			return []net.IP{net.ParseIP("93.184.216.34")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	return s
+}
+
+func TestFindProxyForURL(t *testing.T) {
+	s := newTestScript(t, corpPac)
+	cases := []struct {
+		url, host, expected string
+	}{
+		{"http://intranet/", "intranet", "DIRECT"},
+		{"http://a.internal.example.com/", "a.internal.example.com", "DIRECT"},
+		{"http://Printer.Local/", "Printer.Local", "DIRECT"},
+		{"http://db.example.com/", "db.example.com", "DIRECT"},
+		{"http://192.168.1.1/", "192.168.1.1", "DIRECT"},
+		{"https://a.secure.example.com/", "a.secure.example.com", "HTTPS secure-proxy.example.com:443"},
+		{"http://a.secure.example.com/", "a.secure.example.com", "PROXY deep.example.com:3128"},
+		{"https://socks/", "socks", "DIRECT"},
+		{"http://socks.example.com/", "socks.example.com", "SOCKS5 127.0.0.1:1080"},
+		{"http://www.example.com/", "www.example.com", "PROXY proxy.corp.example.com:8080; DIRECT"},
+		{"http://unknown.example.com/", "unknown.example.com", "PROXY proxy.corp.example.com:8080; DIRECT"},
+	}
+	for _, c := range cases {
+		got, err := s.FindProxyForURL(c.url, c.host)
+		if err != nil {
+			t.Fatalf("%v: %v", c.url, err)
+		}
+		if got != c.expected {
+			t.Fatalf("%v: expected %q, but got %q", c.url, c.expected, got)
+		}
+	}
+}
+
+func TestScriptSemantics(t *testing.T) {
+	cases := []struct {
+		body     string
+		expected string
+	}{
+		{`return "a" + 1 + 2;`, "a12"},
+		{`return 1 + 2 + "a";`, "3a"},
+		{`return typeof undefinedVar;`, "undefined"},
+		{`return (1 == "1") + "," + (1 === "1") + "," + (null == undefined) + "," + (0 == false);`, "true,false,true,true"},
+		{`var s = ""; var i = 0; while (true) { i++; if (i % 2) continue; if (i > 6) break; s += i; } return s;`, "246"},
+		{`var a = [1, 2]; a.push(3); a[4] = 5; return a.join("-") + ":" + a.length;`, "1-2-3--5:5"},
+		{`return "www.example.com".split(".")[1].toUpperCase();`, "EXAMPLE"},
+		{`return "example.com".substr(-3) + "example.com".slice(0, 3) + "abc".charAt(1);`, "comexab"},
+		{`var f = function (n) { return n <= 1 ? 1 : n * f(n - 1); }; return "" + f(5);`, "120"},
+		{`return "" + convert_addr("10.0.0.1") + "," + (0x10 + 1e1);`, "167772161,26"},
+		{`return url.indexOf("://") >= 0 && host.length > 3 ? "y" : "n";`, "y"},
+		// 企业 PAC 文件中常见的对象、正则、switch、try 及 new
+		{`var m = {"example.com": "PROXY a:1"}; return m[host] || "DIRECT";`, "PROXY a:1"},
+		{`return /^exa.*\.com$/i.test(host) ? host.replace(/\./g, "_") : "";`, "example_com"},
+		{`switch (host) { case "other": return "a"; case "example.com": return "b"; default: return "c"; }`, "b"},
+		{`try { undefinedFn(); } catch (e) { return "caught " + e.name; }`, "caught ReferenceError"},
+		{`var d = new Date(0); return typeof d.getTime() + new Array(3).length;`, "number3"},
+	}
+	for _, c := range cases {
+		src := "function FindProxyForURL(url, host) {\n" + c.body + "\n}"
+		s := newTestScript(t, src)
+		got, err := s.FindProxyForURL("http://example.com/", "example.com")
+		if err != nil {
+			t.Fatalf("%v: %v", c.body, err)
+		}
+		if got != c.expected {
+			t.Fatalf("%v: expected %q, but got %q", c.body, c.expected, got)
+		}
+	}
+}
+
+func TestScriptErrors(t *testing.T) {
+	for _, src := range []string{
+		`function FindProxyForURL(url, host) { return "DIRECT"`,
+		`var x = "unterminated;`,
+		`function other() {}`,
+	} {
+		if _, err := Parse(src); err == nil {
+			t.Fatalf("expected parse error for %v", src)
+		}
+	}
+
+	for _, body := range []string{
+		`while (true) {}`,
+		`function f() { return f(); } return f();`,
+		`return 1;`,
+		`return dateRange("JAN");`,
+	} {
+		s := newTestScript(t, "function FindProxyForURL(url, host) {\n"+body+"\n}")
+		if _, err := s.FindProxyForURL("http://example.com/", "example.com"); err == nil {
+			t.Fatalf("expected runtime error for %v", body)
+		}
+	}
+}
+
+func TestTimeFunctions(t *testing.T) {
+	// 2024-01-05 为星期五
+	now := time.Date(2024, 1, 5, 17, 30, 0, 0, time.UTC)
+	cases := map[string]bool{
+		`weekdayRange("FRI", "GMT")`:             true,
+		`weekdayRange("MON", "THU", "GMT")`:      false,
+		`weekdayRange("THU", "MON", "GMT")`:      true,
+		`timeRange(17, "GMT")`:                   true,
+		`timeRange(8, 17, "GMT")`:                false,
+		`timeRange(8, 18, "GMT")`:                true,
+		`timeRange(22, 6, "GMT")`:                false,
+		`timeRange(17, 0, 17, 29, "GMT")`:        false,
+		`timeRange(17, 30, 0, 17, 30, 0, "GMT")`: true,
+	}
+	for call, expected := range cases {
+		s := newTestScript(t, "function FindProxyForURL(url, host) { return "+call+" ? \"yes\" : \"no\"; }")
+		s.Now = func() time.Time { return now }
+		got, err := s.FindProxyForURL("http://example.com/", "example.com")
+		if err != nil {
+			t.Fatalf("%v: %v", call, err)
+		}
+		if (got == "yes") != expected {
+			t.Fatalf("%v: expected %v", call, expected)
+		}
+	}
+}
+
+// 脚本修改全局变量不影响并发的调用
+func TestScriptConcurrent(t *testing.T) {
+	s := newTestScript(t, `
+var count = 0;
+var seen = [];
+function record(host) { count++; seen.push(host); return count; }
+function FindProxyForURL(url, host) {
+	record(host);
+	return "PROXY " + host + ":" + count + ":" + seen.length;
+}`)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := s.FindProxyForURL("http://example.com/", "example.com")
+			if err != nil || !strings.HasSuffix(got, ":1:1") {
+				t.Errorf("unexpected result %q %v", got, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
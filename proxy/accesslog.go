@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Options.AccessLog: 每个 flow 结束时记录一行访问日志，字段固定，便于接入日志系统:
+//
+//	flow、conn、method、host、url、status、req_bytes、res_bytes、duration_ms，出错时另有 error
+//
+// status 为返回给客户端的状态码，CONNECT 成功时为 200，客户端断开等未响应时为 0
+// 出错的 flow 记录为 warn 级别，其余为 info 级别
+// 访问日志使用单独的 logger，Options.AccessLogFormat、Options.AccessLogLevel 均为空时使用 logrus 的全局 logger
+// 设置任一项时输出至 stderr，不修改全局 logger 的设置，proxy 的其他日志仍使用全局 logger
+
+const (
+	AccessLogFormatText = "text"
+	AccessLogFormatJSON = "json"
+)
+
+func newAccessLogger(format, level string) (*log.Logger, error) {
+	if format == "" && level == "" {
+		return log.StandardLogger(), nil
+	}
+	logger := log.New()
+	switch format {
+	case "", AccessLogFormatText:
+		logger.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	case AccessLogFormatJSON:
+		logger.SetFormatter(&log.JSONFormatter{})
+	default:
+		return nil, fmt.Errorf("invalid log format %v, should be text or json", format)
+	}
+	if level != "" {
+		lvl, err := log.ParseLevel(level)
+		if err != nil {
+			return nil, err
+		}
+		logger.SetLevel(lvl)
+	}
+	return logger, nil
+}
+
+// 访问日志的 logger，见 Options.AccessLogFormat、Options.AccessLogLevel
+func (proxy *Proxy) AccessLogger() *log.Logger {
+	return proxy.accessLogger
+}
+
+func (proxy *Proxy) shouldLogAccess(f *Flow) bool {
+	if !proxy.Opts.AccessLog {
+		return false
+	}
+	if proxy.accessLogIgnoreHosts.match(f.Request.URL.Host) {
+		return false
+	}
+	if filter := proxy.Opts.AccessLogFilter; filter != nil && !filter(f) {
+		return false
+	}
+	return true
+}
+
+func (proxy *Proxy) logAccess(f *Flow) {
+	if !proxy.shouldLogAccess(f) {
+		return
+	}
+	status := f.StatusCode()
+	fields := log.Fields{
+		"flow":        f.Id.String(),
+		"method":      f.Request.Method,
+		"host":        f.Request.URL.Host,
+		"url":         f.Request.URL.String(),
+		"status":      status,
+		"req_bytes":   f.Stats.RequestBytes,
+		"res_bytes":   f.Stats.ResponseBytes,
+		"duration_ms": float64(time.Since(f.Stats.Start)) / float64(time.Millisecond),
+	}
+	if f.Request.Method == "CONNECT" {
+		fields["url"] = f.Request.URL.Host
+	}
+	if f.ConnContext != nil {
+		fields["conn"] = f.ConnContext.Id().String()
+	}
+	entry := proxy.accessLogger.WithFields(fields)
+	if f.Err != nil {
+		entry.WithField("error", f.Err.Error()).Warn("access")
+		return
+	}
+	if status == 0 || status >= 500 {
+		entry.Warn("access")
+		return
+	}
+	entry.Info("access")
+}
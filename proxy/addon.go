@@ -30,20 +30,57 @@ type Addon interface {
 	// The full HTTP request has been read.
 	Request(*Flow)
 
+	// A 1xx informational response (e.g. 103 Early Hints) has been received from the server, it will be forwarded to the client.
+	Informational(f *Flow, statusCode int, header http.Header)
+
 	// HTTP response headers were successfully read. At this point, the body is empty.
 	Responseheaders(*Flow)
 
-	// The full HTTP response has been read.
+	// The full HTTP response has been read, or an addon has set f.Response in Requestheaders or Request,
+	// or f.Response is the error response after requesting the server failed (f.Err is set).
 	Response(*Flow)
 
+	// The flow is completely finished: the response body has been written to the client (including f.Stream flows),
+	// or the CONNECT tunnel / websocket connection has closed. Never called before Response, f.Done() is already closed.
+	FlowDone(*Flow)
+
+	// The flow failed, e.g. the client disconnected while uploading the request body (*ClientAbortError).
+	// When requesting the server or reading the response body fails, Error, ServerError and Response are called in this order, f.Err holds the error.
+	Error(f *Flow, err error)
+
+	// Requesting the server or reading the response body failed, return a response (e.g. a custom error page) to send to the client.
+	// The first non-nil response is used, a zero StatusCode defaults to 502 (504 on ErrUpstreamTimeout). If all return nil, the client gets a proxy-generated 502/504.
+	ServerError(f *Flow, err error) *Response
+
+	// The WebSocket upgrade (101) of an intercepted ws / wss connection has been forwarded to the client, messages will follow.
+	WebSocketStart(*Flow)
+
+	// A complete WebSocket message (continuation frames reassembled) has been received. Modify msg.Payload to change the forwarded data, or call msg.Drop() to drop it.
+	// Only for intercepted ws / wss connections, called concurrently for the two directions. Control frames are passed only if the addon implements WebSocketControlAddon.
+	// Frames sent to the server are masked again after the addons return.
+	WebSocketMessage(f *Flow, msg *WebSocketMessage)
+
+	// Both directions of the WebSocket connection have closed, called before FlowDone.
+	WebSocketEnd(*Flow)
+
+	// A complete gRPC message (5-byte length-prefixed frame) has been read from the request or response body while forwarding.
+	// Each message of a streaming RPC fires separately, the two directions may be called concurrently. msg is read-only.
+	GrpcMessage(f *Flow, isFromClient bool, msg *GrpcMessage)
+
 	// Stream request body modifier
 	StreamRequestModifier(*Flow, io.Reader) io.Reader
 
-	// Stream response body modifier
+	// Stream response body modifier, in is nil when the body has been read into Response.Body.
+	// A non-nil reader returned for such a flow is sent instead of Response.Body.
+	// If the returned reader fails, Error is called with the error (or the *AbortError if it called f.AbortWithError) and the client connection is aborted.
 	StreamResponseModifier(*Flow, io.Reader) io.Reader
 
 	// onAccessProxyServer
 	AccessProxyServer(req *http.Request, res http.ResponseWriter)
+
+	// An intercepted CONNECT tunnel carries a non-TLS stream (e.g. mqtt, a database protocol), f is the CONNECT flow. Plain ws goes to the WebSocket events instead.
+	// Bytes read from client have not been sent to server. After all addons return, the proxy copies the remaining bytes in both directions.
+	TcpStream(f *Flow, client, server io.ReadWriter)
 }
 
 // BaseAddon do nothing
@@ -56,10 +93,21 @@ func (addon *BaseAddon) ServerDisconnected(*ConnContext) {}
 
 func (addon *BaseAddon) TlsEstablishedServer(*ConnContext) {}
 
-func (addon *BaseAddon) Requestheaders(*Flow)  {}
-func (addon *BaseAddon) Request(*Flow)         {}
-func (addon *BaseAddon) Responseheaders(*Flow) {}
-func (addon *BaseAddon) Response(*Flow)        {}
+func (addon *BaseAddon) Requestheaders(*Flow)                  {}
+func (addon *BaseAddon) Request(*Flow)                         {}
+func (addon *BaseAddon) Informational(*Flow, int, http.Header) {}
+func (addon *BaseAddon) Responseheaders(*Flow)                 {}
+func (addon *BaseAddon) Response(*Flow)                        {}
+func (addon *BaseAddon) FlowDone(*Flow)                        {}
+func (addon *BaseAddon) Error(*Flow, error)                    {}
+func (addon *BaseAddon) ServerError(*Flow, error) *Response {
+	return nil
+}
+func (addon *BaseAddon) WebSocketStart(*Flow)                            {}
+func (addon *BaseAddon) WebSocketMessage(f *Flow, msg *WebSocketMessage) {}
+func (addon *BaseAddon) WebSocketEnd(*Flow)                              {}
+
+func (addon *BaseAddon) GrpcMessage(f *Flow, isFromClient bool, msg *GrpcMessage) {}
 func (addon *BaseAddon) StreamRequestModifier(f *Flow, in io.Reader) io.Reader {
 	return in
 }
@@ -67,6 +115,8 @@ func (addon *BaseAddon) StreamResponseModifier(f *Flow, in io.Reader) io.Reader
 	return in
 }
 
+func (addon *BaseAddon) TcpStream(f *Flow, client, server io.ReadWriter) {}
+
 func (addon *BaseAddon) AccessProxyServer(req *http.Request, res http.ResponseWriter) {
 	res.WriteHeader(400)
 	io.WriteString(res, "此为代理服务器，不能直接发起请求")
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 每个 flow 中 addon 的总耗时预算，超出后跳过该阶段剩余的 addon 回调
+// header 阶段: Requestheaders、Responseheaders
+// body 阶段: Request、Response
+
+const (
+	addonPhaseHeader = iota
+	addonPhaseBody
+)
+
+func addonPhase(event string) (int, bool) {
+	switch event {
+	case "Requestheaders", "Responseheaders":
+		return addonPhaseHeader, true
+	case "Request", "Response":
+		return addonPhaseBody, true
+	}
+	return 0, false
+}
+
+func (proxy *Proxy) addonBudget(phase int) time.Duration {
+	if phase == addonPhaseHeader {
+		return proxy.Opts.AddonHeaderBudget
+	}
+	return proxy.Opts.AddonBodyBudget
+}
+
+// 预算已用完时返回 false
+func (proxy *Proxy) withinAddonBudget(f *Flow, addon Addon, event string) bool {
+	phase, ok := addonPhase(event)
+	if !ok {
+		return true
+	}
+	budget := proxy.addonBudget(phase)
+	if budget <= 0 || f.addonSpent[phase] < budget {
+		return true
+	}
+	if !f.addonBudgetWarned[phase] {
+		f.addonBudgetWarned[phase] = true
+		log.Warnf("flow %v addon time budget %v exceeded (spent %v), skip remaining %v callbacks", f.Id, budget, f.addonSpent[phase], event)
+	}
+	log.Debugf("addon budget exceeded, skip %T %v", addon, event)
+	return false
+}
+
+func (proxy *Proxy) spendAddonBudget(f *Flow, event string, d time.Duration) {
+	if phase, ok := addonPhase(event); ok {
+		f.addonSpent[phase] += d
+	}
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 每个 addon 事件的调用耗时统计，仅当 Options.AddonStats 为 true 时记录
+
+type AddonStat struct {
+	Addon  string // addon 类型，如 *addon.MapRemote
+	Event  string // 事件名，如 Request
+	Calls  int64
+	Errors int64 // 调用时 panic 的次数
+	Total  time.Duration
+	Max    time.Duration
+}
+
+func (s *AddonStat) Avg() time.Duration {
+	if s.Calls == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(s.Calls)
+}
+
+// 以 addon 类型区分，同一类型的多个 addon 合并统计
+type addonStatKey struct {
+	addon string
+	event string
+}
+
+type addonStats struct {
+	mu    sync.Mutex
+	stats map[addonStatKey]*AddonStat
+}
+
+func (as *addonStats) record(addon Addon, event string, d time.Duration, panicked bool) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	if as.stats == nil {
+		as.stats = make(map[addonStatKey]*AddonStat)
+	}
+	key := addonStatKey{addon: fmt.Sprintf("%T", addon), event: event}
+	stat, ok := as.stats[key]
+	if !ok {
+		stat = &AddonStat{Addon: key.addon, Event: event}
+		as.stats[key] = stat
+	}
+	stat.Calls++
+	stat.Total += d
+	if d > stat.Max {
+		stat.Max = d
+	}
+	if panicked {
+		stat.Errors++
+	}
+}
+
+// 调用 addon 事件，统一处理耗时预算、耗时统计及 dry run
+func (proxy *Proxy) invokeAddon(f *Flow, addon Addon, event string, fn func()) {
+	if !proxy.withinAddonBudget(f, addon, event) {
+		return
+	}
+
+	start := time.Now()
+	defer func() {
+		d := time.Since(start)
+		proxy.spendAddonBudget(f, event, d)
+		if proxy.Opts.AddonStats {
+			err := recover()
+			proxy.addonStats.record(addon, event, d, err != nil)
+			if err != nil {
+				panic(err)
+			}
+		}
+	}()
+
+	if proxy.dryRun(addon) && dryRunSnapshot(event) {
+		proxy.dryRunInvoke(f, addon, event, fn)
+		return
+	}
+	fn()
+}
+
+// 调用没有 flow 的 addon 事件，如 ClientConnected、ServerConnected、AccessProxyServer，仅记录耗时统计
+// 不计入 flow 的耗时预算，dry run 时照常调用
+func (proxy *Proxy) invokeConnAddon(addon Addon, event string, fn func()) {
+	if !proxy.Opts.AddonStats {
+		fn()
+		return
+	}
+	start := time.Now()
+	defer func() {
+		err := recover()
+		proxy.addonStats.record(addon, event, time.Since(start), err != nil)
+		if err != nil {
+			panic(err)
+		}
+	}()
+	fn()
+}
+
+// 按 addon 添加顺序及事件名排序
+func (proxy *Proxy) AddonStats() []AddonStat {
+	proxy.addonStats.mu.Lock()
+	defer proxy.addonStats.mu.Unlock()
+
+	order := make(map[string]int)
+	for i := len(proxy.Addons) - 1; i >= 0; i-- {
+		order[fmt.Sprintf("%T", proxy.Addons[i])] = i
+	}
+	keys := make([]addonStatKey, 0, len(proxy.addonStats.stats))
+	for key := range proxy.addonStats.stats {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if order[keys[i].addon] != order[keys[j].addon] {
+			return order[keys[i].addon] < order[keys[j].addon]
+		}
+		return keys[i].event < keys[j].event
+	})
+
+	stats := make([]AddonStat, 0, len(keys))
+	for _, key := range keys {
+		stats = append(stats, *proxy.addonStats.stats[key])
+	}
+	return stats
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/tidwall/match"
+)
+
+// Options.BlockHosts: 在拦截及连接上游前拒绝请求，CONNECT 隧道不会建立
+// 规则同 RoutingUpstream，支持精确匹配、通配符及以 . 开头的后缀
+
+type blockHosts []*upstreamRoute
+
+func newBlockHosts(patterns []string) blockHosts {
+	hosts := make(blockHosts, 0, len(patterns))
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		hosts = append(hosts, &upstreamRoute{
+			pattern: pattern,
+			exact:   !strings.HasPrefix(pattern, ".") && !match.IsPattern(pattern),
+		})
+	}
+	return hosts
+}
+
+// host 可包含端口
+func (hosts blockHosts) match(host string) bool {
+	if len(hosts) == 0 {
+		return false
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	for _, route := range hosts {
+		if route.match(host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (proxy *Proxy) blockStatus() int {
+	if proxy.Opts.BlockStatus > 0 {
+		return proxy.Opts.BlockStatus
+	}
+	return http.StatusForbidden
+}
+
+// 响应 Options.BlockStatus 及 Options.BlockBody
+func (proxy *Proxy) replyBlocked(res http.ResponseWriter) {
+	if len(proxy.Opts.BlockBody) > 0 && res.Header().Get("Content-Type") == "" {
+		res.Header().Set("Content-Type", http.DetectContentType(proxy.Opts.BlockBody))
+	}
+	res.WriteHeader(proxy.blockStatus())
+	if len(proxy.Opts.BlockBody) > 0 {
+		res.Write(proxy.Opts.BlockBody)
+	}
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// 解析及重新编码 206 multipart/byteranges 响应
+// https://www.rfc-editor.org/rfc/rfc9110#name-media-type-multipart-byteran
+
+// 响应的 Content-Type 不是 multipart/byteranges 或缺少 boundary
+var ErrNotByteRanges = errors.New("not multipart/byteranges response")
+
+// multipart/byteranges 响应中的一个分段
+type RangePart struct {
+	Header http.Header // 分段的 header，如 Content-Type，不包含 Content-Range
+	Start  int64       // Content-Range 的起始位置
+	End    int64       // Content-Range 的结束位置，包含此位置
+	Size   int64       // 资源的总大小，未知（*）时为 -1
+	Body   []byte
+}
+
+func (p *RangePart) contentRange() string {
+	size := "*"
+	if p.Size >= 0 {
+		size = strconv.FormatInt(p.Size, 10)
+	}
+	return fmt.Sprintf("bytes %d-%d/%s", p.Start, p.End, size)
+}
+
+// 如 bytes 0-99/1000、bytes 0-99/*
+func parseContentRange(value string) (start, end, size int64, err error) {
+	errMalformed := fmt.Errorf("malformed Content-Range %q", value)
+	spec := strings.TrimSpace(value)
+	if !strings.HasPrefix(spec, "bytes ") {
+		return 0, 0, 0, errMalformed
+	}
+	spec = strings.TrimSpace(strings.TrimPrefix(spec, "bytes "))
+	rng, total, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, 0, errMalformed
+	}
+	first, last, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, 0, 0, errMalformed
+	}
+	if start, err = strconv.ParseInt(first, 10, 64); err != nil || start < 0 {
+		return 0, 0, 0, errMalformed
+	}
+	if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+		return 0, 0, 0, errMalformed
+	}
+	size = -1
+	if total != "*" {
+		if size, err = strconv.ParseInt(total, 10, 64); err != nil || size <= end {
+			return 0, 0, 0, errMalformed
+		}
+	}
+	return start, end, size, nil
+}
+
+func (r *Response) byteRangesBoundary() (string, error) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" || params["boundary"] == "" {
+		return "", ErrNotByteRanges
+	}
+	return params["boundary"], nil
+}
+
+// 解析 multipart/byteranges 响应的各个分段，body 经过 Content-Encoding 压缩时先解压
+func (r *Response) ByteRanges() ([]RangePart, error) {
+	boundary, err := r.byteRangesBoundary()
+	if err != nil {
+		return nil, err
+	}
+	body, err := r.DecodedBody()
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make([]RangePart, 0)
+	mr := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		// NextRawPart 不处理分段的 Content-Transfer-Encoding，保持原始内容
+		p, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(p)
+		if err != nil {
+			return nil, err
+		}
+
+		header := http.Header(p.Header)
+		start, end, size, err := parseContentRange(header.Get("Content-Range"))
+		if err != nil {
+			return nil, err
+		}
+		header.Del("Content-Range")
+		parts = append(parts, RangePart{
+			Header: header,
+			Start:  start,
+			End:    end,
+			Size:   size,
+			Body:   data,
+		})
+	}
+	return parts, nil
+}
+
+// 使用原有的 boundary 将 parts 重新编码为响应 body，各分段的 Content-Range 由 Start、End、Size 生成
+// 修改分段的 Body 长度时需同时修改 End
+func (r *Response) SetByteRanges(parts []RangePart) error {
+	boundary, err := r.byteRangesBoundary()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	if err := mw.SetBoundary(boundary); err != nil {
+		return err
+	}
+	for i := range parts {
+		p := &parts[i]
+		header := make(textproto.MIMEHeader)
+		for key, values := range p.Header {
+			header[key] = append([]string(nil), values...)
+		}
+		header.Set("Content-Range", p.contentRange())
+		w, err := mw.CreatePart(header)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(p.Body); err != nil {
+			return err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	r.Body = buf.Bytes()
+	r.Header.Del("Content-Encoding")
+	r.Header.Set("Content-Length", strconv.Itoa(len(r.Body)))
+	r.Header.Del("Transfer-Encoding")
+	r.decodedBody = nil
+	r.decoded = false
+	r.decodedErr = nil
+	return nil
+}
@@ -0,0 +1,237 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 记录 chunked transfer-encoding 的原始分块信息，用于协议层面的调试
+// 标准库会隐藏 chunk 大小及 chunk-extension，因此需要在连接层面记录原始字节后解析
+
+// chunked response 中的一个分块
+type Chunk struct {
+	Size       int64  `json:"size"`
+	Extensions string `json:"extensions"` // 原始 chunk-extension，不包含开头的 ';'
+}
+
+var errChunkMalformed = errors.New("malformed chunked encoding")
+
+// 记录连接读取到的原始字节
+type recordConn struct {
+	net.Conn
+	serverConn *ServerConn
+}
+
+func (c *recordConn) Read(data []byte) (int, error) {
+	n, err := c.Conn.Read(data)
+	if n > 0 {
+		c.serverConn.record(data[:n])
+	}
+	return n, err
+}
+
+// 边读取边解析，不保留原始字节，stream 模式的大响应不会占用额外内存
+type rawRecorder struct {
+	recording int32 // 未记录时 recordConn.Read 无需加锁
+	mu        sync.Mutex
+	parser    *chunkParser
+}
+
+func (c *ServerConn) startRecord() {
+	c.recorder.mu.Lock()
+	defer c.recorder.mu.Unlock()
+	c.recorder.parser = new(chunkParser)
+	atomic.StoreInt32(&c.recorder.recording, 1)
+}
+
+func (c *ServerConn) stopRecord() ([]*Chunk, error) {
+	c.recorder.mu.Lock()
+	defer c.recorder.mu.Unlock()
+	atomic.StoreInt32(&c.recorder.recording, 0)
+	parser := c.recorder.parser
+	c.recorder.parser = nil
+	if parser == nil {
+		return nil, nil
+	}
+	return parser.result()
+}
+
+func (c *ServerConn) record(data []byte) {
+	if atomic.LoadInt32(&c.recorder.recording) == 0 {
+		return
+	}
+	c.recorder.mu.Lock()
+	defer c.recorder.mu.Unlock()
+	if c.recorder.parser != nil {
+		c.recorder.parser.write(data)
+	}
+}
+
+const maxChunkLineSize = 64 * 1024
+
+const (
+	chunkStateHead = iota
+	chunkStateSize
+	chunkStateData
+	chunkStateDataEnd
+	chunkStateTrailer
+	chunkStateDone
+)
+
+// 解析原始 http response 字节中的 chunked body，跳过 1xx 的中间响应，last-chunk 之后的 trailer 由标准库解析
+type chunkParser struct {
+	state     int
+	line      []byte
+	status    int   // 当前 head 的状态码
+	remaining int64 // 当前 chunk 剩余的数据字节数，chunkStateDataEnd 时为剩余的 CRLF 字节数
+	chunks    []*Chunk
+	err       error
+}
+
+func (p *chunkParser) write(data []byte) {
+	for len(data) > 0 && p.err == nil && p.state != chunkStateDone {
+		switch p.state {
+		case chunkStateData:
+			n := int64(len(data))
+			if n > p.remaining {
+				n = p.remaining
+			}
+			p.remaining -= n
+			data = data[n:]
+			if p.remaining == 0 {
+				p.state = chunkStateDataEnd
+				p.remaining = 2
+			}
+		case chunkStateDataEnd:
+			if (p.remaining == 2 && data[0] != '\r') || (p.remaining == 1 && data[0] != '\n') {
+				p.err = errChunkMalformed
+				return
+			}
+			data = data[1:]
+			p.remaining--
+			if p.remaining == 0 {
+				p.state = chunkStateSize
+			}
+		default:
+			index := bytes.IndexByte(data, '\n')
+			if index == -1 {
+				p.line = append(p.line, data...)
+				data = nil
+			} else {
+				p.line = append(p.line, data[:index]...)
+				data = data[index+1:]
+			}
+			if len(p.line) > maxChunkLineSize {
+				p.err = errChunkMalformed
+				return
+			}
+			if index != -1 {
+				line := strings.TrimRight(string(p.line), "\r")
+				p.line = p.line[:0]
+				p.parseLine(line)
+			}
+		}
+	}
+}
+
+func (p *chunkParser) parseLine(line string) {
+	switch p.state {
+	case chunkStateHead:
+		if p.status == 0 {
+			// status line: HTTP/1.1 200 OK
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				p.err = errChunkMalformed
+				return
+			}
+			status, err := strconv.Atoi(fields[1])
+			if err != nil {
+				p.err = errChunkMalformed
+				return
+			}
+			p.status = status
+			return
+		}
+		if line != "" {
+			return
+		}
+		// head 结束，1xx（101 除外）之后还有最终的响应
+		if p.status >= 100 && p.status <= 199 && p.status != http.StatusSwitchingProtocols {
+			p.status = 0
+			return
+		}
+		p.state = chunkStateSize
+	case chunkStateSize:
+		sizeStr, ext, _ := strings.Cut(line, ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeStr), 16, 64)
+		if err != nil || size < 0 {
+			p.err = errChunkMalformed
+			return
+		}
+		p.chunks = append(p.chunks, &Chunk{Size: size, Extensions: strings.TrimSpace(ext)})
+		if size == 0 {
+			p.state = chunkStateTrailer
+			return
+		}
+		p.state = chunkStateData
+		p.remaining = size
+	case chunkStateTrailer:
+		if line == "" {
+			p.state = chunkStateDone
+		}
+	}
+}
+
+// 未读取到 last-chunk 时返回已解析的 chunk 及 errChunkMalformed
+func (p *chunkParser) result() ([]*Chunk, error) {
+	if p.err == nil && p.state != chunkStateDone && p.state != chunkStateTrailer {
+		p.err = errChunkMalformed
+	}
+	if p.chunks == nil {
+		p.chunks = make([]*Chunk, 0)
+	}
+	return p.chunks, p.err
+}
+
+// 在 response body 读取完毕后调用，stream 模式时在 body 转发完成后调用
+func (f *Flow) captureChunks(serverConn *ServerConn, proxyRes *http.Response) {
+	f.Response.Trailer = proxyRes.Trailer
+	if serverConn == nil {
+		return
+	}
+	chunks, err := serverConn.stopRecord()
+	if len(proxyRes.TransferEncoding) == 0 || proxyRes.TransferEncoding[0] != "chunked" {
+		return
+	}
+	if err != nil {
+		log.Warnf("parse chunks error: %v\n", err)
+	}
+	f.Response.Chunks = chunks
+}
+
+// Options.ResponseFraming
+const (
+	FramingContentLength = "content-length" // 读取至 Response.Body 的响应（如上游为 chunked）以 Content-Length 发送，超过 StreamLargeBodies 的响应仍为 chunked
+	FramingChunked       = "chunked"        // 移除 Content-Length，http/1.1 客户端以 chunked 接收
+)
+
+// 1xx、204、304 不允许有 body
+func bodyAllowedForStatus(status int) bool {
+	switch {
+	case status >= 100 && status <= 199:
+		return false
+	case status == 204:
+		return false
+	case status == 304:
+		return false
+	}
+	return true
+}
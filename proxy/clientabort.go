@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// 客户端在上传 request body 时断开，此时上游请求已被取消
+// 通过 Addon.Error 通知
+type ClientAbortError struct {
+	BytesSent int64 // 断开前已从客户端读取的 body 字节数
+	Err       error
+}
+
+func (e *ClientAbortError) Error() string {
+	return fmt.Sprintf("client aborted after sending %v bytes of request body: %v", e.BytesSent, e.Err)
+}
+
+func (e *ClientAbortError) Unwrap() error {
+	return e.Err
+}
+
+// 包装客户端的 request body，读取出错时取消上游请求
+type clientBodyReader struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+
+	n   int64
+	mu  sync.Mutex
+	err error
+}
+
+func (r *clientBodyReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(&r.n, int64(n))
+	if err != nil && err != io.EOF {
+		r.mu.Lock()
+		if r.err == nil {
+			r.err = err
+		}
+		r.mu.Unlock()
+		r.cancel()
+	}
+	return n, err
+}
+
+// 客户端未中途断开时返回 nil
+func (r *clientBodyReader) abortErr() *ClientAbortError {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		return nil
+	}
+	return &ClientAbortError{
+		BytesSent: atomic.LoadInt64(&r.n),
+		Err:       r.err,
+	}
+}
+
+// 客户端断开时取消上游请求，clientGone 返回是否因此取消
+// 上游连接关闭时 wrapServerConn.Close 会关闭客户端连接的读取端，req.Context() 同样被取消，
+// 但此时客户端仍在等待响应（如重试或 502），不取消上游请求
+func withClientCancel(req *http.Request, connCtx *ConnContext) (ctx context.Context, cancel context.CancelFunc, clientGone func() bool) {
+	ctx, cancel = context.WithCancel(context.Background())
+	var gone int32
+	go func() {
+		select {
+		case <-req.Context().Done():
+			if atomic.LoadInt32(&connCtx.serverConnClosed) == 0 {
+				atomic.StoreInt32(&gone, 1)
+				cancel()
+			}
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel, func() bool {
+		return atomic.LoadInt32(&gone) == 1
+	}
+}
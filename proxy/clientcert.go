@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// 连接上游时提供客户端证书（mTLS）
+// 未拦截的 CONNECT 隧道中 tls 由客户端与服务器直接协商，客户端自身的证书原样透传
+
+// 请求上游时 context 中记录目标 host，用于 http.Transport 握手时选择客户端证书
+// new(struct{}) 的地址可能与 proxyReqCtxKey 相同，需使用单独的类型
+type upstreamHostCtxKeyType struct{}
+
+var upstreamHostCtxKey = upstreamHostCtxKeyType{}
+
+func loadClientCertificate(opts *Options) (*tls.Certificate, error) {
+	if opts.ClientCertFile == "" {
+		return nil, nil
+	}
+	keyFile := opts.ClientCertKeyFile
+	if keyFile == "" {
+		keyFile = opts.ClientCertFile
+	}
+	cert, err := tls.LoadX509KeyPair(opts.ClientCertFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+func (proxy *Proxy) hasClientCertificate() bool {
+	return proxy.clientCert != nil || proxy.Opts.GetClientCertificate != nil
+}
+
+// host 为空时表示未知，不调用 Options.GetClientCertificate
+func (proxy *Proxy) clientCertificate(host string, info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if proxy.Opts.GetClientCertificate != nil && host != "" {
+		cert, err := proxy.Opts.GetClientCertificate(host, info)
+		if err != nil || cert != nil {
+			return cert, err
+		}
+	}
+	if proxy.clientCert != nil {
+		return proxy.clientCert, nil
+	}
+	// 不提供证书
+	return new(tls.Certificate), nil
+}
+
+// host 已知时使用，如拦截的 https 连接
+func (proxy *Proxy) setClientCertificate(cfg *tls.Config, host string) {
+	if !proxy.hasClientCertificate() {
+		return
+	}
+	cfg.GetClientCertificate = func(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return proxy.clientCertificate(host, info)
+	}
+}
+
+// http.Transport 共用的配置，从握手的 context 中获取 host
+func (proxy *Proxy) setTransportClientCertificate(cfg *tls.Config) {
+	if !proxy.hasClientCertificate() {
+		return
+	}
+	cfg.GetClientCertificate = func(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		host, _ := info.Context().Value(upstreamHostCtxKey).(string)
+		return proxy.clientCertificate(host, info)
+	}
+}
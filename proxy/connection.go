@@ -7,22 +7,76 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/samber/lo"
 	uuid "github.com/satori/go.uuid"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/net/proxy"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// 协商的 tls 参数，proxy 未终止 tls（未拦截的 CONNECT、http 请求）时为零值
+type TlsInfo struct {
+	Version            uint16 // tls.VersionTLS12、tls.VersionTLS13 等
+	CipherSuite        uint16 // tls.TLS_AES_128_GCM_SHA256 等，名称可通过 tls.CipherSuiteName 获取
+	NegotiatedProtocol string // ALPN 协商结果，如 h2、http/1.1，未协商时为空
+	ServerName         string // SNI，客户端未发送时为空
+}
+
+func newTlsInfo(state tls.ConnectionState) TlsInfo {
+	return TlsInfo{
+		Version:            state.Version,
+		CipherSuite:        state.CipherSuite,
+		NegotiatedProtocol: state.NegotiatedProtocol,
+		ServerName:         state.ServerName,
+	}
+}
+
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+func (i TlsInfo) MarshalJSON() ([]byte, error) {
+	m := make(map[string]interface{})
+	if name, ok := tlsVersionNames[i.Version]; ok {
+		m["version"] = name
+	} else {
+		m["version"] = fmt.Sprintf("0x%04X", i.Version)
+	}
+	m["cipherSuite"] = tls.CipherSuiteName(i.CipherSuite)
+	m["alpn"] = i.NegotiatedProtocol
+	m["sni"] = i.ServerName
+	return json.Marshal(m)
+}
+
+// http.Transport 建立的上游连接的 tls 参数，recordConn 包装的连接取其底层连接
+func connTlsInfo(c net.Conn) TlsInfo {
+	if rc, ok := c.(*recordConn); ok {
+		c = rc.Conn
+	}
+	if tc, ok := c.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		return newTlsInfo(tc.ConnectionState())
+	}
+	return TlsInfo{}
+}
+
 // client connection
 type ClientConn struct {
 	Id           uuid.UUID
 	Conn         net.Conn
 	Tls          bool
-	UpstreamCert bool // Connect to upstream server to look up certificate details. Default: True
+	UpstreamCert bool    // Connect to upstream server to look up certificate details. Default: True
+	JA3          string  // JA3 fingerprint (md5) of the client's tls ClientHello, empty if not tls or not captured
+	OriginalDst  string  // 透明代理模式下连接的原始目标地址（ip:port），见 Options.Transparent
+	TlsInfo      TlsInfo // 客户端与 proxy 协商的 tls 参数，拦截的 https 连接握手完成后设置
 	clientHello  *tls.ClientHelloInfo
 }
 
@@ -39,6 +93,15 @@ func (c *ClientConn) MarshalJSON() ([]byte, error) {
 	m := make(map[string]interface{})
 	m["id"] = c.Id
 	m["tls"] = c.Tls
+	if c.JA3 != "" {
+		m["ja3"] = c.JA3
+	}
+	if c.OriginalDst != "" {
+		m["originalDst"] = c.OriginalDst
+	}
+	if c.TlsInfo.Version != 0 {
+		m["tlsInfo"] = c.TlsInfo
+	}
 	m["address"] = c.Conn.RemoteAddr().String()
 	return json.Marshal(m)
 }
@@ -48,12 +111,50 @@ type ServerConn struct {
 	Id      uuid.UUID
 	Address string
 	Conn    net.Conn
+	TlsInfo TlsInfo // 拦截的 https 连接 proxy 与上游握手时协商的 tls 参数，由 http.Transport 建立的上游连接不设置，每个 flow 实际使用的见 FlowStats.ServerTlsInfo
 
 	tlsHandshaked   chan struct{}
 	tlsHandshakeErr error
 	tlsConn         *tls.Conn
 	tlsState        *tls.ConnectionState
 	client          *http.Client
+	recorder        rawRecorder
+
+	addrMu     sync.Mutex
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	reused     bool
+}
+
+// 记录最近一次使用此 ServerConn 的请求的上游连接地址及是否复用
+// http2 时多个 stream 并发请求，每个 flow 实际使用的连接见 FlowStats.ServerRemoteAddr 等
+func (c *ServerConn) setAddr(local, remote net.Addr, reused bool) {
+	c.addrMu.Lock()
+	defer c.addrMu.Unlock()
+	c.localAddr = local
+	c.remoteAddr = remote
+	c.reused = reused
+}
+
+// 最近一次请求使用的上游连接的本地地址，可在 Addon.Response 中获取，尚未发起请求时为 nil
+func (c *ServerConn) LocalAddr() net.Addr {
+	c.addrMu.Lock()
+	defer c.addrMu.Unlock()
+	return c.localAddr
+}
+
+// 最近一次请求使用的上游连接的远端地址，经过上游代理时为代理地址
+func (c *ServerConn) RemoteAddr() net.Addr {
+	c.addrMu.Lock()
+	defer c.addrMu.Unlock()
+	return c.remoteAddr
+}
+
+// 最近一次请求是否复用了之前请求的上游连接，为 false 时新建了连接
+func (c *ServerConn) Reused() bool {
+	c.addrMu.Lock()
+	defer c.addrMu.Unlock()
+	return c.reused
 }
 
 func newServerConn() *ServerConn {
@@ -72,9 +173,24 @@ func (c *ServerConn) MarshalJSON() ([]byte, error) {
 		peername = c.Conn.RemoteAddr().String()
 	}
 	m["peername"] = peername
+	if local, remote := c.LocalAddr(), c.RemoteAddr(); local != nil && remote != nil {
+		m["localAddr"] = local.String()
+		m["remoteAddr"] = remote.String()
+	}
+	if c.TlsInfo.Version != 0 {
+		m["tlsInfo"] = c.TlsInfo
+	}
 	return json.Marshal(m)
 }
 
+// 协商为 h2 时 http.Transport 需要 *tls.Conn 才会使用 http2，此时不记录原始数据，Flow.CaptureChunks 不生效
+func (c *ServerConn) transportConn() net.Conn {
+	if c.tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+		return c.tlsConn
+	}
+	return &recordConn{Conn: c.tlsConn, serverConn: c}
+}
+
 func (c *ServerConn) TlsState() *tls.ConnectionState {
 	<-c.tlsHandshaked
 	return c.tlsState
@@ -92,7 +208,9 @@ type ConnContext struct {
 
 	proxy              *Proxy
 	pipeConn           *pipeConn
-	closeAfterResponse bool // after http response, http server will close the connection
+	closeAfterResponse bool              // after http response, http server will close the connection
+	loopback           http.RoundTripper // Proxy.RoundTrip 设置的内存上游
+	serverConnClosed   int32             // 上游连接已关闭，之后客户端连接的读取端随之关闭
 }
 
 func newConnContext(c net.Conn, proxy *Proxy) *ConnContext {
@@ -103,6 +221,7 @@ func newConnContext(c net.Conn, proxy *Proxy) *ConnContext {
 	}
 }
 
+// 客户端连接的 id，同一连接上的 flow 相同，proxy 的日志中记录为 conn 字段
 func (connCtx *ConnContext) Id() uuid.UUID {
 	return connCtx.ClientConn.Id
 }
@@ -116,35 +235,44 @@ func (connCtx *ConnContext) initHttpServerConn() {
 	}
 
 	serverConn := newServerConn()
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := connCtx.proxy.dialTarget(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		cw := &wrapServerConn{
+			Conn:    c,
+			proxy:   connCtx.proxy,
+			connCtx: connCtx,
+		}
+		serverConn.Conn = cw
+		serverConn.Address = addr
+		defer func() {
+			for _, addon := range connCtx.proxy.Addons {
+				connCtx.proxy.invokeConnAddon(addon, "ServerConnected", func() { addon.ServerConnected(connCtx) })
+			}
+		}()
+		return &recordConn{Conn: cw, serverConn: serverConn}, nil
+	}
 	serverConn.client = &http.Client{
-		Transport: &http.Transport{
-			Proxy: connCtx.proxy.realUpstreamProxy(),
-			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-				c, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+		Transport: newSocksTransport(&http.Transport{
+			Proxy:       connCtx.proxy.realUpstreamProxy(),
+			DialContext: dial,
+			// addon 将请求改为 https 时
+			DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				c, err := dial(ctx, network, addr)
 				if err != nil {
 					return nil, err
 				}
-				cw := &wrapServerConn{
-					Conn:    c,
-					proxy:   connCtx.proxy,
-					connCtx: connCtx,
-				}
-				serverConn.Conn = cw
-				serverConn.Address = addr
-				defer func() {
-					for _, addon := range connCtx.proxy.Addons {
-						addon.ServerConnected(connCtx)
-					}
-				}()
-				return cw, nil
-			},
-			ForceAttemptHTTP2:  false, // disable http2
-			DisableCompression: true,  // To get the original response from the server, set Transport.DisableCompression to true.
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: connCtx.proxy.Opts.SslInsecure,
-				KeyLogWriter:       getTlsKeyLogWriter(),
+				return connCtx.proxy.dialTlsUpstream(ctx, c, addr)
 			},
-		},
+			ForceAttemptHTTP2:   connCtx.proxy.Opts.EnableHTTP2,
+			DisableCompression:  true, // To get the original response from the server, set Transport.DisableCompression to true.
+			TLSClientConfig:     connCtx.proxy.newTlsClientConfig(),
+			MaxIdleConns:        connCtx.proxy.Opts.MaxIdleConns,
+			MaxIdleConnsPerHost: connCtx.proxy.Opts.MaxIdleConnsPerHost,
+			IdleConnTimeout:     connCtx.proxy.Opts.IdleConnTimeout,
+		}),
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			// 禁止自动重定向
 			return http.ErrUseLastResponse
@@ -170,7 +298,7 @@ func (connCtx *ConnContext) initServerTcpConn(req *http.Request) error {
 	}
 
 	for _, addon := range connCtx.proxy.Addons {
-		addon.ServerConnected(connCtx)
+		connCtx.proxy.invokeConnAddon(addon, "ServerConnected", func() { addon.ServerConnected(connCtx) })
 	}
 
 	return nil
@@ -186,10 +314,15 @@ func (connCtx *ConnContext) initHttpsServerConn() {
 			Transport: &http.Transport{
 				DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
 					<-connCtx.ServerConn.tlsHandshaked
-					return connCtx.ServerConn.tlsConn, connCtx.ServerConn.tlsHandshakeErr
+					if connCtx.ServerConn.tlsHandshakeErr != nil {
+						return nil, connCtx.ServerConn.tlsHandshakeErr
+					}
+					return connCtx.ServerConn.transportConn(), nil
 				},
-				ForceAttemptHTTP2:  false, // disable http2
-				DisableCompression: true,  // To get the original response from the server, set Transport.DisableCompression to true.
+				// 每次 dial 返回的是同一个 tls 连接，不能同时存在多个 http/1.1 连接读写
+				MaxConnsPerHost:    1,
+				ForceAttemptHTTP2:  connCtx.proxy.Opts.EnableHTTP2,
+				DisableCompression: true, // To get the original response from the server, set Transport.DisableCompression to true.
 			},
 			CheckRedirect: func(req *http.Request, via []*http.Request) error {
 				// 禁止自动重定向
@@ -199,10 +332,10 @@ func (connCtx *ConnContext) initHttpsServerConn() {
 	} else {
 		serverConn := newServerConn()
 		serverConn.client = &http.Client{
-			Transport: &http.Transport{
+			Transport: newSocksTransport(&http.Transport{
 				Proxy: connCtx.proxy.realUpstreamProxy(),
 				DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-					c, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+					c, err := connCtx.proxy.dialTarget(ctx, network, addr)
 					if err != nil {
 						return nil, err
 					}
@@ -215,26 +348,23 @@ func (connCtx *ConnContext) initHttpsServerConn() {
 					serverConn.Address = addr
 
 					for _, addon := range connCtx.proxy.Addons {
-						addon.ServerConnected(connCtx)
+						connCtx.proxy.invokeConnAddon(addon, "ServerConnected", func() { addon.ServerConnected(connCtx) })
 					}
 
-					if err := connCtx.tlsHandshake(connCtx.ClientConn.clientHello); err != nil {
+					if err := connCtx.tlsHandshake(ctx, connCtx.ClientConn.clientHello); err != nil {
 						return nil, err
 					}
 
 					for _, addon := range connCtx.proxy.Addons {
-						addon.TlsEstablishedServer(connCtx)
+						connCtx.proxy.invokeConnAddon(addon, "TlsEstablishedServer", func() { addon.TlsEstablishedServer(connCtx) })
 					}
 
-					return serverConn.tlsConn, nil
-				},
-				ForceAttemptHTTP2:  false, // disable http2
-				DisableCompression: true,  // To get the original response from the server, set Transport.DisableCompression to true.
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: connCtx.proxy.Opts.SslInsecure,
-					KeyLogWriter:       getTlsKeyLogWriter(),
+					return serverConn.transportConn(), nil
 				},
-			},
+				ForceAttemptHTTP2:  connCtx.proxy.Opts.EnableHTTP2,
+				DisableCompression: true, // To get the original response from the server, set Transport.DisableCompression to true.
+				TLSClientConfig:    connCtx.proxy.newTlsClientConfig(),
+			}),
 			CheckRedirect: func(req *http.Request, via []*http.Request) error {
 				// 禁止自动重定向
 				return http.ErrUseLastResponse
@@ -244,16 +374,26 @@ func (connCtx *ConnContext) initHttpsServerConn() {
 	}
 }
 
-func (connCtx *ConnContext) tlsHandshake(clientHello *tls.ClientHelloInfo) error {
+// ctx 结束时中断与上游的握手
+func (connCtx *ConnContext) tlsHandshake(ctx context.Context, clientHello *tls.ClientHelloInfo) error {
+	host := clientHello.ServerName
+	if host == "" {
+		host = connCtx.pipeConn.host
+	}
 	cfg := &tls.Config{
-		InsecureSkipVerify: connCtx.proxy.Opts.SslInsecure,
-		KeyLogWriter:       getTlsKeyLogWriter(),
+		InsecureSkipVerify: connCtx.proxy.insecureSkipVerify(host),
+		KeyLogWriter:       connCtx.proxy.keyLogWriter,
 		ServerName:         clientHello.ServerName,
-		NextProtos:         []string{"http/1.1"}, // todo: h2
+		NextProtos:         []string{"http/1.1"},
 		//NextProtos: []string{"http/1.1", "apns-security-v3", "apns-pack-v1"},
 		// CurvePreferences:   clientHello.SupportedCurves, // todo: 如果打开会出错
 		CipherSuites: clientHello.CipherSuites,
 	}
+	// 客户端支持时与上游协商 h2
+	if connCtx.proxy.Opts.EnableHTTP2 && lo.Contains(clientHello.SupportedProtos, "h2") {
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+	}
+	connCtx.proxy.setClientCertificate(cfg, host)
 	if len(clientHello.SupportedVersions) > 0 {
 		minVersion := clientHello.SupportedVersions[0]
 		maxVersion := clientHello.SupportedVersions[0]
@@ -270,7 +410,7 @@ func (connCtx *ConnContext) tlsHandshake(clientHello *tls.ClientHelloInfo) error
 	}
 
 	tlsConn := tls.Client(connCtx.ServerConn.Conn, cfg)
-	err := tlsConn.HandshakeContext(context.Background())
+	err := tlsConn.HandshakeContext(ctx)
 	if err != nil {
 		connCtx.ServerConn.tlsHandshakeErr = err
 		close(connCtx.ServerConn.tlsHandshaked)
@@ -280,6 +420,7 @@ func (connCtx *ConnContext) tlsHandshake(clientHello *tls.ClientHelloInfo) error
 	connCtx.ServerConn.tlsConn = tlsConn
 	tlsState := tlsConn.ConnectionState()
 	connCtx.ServerConn.tlsState = &tlsState
+	connCtx.ServerConn.TlsInfo = newTlsInfo(tlsState)
 	close(connCtx.ServerConn.tlsHandshaked)
 
 	return nil
@@ -288,103 +429,109 @@ func (connCtx *ConnContext) tlsHandshake(clientHello *tls.ClientHelloInfo) error
 // wrap tcpConn for remote client
 type wrapClientConn struct {
 	net.Conn
-	proxy    *Proxy
-	connCtx  *ConnContext
-	closed   bool
-	closeErr error
-}
+	proxy     *Proxy
+	connCtx   *ConnContext
+	closeOnce sync.Once // Close 可能在 http.Server 及隧道转发的 goroutine 中同时调用
+	closeErr  error
 
-func (c *wrapClientConn) Close() error {
-	if c.closed {
-		return c.closeErr
-	}
-	log.Debugln("in wrapClientConn close", c.connCtx.ClientConn.Conn.RemoteAddr())
+	originalDst string // Options.Transparent
+	peeked      []byte // 透明代理模式下识别连接类型时已读取的数据
 
-	c.closed = true
-	c.closeErr = c.Conn.Close()
+	limiter     *connLimiter // Options.MaxConnections
+	releaseOnce sync.Once
+}
 
-	for _, addon := range c.proxy.Addons {
-		addon.ClientDisconnected(c.connCtx.ClientConn)
-	}
+// 归还 Options.MaxConnections 的名额，未经 wrapClientConn.Close 关闭连接时需调用
+func (c *wrapClientConn) releaseLimit() {
+	c.releaseOnce.Do(c.limiter.release)
+}
 
-	if c.connCtx.ServerConn != nil && c.connCtx.ServerConn.Conn != nil {
-		c.connCtx.ServerConn.Conn.Close()
+func (c *wrapClientConn) Read(b []byte) (int, error) {
+	if len(c.peeked) > 0 {
+		n := copy(b, c.peeked)
+		c.peeked = c.peeked[n:]
+		return n, nil
 	}
-
-	return c.closeErr
+	return c.Conn.Read(b)
 }
 
-// wrap tcpListener for remote client
-type wrapListener struct {
-	net.Listener
-	proxy *Proxy
+// unix socket 的客户端通常未绑定地址（Name 为空或 @），使用监听的 socket 路径，便于在日志中区分
+func (c *wrapClientConn) RemoteAddr() net.Addr {
+	addr := c.Conn.RemoteAddr()
+	if unixAddr, ok := addr.(*net.UnixAddr); ok && (unixAddr.Name == "" || unixAddr.Name == "@") {
+		if local, ok := c.Conn.LocalAddr().(*net.UnixAddr); ok {
+			return &net.UnixAddr{Name: unixAddrPrefix + local.Name, Net: unixAddr.Net}
+		}
+	}
+	return addr
 }
 
-func (l *wrapListener) Accept() (net.Conn, error) {
-	c, err := l.Listener.Accept()
-	if err != nil {
-		return nil, err
+// 停止读取客户端连接，tcp 及 unix socket 连接支持
+func (c *wrapClientConn) closeRead() error {
+	if conn, ok := c.Conn.(interface{ CloseRead() error }); ok {
+		return conn.CloseRead()
 	}
+	return nil
+}
 
-	return &wrapClientConn{
-		Conn:  c,
-		proxy: l.proxy,
-	}, nil
+func (c *wrapClientConn) Close() error {
+	c.closeOnce.Do(func() {
+		log.Debugln("in wrapClientConn close", c.connCtx.ClientConn.Conn.RemoteAddr())
+
+		c.closeErr = c.Conn.Close()
+
+		// 每个连接只触发一次，无论其上经过多少个 flow
+		for _, addon := range c.proxy.Addons {
+			c.proxy.invokeConnAddon(addon, "ClientDisconnected", func() { addon.ClientDisconnected(c.connCtx.ClientConn) })
+		}
+		c.releaseLimit()
+
+		if c.connCtx.ServerConn != nil && c.connCtx.ServerConn.Conn != nil {
+			c.connCtx.ServerConn.Conn.Close()
+		}
+	})
+	return c.closeErr
 }
 
 // wrap tcpConn for remote server
 type wrapServerConn struct {
 	net.Conn
-	proxy    *Proxy
-	connCtx  *ConnContext
-	closed   bool
-	closeErr error
+	proxy     *Proxy
+	connCtx   *ConnContext
+	closeOnce sync.Once
+	closeErr  error
 }
 
 func (c *wrapServerConn) Close() error {
-	if c.closed {
-		return c.closeErr
-	}
-	log.Debugln("in wrapServerConn close", c.connCtx.ClientConn.Conn.RemoteAddr())
+	c.closeOnce.Do(func() {
+		log.Debugln("in wrapServerConn close", c.connCtx.ClientConn.Conn.RemoteAddr())
 
-	c.closed = true
-	c.closeErr = c.Conn.Close()
+		atomic.StoreInt32(&c.connCtx.serverConnClosed, 1)
+		c.closeErr = c.Conn.Close()
 
-	for _, addon := range c.proxy.Addons {
-		addon.ServerDisconnected(c.connCtx)
-	}
-
-	if !c.connCtx.ClientConn.Tls {
-		c.connCtx.ClientConn.Conn.(*wrapClientConn).Conn.(*net.TCPConn).CloseRead()
-	} else {
-		// if keep-alive connection close
-		if !c.connCtx.closeAfterResponse {
-			c.connCtx.pipeConn.Close()
+		for _, addon := range c.proxy.Addons {
+			c.proxy.invokeConnAddon(addon, "ServerDisconnected", func() { addon.ServerDisconnected(c.connCtx) })
 		}
-	}
 
+		if !c.connCtx.ClientConn.Tls {
+			c.connCtx.ClientConn.Conn.(*wrapClientConn).closeRead()
+		} else {
+			// if keep-alive connection close
+			if !c.connCtx.closeAfterResponse {
+				c.connCtx.pipeConn.Close()
+			}
+		}
+	})
 	return c.closeErr
 }
 
 // connect proxy when set https_proxy env
 // ref: http/transport.go dialConn func
-func getProxyConn(proxyUrl *url.URL, address string) (conn net.Conn, err error) {
-	if strings.Contains(proxyUrl.Scheme, "socks") {
-		auth := &proxy.Auth{}
-		if password, b := proxyUrl.User.Password(); b {
-			auth.User = proxyUrl.User.Username()
-			auth.Password = password
-		}
-		dialer, err := proxy.SOCKS5("tcp", proxyUrl.Host, auth, proxy.Direct)
-		if err != nil {
-			return nil, err
-		}
-		conn, err = dialer.Dial("tcp", address)
-		if err != nil {
-			return nil, err
-		}
+func getProxyConn(proxyUrl *url.URL, address string, dial dialerFunc, resolve resolveFunc) (conn net.Conn, err error) {
+	if isSocksScheme(proxyUrl.Scheme) {
+		return dialSocksUpstream(context.Background(), proxyUrl, address, dial, resolve)
 	} else {
-		conn, err = (&net.Dialer{}).DialContext(context.Background(), "tcp", proxyUrl.Host)
+		conn, err = dial(context.Background(), "tcp", proxyUrl.Host)
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Options.MaxConnections，限制同时处理的客户端连接数
+// 在 wrapListener.Accept 前获取，连接关闭（wrapClientConn.Close，即 ClientDisconnected 之后）时释放
+// 达到上限时不再 accept，新连接在内核的 backlog 中等待
+// socks5 连接通过 http 端口建立隧道，隧道连接同样计入，因此只在 http 端口限制，避免 socks5 连接与其隧道互相等待
+
+type connLimiter struct {
+	sem chan struct{}
+}
+
+// max 为 0 时返回 nil，nil 的 connLimiter 可直接调用
+func newConnLimiter(max int) *connLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &connLimiter{sem: make(chan struct{}, max)}
+}
+
+// 等待空闲名额，done 关闭时返回 false
+func (l *connLimiter) acquire(done <-chan struct{}) bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	default:
+	}
+	log.Debugf("max connections %v reached, waiting for connections to close", cap(l.sem))
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+func (l *connLimiter) release() {
+	if l == nil {
+		return
+	}
+	<-l.sem
+}
+
+// 当前占用的连接数
+func (l *connLimiter) count() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.sem)
+}
+
+// wrap tcpListener for remote client
+type wrapListener struct {
+	net.Listener
+	proxy   *Proxy
+	limiter *connLimiter
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newWrapListener(ln net.Listener, proxy *Proxy) *wrapListener {
+	return &wrapListener{
+		Listener: ln,
+		proxy:    proxy,
+		limiter:  proxy.connLimiter,
+		done:     make(chan struct{}),
+	}
+}
+
+func (l *wrapListener) Accept() (net.Conn, error) {
+	if !l.limiter.acquire(l.done) {
+		return nil, net.ErrClosed
+	}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		l.limiter.release()
+		return nil, err
+	}
+
+	return &wrapClientConn{
+		Conn:    c,
+		proxy:   l.proxy,
+		limiter: l.limiter,
+	}, nil
+}
+
+func (l *wrapListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return l.Listener.Close()
+}
@@ -0,0 +1,32 @@
+package proxy
+
+import "sync/atomic"
+
+// 请求上游（不包括 CONNECT 隧道）时连接池的使用情况，用于判断 Options.MaxIdleConnsPerHost 等设置是否合适
+// 新建连接数相对于请求数较多时说明连接被频繁关闭重建，可增大空闲连接数上限
+
+type UpstreamPoolStats struct {
+	NewConns    int64 // 新建的上游连接数
+	ReusedConns int64 // 复用已有连接的请求数
+}
+
+type upstreamPoolStats struct {
+	newConns    int64
+	reusedConns int64
+}
+
+func (s *upstreamPoolStats) gotConn(reused bool) {
+	if reused {
+		atomic.AddInt64(&s.reusedConns, 1)
+	} else {
+		atomic.AddInt64(&s.newConns, 1)
+	}
+}
+
+// 上游连接池的统计，见 Options.MaxIdleConns、Options.MaxIdleConnsPerHost、Options.IdleConnTimeout
+func (proxy *Proxy) UpstreamPoolStats() UpstreamPoolStats {
+	return UpstreamPoolStats{
+		NewConns:    atomic.LoadInt64(&proxy.poolStats.newConns),
+		ReusedConns: atomic.LoadInt64(&proxy.poolStats.reusedConns),
+	}
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// 解析 Cookie header，支持多个 Cookie header（如 http2 中每个 cookie 单独一个 header）
+func (r *Request) Cookies() []*http.Cookie {
+	return (&http.Request{Header: r.Header}).Cookies()
+}
+
+// 设置请求中的 cookie，替换同名的 cookie，仅使用 c.Name 及 c.Value
+// 所有 cookie 合并为一个 Cookie header
+func (r *Request) SetCookie(c *http.Cookie) {
+	cookie := (&http.Cookie{Name: c.Name, Value: c.Value}).String()
+	if cookie == "" {
+		return
+	}
+	pairs := make([]string, 0)
+	replaced := false
+	for _, old := range r.Cookies() {
+		if old.Name == c.Name {
+			if replaced {
+				continue
+			}
+			replaced = true
+			pairs = append(pairs, cookie)
+			continue
+		}
+		pairs = append(pairs, (&http.Cookie{Name: old.Name, Value: old.Value}).String())
+	}
+	if !replaced {
+		pairs = append(pairs, cookie)
+	}
+	if r.Header == nil {
+		r.Header = make(http.Header)
+	}
+	r.Header.Set("Cookie", strings.Join(pairs, "; "))
+}
+
+// 解析所有 Set-Cookie header，包括 Secure、HttpOnly、SameSite、Expires、Max-Age 等属性
+// Max-Age=0 或负数时 MaxAge 为 -1，Expires 无法解析时为零值，原始值见 RawExpires
+func (r *Response) Cookies() []*http.Cookie {
+	return (&http.Response{Header: r.Header}).Cookies()
+}
+
+// 添加 Set-Cookie，替换 Name、Domain、Path 均相同的 Set-Cookie，c 无效时不修改
+func (r *Response) SetCookie(c *http.Cookie) {
+	setCookie := c.String()
+	if setCookie == "" {
+		return
+	}
+	if r.Header == nil {
+		r.Header = make(http.Header)
+	}
+	values := make([]string, 0)
+	for _, v := range r.Header.Values("Set-Cookie") {
+		old := (&http.Response{Header: http.Header{"Set-Cookie": {v}}}).Cookies()
+		if len(old) == 1 && old[0].Name == c.Name && sameCookieDomain(old[0].Domain, c.Domain) && old[0].Path == c.Path {
+			continue
+		}
+		values = append(values, v)
+	}
+	r.Header["Set-Cookie"] = append(values, setCookie)
+}
+
+// Domain 属性忽略大小写及前导的 .
+func sameCookieDomain(a, b string) bool {
+	return strings.EqualFold(strings.TrimPrefix(a, "."), strings.TrimPrefix(b, "."))
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/groupcache/singleflight"
+)
+
+// 连接上游时使用的 dns 缓存，仅当 Options.DNSCacheTTL > 0 时启用
+// 解析失败的结果按 Options.DNSNegativeTTL 缓存，避免不存在的 host 反复请求 dns 服务器
+// 同一 host 同时只发起一次解析，并发的请求共享结果
+
+type DNSCacheStats struct {
+	Hits         int64 // 命中成功解析的缓存
+	NegativeHits int64 // 命中解析失败的缓存
+	Misses       int64 // 未命中缓存，实际发起解析，并发共享同一次解析时只计一次
+	Entries      int   // 当前缓存的 host 数，包含已过期但未清理的
+}
+
+type dnsCacheEntry struct {
+	addrs   []net.IPAddr
+	err     error
+	expires time.Time
+}
+
+type dnsCache struct {
+	ttl         time.Duration
+	negativeTTL time.Duration
+	lookup      func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+	mu      sync.Mutex
+	entries map[string]*dnsCacheEntry
+	stats   DNSCacheStats
+	group   singleflight.Group
+}
+
+// ttl 为 0 时返回 nil，nil 的 dnsCache 可直接调用
+// resolver 为 nil 时使用 net.DefaultResolver
+func newDNSCache(ttl, negativeTTL time.Duration, resolver *net.Resolver) *dnsCache {
+	if ttl <= 0 {
+		return nil
+	}
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &dnsCache{
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		lookup:      resolver.LookupIPAddr,
+		entries:     make(map[string]*dnsCacheEntry),
+	}
+}
+
+func (c *dnsCache) lookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	now := time.Now()
+	c.mu.Lock()
+	if entry, ok := c.entries[host]; ok && now.Before(entry.expires) {
+		if entry.err != nil {
+			c.stats.NegativeHits++
+		} else {
+			c.stats.Hits++
+		}
+		c.mu.Unlock()
+		return entry.addrs, entry.err
+	}
+	c.mu.Unlock()
+
+	// 以首个请求的 ctx 解析，其被取消时共享的请求同样返回取消的错误
+	v, err := c.group.Do(host, func() (interface{}, error) {
+		c.mu.Lock()
+		c.stats.Misses++
+		c.mu.Unlock()
+
+		addrs, err := c.lookup(ctx, host)
+		// 请求被取消不代表 host 不存在
+		if err != nil && (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+			return nil, err
+		}
+
+		now := time.Now()
+		entry := &dnsCacheEntry{addrs: addrs, err: err, expires: now.Add(c.ttl)}
+		if err != nil {
+			if c.negativeTTL <= 0 {
+				return nil, err
+			}
+			entry.expires = now.Add(c.negativeTTL)
+		}
+		c.mu.Lock()
+		c.insert(host, entry, now)
+		c.mu.Unlock()
+		return addrs, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]net.IPAddr), nil
+}
+
+const maxDNSCacheEntries = 1024
+
+// 超过 maxDNSCacheEntries 时先移除过期的，仍超过时移除最早过期的
+func (c *dnsCache) insert(host string, entry *dnsCacheEntry, now time.Time) {
+	if _, ok := c.entries[host]; !ok && len(c.entries) >= maxDNSCacheEntries {
+		c.removeExpired(now)
+		for len(c.entries) >= maxDNSCacheEntries {
+			var oldest string
+			for h, e := range c.entries {
+				if oldest == "" || e.expires.Before(c.entries[oldest].expires) {
+					oldest = h
+				}
+			}
+			delete(c.entries, oldest)
+		}
+	}
+	c.entries[host] = entry
+}
+
+func (c *dnsCache) removeExpired(now time.Time) {
+	for host, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, host)
+		}
+	}
+}
+
+// 解析 addr 中的 host 后依次尝试连接，addr 为 ip 时直接连接
+func (c *dnsCache) dial(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	addrs, err := c.lookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	for _, ip := range addrs {
+		conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	if err == nil {
+		err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return nil, err
+}
+
+func (c *dnsCache) snapshot() DNSCacheStats {
+	if c == nil {
+		return DNSCacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	return stats
+}
@@ -0,0 +1,342 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// dry run: 记录 addon 将要对 flow 做出的修改，但不实际修改
+// 事件中对 Request、Response（包括 trailer）及 Flow.Stream、Flow.UseSeparateClient、Flow.CaptureChunks、Flow.StreamLargeBodies、
+// Flow.KeepHostHeader、Flow.UpstreamProxy、Flow.Tags 的修改会被记录并还原
+// StreamRequestModifier、StreamResponseModifier 返回的 reader 会替换 body 且无法还原，dry run 的 addon 不调用这两个方法，
+// 因此 dry run 时 addon 无法通过它们观察 stream 模式的 body
+
+// 实现此接口的 addon 可单独开启 dry run，不受 Options.DryRun 影响
+type DryRunAddon interface {
+	DryRun() bool
+}
+
+func (proxy *Proxy) dryRun(addon Addon) bool {
+	if proxy.Opts.DryRun {
+		return true
+	}
+	if a, ok := addon.(DryRunAddon); ok {
+		return a.DryRun()
+	}
+	return false
+}
+
+// WebSocketMessage 在 websocket 两个方向的 goroutine 中并发调用，不快照及还原 flow
+// dry run 时只比较返回的消息内容，见 webSocket.message
+func dryRunSnapshot(event string) bool {
+	return event != "WebSocketMessage"
+}
+
+// 执行会修改 flow 的 addon 事件，记录修改并还原
+func (proxy *Proxy) dryRunInvoke(f *Flow, addon Addon, event string, fn func()) {
+	snapshot := newFlowSnapshot(f)
+	fn()
+	if changes := snapshot.diff(f); len(changes) > 0 {
+		log.WithFields(log.Fields{
+			"in":    "Proxy.dryRun",
+			"addon": fmt.Sprintf("%T", addon),
+			"event": event,
+			"url":   f.Request.URL.String(),
+		}).Infof("dry run, would modify: %v\n", strings.Join(changes, "; "))
+	}
+	snapshot.restore(f)
+}
+
+type requestSnapshot struct {
+	req       *Request
+	method    string
+	urlPtr    *url.URL
+	url       url.URL
+	headerMap http.Header
+	header    http.Header
+	body      []byte
+}
+
+type responseSnapshot struct {
+	res        *Response
+	statusCode int
+	headerMap  http.Header
+	header     http.Header
+	body       []byte
+	bodyReader io.Reader
+	trailerMap http.Header
+	trailer    http.Header
+}
+
+type flowSnapshot struct {
+	request  *requestSnapshot
+	response *responseSnapshot
+	aborted  *AbortError
+
+	stream            bool
+	useSeparateClient bool
+	captureChunks     bool
+	streamLargeBodies int64
+	keepHostHeader    bool
+	upstreamProxyPtr  *url.URL
+	upstreamProxy     *url.URL
+	tagsMap           map[string]string
+	tags              map[string]string
+}
+
+func cloneURL(u *url.URL) *url.URL {
+	if u == nil {
+		return nil
+	}
+	c := *u
+	return &c
+}
+
+func urlString(u *url.URL) string {
+	if u == nil {
+		return "none"
+	}
+	return u.String()
+}
+
+func cloneTags(tags map[string]string) map[string]string {
+	if tags == nil {
+		return nil
+	}
+	c := make(map[string]string, len(tags))
+	for key, value := range tags {
+		c[key] = value
+	}
+	return c
+}
+
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+func newFlowSnapshot(f *Flow) *flowSnapshot {
+	s := &flowSnapshot{
+		request: &requestSnapshot{
+			req:       f.Request,
+			method:    f.Request.Method,
+			urlPtr:    f.Request.URL,
+			url:       *f.Request.URL,
+			headerMap: f.Request.Header,
+			header:    f.Request.Header.Clone(),
+			body:      cloneBytes(f.Request.Body),
+		},
+		aborted:           f.aborted,
+		stream:            f.Stream,
+		useSeparateClient: f.UseSeparateClient,
+		captureChunks:     f.CaptureChunks,
+		streamLargeBodies: f.StreamLargeBodies,
+		keepHostHeader:    f.KeepHostHeader,
+		upstreamProxyPtr:  f.UpstreamProxy,
+		upstreamProxy:     cloneURL(f.UpstreamProxy),
+		tagsMap:           f.Tags,
+		tags:              cloneTags(f.Tags),
+	}
+	if f.Response != nil {
+		s.response = &responseSnapshot{
+			res:        f.Response,
+			statusCode: f.Response.StatusCode,
+			headerMap:  f.Response.Header,
+			header:     f.Response.Header.Clone(),
+			body:       cloneBytes(f.Response.Body),
+			bodyReader: f.Response.BodyReader,
+			trailerMap: f.Response.Trailer,
+			trailer:    f.Response.Trailer.Clone(),
+		}
+	}
+	return s
+}
+
+func (s *flowSnapshot) diff(f *Flow) []string {
+	changes := make([]string, 0)
+
+	req := s.request
+	if f.Request.Method != req.method {
+		changes = append(changes, fmt.Sprintf("request method %v -> %v", req.method, f.Request.Method))
+	}
+	if f.Request.URL.String() != req.url.String() {
+		changes = append(changes, fmt.Sprintf("request url %v -> %v", req.url.String(), f.Request.URL.String()))
+	}
+	changes = append(changes, diffHeader("request", req.header, f.Request.Header)...)
+	if !bytes.Equal(f.Request.Body, req.body) {
+		changes = append(changes, fmt.Sprintf("request body %v bytes -> %v bytes", len(req.body), len(f.Request.Body)))
+	}
+	if f.aborted != nil && f.aborted != s.aborted {
+		changes = append(changes, fmt.Sprintf("abort with status %v: %v", f.aborted.StatusCode, f.aborted.Reason))
+	}
+	if f.Stream != s.stream {
+		changes = append(changes, fmt.Sprintf("stream %v -> %v", s.stream, f.Stream))
+	}
+	if f.UseSeparateClient != s.useSeparateClient {
+		changes = append(changes, fmt.Sprintf("use separate client %v -> %v", s.useSeparateClient, f.UseSeparateClient))
+	}
+	if f.CaptureChunks != s.captureChunks {
+		changes = append(changes, fmt.Sprintf("capture chunks %v -> %v", s.captureChunks, f.CaptureChunks))
+	}
+	if f.StreamLargeBodies != s.streamLargeBodies {
+		changes = append(changes, fmt.Sprintf("stream large bodies %v -> %v", s.streamLargeBodies, f.StreamLargeBodies))
+	}
+	if f.KeepHostHeader != s.keepHostHeader {
+		changes = append(changes, fmt.Sprintf("keep host header %v -> %v", s.keepHostHeader, f.KeepHostHeader))
+	}
+	if before, after := urlString(s.upstreamProxy), urlString(f.UpstreamProxy); before != after {
+		changes = append(changes, fmt.Sprintf("upstream proxy %v -> %v", before, after))
+	}
+	changes = append(changes, diffTags(s.tags, f.Tags)...)
+
+	if s.response == nil {
+		if f.Response != nil {
+			changes = append(changes, fmt.Sprintf("response replaced with status %v", f.Response.StatusCode))
+		}
+		return changes
+	}
+	res := s.response
+	if f.Response == nil {
+		changes = append(changes, "response removed")
+		return changes
+	}
+	if f.Response.StatusCode != res.statusCode {
+		changes = append(changes, fmt.Sprintf("response status %v -> %v", res.statusCode, f.Response.StatusCode))
+	}
+	changes = append(changes, diffHeader("response", res.header, f.Response.Header)...)
+	if !bytes.Equal(f.Response.Body, res.body) {
+		changes = append(changes, fmt.Sprintf("response body %v bytes -> %v bytes", len(res.body), len(f.Response.Body)))
+	}
+	if f.Response.BodyReader != res.bodyReader {
+		changes = append(changes, "response body reader replaced")
+	}
+	changes = append(changes, diffHeader("response trailer", res.trailer, f.Response.Trailer)...)
+	return changes
+}
+
+func diffTags(before, after map[string]string) []string {
+	keys := make(map[string]bool)
+	for key := range before {
+		keys[key] = true
+	}
+	for key := range after {
+		keys[key] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	changes := make([]string, 0)
+	for _, key := range sorted {
+		a, inBefore := before[key]
+		b, inAfter := after[key]
+		if !inBefore {
+			changes = append(changes, fmt.Sprintf("tag add %v=%v", key, b))
+		} else if !inAfter {
+			changes = append(changes, fmt.Sprintf("tag del %v", key))
+		} else if a != b {
+			changes = append(changes, fmt.Sprintf("tag %v: %v -> %v", key, a, b))
+		}
+	}
+	return changes
+}
+
+func diffHeader(prefix string, before, after http.Header) []string {
+	keys := make(map[string]bool)
+	for key := range before {
+		keys[key] = true
+	}
+	for key := range after {
+		keys[key] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	changes := make([]string, 0)
+	for _, key := range sorted {
+		a, b := strings.Join(before[key], ", "), strings.Join(after[key], ", ")
+		if _, ok := before[key]; !ok {
+			changes = append(changes, fmt.Sprintf("%v header add %v: %v", prefix, key, b))
+		} else if _, ok := after[key]; !ok {
+			changes = append(changes, fmt.Sprintf("%v header del %v", prefix, key))
+		} else if a != b {
+			changes = append(changes, fmt.Sprintf("%v header %v: %v -> %v", prefix, key, a, b))
+		}
+	}
+	return changes
+}
+
+// 还原时保持原有的指针及 header map，因为 Request.URL、Request.Header 与 Request.Raw() 共享
+func (s *flowSnapshot) restore(f *Flow) {
+	req := s.request
+	f.Request = req.req
+	f.Request.Method = req.method
+	f.Request.URL = req.urlPtr
+	*f.Request.URL = req.url
+	f.Request.Header = restoreHeader(req.headerMap, req.header)
+	f.Request.Body = req.body
+	f.aborted = s.aborted
+	f.Stream = s.stream
+	f.UseSeparateClient = s.useSeparateClient
+	f.CaptureChunks = s.captureChunks
+	f.StreamLargeBodies = s.streamLargeBodies
+	f.KeepHostHeader = s.keepHostHeader
+	f.UpstreamProxy = s.upstreamProxyPtr
+	if f.UpstreamProxy != nil {
+		*f.UpstreamProxy = *s.upstreamProxy
+	}
+	f.Tags = restoreTags(s.tagsMap, s.tags)
+
+	if s.response == nil {
+		f.Response = nil
+		return
+	}
+	res := s.response
+	f.Response = res.res
+	f.Response.StatusCode = res.statusCode
+	f.Response.Header = restoreHeader(res.headerMap, res.header)
+	f.Response.Body = res.body
+	f.Response.BodyReader = res.bodyReader
+	f.Response.Trailer = restoreHeader(res.trailerMap, res.trailer)
+}
+
+// 同 restoreHeader，SetTag 可能已在原有的 map 中修改
+func restoreTags(current, snapshot map[string]string) map[string]string {
+	if current == nil || snapshot == nil {
+		return snapshot
+	}
+	for key := range current {
+		delete(current, key)
+	}
+	for key, value := range snapshot {
+		current[key] = value
+	}
+	return current
+}
+
+func restoreHeader(current, snapshot http.Header) http.Header {
+	if current == nil || snapshot == nil {
+		return snapshot
+	}
+	for key := range current {
+		delete(current, key)
+	}
+	for key, value := range snapshot {
+		current[key] = value
+	}
+	return current
+}
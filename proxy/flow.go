@@ -3,9 +3,12 @@ package proxy
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"time"
 
 	uuid "github.com/satori/go.uuid"
 )
@@ -19,6 +22,10 @@ type Request struct {
 	Body   []byte
 
 	raw *http.Request
+
+	maxDecodedSize int64 // Options.MaxDecompressedSize
+	decodedBody    []byte
+	decodedErr     error
 }
 
 func newRequest(req *http.Request) *Request {
@@ -95,12 +102,18 @@ func (req *Request) UnmarshalJSON(data []byte) error {
 // flow http response
 type Response struct {
 	StatusCode int         `json:"statusCode"`
+	Proto      string      `json:"proto,omitempty"` // 上游响应的协议版本，如 HTTP/1.1、HTTP/2.0
 	Header     http.Header `json:"header"`
 	Body       []byte      `json:"-"`
 	BodyReader io.Reader
 
+	Trailer http.Header `json:"trailer"`
+	Chunks  []*Chunk    `json:"chunks"` // only record when Flow.CaptureChunks is true
+
 	close bool // connection close
 
+	maxDecodedSize int64 // Options.MaxDecompressedSize
+
 	decodedBody []byte
 	decoded     bool // decoded reports whether the response was sent compressed but was decoded to decodedBody.
 	decodedErr  error
@@ -108,22 +121,142 @@ type Response struct {
 
 // flow
 type Flow struct {
-	Id          uuid.UUID
+	Id          uuid.UUID // 创建时生成，在该 flow 的所有 addon 回调中不变，proxy 的日志中记录为 flow 字段
 	ConnContext *ConnContext
 	Request     *Request
 	Response    *Response
+	Err         error // 请求上游失败的原因，如 ErrUpstreamTimeout，此时 Response 由 proxy 生成
+
+	// 客户端连接为 http2 时请求所在的 stream id，同一连接（ConnContext.ClientConn.Id）上的 flow 各不相同
+	// http/1.x 或无法获取时为 0，见 h2StreamId
+	StreamId uint32
+
+	// 字节数及耗时，在 ServeHTTP 中逐步记录，Response 事件时已确定，stream 模式的 body 在 flow 结束（Done）时确定
+	Stats FlowStats
 
 	// https://docs.mitmproxy.org/stable/overview-features/#streaming
 	// 如果为 true，则不缓冲 Request.Body 和 Response.Body，且不进入之后的 Addon.Request 和 Addon.Response
 	Stream            bool
-	UseSeparateClient bool // use separate http client to send http request
-	done              chan struct{}
+	StreamLargeBodies int64    // 覆盖此 flow 的 Options.StreamLargeBodies，在 Addon.Requestheaders 中设置时作用于请求及响应，在 Addon.Responseheaders 中设置时作用于响应，为 0 时使用全局设置
+	UseSeparateClient bool     // 使用 proxy 共享的 http client 请求上游，而不是客户端连接对应的 ServerConn，可在 Addon.Requestheaders 或 Addon.Request 中设置
+	KeepHostHeader    bool     // addon 修改 Request.URL 的 host 后，发往上游的 Host 仍使用修改前的值，默认跟随新的 host
+	UpstreamProxy     *url.URL // 在 Addon.Requestheaders 中设置时，覆盖此 flow 的上游代理，包括 CONNECT 隧道的连接
+	CaptureChunks     bool     // 记录 chunked response 原始分块信息至 Response.Chunks，需在 Addon.Requestheaders 中设置，上游为 h2 时没有分块，不记录
+	IsReplay          bool     // 由 Proxy.Replay 重发的 flow，addon 可据此避免再次重发
+
+	// 请求上游时未使用客户端连接对应的 ConnContext.ServerConn，而使用 proxy 共享的 client 的原因，见 SeparateClientForced 等
+	// 为空时使用 ServerConn，在 Addon.Responseheaders 之前确定
+	SeparateClientReason string
+
+	// addon 对 flow 的分类标记，如较早的 addon 设置 type=api，之后的 addon 按标记决定是否处理，见 SetTag、HasTag
+	// 在 flow 的整个生命周期中保留，不加锁：同一 flow 的回调依次调用，仅应在这些回调中修改
+	// WebSocketMessage、GrpcMessage 两个方向并发调用，其中只读
+	Tags map[string]string
+
+	done chan struct{}
+
+	metadata map[string]interface{}
+	aborted  *AbortError // Flow.Abort
+
+	addonSpent        [2]time.Duration // 各阶段 addon 已用时间，见 Options.AddonHeaderBudget
+	addonBudgetWarned [2]bool
+}
+
+// Flow.SeparateClientReason
+const (
+	SeparateClientForced        = "forced"         // addon 设置了 Flow.UseSeparateClient
+	SeparateClientHostChanged   = "host_changed"   // addon 修改了请求 URL 的 host 或 scheme
+	SeparateClientUpstreamProxy = "upstream_proxy" // 拦截的 https 连接设置了 Flow.UpstreamProxy，而 ServerConn 已直接连接上游
+)
+
+// CONNECT 隧道时 RequestBytes、ResponseBytes 为隧道中两个方向传输的总字节数，在 Response 事件时确定
+type FlowStats struct {
+	Start         time.Time     // proxy 收到请求的时间
+	RequestBytes  int64         // 发往上游的请求 body 字节数，stream 模式时读取过程中可通过 atomic 获取
+	ResponseBytes int64         // 从上游接收的响应 body 字节数，stream 模式时读取过程中可通过 atomic 获取
+	Connect       time.Duration // 建立上游连接（包括 tls 握手）的耗时，复用连接时为 0
+	TTFB          time.Duration // 开始请求上游至收到响应首字节的耗时
+	Total         time.Duration // 收到请求至完整接收上游响应 body 的耗时
+
+	// 此 flow 实际使用的上游连接，在 Addon.Responseheaders 之前确定，未请求上游时为 nil
+	// 使用 proxy 共享的 client 时不一定是 ConnContext.ServerConn 对应的连接，经过上游代理时 ServerRemoteAddr 为代理地址
+	ServerLocalAddr  net.Addr
+	ServerRemoteAddr net.Addr
+	Reused           bool    // 复用了之前请求的上游连接，为 false 时新建了连接
+	ServerTlsInfo    TlsInfo // 此 flow 实际使用的上游连接协商的 tls 参数，上游为 http 时为零值
+}
+
+// addon 调用 Flow.Abort 后，proxy 处理 flow 时设置的 Flow.Err，并通过 Addon.Error 通知所有 addon
+type AbortError struct {
+	StatusCode int
+	Reason     string
+	Err        error // Flow.AbortWithError 传入的原因，可通过 errors.Is、errors.As 匹配
+}
+
+func (e *AbortError) Error() string {
+	return fmt.Sprintf("flow aborted by addon: %v", e.Reason)
+}
+
+func (e *AbortError) Unwrap() error {
+	return e.Err
+}
+
+// 在 addon 回调中中止 flow: 跳过之后的 addon 及上游请求
+// statusCode > 0 时响应该状态码后关闭客户端连接，否则直接断开客户端连接（http2 时仅重置该 stream）
+// CONNECT 请求中止后不建立隧道
+func (f *Flow) Abort(statusCode int, reason string) {
+	f.aborted = &AbortError{StatusCode: statusCode, Reason: reason}
+}
+
+// 同 Abort，以 err 作为原因，Addon.Error 收到的 *AbortError 可匹配 err
+// 也可在 Addon.StreamResponseModifier 返回的 reader 中调用后返回错误，此时响应 header 已发送，statusCode 被忽略，直接断开客户端连接
+func (f *Flow) AbortWithError(statusCode int, err error) {
+	f.aborted = &AbortError{StatusCode: statusCode, Reason: err.Error(), Err: err}
+}
+
+func (f *Flow) Aborted() bool {
+	return f.aborted != nil
+}
+
+// 供 addon 之间通过 flow 传递数据
+func (f *Flow) SetMetadata(key string, value interface{}) {
+	if f.metadata == nil {
+		f.metadata = make(map[string]interface{})
+	}
+	f.metadata[key] = value
+}
+
+func (f *Flow) Metadata(key string) (interface{}, bool) {
+	value, ok := f.metadata[key]
+	return value, ok
+}
+
+func (f *Flow) SetTag(key, value string) {
+	if f.Tags == nil {
+		f.Tags = make(map[string]string)
+	}
+	f.Tags[key] = value
+}
+
+// 没有该标记时返回空字符串
+func (f *Flow) Tag(key string) string {
+	return f.Tags[key]
+}
+
+func (f *Flow) HasTag(key string) bool {
+	_, ok := f.Tags[key]
+	return ok
+}
+
+func (f *Flow) DeleteTag(key string) {
+	delete(f.Tags, key)
 }
 
 func newFlow() *Flow {
 	return &Flow{
-		Id:   uuid.NewV4(),
-		done: make(chan struct{}),
+		Id:    uuid.NewV4(),
+		Stats: FlowStats{Start: time.Now()},
+		done:  make(chan struct{}),
 	}
 }
 
@@ -135,10 +268,43 @@ func (f *Flow) finish() {
 	close(f.done)
 }
 
+// flow 结束时调用，关闭 f.Done() 后触发 Addon.FlowDone，并记录访问日志
+func (proxy *Proxy) finishFlow(f *Flow) {
+	f.finish()
+	for _, addon := range proxy.Addons {
+		proxy.invokeAddon(f, addon, "FlowDone", func() { addon.FlowDone(f) })
+	}
+	proxy.logAccess(f)
+	proxy.flows.done(f)
+}
+
+// 返回给客户端的状态码，包括 proxy 生成的错误响应及 Flow.Abort 的状态码，CONNECT 成功时为 200，客户端断开等未响应时为 0
+// 在 FlowDone 中确定，见 Options.AccessLog
+func (f *Flow) StatusCode() int {
+	switch {
+	case f.aborted != nil:
+		if f.aborted.StatusCode > 0 {
+			return f.aborted.StatusCode
+		}
+		return 0
+	case f.Response != nil:
+		return f.Response.StatusCode
+	case f.Err != nil:
+		if f.Request.Method == "CONNECT" {
+			return connectErrorStatus(f.Err)
+		}
+		return requestErrorStatus(f.Err)
+	}
+	return 0
+}
+
 func (f *Flow) MarshalJSON() ([]byte, error) {
 	j := make(map[string]interface{})
 	j["id"] = f.Id
 	j["request"] = f.Request
 	j["response"] = f.Response
+	if len(f.Tags) > 0 {
+		j["tags"] = f.Tags
+	}
 	return json.Marshal(j)
 }
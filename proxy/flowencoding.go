@@ -5,15 +5,26 @@ import (
 	"compress/flate"
 	"compress/gzip"
 	"errors"
+	"fmt"
 	"io"
+	"net/http"
 	"strconv"
 	"strings"
 
 	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
 	log "github.com/sirupsen/logrus"
 )
 
-var errEncodingNotSupport = errors.New("content-encoding not support")
+// Content-Encoding 不是 gzip、deflate、br、zstd 及其组合时，DecodedBody 返回原始 body 及此错误
+var ErrUnsupportedEncoding = errors.New("unsupported content-encoding")
+
+// 解压后的 body 超过 Options.MaxDecompressedSize
+var ErrDecompressedTooLarge = errors.New("decompressed body too large")
+
+// Content-Encoding 为 dcb/dcz（Compression Dictionary Transport），需要额外的字典才能解压
+// 此时 DecodedBody 返回原始 body 及此错误
+var ErrDictionaryEncoding = errors.New("unsupported dictionary encoding")
 
 var textContentTypes = []string{
 	"text",
@@ -57,8 +68,14 @@ func (r *Response) DecodedBody() ([]byte, error) {
 		r.decodedBody = r.Body
 		return r.decodedBody, nil
 	}
+	if isDictionaryEncoding(enc) {
+		return r.Body, fmt.Errorf("%w: %v", ErrDictionaryEncoding, enc)
+	}
+	if !isSupportedEncoding(enc) {
+		return r.Body, fmt.Errorf("%w: %v", ErrUnsupportedEncoding, enc)
+	}
 
-	decodedBody, decodedErr := decode(enc, r.Body)
+	decodedBody, decodedErr := decode(enc, r.Body, r.maxDecodedSize)
 	if decodedErr != nil {
 		r.decodedErr = decodedErr
 		log.Error(r.decodedErr)
@@ -70,6 +87,42 @@ func (r *Response) DecodedBody() ([]byte, error) {
 	return r.decodedBody, nil
 }
 
+// 解压失败时 r.Body 保持原样
+func (r *Request) DecodedBody() ([]byte, error) {
+	if r.decodedBody != nil {
+		return r.decodedBody, nil
+	}
+
+	if r.decodedErr != nil {
+		return nil, r.decodedErr
+	}
+
+	if len(r.Body) == 0 {
+		return r.Body, nil
+	}
+
+	enc := r.Header.Get("Content-Encoding")
+	if enc == "" || enc == "identity" {
+		return r.Body, nil
+	}
+	if isDictionaryEncoding(enc) {
+		return r.Body, fmt.Errorf("%w: %v", ErrDictionaryEncoding, enc)
+	}
+	if !isSupportedEncoding(enc) {
+		return r.Body, fmt.Errorf("%w: %v", ErrUnsupportedEncoding, enc)
+	}
+
+	decodedBody, decodedErr := decode(enc, r.Body, r.maxDecodedSize)
+	if decodedErr != nil {
+		r.decodedErr = decodedErr
+		log.Error(r.decodedErr)
+		return nil, decodedErr
+	}
+
+	r.decodedBody = decodedBody
+	return r.decodedBody, nil
+}
+
 func (r *Response) ReplaceToDecodedBody() {
 	body, err := r.DecodedBody()
 	if err != nil || body == nil {
@@ -82,39 +135,172 @@ func (r *Response) ReplaceToDecodedBody() {
 	r.Header.Del("Transfer-Encoding")
 }
 
-func decode(enc string, body []byte) ([]byte, error) {
-	if enc == "gzip" {
-		dreader, err := gzip.NewReader(bytes.NewReader(body))
+// 以 data 替换 body，并保持 Content-Encoding、Content-Length、Transfer-Encoding 一致
+// data 为未压缩的内容，按原有的 Content-Encoding 重新压缩，无法压缩（如 zstd、dcb）时移除 Content-Encoding
+// contentType 不为空时同时设置 Content-Type
+func (r *Response) ReplaceBody(contentType string, data []byte) error {
+	if r.Header == nil {
+		r.Header = make(http.Header)
+	}
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+
+	body := data
+	encoded := false
+	if enc := r.Header.Get("Content-Encoding"); enc != "" && enc != "identity" {
+		b, err := encode(enc, data)
+		if err == nil {
+			body = b
+			encoded = true
+		} else if errors.Is(err, ErrUnsupportedEncoding) {
+			log.Debugf("replace body: %v, remove content-encoding", err)
+			r.Header.Del("Content-Encoding")
+		} else {
+			return err
+		}
+	}
+
+	r.Body = body
+	r.BodyReader = nil
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	r.Header.Del("Transfer-Encoding")
+	r.decodedBody = data
+	r.decoded = encoded
+	r.decodedErr = nil
+	return nil
+}
+
+// 将解压后的 body 交给 fn 修改，再以 ReplaceBody 设置，解压失败时不修改 body 并返回错误
+func (r *Response) DecodeAndReplace(fn func(body []byte) []byte) error {
+	body, err := r.DecodedBody()
+	if err != nil {
+		return err
+	}
+	return r.ReplaceBody("", fn(body))
+}
+
+// 多个编码按应用顺序列出，与 decode 相反，从前往后压缩
+func encode(enc string, body []byte) ([]byte, error) {
+	for _, e := range strings.Split(enc, ",") {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "identity" {
+			continue
+		}
+		var err error
+		body, err = encodeOne(e, body)
 		if err != nil {
 			return nil, err
 		}
-		buf := bytes.NewBuffer(make([]byte, 0))
-		_, err = io.Copy(buf, dreader)
+	}
+	return body, nil
+}
+
+// zstd 暂不重新压缩
+func encodeOne(enc string, body []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	var w io.WriteCloser
+	switch enc {
+	case "gzip", "x-gzip":
+		w = gzip.NewWriter(buf)
+	case "br":
+		w = brotli.NewWriter(buf)
+	case "deflate":
+		fw, err := flate.NewWriter(buf, flate.DefaultCompression)
 		if err != nil {
 			return nil, err
 		}
-		err = dreader.Close()
+		w = fw
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedEncoding, enc)
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// 如 "dcb" 或 "gzip, dcz"
+func isDictionaryEncoding(enc string) bool {
+	for _, e := range strings.Split(enc, ",") {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "dcb" || e == "dcz" {
+			return true
+		}
+	}
+	return false
+}
+
+// 如 "br" 或 "gzip, zstd"
+func isSupportedEncoding(enc string) bool {
+	for _, e := range strings.Split(enc, ",") {
+		switch strings.ToLower(strings.TrimSpace(e)) {
+		case "gzip", "x-gzip", "deflate", "br", "zstd", "identity":
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// 多个编码按应用顺序列出，解压时从后往前
+// limit <= 0 时不限制解压后的大小
+func decode(enc string, body []byte, limit int64) ([]byte, error) {
+	encs := strings.Split(enc, ",")
+	for i := len(encs) - 1; i >= 0; i-- {
+		e := strings.ToLower(strings.TrimSpace(encs[i]))
+		if e == "identity" {
+			continue
+		}
+		var err error
+		body, err = decodeOne(e, body, limit)
 		if err != nil {
 			return nil, err
 		}
-		return buf.Bytes(), nil
-	} else if enc == "br" {
-		dreader := brotli.NewReader(bytes.NewReader(body))
-		buf := bytes.NewBuffer(make([]byte, 0))
-		_, err := io.Copy(buf, dreader)
+	}
+	return body, nil
+}
+
+func decodeOne(enc string, body []byte, limit int64) ([]byte, error) {
+	var dreader io.Reader
+	switch enc {
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(body))
 		if err != nil {
 			return nil, err
 		}
-		return buf.Bytes(), nil
-	} else if enc == "deflate" {
-		dreader := flate.NewReader(bytes.NewReader(body))
-		buf := bytes.NewBuffer(make([]byte, 0))
-		_, err := io.Copy(buf, dreader)
+		defer zr.Close()
+		dreader = zr
+	case "br":
+		dreader = brotli.NewReader(bytes.NewReader(body))
+	case "deflate":
+		fr := flate.NewReader(bytes.NewReader(body))
+		defer fr.Close()
+		dreader = fr
+	case "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(body), zstd.WithDecoderConcurrency(1))
 		if err != nil {
 			return nil, err
 		}
-		return buf.Bytes(), nil
+		defer zr.Close()
+		dreader = zr
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedEncoding, enc)
 	}
 
-	return nil, errEncodingNotSupport
+	if limit > 0 {
+		dreader = io.LimitReader(dreader, limit+1)
+	}
+	buf := bytes.NewBuffer(make([]byte, 0))
+	n, err := io.Copy(buf, dreader)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && n > limit {
+		return nil, fmt.Errorf("%w: %v encoded body exceeds %v bytes after decompression", ErrDecompressedTooLarge, enc, limit)
+	}
+	return buf.Bytes(), nil
 }
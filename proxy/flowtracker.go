@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+)
+
+// 记录进行中的 flow，Proxy.Shutdown 等待其完成，超时后关闭其客户端连接
+// proxy.server.Shutdown 不等待 hijack 的连接，CONNECT 隧道及 websocket 的 flow 需在此等待
+// 进行中的连接在等待期间仍可能产生新的 flow（如 keep-alive 的下一个请求），因此不使用 sync.WaitGroup
+
+type flowTracker struct {
+	mu    sync.Mutex
+	flows map[*Flow]struct{}
+	idle  chan struct{} // 等待时创建，flow 全部完成时关闭
+}
+
+func (t *flowTracker) add(f *Flow) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.flows == nil {
+		t.flows = make(map[*Flow]struct{})
+	}
+	t.flows[f] = struct{}{}
+}
+
+func (t *flowTracker) done(f *Flow) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.flows, f)
+	if len(t.flows) == 0 && t.idle != nil {
+		close(t.idle)
+		t.idle = nil
+	}
+}
+
+func (t *flowTracker) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.flows)
+}
+
+// 等待进行中的 flow 全部完成，ctx 结束时返回 ctx.Err()
+func (t *flowTracker) wait(ctx context.Context) error {
+	t.mu.Lock()
+	if len(t.flows) == 0 {
+		t.mu.Unlock()
+		return nil
+	}
+	if t.idle == nil {
+		t.idle = make(chan struct{})
+	}
+	idle := t.idle
+	t.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 关闭进行中 flow 的客户端连接，隧道及 websocket 随之结束
+func (t *flowTracker) closeAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for f := range t.flows {
+		if f.ConnContext != nil && f.ConnContext.ClientConn != nil && f.ConnContext.ClientConn.Conn != nil {
+			f.ConnContext.ClientConn.Conn.Close()
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// gRPC 的消息在 http2 body 中以 5 字节前缀分帧: 1 字节压缩标志 + 4 字节大端的消息长度
+// content-type 为 application/grpc（含 application/grpc+proto 等）的请求默认为 stream 模式，以支持流式 RPC
+// addon 可在 Requestheaders 中将 f.Stream 设为 false，读取完整的 body 并触发 Request、Response（仅适用于 unary RPC）
+// 请求及响应 body 中的每个消息在转发时触发 Addon.GrpcMessage，不解码 protobuf，不修改转发的数据
+// grpc-status 在响应的 trailer 中，见 Response.GrpcStatus
+
+var ErrGrpcFrameTruncated = errors.New("grpc frame truncated")
+
+type GrpcMessage struct {
+	Compressed bool   // 压缩标志，压缩算法见 grpc-encoding header
+	Data       []byte // 消息的原始字节，通常为 protobuf 编码
+}
+
+// content-type 为 application/grpc 或 application/grpc+xxx，不包括 grpc-web
+func IsGrpc(header http.Header) bool {
+	ct := strings.ToLower(header.Get("Content-Type"))
+	if i := strings.IndexByte(ct, ';'); i >= 0 {
+		ct = strings.TrimSpace(ct[:i])
+	}
+	return ct == "application/grpc" || strings.HasPrefix(ct, "application/grpc+")
+}
+
+// 解析完整 body 中的消息，如 f.Stream 为 false 时的 Request.Body、Response.Body
+// 最后一个消息不完整时返回已解析的消息及 ErrGrpcFrameTruncated
+func ParseGrpcMessages(body []byte) ([]*GrpcMessage, error) {
+	var msgs []*GrpcMessage
+	for len(body) > 0 {
+		if len(body) < 5 {
+			return msgs, ErrGrpcFrameTruncated
+		}
+		size := binary.BigEndian.Uint32(body[1:5])
+		if uint64(len(body)-5) < uint64(size) {
+			return msgs, ErrGrpcFrameTruncated
+		}
+		msgs = append(msgs, &GrpcMessage{Compressed: body[0]&1 == 1, Data: body[5 : 5+size]})
+		body = body[5+size:]
+	}
+	return msgs, nil
+}
+
+// grpc-status 及 grpc-message，通常在 trailer 中，仅有 header 的响应（如服务端直接返回错误）在 header 中
+// stream 模式的响应在 body 转发完成后才有 trailer，可在 Addon.FlowDone 中获取，没有 grpc-status 时 ok 为 false
+func (r *Response) GrpcStatus() (code int, message string, ok bool) {
+	header := r.Trailer
+	if header.Get("Grpc-Status") == "" {
+		header = r.Header
+	}
+	status := header.Get("Grpc-Status")
+	if status == "" {
+		return 0, "", false
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return 0, "", false
+	}
+	message = header.Get("Grpc-Message")
+	if unescaped, err := url.PathUnescape(message); err == nil {
+		message = unescaped
+	}
+	return code, message, true
+}
+
+func (proxy *Proxy) grpcMessage(f *Flow, isFromClient bool, msg *GrpcMessage) {
+	for _, addon := range proxy.Addons {
+		proxy.invokeAddon(f, addon, "GrpcMessage", func() { addon.GrpcMessage(f, isFromClient, msg) })
+	}
+}
+
+// 转发时逐个解析 body 中的消息，每个完整的消息触发一次 Addon.GrpcMessage
+// 超过 limit 的消息不缓冲，跳过且不触发
+type grpcMessageReader struct {
+	r         io.Reader
+	limit     int64
+	onMessage func(*GrpcMessage)
+
+	buf  []byte // 未完整的帧
+	skip int64  // 跳过的消息剩余的字节数
+}
+
+func (proxy *Proxy) newGrpcMessageReader(f *Flow, isFromClient bool, r io.Reader) io.Reader {
+	return &grpcMessageReader{
+		r:     r,
+		limit: proxy.streamLargeBodies(f),
+		onMessage: func(msg *GrpcMessage) {
+			proxy.grpcMessage(f, isFromClient, msg)
+		},
+	}
+}
+
+func (r *grpcMessageReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.parse(p[:n])
+	}
+	if err == io.EOF && (len(r.buf) > 0 || r.skip > 0) {
+		log.Debugf("grpc: %v", ErrGrpcFrameTruncated)
+		r.buf, r.skip = nil, 0
+	}
+	return n, err
+}
+
+func (r *grpcMessageReader) parse(data []byte) {
+	for len(data) > 0 {
+		if r.skip > 0 {
+			n := int64(len(data))
+			if n > r.skip {
+				n = r.skip
+			}
+			r.skip -= n
+			data = data[n:]
+			continue
+		}
+		if len(r.buf) < 5 {
+			n := 5 - len(r.buf)
+			if n > len(data) {
+				n = len(data)
+			}
+			r.buf = append(r.buf, data[:n]...)
+			data = data[n:]
+			if len(r.buf) < 5 {
+				return
+			}
+		}
+		size := int64(binary.BigEndian.Uint32(r.buf[1:5]))
+		if size > r.limit {
+			log.Debugf("grpc: skip message size %v > %v", size, r.limit)
+			r.buf = r.buf[:0]
+			r.skip = size
+			continue
+		}
+		n := 5 + int(size) - len(r.buf)
+		if n > len(data) {
+			r.buf = append(r.buf, data...)
+			return
+		}
+		r.buf = append(r.buf, data[:n]...)
+		data = data[n:]
+		msg := &GrpcMessage{Compressed: r.buf[0]&1 == 1, Data: r.buf[5:]}
+		r.buf = nil // msg.Data 引用了 buf
+		r.onMessage(msg)
+	}
+}
+
+// 每次写入后 flush，流式 RPC 的消息及时发送给客户端
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func (w *flushWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.f.Flush()
+	return n, err
+}
+
+// 在 body 写入完成后调用，http/1.1 仅 chunked 的响应可发送 trailer
+func writeTrailer(res http.ResponseWriter, trailer http.Header) {
+	for key, values := range trailer {
+		for _, v := range values {
+			res.Header().Add(http.TrailerPrefix+key, v)
+		}
+	}
+}
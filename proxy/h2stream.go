@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"net/http"
+	"reflect"
+)
+
+// net/http 及 golang.org/x/net/http2 未暴露请求所在的 stream id
+// 客户端连接为 http2 时 ServeHTTP 收到的 ResponseWriter 为 x/net/http2 的 *responseWriter，
+// 通过反射读取其 rws.stream.id（只读，不修改），结构不符（如升级 x/net 后字段变化）时返回 0
+
+func h2StreamId(res http.ResponseWriter) uint32 {
+	v := reflect.ValueOf(res)
+	for _, name := range []string{"rws", "stream"} {
+		if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+			return 0
+		}
+		v = v.Elem().FieldByName(name)
+		if !v.IsValid() {
+			return 0
+		}
+	}
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return 0
+	}
+	id := v.Elem().FieldByName("id")
+	if !id.IsValid() || id.Kind() != reflect.Uint32 {
+		return 0
+	}
+	return uint32(id.Uint())
+}
@@ -4,10 +4,11 @@ import (
 	"bytes"
 	"encoding/json"
 	"io"
-	"net"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -21,6 +22,7 @@ var normalErrMsgs []string = []string{
 	"connect: connection refused",
 	"connect: connection reset by peer",
 	"use of closed network connection",
+	"context canceled",
 }
 
 // 仅打印预料之外的错误信息
@@ -40,15 +42,41 @@ func logErr(log *log.Entry, err error) (loged bool) {
 }
 
 // 转发流量
-func transfer(log *log.Entry, server, client io.ReadWriteCloser) {
+// 统计读取的字节数，读取过程中可通过 atomic 获取
+type countReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
+
+// 返回 client 至 server 及 server 至 client 已传输的字节数
+// idleTimeout > 0 时两个方向均超过 idleTimeout 未传输数据则结束，timedOut 为 true
+func transfer(log *log.Entry, server, client io.ReadWriteCloser, idleTimeout time.Duration) (sent, received int64, timedOut bool) {
 	done := make(chan struct{})
 	defer close(done)
 
+	// 出错返回时另一方向可能仍在传输
+	var sentN, receivedN int64
+	idle := newIdleDeadline(idleTimeout, server, client)
+	defer func() {
+		sent, received = atomic.LoadInt64(&sentN), atomic.LoadInt64(&receivedN)
+		timedOut = idle.timedOut()
+	}()
+
 	errChan := make(chan error)
 	go func() {
-		_, err := io.Copy(server, client)
+		_, err := io.Copy(server, &countReader{r: idle.reader(client), n: &sentN})
 		log.Debugln("client copy end", err)
 		client.Close()
+		// 将客户端的 EOF 转达给上游，上游随之关闭连接，另一方向的转发才会结束
+		if conn, ok := server.(interface{ CloseWrite() error }); ok {
+			conn.CloseWrite()
+		}
 		select {
 		case <-done:
 			return
@@ -57,13 +85,13 @@ func transfer(log *log.Entry, server, client io.ReadWriteCloser) {
 		}
 	}()
 	go func() {
-		_, err := io.Copy(client, server)
+		_, err := io.Copy(client, &countReader{r: idle.reader(server), n: &receivedN})
 		log.Debugln("server copy end", err)
 		server.Close()
 
 		if clientConn, ok := client.(*wrapClientConn); ok {
-			err := clientConn.Conn.(*net.TCPConn).CloseRead()
-			log.Debugln("clientConn.Conn.(*net.TCPConn).CloseRead()", err)
+			err := clientConn.closeRead()
+			log.Debugln("clientConn.closeRead()", err)
 		}
 
 		select {
@@ -80,6 +108,7 @@ func transfer(log *log.Entry, server, client io.ReadWriteCloser) {
 			return // 如果有错误，直接返回
 		}
 	}
+	return
 }
 
 // 尝试将 Reader 读取至 buffer 中
@@ -105,25 +134,58 @@ func readerToBuffer(r io.Reader, limit int64) ([]byte, io.Reader, error) {
 }
 
 // Wireshark 解析 https 设置
-var tlsKeyLogWriter io.Writer
-var tlsKeyLogOnce sync.Once
+// 同一文件在进程内只打开一次，多个连接及多个 proxy 实例的写入串行进行，保证每行完整
 
-func getTlsKeyLogWriter() io.Writer {
-	tlsKeyLogOnce.Do(func() {
-		logfile := os.Getenv("SSLKEYLOGFILE")
-		if logfile == "" {
-			return
-		}
+type keyLogWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *keyLogWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
 
-		writer, err := os.OpenFile(logfile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+var keyLogWriters = struct {
+	sync.Mutex
+	m map[string]*keyLogWriter
+}{m: make(map[string]*keyLogWriter)}
+
+func openKeyLogFile(filename string) (*keyLogWriter, error) {
+	keyLogWriters.Lock()
+	defer keyLogWriters.Unlock()
+	if w, ok := keyLogWriters.m[filename]; ok {
+		return w, nil
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	w := &keyLogWriter{w: file}
+	keyLogWriters.m[filename] = w
+	return w, nil
+}
+
+// Options.SslKeyLogFile 优先于环境变量 SSLKEYLOGFILE，均未设置时返回 nil
+func newTlsKeyLogWriter(opts *Options) (io.Writer, error) {
+	if opts.SslKeyLogFile != "" {
+		w, err := openKeyLogFile(opts.SslKeyLogFile)
 		if err != nil {
-			log.Debugf("getTlsKeyLogWriter OpenFile error: %v", err)
-			return
+			return nil, err
 		}
-
-		tlsKeyLogWriter = writer
-	})
-	return tlsKeyLogWriter
+		return w, nil
+	}
+	filename := os.Getenv("SSLKEYLOGFILE")
+	if filename == "" {
+		return nil, nil
+	}
+	w, err := openKeyLogFile(filename)
+	if err != nil {
+		log.Debugf("open SSLKEYLOGFILE error: %v", err)
+		return nil, nil
+	}
+	return w, nil
 }
 
 func NewStructFromFile[T any](filename string) (*T, error) {
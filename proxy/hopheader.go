@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// 转发前移除 hop-by-hop header（RFC 7230 6.1），这些 header 仅对客户端与 proxy、proxy 与上游之间的单个连接有效
+// 如 Proxy-Connection 可能使上游误判连接状态，Proxy-Authorization 会泄露 proxy 的认证信息
+// Connection 中列出的 header 同样移除，Options.PreserveHeaders 中的 header 保留
+
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection", // 非标准，但客户端常发送
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// key 为 canonical header
+type preserveHeaders map[string]bool
+
+func newPreserveHeaders(headers []string) preserveHeaders {
+	p := make(preserveHeaders)
+	for _, h := range headers {
+		p[http.CanonicalHeaderKey(strings.TrimSpace(h))] = true
+	}
+	return p
+}
+
+func (p preserveHeaders) removeHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name != "" && !p[name] {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		if !p[name] {
+			h.Del(name)
+		}
+	}
+}
+
+// 移除请求的 hop-by-hop header，保留协议升级（如 ws）的 Connection、Upgrade 及 gRPC 需要的 TE: trailers
+func (p preserveHeaders) removeRequestHopHeaders(h http.Header) {
+	upgrade := upgradeType(h)
+	trailers := false
+	for _, value := range h.Values("Te") {
+		for _, te := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(te), "trailers") {
+				trailers = true
+			}
+		}
+	}
+	p.removeHopHeaders(h)
+	if trailers && h.Get("Te") == "" {
+		h.Set("Te", "trailers")
+	}
+	if upgrade != "" {
+		h.Set("Connection", "Upgrade")
+		h.Set("Upgrade", upgrade)
+	}
+}
+
+// 移除响应的 hop-by-hop header，101 响应保留协议升级的 header
+func (p preserveHeaders) removeResponseHopHeaders(statusCode int, h http.Header) {
+	upgrade := ""
+	if statusCode == http.StatusSwitchingProtocols {
+		upgrade = upgradeType(h)
+	}
+	p.removeHopHeaders(h)
+	if upgrade != "" {
+		h.Set("Connection", "Upgrade")
+		h.Set("Upgrade", upgrade)
+	}
+}
+
+func upgradeType(h http.Header) string {
+	for _, value := range h.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
@@ -3,13 +3,20 @@ package proxy
 import (
 	"bufio"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"net"
 	"net/http"
-	"strings"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/lqqyt2423/go-mitmproxy/cert"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
 )
 
 // 模拟了标准库中 server 运行，目的是仅通过当前进程内存转发 socket 数据，不需要经过 tcp 或 unix socket
@@ -28,13 +35,15 @@ type pipeConn struct {
 	host        string // server host:port
 	remoteAddr  string // client ip:port
 	connContext *ConnContext
+	flow        *Flow         // CONNECT 的 flow
+	connectReq  *http.Request // CONNECT 请求，包含 Flow.UpstreamProxy
 }
 
 func newPipeConn(c net.Conn, req *http.Request) *pipeConn {
 	connContext := req.Context().Value(connContextKey).(*ConnContext)
 	pipeConn := &pipeConn{
 		Conn:        c,
-		r:           bufio.NewReader(c),
+		r:           bufio.NewReaderSize(c, maxTLSRecordSize), // 可预读完整的 ClientHello 记录
 		host:        req.Host,
 		remoteAddr:  req.RemoteAddr,
 		connContext: connContext,
@@ -81,68 +90,269 @@ func (l *middleListener) Addr() net.Addr { return nil }
 
 // middle: man-in-the-middle server
 type middle struct {
-	proxy    *Proxy
-	ca       *cert.CA
-	listener *middleListener
-	server   *http.Server
+	proxy         *Proxy
+	ca            *cert.CA
+	cas           []*cert.CA // Options.CAs
+	listener      *middleListener
+	server        *http.Server
+	tlsConfig     *tls.Config
+	webSocket     *webSocket
+	handshakeChan chan *pipeConn // 等待 worker 处理 tls 握手的连接，仅当 Options.HandshakeWorkers > 0 时使用
+	handshakeSem  chan struct{}  // 限制同时进行的 tls 握手数，仅当 Options.MaxConcurrentHandshakes > 0 时使用
+
+	queuedHandshakes int64 // 等待 handshakeSem 的握手数
+
+	closeOnce sync.Once
+}
+
+func newCA(opts *Options) (*cert.CA, error) {
+	if len(opts.CaCert) == 0 && len(opts.CaKey) == 0 {
+		return cert.NewCA(opts.CaRootPath)
+	}
+	if len(opts.CaCert) == 0 || len(opts.CaKey) == 0 {
+		return nil, errors.New("both Options.CaCert and Options.CaKey are required")
+	}
+	return cert.NewCAFromPEM(opts.CaCert, opts.CaKey)
 }
 
 func newMiddle(proxy *Proxy) (*middle, error) {
-	ca, err := cert.NewCA(proxy.Opts.CaRootPath)
+	ca, err := newCA(proxy.Opts)
 	if err != nil {
 		return nil, err
 	}
+	keyType, err := cert.ParseKeyType(proxy.Opts.CertKeyType)
+	if err != nil {
+		return nil, err
+	}
+	ca.SetCertKeyType(keyType)
+	if proxy.Opts.CertCacheDir != "" {
+		if err := ca.SetCertCacheDir(proxy.Opts.CertCacheDir); err != nil {
+			return nil, err
+		}
+	}
+	// 每个 CA 有各自的证书缓存，同一 host 由不同 CA 签发的证书互不影响
+	for _, extra := range proxy.Opts.CAs {
+		if extra == nil {
+			return nil, errors.New("Options.CAs contains nil CA")
+		}
+		extra.SetCertKeyType(keyType)
+		if proxy.Opts.CertCacheDir != "" {
+			if err := extra.SetCertCacheDir(filepath.Join(proxy.Opts.CertCacheDir, caCacheSubdir(extra))); err != nil {
+				return nil, err
+			}
+		}
+	}
 
 	m := &middle{
-		proxy: proxy,
-		ca:    ca,
+		proxy:     proxy,
+		ca:        ca,
+		cas:       proxy.Opts.CAs,
+		webSocket: &webSocket{proxy: proxy},
 		listener: &middleListener{
 			connChan: make(chan net.Conn),
 			doneChan: make(chan struct{}),
 		},
 	}
 
+	if proxy.Opts.HandshakeWorkers > 0 {
+		m.handshakeChan = make(chan *pipeConn, proxy.Opts.HandshakeBacklog)
+	}
+	if proxy.Opts.MaxConcurrentHandshakes > 0 {
+		m.handshakeSem = make(chan struct{}, proxy.Opts.MaxConcurrentHandshakes)
+	}
+
+	m.tlsConfig = &tls.Config{
+		SessionTicketsDisabled: true, // 设置此值为 true ，确保每次都会调用下面的 GetCertificate 方法
+		KeyLogWriter:           proxy.keyLogWriter,
+		// ALPN 在 GetCertificate 之前协商，需在此与上游握手，才能按上游的协商结果决定是否向客户端提供 h2
+		GetConfigForClient: func(clientHello *tls.ClientHelloInfo) (*tls.Config, error) {
+			connCtx := clientHello.Context().Value(connContextKey).(*ConnContext)
+			connCtx.ClientConn.clientHello = clientHello
+
+			if !connCtx.ClientConn.UpstreamCert {
+				return nil, nil
+			}
+			if err := connCtx.tlsHandshake(clientHello.Context(), clientHello); err != nil {
+				return nil, err
+			}
+			for _, addon := range connCtx.proxy.Addons {
+				connCtx.proxy.invokeConnAddon(addon, "TlsEstablishedServer", func() { addon.TlsEstablishedServer(connCtx) })
+			}
+
+			// 所有请求共用与上游的同一个 tls 连接，上游未协商 h2 时客户端也只能使用 http/1.1
+			if proxy.Opts.EnableHTTP2 && connCtx.ServerConn.tlsState.NegotiatedProtocol != "h2" {
+				cfg := m.tlsConfig.Clone()
+				cfg.NextProtos = []string{"http/1.1"}
+				return cfg, nil
+			}
+			return nil, nil
+		},
+		GetCertificate: func(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return getCertForHello(m.selectCA(clientHello.ServerName), clientHello)
+		},
+	}
+
+	// tls 握手由 middle.handshake 完成，server 接收到的是已完成握手的 *tls.Conn
 	server := &http.Server{
 		Handler: m,
 		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
 			return context.WithValue(ctx, connContextKey, c.(*tls.Conn).NetConn().(*pipeConn).connContext)
 		},
 		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)), // disable http2
-		TLSConfig: &tls.Config{
-			SessionTicketsDisabled: true, // 设置此值为 true ，确保每次都会调用下面的 GetCertificate 方法
-			GetCertificate: func(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-				connCtx := clientHello.Context().Value(connContextKey).(*ConnContext)
-				connCtx.ClientConn.clientHello = clientHello
-
-				if connCtx.ClientConn.UpstreamCert {
-					if err := connCtx.tlsHandshake(clientHello); err != nil {
-						return nil, err
-					}
-
-					for _, addon := range connCtx.proxy.Addons {
-						addon.TlsEstablishedServer(connCtx)
-					}
-				}
-
-				return ca.GetCert(clientHello.ServerName)
-			},
-		},
+	}
+	proxy.setServerTimeouts(server)
+	if proxy.Opts.EnableHTTP2 {
+		m.tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		server.TLSNextProto = nil
+		if err := http2.ConfigureServer(server, &http2.Server{}); err != nil {
+			return nil, err
+		}
 	}
 	m.server = server
 	return m, nil
 }
 
+func (m *middle) selectCA(sni string) *cert.CA {
+	if m.proxy.Opts.SelectCA != nil {
+		if ca := m.proxy.Opts.SelectCA(sni); ca != nil {
+			return ca
+		}
+	}
+	return m.ca
+}
+
+// Options.CAs 的证书保存在 CertCacheDir 下以根证书指纹命名的子目录，不随 CAs 的顺序改变
+func caCacheSubdir(ca *cert.CA) string {
+	sum := sha256.Sum256(ca.RootCert.Raw)
+	return "ca-" + hex.EncodeToString(sum[:8])
+}
+
+// 客户端不支持 Options.CertKeyType 类型证书的签名算法时（如不支持 ed25519 的浏览器），改用 rsa 证书
+func getCertForHello(ca *cert.CA, clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c, err := ca.GetCert(clientHello.ServerName)
+	if err != nil || ca.CertKeyType() == cert.KeyTypeRSA {
+		return c, err
+	}
+	if err := clientHello.SupportsCertificate(c); err != nil {
+		log.Debugf("client not support %v cert for %v: %v", ca.CertKeyType(), clientHello.ServerName, err)
+		return ca.GetCertOfType(clientHello.ServerName, cert.KeyTypeRSA)
+	}
+	return c, nil
+}
+
 func (m *middle) start() error {
-	return m.server.ServeTLS(m.listener, "", "")
+	for i := 0; i < m.proxy.Opts.HandshakeWorkers; i++ {
+		go m.handshakeWorker()
+	}
+	return m.server.Serve(m.listener)
 }
 
 func (m *middle) close() error {
-	close(m.listener.doneChan)
+	m.closeOnce.Do(func() {
+		close(m.listener.doneChan)
+	})
 	return nil
 }
 
-func (m *middle) dial(req *http.Request) (net.Conn, error) {
+// 停止接收新连接，并等待进行中的请求完成
+func (m *middle) shutdown(ctx context.Context) error {
+	m.close()
+	return m.server.Shutdown(ctx)
+}
+
+func (m *middle) handshakeWorker() {
+	for {
+		select {
+		case pipeServerConn := <-m.handshakeChan:
+			m.handshake(pipeServerConn)
+		case <-m.listener.doneChan:
+			return
+		}
+	}
+}
+
+// 等待握手名额，超时或 middle 关闭时返回 false
+func (m *middle) acquireHandshake() bool {
+	if m.handshakeSem == nil {
+		return true
+	}
+	select {
+	case m.handshakeSem <- struct{}{}:
+		return true
+	default:
+	}
+
+	atomic.AddInt64(&m.queuedHandshakes, 1)
+	defer atomic.AddInt64(&m.queuedHandshakes, -1)
+
+	timeout := m.proxy.Opts.HandshakeQueueTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case m.handshakeSem <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-m.listener.doneChan:
+		return false
+	}
+}
+
+func (m *middle) releaseHandshake() {
+	if m.handshakeSem != nil {
+		<-m.handshakeSem
+	}
+}
+
+const defaultHandshakeTimeout = 10 * time.Second
+
+func (m *middle) handshakeTimeout() time.Duration {
+	timeout := m.proxy.Opts.HandshakeTimeout
+	if timeout == 0 {
+		return defaultHandshakeTimeout
+	}
+	return timeout
+}
+
+// 与客户端进行 tls 握手，完成后交给 server 处理
+func (m *middle) handshake(pipeServerConn *pipeConn) {
+	if !m.acquireHandshake() {
+		log.Warnf("tls handshake from %v dropped: wait for handshake slot timeout", pipeServerConn.remoteAddr)
+		pipeServerConn.Close()
+		return
+	}
+	tlsConn := tls.Server(pipeServerConn, m.tlsConfig)
+	ctx := context.WithValue(context.Background(), connContextKey, pipeServerConn.connContext)
+	// 客户端只发送部分 ClientHello 时，避免一直占用握手名额及 worker
+	cancel := func() {}
+	if timeout := m.handshakeTimeout(); timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	err := tlsConn.HandshakeContext(ctx)
+	cancel()
+	m.releaseHandshake()
+	if err != nil {
+		log.Debugf("tls handshake error from %v: %v", pipeServerConn.remoteAddr, err)
+		tlsConn.Close()
+		return
+	}
+	pipeServerConn.connContext.ClientConn.TlsInfo = newTlsInfo(tlsConn.ConnectionState())
+
+	select {
+	case m.listener.connChan <- tlsConn:
+	case <-m.listener.doneChan:
+		tlsConn.Close()
+	}
+}
+
+func (m *middle) dial(f *Flow, req *http.Request) (net.Conn, error) {
 	pipeClientConn, pipeServerConn := newPipes(req)
+	pipeServerConn.flow = f
+	pipeServerConn.connectReq = req
 
 	if pipeServerConn.connContext.ClientConn.UpstreamCert {
 		err := pipeServerConn.connContext.initServerTcpConn(req)
@@ -158,26 +368,27 @@ func (m *middle) dial(req *http.Request) (net.Conn, error) {
 }
 
 func (m *middle) ServeHTTP(res http.ResponseWriter, req *http.Request) {
-	if strings.EqualFold(req.Header.Get("Connection"), "Upgrade") && strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
-		// wss
-		defaultWebSocket.wss(res, req)
-		return
-	}
-
 	if req.URL.Scheme == "" {
 		req.URL.Scheme = "https"
 	}
 	if req.URL.Host == "" {
 		req.URL.Host = req.Host
 	}
+
+	if isWebSocketUpgrade(req.Header) {
+		// wss
+		m.webSocket.wss(res, req)
+		return
+	}
 	m.proxy.ServeHTTP(res, req)
 }
 
 // 解析 connect 流量
-// 如果是 tls 流量，则进入 listener.Accept => Middle.ServeHTTP
-// 否则很可能是 ws 流量
+// 如果是 tls 流量，则进入 middle.handshake => listener.Accept => Middle.ServeHTTP
+// 明文 ws 的升级请求进入 webSocket.ws 解析消息
+// 否则（如 mqtt 或服务端先发送数据的协议）作为 tcp 流交给 Addon.TcpStream
 func (m *middle) intercept(pipeServerConn *pipeConn) {
-	buf, err := pipeServerConn.Peek(3)
+	buf, timeout, err := peekClient(pipeServerConn, 3)
 	if err != nil {
 		log.Errorf("Peek error: %v\n", err)
 		pipeServerConn.Close()
@@ -185,13 +396,38 @@ func (m *middle) intercept(pipeServerConn *pipeConn) {
 	}
 
 	// https://github.com/mitmproxy/mitmproxy/blob/main/mitmproxy/net/tls.py is_tls_record_magic
-	if buf[0] == 0x16 && buf[1] == 0x03 && buf[2] <= 0x03 {
+	if !timeout && buf[0] == 0x16 && buf[1] == 0x03 && buf[2] <= 0x03 {
 		// tls
 		pipeServerConn.connContext.ClientConn.Tls = true
+		if pipeServerConn.connContext.ClientConn.JA3 == "" {
+			pipeServerConn.SetReadDeadline(time.Now().Add(clientHelloPeekTimeout))
+			ja3, err := peekJA3(pipeServerConn.r)
+			pipeServerConn.SetReadDeadline(time.Time{})
+			if err == nil {
+				pipeServerConn.connContext.ClientConn.JA3 = ja3
+			} else {
+				log.Debugf("capture ja3 error: %v", err)
+			}
+		}
+		if m.proxy.shouldInterceptBySNI != nil && !m.shouldIntercept(pipeServerConn, true) {
+			m.passthrough(pipeServerConn)
+			return
+		}
 		pipeServerConn.connContext.initHttpsServerConn()
-		m.listener.connChan <- pipeServerConn
+		if m.handshakeChan == nil {
+			m.handshake(pipeServerConn)
+			return
+		}
+		select {
+		case m.handshakeChan <- pipeServerConn:
+		case <-m.listener.doneChan:
+			pipeServerConn.Close()
+		}
+	} else if m.proxy.shouldInterceptBySNI != nil && !m.shouldIntercept(pipeServerConn, false) {
+		m.passthrough(pipeServerConn)
+	} else if req := peekWebSocketUpgrade(pipeServerConn); req != nil {
+		m.webSocket.ws(pipeServerConn, req)
 	} else {
-		// ws
-		defaultWebSocket.ws(pipeServerConn, pipeServerConn.host)
+		m.tcpStream(pipeServerConn)
 	}
 }
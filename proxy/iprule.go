@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+	log "github.com/sirupsen/logrus"
+)
+
+// 根据目标 host 解析后的 IP 所属网段或 ASN 判断是否拦截
+// 用法: proxy.SetShouldInterceptRule(rule.Match)
+
+// 查询 IP 所属的 ASN
+type ASNLookup interface {
+	ASN(ip net.IP) (uint, error)
+}
+
+// 需通过 NewIPRule 创建
+type IPRule struct {
+	CIDRs     []string // 如 10.0.0.0/8, 2001:db8::/32
+	ASNs      []uint   // 如 16509，需要设置 ASNLookup
+	ASNLookup ASNLookup
+	Resolver  func(ctx context.Context, host string) ([]net.IP, error) // 为空时使用 proxy 的 Options.Resolver 及 dns 缓存，不经过 proxy 调用时使用 net.DefaultResolver
+	Timeout   time.Duration                                            // 解析 host 超时时间，0 表示 5s
+
+	nets []*net.IPNet
+}
+
+func NewIPRule(cidrs []string, asns []uint, asnLookup ASNLookup) (*IPRule, error) {
+	rule := &IPRule{
+		CIDRs:     cidrs,
+		ASNs:      asns,
+		ASNLookup: asnLookup,
+	}
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		rule.nets = append(rule.nets, ipnet)
+	}
+	if len(asns) > 0 && asnLookup == nil {
+		return nil, fmt.Errorf("asn rule need asn lookup")
+	}
+	return rule, nil
+}
+
+// req is received by proxy.server
+func (rule *IPRule) Match(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = req.Host
+	}
+
+	ips, err := rule.resolve(req.Context(), host)
+	if err != nil {
+		log.Debugf("ip rule resolve %v error: %v", host, err)
+		return false
+	}
+	for _, ip := range ips {
+		if rule.MatchIP(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *IPRule) MatchIP(ip net.IP) bool {
+	for _, ipnet := range rule.nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	if len(rule.ASNs) == 0 || rule.ASNLookup == nil {
+		return false
+	}
+	asn, err := rule.ASNLookup.ASN(ip)
+	if err != nil {
+		log.Debugf("ip rule asn lookup %v error: %v", ip, err)
+		return false
+	}
+	for _, a := range rule.ASNs {
+		if a == asn {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *IPRule) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	timeout := rule.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if rule.Resolver != nil {
+		return rule.Resolver(ctx, host)
+	}
+	// Match 的 req 为 proxy 收到的请求，context 中有对应的 proxy
+	if connCtx, ok := ctx.Value(connContextKey).(*ConnContext); ok && connCtx.proxy != nil {
+		addrs, err := connCtx.proxy.lookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		ips := make([]net.IP, 0, len(addrs))
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+		return ips, nil
+	}
+	return net.DefaultResolver.LookupIP(ctx, "ip", host)
+}
+
+// 基于 MaxMind ASN 数据库，如 GeoLite2-ASN.mmdb
+type MaxMindASNLookup struct {
+	db *maxminddb.Reader
+}
+
+func NewMaxMindASNLookup(filename string) (*MaxMindASNLookup, error) {
+	db, err := maxminddb.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &MaxMindASNLookup{db: db}, nil
+}
+
+func (l *MaxMindASNLookup) ASN(ip net.IP) (uint, error) {
+	var record struct {
+		AutonomousSystemNumber uint `maxminddb:"autonomous_system_number"`
+	}
+	if err := l.db.Lookup(ip, &record); err != nil {
+		return 0, err
+	}
+	return record.AutonomousSystemNumber, nil
+}
+
+func (l *MaxMindASNLookup) Close() error {
+	return l.db.Close()
+}
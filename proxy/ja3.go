@@ -0,0 +1,301 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JA3 客户端 tls 指纹: md5(SSLVersion,Ciphers,Extensions,EllipticCurves,EllipticCurvePointFormats)
+// https://github.com/salesforce/ja3
+
+var errNotClientHello = errors.New("not a tls client hello")
+
+const (
+	JA3ActionBlock       = "block"       // 关闭连接
+	JA3ActionRoute       = "route"       // 转发至 Addr，如蜜罐
+	JA3ActionPassthrough = "passthrough" // 不拦截，直接转发至目标服务器
+)
+
+type JA3Rule struct {
+	Hash   string // JA3 md5
+	Action string // block, route, passthrough
+	Addr   string // Action 为 route 时转发的地址 host:port
+}
+
+// 设置规则后，CONNECT 隧道会先返回 200 Connection Established 并读取客户端的 ClientHello 计算 JA3，
+// 在 SetShouldInterceptRule 的规则及 CONNECT flow 的 Addon.Requestheaders 之前按规则处理，二者均可通过 ClientConn.JA3 获取
+// block 时不连接上游；因 200 已返回，此时上游不可达或 Flow.Abort 只能关闭隧道，不再返回 502 等状态码
+// 客户端在 tcpPeekTimeout 内未发送数据时视为服务端先发送数据的协议，不计算 JA3
+// 拦截的 tls 连接无论是否设置规则都会记录 JA3，见 ClientConn.JA3
+func (proxy *Proxy) SetJA3Rules(rules []*JA3Rule) {
+	m := make(map[string]*JA3Rule, len(rules))
+	for _, rule := range rules {
+		m[strings.ToLower(rule.Hash)] = rule
+	}
+	proxy.ja3Rules = m
+}
+
+// 请求所在客户端连接的 JA3，供 SetShouldInterceptRule 的规则使用，未采集时为空
+func JA3FromRequest(req *http.Request) string {
+	if connCtx, ok := req.Context().Value(connContextKey).(*ConnContext); ok {
+		return connCtx.ClientConn.JA3
+	}
+	return ""
+}
+
+// 等待客户端发送 ClientHello 的时间
+const clientHelloPeekTimeout = 5 * time.Second
+
+// 预读 ClientHello 所需的缓冲大小，tls 记录头部 5 字节，内容最大 2^14+2048
+const maxTLSRecordSize = 5 + 1<<14 + 2048
+
+// 可以预读数据的 conn
+type peekConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekConn) Read(data []byte) (int, error) {
+	return c.r.Read(data)
+}
+
+// 预读 cconn 中的 ClientHello 记录 JA3，返回的 conn 替代 cconn 使用
+func captureJA3(client *ClientConn, cconn net.Conn) net.Conn {
+	pc := &peekConn{
+		Conn: cconn,
+		r:    bufio.NewReaderSize(cconn, maxTLSRecordSize),
+	}
+	defer cconn.SetReadDeadline(time.Time{})
+	cconn.SetReadDeadline(time.Now().Add(tcpPeekTimeout))
+	if b, err := pc.r.Peek(1); err != nil || b[0] != 0x16 {
+		return pc
+	}
+	cconn.SetReadDeadline(time.Now().Add(clientHelloPeekTimeout))
+	if ja3, err := peekJA3(pc.r); err == nil {
+		client.JA3 = ja3
+	}
+	return pc
+}
+
+func peekJA3(r *bufio.Reader) (string, error) {
+	hello, err := peekClientHello(r)
+	if err != nil {
+		return "", err
+	}
+	_, hash := hello.ja3()
+	return hash, nil
+}
+
+// record 为完整的 tls 记录，ClientHello 需在首个记录中
+func parseJA3(record []byte) (ja3 string, hash string, err error) {
+	hello, err := parseClientHello(record)
+	if err != nil {
+		return "", "", err
+	}
+	ja3, hash = hello.ja3()
+	return ja3, hash, nil
+}
+
+// JA3 及 SNI 使用的 ClientHello 字段，已去除 GREASE 值
+type clientHello struct {
+	version      uint16
+	ciphers      []string
+	extensions   []string
+	curves       []string
+	pointFormats []string
+	serverName   string
+}
+
+func (hello *clientHello) ja3() (ja3 string, hash string) {
+	ja3 = strings.Join([]string{
+		strconv.Itoa(int(hello.version)),
+		strings.Join(hello.ciphers, "-"),
+		strings.Join(hello.extensions, "-"),
+		strings.Join(hello.curves, "-"),
+		strings.Join(hello.pointFormats, "-"),
+	}, ",")
+	sum := md5.Sum([]byte(ja3))
+	return ja3, hex.EncodeToString(sum[:])
+}
+
+// 预读 r 中的首个 tls 记录并解析 ClientHello，不消耗数据，r 的缓冲需不小于 maxTLSRecordSize
+func peekClientHello(r *bufio.Reader) (*clientHello, error) {
+	header, err := r.Peek(5)
+	if err != nil {
+		return nil, err
+	}
+	if header[0] != 0x16 {
+		return nil, errNotClientHello
+	}
+	n := int(binary.BigEndian.Uint16(header[3:5]))
+	if 5+n > maxTLSRecordSize {
+		return nil, errNotClientHello
+	}
+	record, err := r.Peek(5 + n)
+	if err != nil {
+		return nil, err
+	}
+	return parseClientHello(record)
+}
+
+// record 为完整的 tls 记录，ClientHello 需在首个记录中
+func parseClientHello(record []byte) (*clientHello, error) {
+	if len(record) < 5 || record[0] != 0x16 {
+		return nil, errNotClientHello
+	}
+	s := cryptoString(record[5:])
+
+	var msgType uint8
+	var body cryptoString
+	if !s.readUint8(&msgType) || msgType != 1 || !s.readUint24LengthPrefixed(&body) {
+		return nil, errNotClientHello
+	}
+
+	hello := &clientHello{}
+	var random, sessionId, compression cryptoString
+	var cipherSuites cryptoString
+	if !body.readUint16(&hello.version) || !body.readBytes(&random, 32) ||
+		!body.readUint8LengthPrefixed(&sessionId) ||
+		!body.readUint16LengthPrefixed(&cipherSuites) ||
+		!body.readUint8LengthPrefixed(&compression) {
+		return nil, errNotClientHello
+	}
+
+	for len(cipherSuites) > 0 {
+		var c uint16
+		if !cipherSuites.readUint16(&c) {
+			return nil, errNotClientHello
+		}
+		if !isGREASE(c) {
+			hello.ciphers = append(hello.ciphers, strconv.Itoa(int(c)))
+		}
+	}
+
+	var exts cryptoString
+	if len(body) > 0 && !body.readUint16LengthPrefixed(&exts) {
+		return nil, errNotClientHello
+	}
+	for len(exts) > 0 {
+		var typ uint16
+		var data cryptoString
+		if !exts.readUint16(&typ) || !exts.readUint16LengthPrefixed(&data) {
+			return nil, errNotClientHello
+		}
+		if isGREASE(typ) {
+			continue
+		}
+		hello.extensions = append(hello.extensions, strconv.Itoa(int(typ)))
+
+		switch typ {
+		case 0: // server_name
+			var names cryptoString
+			if !data.readUint16LengthPrefixed(&names) {
+				return nil, errNotClientHello
+			}
+			for len(names) > 0 {
+				var nameType uint8
+				var name cryptoString
+				if !names.readUint8(&nameType) || !names.readUint16LengthPrefixed(&name) {
+					return nil, errNotClientHello
+				}
+				if nameType == 0 && hello.serverName == "" { // host_name
+					hello.serverName = string(name)
+				}
+			}
+		case 10: // supported_groups
+			var groups cryptoString
+			if !data.readUint16LengthPrefixed(&groups) {
+				return nil, errNotClientHello
+			}
+			for len(groups) > 0 {
+				var g uint16
+				if !groups.readUint16(&g) {
+					return nil, errNotClientHello
+				}
+				if !isGREASE(g) {
+					hello.curves = append(hello.curves, strconv.Itoa(int(g)))
+				}
+			}
+		case 11: // ec_point_formats
+			var formats cryptoString
+			if !data.readUint8LengthPrefixed(&formats) {
+				return nil, errNotClientHello
+			}
+			for _, f := range formats {
+				hello.pointFormats = append(hello.pointFormats, strconv.Itoa(int(f)))
+			}
+		}
+	}
+	return hello, nil
+}
+
+// https://datatracker.ietf.org/doc/html/rfc8701
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// 参考 golang.org/x/crypto/cryptobyte
+type cryptoString []byte
+
+func (s *cryptoString) read(n int) ([]byte, bool) {
+	if len(*s) < n || n < 0 {
+		return nil, false
+	}
+	v := (*s)[:n]
+	*s = (*s)[n:]
+	return v, true
+}
+
+func (s *cryptoString) readUint8(out *uint8) bool {
+	v, ok := s.read(1)
+	if !ok {
+		return false
+	}
+	*out = v[0]
+	return true
+}
+
+func (s *cryptoString) readUint16(out *uint16) bool {
+	v, ok := s.read(2)
+	if !ok {
+		return false
+	}
+	*out = binary.BigEndian.Uint16(v)
+	return true
+}
+
+func (s *cryptoString) readBytes(out *cryptoString, n int) bool {
+	v, ok := s.read(n)
+	if !ok {
+		return false
+	}
+	*out = v
+	return true
+}
+
+func (s *cryptoString) readUint8LengthPrefixed(out *cryptoString) bool {
+	var n uint8
+	return s.readUint8(&n) && s.readBytes(out, int(n))
+}
+
+func (s *cryptoString) readUint16LengthPrefixed(out *cryptoString) bool {
+	var n uint16
+	return s.readUint16(&n) && s.readBytes(out, int(n))
+}
+
+func (s *cryptoString) readUint24LengthPrefixed(out *cryptoString) bool {
+	v, ok := s.read(3)
+	if !ok {
+		return false
+	}
+	n := int(v[0])<<16 | int(v[1])<<8 | int(v[2])
+	return s.readBytes(out, n)
+}
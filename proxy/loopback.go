@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// 进程内回环模式: 不监听端口，直接将请求交给 ServeHTTP 处理，经过完整的 addon 流程
+// 设置 SetLoopbackUpstream 后上游也在内存中处理，便于确定性的测试及 addon 的 benchmark
+
+var errLoopbackAborted = errors.New("loopback: response aborted")
+
+// 设置 Proxy.RoundTrip 使用的上游，为 nil 时仍通过网络请求目标服务器
+func (proxy *Proxy) SetLoopbackUpstream(handler http.Handler) {
+	proxy.loopbackUpstream = handler
+}
+
+// 实现 http.RoundTripper，req 需为绝对 URL，如 http://example.com/path
+// 每次调用使用独立的 ConnContext，不复用连接
+func (proxy *Proxy) RoundTrip(req *http.Request) (res *http.Response, err error) {
+	if req.URL == nil || !req.URL.IsAbs() || req.URL.Host == "" {
+		return nil, errors.New("loopback: request url must be absolute")
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	connCtx := newConnContext(server, proxy)
+	if proxy.loopbackUpstream != nil {
+		connCtx.loopback = &loopbackTransport{handler: proxy.loopbackUpstream}
+	}
+	for _, addon := range proxy.Addons {
+		proxy.invokeConnAddon(addon, "ClientConnected", func() { addon.ClientConnected(connCtx.ClientConn) })
+	}
+	defer func() {
+		for _, addon := range proxy.Addons {
+			proxy.invokeConnAddon(addon, "ClientDisconnected", func() { addon.ClientDisconnected(connCtx.ClientConn) })
+		}
+	}()
+
+	// 模拟 proxy.server 收到的请求
+	ctx := context.WithValue(req.Context(), connContextKey, connCtx)
+	sreq := req.Clone(ctx)
+	sreq.RequestURI = req.URL.String()
+	sreq.RemoteAddr = server.RemoteAddr().String()
+	if sreq.Host == "" {
+		sreq.Host = req.URL.Host
+	}
+	if sreq.Body == nil {
+		sreq.Body = http.NoBody
+	}
+
+	w := newLoopbackResponseWriter()
+	defer func() {
+		if r := recover(); r != nil {
+			if r != http.ErrAbortHandler {
+				panic(r)
+			}
+			res, err = nil, errLoopbackAborted
+		}
+	}()
+	proxy.ServeHTTP(w, sreq)
+	return w.result(req), nil
+}
+
+// 在内存中调用 handler 作为上游
+type loopbackTransport struct {
+	handler http.Handler
+}
+
+func (t *loopbackTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	sreq := req.Clone(req.Context())
+	sreq.RequestURI = req.URL.RequestURI()
+	sreq.RemoteAddr = "loopback"
+	if sreq.Host == "" {
+		sreq.Host = req.URL.Host
+	}
+	if sreq.Body == nil {
+		sreq.Body = http.NoBody
+	}
+	defer sreq.Body.Close()
+
+	w := newLoopbackResponseWriter()
+	t.handler.ServeHTTP(w, sreq)
+	return w.result(req), nil
+}
+
+type loopbackResponseWriter struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	sentHeader  http.Header
+	body        bytes.Buffer
+}
+
+func newLoopbackResponseWriter() *loopbackResponseWriter {
+	return &loopbackResponseWriter{header: make(http.Header)}
+}
+
+func (w *loopbackResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *loopbackResponseWriter) WriteHeader(code int) {
+	// 1xx 响应不记录
+	if w.wroteHeader || (code >= 100 && code < 200 && code != http.StatusSwitchingProtocols) {
+		return
+	}
+	w.wroteHeader = true
+	w.status = code
+	w.sentHeader = w.header.Clone()
+}
+
+func (w *loopbackResponseWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.body.Write(data)
+}
+
+func (w *loopbackResponseWriter) Flush() {}
+
+func (w *loopbackResponseWriter) result(req *http.Request) *http.Response {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(w.status) + " " + http.StatusText(w.status),
+		StatusCode:    w.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.sentHeader,
+		Body:          ioutil.NopCloser(bytes.NewReader(w.body.Bytes())),
+		ContentLength: int64(w.body.Len()),
+		Request:       req,
+	}
+}
@@ -0,0 +1,248 @@
+// Package metrics 以 prometheus.Collector 的形式提供 proxy 的统计数据，作为 addon 添加到 proxy，可注册至已有的 prometheus.Registry
+// 仅此包依赖 Prometheus 客户端，proxy 本身不引入
+//
+// 例如:
+//
+//	m := metrics.New(nil)
+//	p.AddAddon(m)
+//	prometheus.MustRegister(m)
+//	http.Handle("/metrics", promhttp.Handler())
+//
+// 或不使用已有的 Registry，直接以 m 作为 handler: http.Handle("/metrics", m)
+//
+// 输出的指标，除 go_mitmproxy_flows_in_flight 外均按 method 及 status_class（2xx、5xx 等，未响应时为 none）区分:
+//
+//	go_mitmproxy_flows_total                 已结束的 flow 数
+//	go_mitmproxy_flows_in_flight             进行中的 flow 数，按 method 区分
+//	go_mitmproxy_request_bytes_total         发往上游的请求 body 字节数，CONNECT 隧道为客户端发出的字节数
+//	go_mitmproxy_response_bytes_total        从上游接收的响应 body 字节数，CONNECT 隧道为上游发出的字节数
+//	go_mitmproxy_upstream_errors_total       请求或连接上游失败（Flow.Err）的 flow 数，不包括 Flow.Abort
+//	go_mitmproxy_flow_duration_seconds       proxy 收到请求至 flow 结束的耗时
+//
+// http2 客户端连接上的 stream 按连接汇总，不区分标签:
+//
+//	go_mitmproxy_h2_streams_in_flight                    进行中的 stream 数
+//	go_mitmproxy_h2_connection_streams                   每个连接上的 stream 总数，连接断开时记录
+//	go_mitmproxy_h2_connection_max_concurrent_streams    每个连接上同时进行的 stream 数峰值，连接断开时记录
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	uuid "github.com/satori/go.uuid"
+)
+
+// 与 Prometheus 客户端的默认值相同
+var DefaultBuckets = prometheus.DefBuckets
+
+// Requestheaders 中记录的 method，flow 结束时据此减少进行中的数量，addon 之后修改 method 不影响
+const inFlightMetadataKey = "metrics.inflight"
+
+// Requestheaders 中记录的 http2 连接统计，flow 结束时据此减少进行中的 stream 数
+const h2ConnMetadataKey = "metrics.h2conn"
+
+// stream 数直方图的上界: 1、2、4 ... 512
+var streamBuckets = prometheus.ExponentialBuckets(1, 2, 10)
+
+var seriesLabels = []string{"method", "status_class"}
+
+type Metrics struct {
+	proxy.BaseAddon
+
+	flows          *prometheus.CounterVec
+	inFlight       *prometheus.GaugeVec
+	requestBytes   *prometheus.CounterVec
+	responseBytes  *prometheus.CounterVec
+	upstreamErrors *prometheus.CounterVec
+	duration       *prometheus.HistogramVec
+
+	h2InFlight      prometheus.Gauge
+	h2Streams       prometheus.Histogram
+	h2MaxConcurrent prometheus.Histogram
+
+	h2Mu    sync.Mutex
+	h2Conns map[uuid.UUID]*h2ConnStat // 按 ClientConn.Id
+
+	handler http.Handler
+}
+
+type h2ConnStat struct {
+	total         int
+	active        int
+	maxConcurrent int
+}
+
+// buckets 为耗时直方图的上界（秒），为空时使用 DefaultBuckets
+func New(buckets []float64) *Metrics {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	sorted := append([]float64{}, buckets...)
+	sort.Float64s(sorted)
+	m := &Metrics{
+		flows: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "go_mitmproxy_flows_total",
+			Help: "Total number of finished flows.",
+		}, seriesLabels),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "go_mitmproxy_flows_in_flight",
+			Help: "Number of flows in progress.",
+		}, []string{"method"}),
+		requestBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "go_mitmproxy_request_bytes_total",
+			Help: "Total request body bytes sent upstream.",
+		}, seriesLabels),
+		responseBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "go_mitmproxy_response_bytes_total",
+			Help: "Total response body bytes received from upstream.",
+		}, seriesLabels),
+		upstreamErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "go_mitmproxy_upstream_errors_total",
+			Help: "Total number of flows failed to request upstream.",
+		}, seriesLabels),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "go_mitmproxy_flow_duration_seconds",
+			Help:    "Duration of flows from request received to flow done.",
+			Buckets: sorted,
+		}, seriesLabels),
+		h2InFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "go_mitmproxy_h2_streams_in_flight",
+			Help: "Number of http2 streams in progress.",
+		}),
+		h2Streams: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "go_mitmproxy_h2_connection_streams",
+			Help:    "Number of streams per closed http2 client connection.",
+			Buckets: streamBuckets,
+		}),
+		h2MaxConcurrent: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "go_mitmproxy_h2_connection_max_concurrent_streams",
+			Help:    "Peak number of concurrent streams per closed http2 client connection.",
+			Buckets: streamBuckets,
+		}),
+		h2Conns: make(map[uuid.UUID]*h2ConnStat),
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(m)
+	m.handler = promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	return m
+}
+
+// 客户端可发送任意 method，不在此列表中的记为 OTHER，避免标签数量无限增长
+func methodLabel(method string) string {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH":
+		return method
+	}
+	return "OTHER"
+}
+
+func statusClass(code int) string {
+	if code < 100 || code > 599 {
+		return "none"
+	}
+	return strconv.Itoa(code/100) + "xx"
+}
+
+func (m *Metrics) Requestheaders(f *proxy.Flow) {
+	method := methodLabel(f.Request.Method)
+	f.SetMetadata(inFlightMetadataKey, method)
+	m.inFlight.WithLabelValues(method).Inc()
+
+	if f.Request.Proto != "HTTP/2.0" {
+		return
+	}
+	id := f.ConnContext.ClientConn.Id
+	m.h2Mu.Lock()
+	conn, ok := m.h2Conns[id]
+	if !ok {
+		conn = &h2ConnStat{}
+		m.h2Conns[id] = conn
+	}
+	conn.total++
+	conn.active++
+	if conn.active > conn.maxConcurrent {
+		conn.maxConcurrent = conn.active
+	}
+	m.h2Mu.Unlock()
+	f.SetMetadata(h2ConnMetadataKey, conn)
+	m.h2InFlight.Inc()
+}
+
+func (m *Metrics) FlowDone(f *proxy.Flow) {
+	duration := time.Since(f.Stats.Start).Seconds()
+	var abortErr *proxy.AbortError
+	upstreamError := f.Err != nil && !errors.As(f.Err, &abortErr)
+	method := methodLabel(f.Request.Method)
+	class := statusClass(f.StatusCode())
+
+	// 之前的 addon 在 Requestheaders 中 Abort 时不会调用本 addon 的 Requestheaders
+	if method, ok := f.Metadata(inFlightMetadataKey); ok {
+		m.inFlight.WithLabelValues(method.(string)).Dec()
+	}
+	if conn, ok := f.Metadata(h2ConnMetadataKey); ok {
+		m.h2Mu.Lock()
+		conn.(*h2ConnStat).active--
+		m.h2Mu.Unlock()
+		m.h2InFlight.Dec()
+	}
+	m.flows.WithLabelValues(method, class).Inc()
+	m.requestBytes.WithLabelValues(method, class).Add(float64(f.Stats.RequestBytes))
+	m.responseBytes.WithLabelValues(method, class).Add(float64(f.Stats.ResponseBytes))
+	// 没有错误时也输出 0，便于计算错误率
+	upstreamErrors := m.upstreamErrors.WithLabelValues(method, class)
+	if upstreamError {
+		upstreamErrors.Inc()
+	}
+	m.duration.WithLabelValues(method, class).Observe(duration)
+}
+
+func (m *Metrics) ClientDisconnected(client *proxy.ClientConn) {
+	m.h2Mu.Lock()
+	conn, ok := m.h2Conns[client.Id]
+	delete(m.h2Conns, client.Id)
+	m.h2Mu.Unlock()
+	if !ok {
+		return
+	}
+	m.h2Streams.Observe(float64(conn.total))
+	m.h2MaxConcurrent.Observe(float64(conn.maxConcurrent))
+}
+
+// prometheus.Collector
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.flows.Describe(ch)
+	m.inFlight.Describe(ch)
+	m.requestBytes.Describe(ch)
+	m.responseBytes.Describe(ch)
+	m.upstreamErrors.Describe(ch)
+	m.duration.Describe(ch)
+	m.h2InFlight.Describe(ch)
+	m.h2Streams.Describe(ch)
+	m.h2MaxConcurrent.Describe(ch)
+}
+
+// prometheus.Collector
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.flows.Collect(ch)
+	m.inFlight.Collect(ch)
+	m.requestBytes.Collect(ch)
+	m.responseBytes.Collect(ch)
+	m.upstreamErrors.Collect(ch)
+	m.duration.Collect(ch)
+	m.h2InFlight.Collect(ch)
+	m.h2Streams.Collect(ch)
+	m.h2MaxConcurrent.Collect(ch)
+}
+
+// 仅输出本 addon 的指标，供 Prometheus 抓取；已注册至其他 Registry 时使用该 Registry 的 handler
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.handler.ServeHTTP(w, r)
+}
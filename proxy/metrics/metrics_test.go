@@ -0,0 +1,249 @@
+package metrics
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lqqyt2423/go-mitmproxy/cert"
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/http2"
+)
+
+func TestMetrics(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+
+	// 已关闭的端口，请求上游失败
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	testProxy, err := proxy.NewProxy(&proxy.Options{HttpAddr: ":29155"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := New([]float64{1, 0.001})
+	testProxy.AddAddon(m)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29155")
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	do := func(method, rawurl, body string) int {
+		t.Helper()
+		req, err := http.NewRequest(method, rawurl, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		ioutil.ReadAll(res.Body)
+		return res.StatusCode
+	}
+	do("GET", origin.URL, "")
+	do("POST", origin.URL, "abc")
+	do("GET", origin.URL+"/missing", "")
+	if status := do("GET", "http://"+closedAddr+"/", ""); status != http.StatusBadGateway {
+		t.Fatalf("expected 502, got %v", status)
+	}
+	do("PROPFIND", origin.URL, "")
+
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+			t.Fatalf("unexpected content type %v", rec.Header().Get("Content-Type"))
+		}
+		return rec.Body.String()
+	}
+	// FlowDone 在响应写入客户端之后触发
+	var text string
+	for i := 0; i < 100; i++ {
+		text = scrape()
+		if strings.Contains(text, `go_mitmproxy_flows_total{method="OTHER",status_class="2xx"} 1`) &&
+			strings.Contains(text, `go_mitmproxy_flows_in_flight{method="GET"} 0`) {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	for _, line := range []string{
+		"# TYPE go_mitmproxy_flows_total counter",
+		`go_mitmproxy_flows_total{method="GET",status_class="2xx"} 1`,
+		`go_mitmproxy_flows_total{method="GET",status_class="4xx"} 1`,
+		`go_mitmproxy_flows_total{method="GET",status_class="5xx"} 1`,
+		`go_mitmproxy_flows_total{method="POST",status_class="2xx"} 1`,
+		`go_mitmproxy_flows_total{method="OTHER",status_class="2xx"} 1`,
+		`go_mitmproxy_flows_in_flight{method="GET"} 0`,
+		`go_mitmproxy_request_bytes_total{method="POST",status_class="2xx"} 3`,
+		`go_mitmproxy_response_bytes_total{method="GET",status_class="2xx"} 5`,
+		`go_mitmproxy_upstream_errors_total{method="GET",status_class="2xx"} 0`,
+		`go_mitmproxy_upstream_errors_total{method="GET",status_class="5xx"} 1`,
+		"# TYPE go_mitmproxy_flow_duration_seconds histogram",
+		`go_mitmproxy_flow_duration_seconds_bucket{method="GET",status_class="2xx",le="1"} 1`,
+		`go_mitmproxy_flow_duration_seconds_bucket{method="GET",status_class="2xx",le="+Inf"} 1`,
+		`go_mitmproxy_flow_duration_seconds_count{method="GET",status_class="2xx"} 1`,
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Fatalf("expected line %v in:\n%v", line, text)
+		}
+	}
+	// buckets 按上界排序
+	if strings.Index(text, `le="0.001"`) > strings.Index(text, `le="1"`) {
+		t.Fatalf("buckets should be sorted:\n%v", text)
+	}
+
+	// 可注册至已有的 Registry
+	registry := prometheus.NewPedanticRegistry()
+	if err := registry.Register(m); err != nil {
+		t.Fatal(err)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total float64
+	for _, family := range families {
+		if family.GetName() != "go_mitmproxy_flows_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			total += metric.GetCounter().GetValue()
+		}
+	}
+	if total != 5 {
+		t.Fatalf("expected 5 flows gathered, but got %v", total)
+	}
+}
+
+func TestMetricsH2(t *testing.T) {
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("hello"))
+		}),
+	}
+	if err := http2.ConfigureServer(server, nil); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	ca, err := cert.NewCAMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := ca.GetCert("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(tls.NewListener(ln, &tls.Config{
+		Certificates: []tls.Certificate{*serverCert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}))
+	endpoint := "https://localhost:" + strconv.Itoa(ln.Addr().(*net.TCPAddr).Port) + "/"
+
+	testProxy, err := proxy.NewProxy(&proxy.Options{
+		HttpAddr:    ":29166",
+		SslInsecure: true,
+		EnableHTTP2: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := New(nil)
+	testProxy.AddAddon(m)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	transport := &http.Transport{
+		ForceAttemptHTTP2: true,
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		Proxy: func(r *http.Request) (*url.URL, error) {
+			return url.Parse("http://127.0.0.1:29166")
+		},
+	}
+	client := &http.Client{Transport: transport}
+	get := func() {
+		res, err := client.Get(endpoint)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer res.Body.Close()
+		ioutil.ReadAll(res.Body)
+		if res.Proto != "HTTP/2.0" {
+			t.Errorf("expected HTTP/2.0, but got %v", res.Proto)
+		}
+	}
+	// 首个请求建立连接，之后的请求复用同一连接
+	get()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			get()
+		}()
+	}
+	wg.Wait()
+	// 客户端断开连接时记录该连接的汇总
+	transport.CloseIdleConnections()
+
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		return rec.Body.String()
+	}
+	var text string
+	for i := 0; i < 100; i++ {
+		text = scrape()
+		if strings.Contains(text, "go_mitmproxy_h2_connection_streams_count 1\n") {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	for _, line := range []string{
+		"go_mitmproxy_h2_streams_in_flight 0",
+		"go_mitmproxy_h2_connection_streams_count 1",
+		"go_mitmproxy_h2_connection_streams_sum 4",
+		`go_mitmproxy_h2_connection_streams_bucket{le="2"} 0`,
+		`go_mitmproxy_h2_connection_streams_bucket{le="4"} 1`,
+		"go_mitmproxy_h2_connection_max_concurrent_streams_count 1",
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Fatalf("expected line %v in:\n%v", line, text)
+		}
+	}
+}
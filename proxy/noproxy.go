@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/tidwall/match"
+)
+
+// Options.NoProxy: 匹配的目标 host 不使用上游代理（Options.Upstream、SetUpstreamProxy、PacUrl 及环境变量），直接连接
+// 规则同 NO_PROXY 环境变量:
+//
+//	*                 所有 host
+//	10.0.0.0/8        CIDR，仅匹配 ip 形式的 host，不解析域名
+//	192.168.1.1       ip
+//	example.com       example.com 及其子域名，同 .example.com
+//	*.example.com     通配符，同 Options.BlockHosts
+//
+// loopback（localhost、127.0.0.0/8、::1）及 link-local 地址默认直连，Options.ProxyLoopback 为 true 时使用上游代理
+// addon 设置的 Flow.UpstreamProxy 不受影响
+
+type noProxy struct {
+	all      bool
+	nets     []*net.IPNet
+	hosts    blockHosts
+	loopback bool // loopback 及 link-local 直连
+}
+
+func newNoProxy(patterns []string, proxyLoopback bool) (*noProxy, error) {
+	p := &noProxy{loopback: !proxyLoopback}
+	var hosts []string
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		switch {
+		case pattern == "":
+			continue
+		case pattern == "*":
+			p.all = true
+		case strings.Contains(pattern, "/"):
+			_, ipnet, err := net.ParseCIDR(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("no proxy %v: %w", pattern, err)
+			}
+			p.nets = append(p.nets, ipnet)
+		case net.ParseIP(strings.Trim(pattern, "[]")) != nil:
+			hosts = append(hosts, strings.Trim(pattern, "[]"))
+		case strings.HasPrefix(pattern, ".") || match.IsPattern(pattern):
+			hosts = append(hosts, pattern)
+		default:
+			hosts = append(hosts, "."+pattern)
+		}
+	}
+	p.hosts = newBlockHosts(hosts)
+	return p, nil
+}
+
+// host 可包含端口
+func (p *noProxy) match(host string) bool {
+	if p.all {
+		return true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+
+	ipHost := host
+	if i := strings.IndexByte(ipHost, '%'); i >= 0 { // ipv6 zone
+		ipHost = ipHost[:i]
+	}
+	if ip := net.ParseIP(ipHost); ip != nil {
+		if p.loopback && (ip.IsLoopback() || ip.IsLinkLocalUnicast()) {
+			return true
+		}
+		for _, ipnet := range p.nets {
+			if ipnet.Contains(ip) {
+				return true
+			}
+		}
+	} else if p.loopback && (host == "localhost" || strings.HasSuffix(host, ".localhost")) {
+		return true
+	}
+	return p.hosts.match(host)
+}
@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lqqyt2423/go-mitmproxy/internal/pac"
+	log "github.com/sirupsen/logrus"
+)
+
+// Options.PacUrl，按 PAC 文件的 FindProxyForURL 为每个请求选择上游代理
+// PAC 文件在 Proxy.Start 时获取，获取或解析失败时 Start 返回错误
+// 之后每隔 Options.PacRefreshInterval 在后台重新获取，失败时继续使用之前的脚本
+// 脚本由 otto 执行，执行出错或结果中没有可用的项时直连
+// 结果按顺序使用首个可用的项，不会在上游代理连接失败时尝试下一项:
+//   DIRECT           直连
+//   PROXY host:port  http 代理，同 HTTP
+//   SOCKS host:port  socks5 代理，同 SOCKS5
+// HTTPS、SOCKS4 暂不支持，跳过
+
+const defaultPacRefreshInterval = 10 * time.Minute
+
+// 获取失败时的重试间隔
+const pacRetryInterval = time.Minute
+
+type pacUpstream struct {
+	src      string
+	interval time.Duration
+	fetch    func() ([]byte, error)
+	resolver *net.Resolver // Options.Resolver，用于 dnsResolve 等函数，为 nil 时使用系统的解析器
+
+	loadMu     sync.Mutex // 首次获取时其他请求等待
+	mu         sync.Mutex
+	script     *pac.Script
+	nextFetch  time.Time
+	refreshing bool
+}
+
+// src 为 http(s) url、file url 或本地文件路径
+func newPacUpstream(src string, interval time.Duration) (*pacUpstream, error) {
+	if interval <= 0 {
+		interval = defaultPacRefreshInterval
+	}
+	p := &pacUpstream{src: src, interval: interval}
+
+	u, err := url.Parse(src)
+	if err != nil {
+		return nil, fmt.Errorf("parse pac url: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		// PAC 文件通常在内网，直接请求
+		client := &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{Proxy: nil},
+		}
+		p.fetch = func() ([]byte, error) {
+			res, err := client.Get(src)
+			if err != nil {
+				return nil, err
+			}
+			defer res.Body.Close()
+			if res.StatusCode != 200 {
+				return nil, fmt.Errorf("unexpected status %v", res.StatusCode)
+			}
+			return ioutil.ReadAll(res.Body)
+		}
+	case "file":
+		p.fetch = func() ([]byte, error) { return ioutil.ReadFile(u.Path) }
+	case "":
+		p.fetch = func() ([]byte, error) { return ioutil.ReadFile(src) }
+	default:
+		return nil, fmt.Errorf("invalid pac url %v, should be http(s) url or file path", src)
+	}
+	return p, nil
+}
+
+// Proxy.Start 时同步获取一次，失败时 Start 返回错误
+func (p *pacUpstream) init() error {
+	p.loadMu.Lock()
+	defer p.loadMu.Unlock()
+	return p.load()
+}
+
+// 获取失败时保留之前的脚本
+func (p *pacUpstream) load() error {
+	body, err := p.fetch()
+	var script *pac.Script
+	if err == nil {
+		script, err = pac.Parse(string(body))
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refreshing = false
+	if err != nil {
+		log.Warnf("pac %v: %v", p.src, err)
+		retry := pacRetryInterval
+		if p.interval < retry {
+			retry = p.interval
+		}
+		p.nextFetch = time.Now().Add(retry)
+		return fmt.Errorf("pac %v: %w", p.src, err)
+	}
+	script.Alert = func(msg string) { log.Infof("pac alert: %v", msg) }
+	if resolver := p.resolver; resolver != nil {
+		script.LookupIP = func(host string) ([]net.IP, error) {
+			return resolver.LookupIP(context.Background(), "ip", host)
+		}
+	}
+	p.script = script
+	p.nextFetch = time.Now().Add(p.interval)
+	log.Debugf("pac %v loaded", p.src)
+	return nil
+}
+
+func (p *pacUpstream) current() (*pac.Script, error) {
+	p.mu.Lock()
+	script, due := p.script, !time.Now().Before(p.nextFetch)
+	if script != nil && due && !p.refreshing {
+		p.refreshing = true
+		go p.load()
+	}
+	p.mu.Unlock()
+	if script != nil {
+		return script, nil
+	}
+	if !due {
+		return nil, fmt.Errorf("pac %v not loaded", p.src)
+	}
+
+	// 未调用 Start 时在首次使用时获取
+	p.loadMu.Lock()
+	defer p.loadMu.Unlock()
+	p.mu.Lock()
+	script, due = p.script, !time.Now().Before(p.nextFetch)
+	p.mu.Unlock()
+	if script != nil {
+		return script, nil
+	}
+	if !due {
+		return nil, fmt.Errorf("pac %v not loaded", p.src)
+	}
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.script, nil
+}
+
+// req 为客户端的请求，CONNECT 时按浏览器的做法只传入 https://host/
+// 没有可用的脚本时返回错误，执行出错时直连
+func (p *pacUpstream) proxyFor(req *http.Request) (*url.URL, error) {
+	script, err := p.current()
+	if err != nil {
+		return nil, err
+	}
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	rawurl := "https://" + host + "/"
+	if req.Method != "CONNECT" && req.URL.IsAbs() {
+		rawurl = req.URL.String()
+	}
+
+	result, err := script.FindProxyForURL(rawurl, host)
+	if err != nil {
+		log.Warnf("pac FindProxyForURL(%v): %v, use direct", rawurl, err)
+		return nil, nil
+	}
+	return parsePacResult(result), nil
+}
+
+// 如 "PROXY proxy:8080; SOCKS5 127.0.0.1:1080; DIRECT"，返回首个可用项对应的上游代理，直连时为 nil
+func parsePacResult(result string) *url.URL {
+	for _, entry := range strings.Split(result, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		var scheme string
+		switch strings.ToUpper(fields[0]) {
+		case "DIRECT":
+			return nil
+		case "PROXY", "HTTP":
+			scheme = "http"
+		case "SOCKS", "SOCKS5":
+			scheme = "socks5"
+		default:
+			log.Debugf("pac: skip unsupported %v", entry)
+			continue
+		}
+		if len(fields) < 2 {
+			continue
+		}
+		return &url.URL{Scheme: scheme, Host: fields[1]}
+	}
+	return nil
+}
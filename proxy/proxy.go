@@ -5,25 +5,100 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
+	"fmt"
 	"github.com/armon/go-socks5"
 	"github.com/haxii/fastproxy/bufiopool"
 	"github.com/haxii/fastproxy/superproxy"
+	"github.com/lqqyt2423/go-mitmproxy/cert"
 	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/match"
 	"io"
+	"io/ioutil"
+	stdlog "log"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
 	"net/url"
+	"os/signal"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 type Options struct {
-	Debug             int
-	HttpAddr          string
-	SocksAddr         string
-	StreamLargeBodies int64 // 当请求或响应体大于此字节时，转为 stream 模式
-	SslInsecure       bool
-	CaRootPath        string
-	Upstream          string
+	Debug                     int
+	HttpAddr                  string // 监听地址，以 unix: 开头时监听 unix socket，如 unix:/var/run/go-mitmproxy.sock
+	SocksAddr                 string
+	SocksAuth                 map[string]string // socks5 代理的用户名及密码，为空时不需要认证
+	StreamLargeBodies         int64             // 当请求或响应体大于此字节时，转为 stream 模式
+	SslInsecure               bool
+	EnableHTTP2               bool                   // 允许客户端及上游使用 http2，拦截的 https 连接会通过 ALPN 协商 h2
+	InsecureHosts             []string               // 不校验上游证书的 host 列表，支持通配符，如 *.dev.example.com
+	InsecureSkipVerifyForHost func(host string) bool // 返回是否跳过 host 的上游证书校验，设置时优先于 SslInsecure 及 InsecureHosts，host 不含端口
+	BlockHosts                []string               // 拒绝请求的 host 列表，支持通配符及以 . 开头的后缀，如 *.ads.example.com、.tracker.com，不会拦截或连接上游
+	BlockStatus               int                    // 拒绝 BlockHosts 时的状态码，默认 403
+	BlockBody                 []byte                 // 拒绝 BlockHosts 时的响应 body，CONNECT 隧道不发送
+	CaRootPath                string
+	CaCert                    []byte                    // pem 格式的 CA 证书，与 CaKey 同时设置时优先于 CaRootPath 使用，不读写磁盘
+	CaKey                     []byte                    // pem 格式的 CA 私钥
+	CertCacheDir              string                    // 签发的证书持久化目录，重启后复用，为空时不持久化
+	CertKeyType               string                    // 签发证书的密钥类型: rsa、ecdsa-p256、ed25519，默认 rsa，客户端不支持时使用 rsa
+	CAs                       []*cert.CA                // 默认 CA 之外的 CA，由 SelectCA 选择，CertKeyType 同样适用，CertCacheDir 中按 CA 分子目录保存
+	SelectCA                  func(sni string) *cert.CA // 返回为 sni 签发证书的 CA（默认 CA 或 CAs 之一），未设置或返回 nil 时使用默认 CA
+	SslKeyLogFile             string                    // 记录 tls 密钥供 Wireshark 解密，包括与上游及与客户端的连接，优先于环境变量 SSLKEYLOGFILE
+	Upstream                  string
+	PacUrl                    string                                                            // PAC 文件的 url 或本地路径，按 FindProxyForURL 为每个请求选择上游代理，优先级低于 Upstream
+	PacRefreshInterval        time.Duration                                                     // 重新获取 PAC 文件的间隔，为 0 时默认 10 分钟
+	NoProxy                   []string                                                          // 不使用上游代理直接连接的 host 列表，支持后缀、通配符、ip 及 CIDR，如 .corp.example.com、10.0.0.0/8，* 匹配所有
+	ProxyLoopback             bool                                                              // loopback（localhost、127.0.0.0/8、::1）及 link-local 地址也使用上游代理，默认直连
+	Transparent               bool                                                              // 透明代理模式，通过 SO_ORIGINAL_DST 获取 iptables REDIRECT 前的目标地址，仅支持 linux
+	ReverseProxyUpstream      string                                                            // 反向代理模式的上游，如 http://127.0.0.1:8080，设置后客户端可直接请求 proxy，请求将转发至此上游
+	PreferHostHeader          bool                                                              // Host header 与 URL 中的 host 不一致时，发往上游的 Host 使用 header，默认使用 URL 中的 host
+	PreserveHeaders           []string                                                          // 转发时保留的 hop-by-hop header，如 Proxy-Authorization，默认移除，见 hopheader.go
+	ReadHeaderTimeout         time.Duration                                                     // 读取客户端请求头的超时时间，防止 slowloris 攻击，默认 10s，小于 0 时不限制
+	ReadTimeout               time.Duration                                                     // 读取客户端整个请求的超时时间，为 0 时不限制
+	WriteTimeout              time.Duration                                                     // 写入响应的超时时间，为 0 时不限制，streaming 的大响应需设置足够长
+	ConnectTimeout            time.Duration                                                     // 连接上游的超时时间，超时后 CONNECT 返回 504，为 0 时不限制
+	UpstreamTimeout           time.Duration                                                     // 请求上游至收到完整响应的超时时间，超时后返回 504，stream 的响应 body 不受限制，为 0 时不限制
+	TunnelIdleTimeout         time.Duration                                                     // CONNECT 隧道两个方向均无数据传输超过此时间时关闭，Flow.Err 为 ErrTunnelIdleTimeout，为 0 时不限制
+	MaxIdleConns              int                                                               // 上游连接池的空闲连接总数上限，为 0 时不限制，统计通过 Proxy.UpstreamPoolStats 获取
+	MaxIdleConnsPerHost       int                                                               // 每个上游 host 的空闲连接数上限，为 0 时为 http.DefaultMaxIdleConnsPerHost（2）
+	IdleConnTimeout           time.Duration                                                     // 上游空闲连接的保留时间，为 0 时不限制
+	Resolver                  *net.Resolver                                                     // 解析上游 host 使用的 dns 解析器，如指定 dns 服务器，为 nil 时使用系统的解析器，Options.DialUpstream 不受影响
+	DNSCacheTTL               time.Duration                                                     // 连接上游时 dns 解析结果的缓存时间，为 0 时不缓存，缓存统计通过 Proxy.DNSCacheStats 获取
+	DNSNegativeTTL            time.Duration                                                     // dns 解析失败结果的缓存时间，仅当 DNSCacheTTL > 0 时生效，为 0 时不缓存
+	MaxConnections            int                                                               // 同时处理的客户端连接数上限，达到上限时暂停 accept 直至有连接关闭，socks5 连接经 http 端口的隧道同样计入，为 0 时不限制
+	MaxConnectRetries         int                                                               // CONNECT 连接上游遇到连接被拒绝、超时等临时错误时的最大重试次数，为 0 时不重试
+	MaxRetries                int                                                               // GET、HEAD、PUT、DELETE 等幂等请求遇到连接被拒绝、重置等临时错误时的最大重试次数，stream 模式的请求不重试，为 0 时不重试
+	RetryBackoff              time.Duration                                                     // MaxRetries 首次重试前的等待时间，之后每次翻倍，默认 100ms
+	DialUpstream              func(ctx context.Context, network, addr string) (net.Conn, error) // 自定义连接上游的方式，addr 为目标服务器或上游代理地址，返回 ErrUseDefaultDialer 时使用默认方式
+	HandshakeWorkers          int                                                               // 处理客户端 tls 握手的 worker 数量，为 0 时每个连接单独处理，不限制并发
+	HandshakeBacklog          int                                                               // 等待 worker 处理 tls 握手的队列长度，仅当 HandshakeWorkers > 0 时生效
+	MaxConcurrentHandshakes   int                                                               // 同时进行的 tls 握手数上限，为 0 时不限制
+	HandshakeQueueTimeout     time.Duration                                                     // 等待握手名额的超时时间，超时后关闭连接，默认 10s
+	HandshakeTimeout          time.Duration                                                     // 与客户端 tls 握手的超时时间（UpstreamCert 时包括与上游的握手），超时后关闭连接并释放握手名额，默认 10s，小于 0 时不限制
+	DryRun                    bool                                                              // 仅记录 addon 将要对 flow 做出的修改，不实际修改，不调用 addon 的 Stream*Modifier
+	AddonStats                bool                                                              // 记录每个 addon 事件的调用耗时，通过 Proxy.AddonStats 获取
+	AddonHeaderBudget         time.Duration                                                     // 每个 flow 中 Requestheaders、Responseheaders 事件 addon 的总耗时上限，超出后跳过剩余的回调，为 0 时不限制
+	AddonBodyBudget           time.Duration                                                     // 每个 flow 中 Request、Response 事件 addon 的总耗时上限，超出后跳过剩余的回调，为 0 时不限制
+	ResponseFraming           string                                                            // 响应 body 的发送方式，见 FramingContentLength、FramingChunked，默认与 net/http 一致
+	MaxDecompressedSize       int64                                                             // DecodedBody 解压后的最大字节数，超过时返回 ErrDecompressedTooLarge
+	ShutdownGrace             time.Duration                                                     // RunWithSignals 收到退出信号后等待进行中 flow 完成的时间，默认 30s
+	AccessLog                 bool                                                              // 每个 flow 结束时记录一行访问日志，见 accesslog.go
+	AccessLogFormat           string                                                            // 访问日志的输出格式: text、json，与 AccessLogLevel 均为空时使用 logrus 的全局 logger，只作用于访问日志
+	AccessLogLevel            string                                                            // 访问日志 logger 的级别，如 warn 时只记录出错的 flow，不修改 logrus 的全局设置
+	AccessLogIgnoreHosts      []string                                                          // 不记录访问日志的 host 列表，支持通配符及以 . 开头的后缀，如健康检查的 host
+	AccessLogFilter           func(f *Flow) bool                                                // 返回 false 时不记录该 flow 的访问日志，在 AccessLogIgnoreHosts 之后判断
+
+	ClientCertFile       string                                                                        // 连接上游时提供的客户端证书（mTLS），pem 格式
+	ClientCertKeyFile    string                                                                        // ClientCertFile 的私钥，为空时从 ClientCertFile 中读取
+	GetClientCertificate func(host string, info *tls.CertificateRequestInfo) (*tls.Certificate, error) // 按目标 host 选择客户端证书，返回 nil 时使用 ClientCertFile
 }
 
 type Proxy struct {
@@ -31,24 +106,88 @@ type Proxy struct {
 	Version string
 	Addons  []Addon
 
-	client          *http.Client
-	server          *http.Server
-	interceptor     *middle
-	shouldIntercept func(req *http.Request) bool              // req is received by proxy.server
-	upstreamProxy   func(req *http.Request) (*url.URL, error) // req is received by proxy.server, not client request
+	client               *http.Client
+	server               *http.Server
+	interceptor          *middle
+	shouldIntercept      func(req *http.Request) bool // req is received by proxy.server
+	shouldInterceptBySNI func(connCtx *ConnContext, sni string) bool
+	upstreamProxy        func(req *http.Request) (*url.URL, error) // req is received by proxy.server, not client request
+	ja3Rules             map[string]*JA3Rule
+
+	addonStats addonStats
+
+	loopbackUpstream http.Handler // Proxy.RoundTrip 使用的内存上游
+
+	clientCert *tls.Certificate // Options.ClientCertFile
+
+	dnsCache *dnsCache // Options.DNSCacheTTL
+
+	reverseUpstream *url.URL // Options.ReverseProxyUpstream
+
+	blockHosts blockHosts // Options.BlockHosts
+
+	connLimiter *connLimiter // Options.MaxConnections
+
+	pacUpstream *pacUpstream // Options.PacUrl
+
+	noProxy *noProxy // Options.NoProxy
+
+	preserveHeaders preserveHeaders // Options.PreserveHeaders
+
+	poolStats upstreamPoolStats // Proxy.UpstreamPoolStats
+
+	flows flowTracker // 进行中的 flow，见 Proxy.Shutdown
+
+	accessLogger         *log.Logger // Options.AccessLogFormat、Options.AccessLogLevel
+	accessLogIgnoreHosts blockHosts  // Options.AccessLogIgnoreHosts
+
+	keyLogWriter io.Writer // Options.SslKeyLogFile 或 SSLKEYLOGFILE，为 nil 时不记录
 
 	socks5proxy  *socks5.Server
 	socks5tunnel *superproxy.SuperProxy
 	bufioPool    *bufiopool.Pool
+
+	socksMu       sync.Mutex
+	socksListener net.Listener
+	socksConns    map[net.Conn]struct{} // 进行中的 socks5 连接
+	socksWg       sync.WaitGroup
+	socksClosed   bool
 }
 
+// https://datatracker.ietf.org/doc/html/rfc7540#section-8.1.2.2
+var http2ConnectionHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade"}
+
 // proxy.server req context key
 var proxyReqCtxKey = new(struct{})
 
+// Flow.UpstreamProxy context key
+var flowUpstreamProxyCtxKey = new(struct{})
+
+// 读取请求 body 时返回此错误，proxy 将响应 413
+var ErrRequestBodyTooLarge = errors.New("request body too large")
+
+// 读取请求或请求上游失败时返回给客户端的状态码
+func requestErrorStatus(err error) int {
+	if errors.Is(err, ErrRequestBodyTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	if errors.Is(err, ErrUpstreamTimeout) {
+		return http.StatusGatewayTimeout
+	}
+	var resolveErr *ResolveError
+	if errors.As(err, &resolveErr) && resolveErr.Err.IsTimeout {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
 func NewProxy(opts *Options) (*Proxy, error) {
 	if opts.StreamLargeBodies <= 0 {
 		opts.StreamLargeBodies = 1024 * 1024 * 5 // default: 5mb
 	}
+	if opts.MaxDecompressedSize <= 0 {
+		opts.MaxDecompressedSize = 1024 * 1024 * 100 // default: 100mb
+	}
 
 	proxy := &Proxy{
 		Opts:    opts,
@@ -56,16 +195,54 @@ func NewProxy(opts *Options) (*Proxy, error) {
 		Addons:  make([]Addon, 0),
 	}
 
+	clientCert, err := loadClientCertificate(opts)
+	if err != nil {
+		return nil, err
+	}
+	proxy.clientCert = clientCert
+	keyLogWriter, err := newTlsKeyLogWriter(opts)
+	if err != nil {
+		return nil, err
+	}
+	proxy.keyLogWriter = keyLogWriter
+	proxy.dnsCache = newDNSCache(opts.DNSCacheTTL, opts.DNSNegativeTTL, opts.Resolver)
+
+	reverseUpstream, err := parseReverseProxyUpstream(opts.ReverseProxyUpstream)
+	if err != nil {
+		return nil, err
+	}
+	proxy.reverseUpstream = reverseUpstream
+	proxy.blockHosts = newBlockHosts(opts.BlockHosts)
+	if proxy.accessLogger, err = newAccessLogger(opts.AccessLogFormat, opts.AccessLogLevel); err != nil {
+		return nil, err
+	}
+	proxy.accessLogIgnoreHosts = newBlockHosts(opts.AccessLogIgnoreHosts)
+	proxy.preserveHeaders = newPreserveHeaders(opts.PreserveHeaders)
+	proxy.connLimiter = newConnLimiter(opts.MaxConnections)
+	if proxy.noProxy, err = newNoProxy(opts.NoProxy, opts.ProxyLoopback); err != nil {
+		return nil, err
+	}
+	if opts.PacUrl != "" {
+		if proxy.pacUpstream, err = newPacUpstream(opts.PacUrl, opts.PacRefreshInterval); err != nil {
+			return nil, err
+		}
+		proxy.pacUpstream.resolver = opts.Resolver
+	}
+
 	proxy.client = &http.Client{
-		Transport: &http.Transport{
-			Proxy:              proxy.realUpstreamProxy(),
-			ForceAttemptHTTP2:  false, // disable http2
-			DisableCompression: true,  // To get the original response from the server, set Transport.DisableCompression to true.
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: opts.SslInsecure,
-				KeyLogWriter:       getTlsKeyLogWriter(),
+		Transport: newSocksTransport(&http.Transport{
+			Proxy:       proxy.realUpstreamProxy(),
+			DialContext: proxy.dialTarget,
+			DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return proxy.dialTlsUpstream(ctx, nil, addr)
 			},
-		},
+			ForceAttemptHTTP2:   opts.EnableHTTP2,
+			DisableCompression:  true, // To get the original response from the server, set Transport.DisableCompression to true.
+			TLSClientConfig:     proxy.newTlsClientConfig(),
+			MaxIdleConns:        opts.MaxIdleConns,
+			MaxIdleConnsPerHost: opts.MaxIdleConnsPerHost,
+			IdleConnTimeout:     opts.IdleConnTimeout,
+		}),
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			// 禁止自动重定向
 			return http.ErrUseLastResponse
@@ -77,13 +254,15 @@ func NewProxy(opts *Options) (*Proxy, error) {
 		Handler: proxy,
 		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
 			connCtx := newConnContext(c, proxy)
+			connCtx.ClientConn.OriginalDst = c.(*wrapClientConn).originalDst
 			for _, addon := range proxy.Addons {
-				addon.ClientConnected(connCtx.ClientConn)
+				proxy.invokeConnAddon(addon, "ClientConnected", func() { addon.ClientConnected(connCtx.ClientConn) })
 			}
 			c.(*wrapClientConn).connCtx = connCtx
 			return context.WithValue(ctx, connContextKey, connCtx)
 		},
 	}
+	proxy.setServerTimeouts(proxy.server)
 
 	interceptor, err := newMiddle(proxy)
 	if err != nil {
@@ -99,49 +278,187 @@ func (proxy *Proxy) AddAddon(addon Addon) {
 }
 
 func (proxy *Proxy) Start() error {
+	if proxy.pacUpstream != nil {
+		if err := proxy.pacUpstream.init(); err != nil {
+			return err
+		}
+	}
 	addr := proxy.server.Addr
 	if addr == "" {
 		addr = ":http"
 	}
-	ln, err := net.Listen("tcp", addr)
+	ln, err := listenHttp(addr)
 	if err != nil {
 		return err
 	}
-	go proxy.startSocksProxy()
+	if _, ok := unixSocketPath(proxy.Opts.HttpAddr); ok && proxy.Opts.SocksAddr != "" {
+		// socks5 通过 http 代理建立隧道，需连接至 tcp 端口
+		log.Warnf("socks5 proxy requires http addr to be a tcp address, skip listening at %v", proxy.Opts.SocksAddr)
+	} else if proxy.Opts.SocksAddr != "" {
+		socksLn, err := proxy.listenSocks(ln.Addr())
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		go proxy.serveSocks(socksLn)
+	}
 	go proxy.interceptor.start()
 	log.Infof("http proxy start listen at %v\n", proxy.server.Addr)
 
-	pln := &wrapListener{
-		Listener: ln,
-		proxy:    proxy,
+	var pln net.Listener = newWrapListener(ln, proxy)
+	if proxy.Opts.Transparent {
+		pln = newTransparentListener(pln, proxy)
 	}
 	return proxy.server.Serve(pln)
 }
 
-func (proxy *Proxy) startSocksProxy() {
-	if proxy.Opts.SocksAddr != "" {
-		proxyHost, proxyPort, err := net.SplitHostPort(proxy.Opts.HttpAddr)
-		if err != nil {
-			log.Errorf("parse proxy addr err:  %v\n", err.Error())
-			return
-		}
-		if proxyHost == "" {
-			proxyHost = "0.0.0.0"
+// 监听 Options.SocksAddr，在 Start 中同步调用，保证 Close、Shutdown 能关闭监听的端口
+// httpAddr 为 http 代理实际监听的地址
+func (proxy *Proxy) listenSocks(httpAddr net.Addr) (net.Listener, error) {
+	proxyHost, port, err := socksTunnelTarget(httpAddr.String())
+	if err != nil {
+		return nil, err
+	}
+	proxy.socks5tunnel, err = superproxy.NewSuperProxy(proxyHost, port, superproxy.ProxyTypeHTTP, "", "", "")
+	if err != nil {
+		return nil, fmt.Errorf("socks5 tunnel: %w", err)
+	}
+	proxy.bufioPool = bufiopool.New(4096, 4096)
+	socks5Config := &socks5.Config{
+		Dial: proxy.httpTunnelDialer,
+	}
+	if len(proxy.Opts.SocksAuth) > 0 {
+		socks5Config.AuthMethods = []socks5.Authenticator{
+			socks5.UserPassAuthenticator{Credentials: socks5.StaticCredentials(proxy.Opts.SocksAuth)},
 		}
-		port, _ := strconv.ParseInt(proxyPort, 10, 64)
-		proxy.socks5tunnel, _ = superproxy.NewSuperProxy(proxyHost, uint16(port), superproxy.ProxyTypeHTTP, "", "", "")
-		proxy.bufioPool = bufiopool.New(4096, 4096)
-		socks5Config := &socks5.Config{
-			Dial: proxy.httpTunnelDialer,
+		// 认证失败由 serveSocks 记录
+		socks5Config.Logger = stdlog.New(log.StandardLogger().WriterLevel(log.DebugLevel), "", 0)
+	}
+	socks5proxy, err := socks5.New(socks5Config)
+	if err != nil {
+		return nil, err
+	}
+	proxy.socks5proxy = socks5proxy
+
+	ln, err := net.Listen("tcp", proxy.Opts.SocksAddr)
+	if err != nil {
+		return nil, err
+	}
+	proxy.socksMu.Lock()
+	defer proxy.socksMu.Unlock()
+	if proxy.socksClosed {
+		ln.Close()
+		return nil, http.ErrServerClosed
+	}
+	proxy.socksListener = ln
+	proxy.socksConns = make(map[net.Conn]struct{})
+	log.Infof("socks5 proxy start listen at %v\n", proxy.Opts.SocksAddr)
+	return ln, nil
+}
+
+// socks5 隧道连接的 http 代理地址，返回的 host 可直接与端口拼接（ipv6 带方括号）
+// 隧道由本进程连接 http 代理，监听所有地址时使用 loopback
+func socksTunnelTarget(httpAddr string) (string, uint16, error) {
+	host, portStr, err := net.SplitHostPort(httpAddr)
+	if err != nil {
+		return "", 0, fmt.Errorf("parse proxy addr: %w", err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return "", 0, fmt.Errorf("invalid proxy port %q", portStr)
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		if ip.To4() != nil {
+			host = "127.0.0.1"
+		} else {
+			host = "::1"
 		}
-		socks5proxy, err := socks5.New(socks5Config)
+	} else if host == "" {
+		host = "127.0.0.1"
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return host, uint16(port), nil
+}
+
+// 同 socks5.Server.ListenAndServe，记录进行中的连接，认证失败时记录客户端地址
+func (proxy *Proxy) serveSocks(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
 		if err != nil {
-			log.Errorf("socks5 proxy start err:  %v\n", err.Error())
+			proxy.socksMu.Lock()
+			closed := proxy.socksClosed
+			proxy.socksMu.Unlock()
+			if !closed {
+				log.Errorf("socks5 proxy serve err:  %v\n", err.Error())
+			}
 			return
 		}
-		log.Infof("socks5 proxy start listen at %v\n", proxy.Opts.SocksAddr)
-		proxy.socks5proxy = socks5proxy
-		proxy.socks5proxy.ListenAndServe("tcp", proxy.Opts.SocksAddr)
+		if !proxy.trackSocksConn(conn) {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer proxy.untrackSocksConn(conn)
+			err := proxy.socks5proxy.ServeConn(conn)
+			if err != nil && strings.Contains(err.Error(), socks5.UserAuthFailed.Error()) {
+				log.Debugf("socks5 auth failed from %v", conn.RemoteAddr())
+			}
+		}()
+	}
+}
+
+func (proxy *Proxy) trackSocksConn(conn net.Conn) bool {
+	proxy.socksMu.Lock()
+	defer proxy.socksMu.Unlock()
+	if proxy.socksClosed {
+		return false
+	}
+	proxy.socksConns[conn] = struct{}{}
+	proxy.socksWg.Add(1)
+	return true
+}
+
+func (proxy *Proxy) untrackSocksConn(conn net.Conn) {
+	proxy.socksMu.Lock()
+	delete(proxy.socksConns, conn)
+	proxy.socksMu.Unlock()
+	proxy.socksWg.Done()
+}
+
+// 关闭 socks5 监听，force 时同时关闭进行中的连接
+func (proxy *Proxy) closeSocks(force bool) error {
+	proxy.socksMu.Lock()
+	defer proxy.socksMu.Unlock()
+	proxy.socksClosed = true
+	var err error
+	if proxy.socksListener != nil {
+		err = proxy.socksListener.Close()
+		proxy.socksListener = nil
+	}
+	if force {
+		for conn := range proxy.socksConns {
+			conn.Close()
+		}
+	}
+	return err
+}
+
+// 停止接收 socks5 连接，等待进行中的隧道结束，ctx 结束时强制关闭
+func (proxy *Proxy) shutdownSocks(ctx context.Context) error {
+	proxy.closeSocks(false)
+	done := make(chan struct{})
+	go func() {
+		proxy.socksWg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		proxy.closeSocks(true)
+		return ctx.Err()
 	}
 }
 
@@ -149,15 +466,64 @@ func (proxy *Proxy) httpTunnelDialer(ctx context.Context, network, addr string)
 	return proxy.socks5tunnel.MakeTunnel(nil, nil, proxy.bufioPool, addr)
 }
 
+// 立即关闭所有监听及连接，包括进行中的 CONNECT 隧道及 websocket
 func (proxy *Proxy) Close() error {
 	err := proxy.server.Close()
 	proxy.interceptor.close()
+	proxy.closeSocks(true)
+	proxy.flows.closeAll()
 	return err
 }
 
+// 停止接收新连接，并等待进行中的 flow 完成，包括 https 拦截的 flow、CONNECT 隧道及 websocket
+// ctx 结束时强制关闭剩余的连接并返回 ctx.Err()
 func (proxy *Proxy) Shutdown(ctx context.Context) error {
+	// 先关闭 socks5 监听，进行中的隧道通过已建立的 CONNECT 连接继续传输
+	proxy.closeSocks(false)
 	err := proxy.server.Shutdown(ctx)
-	proxy.interceptor.close()
+	// 拦截的连接空闲时由 middle.server 关闭，其 CONNECT 隧道的 flow 随之结束
+	if e := proxy.interceptor.shutdown(ctx); err == nil {
+		err = e
+	}
+	if e := proxy.flows.wait(ctx); err == nil {
+		err = e
+	}
+	if e := proxy.shutdownSocks(ctx); err == nil {
+		err = e
+	}
+	if err != nil {
+		log.Warnf("shutdown: %v, force close %v in-flight flows\n", err, proxy.flows.count())
+		proxy.Close()
+	}
+	return err
+}
+
+// 启动 proxy，收到 SIGINT/SIGTERM 或 ctx 结束时优雅退出：
+// 停止接收新连接，在 Options.ShutdownGrace 内等待进行中的 flow 完成，超时后强制关闭
+func (proxy *Proxy) RunWithSignals(ctx context.Context) error {
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- proxy.Start()
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+	}
+
+	grace := proxy.Opts.ShutdownGrace
+	if grace <= 0 {
+		grace = 30 * time.Second
+	}
+	log.Infof("shutting down, wait up to %v for in-flight flows\n", grace)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	err := proxy.Shutdown(shutdownCtx)
+	<-errChan
 	return err
 }
 
@@ -173,6 +539,14 @@ func (proxy *Proxy) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		"method": req.Method,
 	})
 
+	if !req.URL.IsAbs() || req.URL.Host == "" {
+		if connCtx, ok := req.Context().Value(connContextKey).(*ConnContext); ok && connCtx.ClientConn.OriginalDst != "" {
+			rewriteTransparentRequest(req, connCtx.ClientConn.OriginalDst)
+		} else if proxy.reverseUpstream != nil {
+			proxy.rewriteReverseRequest(req)
+		}
+	}
+
 	if !req.URL.IsAbs() || req.URL.Host == "" {
 		if len(proxy.Addons) == 0 {
 			res.WriteHeader(400)
@@ -180,11 +554,22 @@ func (proxy *Proxy) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 			return
 		}
 		for _, addon := range proxy.Addons {
-			addon.AccessProxyServer(req, res)
+			proxy.invokeConnAddon(addon, "AccessProxyServer", func() { addon.AccessProxyServer(req, res) })
 		}
 		return
 	}
 
+	if proxy.blockHosts.match(req.URL.Host) {
+		log.Infof("blocked host %v", req.URL.Host)
+		proxy.replyBlocked(res)
+		return
+	}
+
+	// addon 将请求方法改为 HEAD 时，上游响应没有 body
+	var upstreamHead bool
+	// reply 发送 body 时读取或写入失败，由调用方中断客户端连接
+	var replyErr error
+
 	reply := func(response *Response, body io.Reader) {
 		if response.Header != nil {
 			for key, value := range response.Header {
@@ -196,12 +581,54 @@ func (proxy *Proxy) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		if response.close {
 			res.Header().Add("Connection", "close")
 		}
+		if upstreamHead {
+			res.Header().Del("Content-Length")
+		}
+		switch proxy.Opts.ResponseFraming {
+		case FramingContentLength:
+			// 仅已读取至 Response.Body 的响应可计算长度，stream 的响应保持原样
+			if body == nil && response.BodyReader == nil && !upstreamHead && req.Method != "HEAD" && bodyAllowedForStatus(response.StatusCode) {
+				res.Header().Del("Transfer-Encoding")
+				res.Header().Set("Content-Length", strconv.Itoa(len(response.Body)))
+			}
+		case FramingChunked:
+			res.Header().Del("Content-Length")
+		}
+		// 声明 trailer 后 net/http 以 chunked 发送 http/1.1 响应，body 之后才能发送 trailer
+		if len(response.Trailer) > 0 && res.Header().Get("Content-Length") == "" {
+			keys := make([]string, 0, len(response.Trailer))
+			for key := range response.Trailer {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			res.Header().Set("Trailer", strings.Join(keys, ", "))
+		}
+		if req.ProtoMajor == 2 {
+			// http2 中不允许出现连接相关的 header
+			for _, key := range http2ConnectionHeaders {
+				res.Header().Del(key)
+			}
+		}
 		res.WriteHeader(response.StatusCode)
+		// 流式 RPC 的 header 及每个消息需及时发送
+		grpc := body != nil && IsGrpc(response.Header)
+		// 以 reader 发送（如 stream）且长度未知时同样先发送 header，以 chunked 发送，上游未声明的 trailer 也可在 body 之后发送
+		chunked := req.ProtoMajor == 1 && (proxy.Opts.ResponseFraming == FramingChunked || body != nil && res.Header().Get("Content-Length") == "")
+		if grpc || chunked {
+			// 先发送 header，避免 net/http 为较小的响应自动计算 Content-Length
+			if flusher, ok := res.(http.Flusher); ok {
+				flusher.Flush()
+			}
+		}
 
 		if body != nil {
-			_, err := io.Copy(res, body)
-			if err != nil {
-				logErr(log, err)
+			var dst io.Writer = res
+			if flusher, ok := res.(http.Flusher); ok && grpc {
+				dst = &flushWriter{w: res, f: flusher}
+			}
+			if _, err := io.Copy(dst, body); err != nil {
+				replyErr = err
+				return
 			}
 		}
 		if response.BodyReader != nil {
@@ -216,56 +643,119 @@ func (proxy *Proxy) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 				logErr(log, err)
 			}
 		}
+		writeTrailer(res, response.Trailer)
 	}
 
 	// when addons panic
 	defer func() {
 		if err := recover(); err != nil {
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
 			log.Warnf("Recovered: %v\n", err)
 		}
 	}()
 
 	f := newFlow()
 	f.Request = newRequest(req)
+	f.Request.maxDecodedSize = proxy.Opts.MaxDecompressedSize
 	f.ConnContext = req.Context().Value(connContextKey).(*ConnContext)
-	defer f.finish()
+	if req.ProtoMajor == 2 {
+		f.StreamId = h2StreamId(res)
+	}
+	if result, ok := req.Context().Value(replayCtxKey).(*replayResult); ok {
+		f.IsReplay = true
+		result.flow = f
+	}
+	proxy.flows.add(f)
+	defer proxy.finishFlow(f)
+
+	// 通过 flow、conn 关联同一 flow 及同一客户端连接的日志
+	log = log.WithField("flow", f.Id).WithField("conn", f.ConnContext.Id())
+
+	atomic.AddUint32(&f.ConnContext.FlowCount, 1) // http2 中同一连接的多个请求并发处理
 
-	f.ConnContext.FlowCount = f.ConnContext.FlowCount + 1
+	// 客户端断开后取消上游请求，不再继续读取上游响应
+	// 客户端上传 body 时断开，取消上游请求，避免上游收到不完整的 body
+	proxyReqCtx, cancel, clientGone := withClientCancel(req, f.ConnContext)
+	defer cancel()
+	var clientBody *clientBodyReader
+	if req.Body != nil && req.Body != http.NoBody {
+		clientBody = &clientBodyReader{ReadCloser: req.Body, cancel: cancel}
+		req.Body = clientBody
+		defer func() {
+			if err := clientBody.abortErr(); err != nil {
+				log.Warn(err)
+				f.Err = err
+				for _, addon := range proxy.Addons {
+					proxy.invokeAddon(f, addon, "Error", func() { addon.Error(f, err) })
+				}
+			}
+		}()
+	}
+
+	// 流式 RPC 不能等待完整的 body，见 grpc.go
+	if IsGrpc(f.Request.Header) {
+		f.Stream = true
+	}
 
 	rawReqUrlHost := f.Request.URL.Host
 	rawReqUrlScheme := f.Request.URL.Scheme
+	rawUpstreamHost := proxy.upstreamHost(f.Request)
+	rawHostHeader := f.Request.Header.Get("Host")
+
+	// addon 在 Requestheaders、Request 中设置了 f.Response，不请求上游，仍触发 Response 事件供记录
+	replyAddonResponse := func() {
+		for _, addon := range proxy.Addons {
+			proxy.invokeAddon(f, addon, "Response", func() { addon.Response(f) })
+		}
+		reply(f.Response, nil)
+	}
 
 	// trigger addon event Requestheaders
 	for _, addon := range proxy.Addons {
-		addon.Requestheaders(f)
+		proxy.invokeAddon(f, addon, "Requestheaders", func() { addon.Requestheaders(f) })
+		if f.aborted != nil {
+			proxy.abortFlow(log, f, res)
+			return
+		}
 		if f.Response != nil {
-			reply(f.Response, nil)
+			replyAddonResponse()
 			return
 		}
 	}
 
 	// Read request body
 	var reqBody io.Reader = req.Body
+	if !f.Stream && req.ContentLength >= proxy.streamLargeBodies(f) {
+		// 根据 Content-Length 直接转为 stream 模式，不读取 body
+		log.Warnf("request body size >= %v\n", proxy.streamLargeBodies(f))
+		f.Stream = true
+	}
 	if !f.Stream {
-		reqBuf, r, err := readerToBuffer(req.Body, proxy.Opts.StreamLargeBodies)
+		reqBuf, r, err := readerToBuffer(req.Body, proxy.streamLargeBodies(f))
 		reqBody = r
 		if err != nil {
 			log.Error(err)
-			res.WriteHeader(502)
+			res.WriteHeader(requestErrorStatus(err))
 			return
 		}
 
 		if reqBuf == nil {
-			log.Warnf("request body size >= %v\n", proxy.Opts.StreamLargeBodies)
+			log.Warnf("request body size >= %v\n", proxy.streamLargeBodies(f))
 			f.Stream = true
 		} else {
 			f.Request.Body = reqBuf
 
 			// trigger addon event Request
 			for _, addon := range proxy.Addons {
-				addon.Request(f)
+				proxy.invokeAddon(f, addon, "Request", func() { addon.Request(f) })
+				if f.aborted != nil {
+					proxy.abortFlow(log, f, res)
+					return
+				}
 				if f.Response != nil {
-					reply(f.Response, nil)
+					replyAddonResponse()
 					return
 				}
 			}
@@ -274,41 +764,189 @@ func (proxy *Proxy) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 	}
 
 	for _, addon := range proxy.Addons {
-		reqBody = addon.StreamRequestModifier(f, reqBody)
+		if proxy.dryRun(addon) {
+			log.Debugf("dry run, skip %T StreamRequestModifier\n", addon)
+			continue
+		}
+		proxy.invokeAddon(f, addon, "StreamRequestModifier", func() { reqBody = addon.StreamRequestModifier(f, reqBody) })
+	}
+	if reqBody != nil && IsGrpc(f.Request.Header) {
+		reqBody = proxy.newGrpcMessageReader(f, true, reqBody)
 	}
 
-	proxyReqCtx := context.WithValue(context.Background(), proxyReqCtxKey, req)
+	// 请求方法可能已被 addon 修改
+	if f.Request.Method != req.Method {
+		log.Debugf("request method rewritten to %v", f.Request.Method)
+		upstreamHead = f.Request.Method == "HEAD"
+		if f.Request.Method == "TRACE" && (len(f.Request.Body) > 0 || f.Stream) {
+			// TRACE 请求不允许携带 body
+			log.Warnf("drop request body for rewritten method TRACE")
+			reqBody = nil
+		}
+	}
+	// GET、HEAD 请求（包括 addon 改写而来的）携带 body 时，长度未知的 body 会被 http.Transport 以 chunked 发送，多数服务器会拒绝
+	// stream 的 body 未被 addon 替换时沿用客户端的 Content-Length，否则读取完整的 body 后以 Content-Length 发送
+	var reqContentLength int64 = -1
+	if reqBody != nil && (f.Request.Method == "GET" || f.Request.Method == "HEAD") {
+		if _, ok := reqBody.(*bytes.Reader); !ok {
+			if reqBody == io.Reader(req.Body) && req.ContentLength >= 0 {
+				reqContentLength = req.ContentLength
+			} else {
+				buf, err := ioutil.ReadAll(reqBody)
+				if err != nil {
+					log.Error(err)
+					res.WriteHeader(requestErrorStatus(err))
+					return
+				}
+				reqBody = bytes.NewReader(buf)
+			}
+		}
+	}
+
+	proxyReqCtx = context.WithValue(proxyReqCtx, proxyReqCtxKey, req)
+	proxyReqCtx = context.WithValue(proxyReqCtx, upstreamHostCtxKey, f.Request.URL.Host)
+	if f.UpstreamProxy != nil {
+		proxyReqCtx = context.WithValue(proxyReqCtx, flowUpstreamProxyCtxKey, f.UpstreamProxy)
+	}
+	var upstreamStart, getConnStart time.Time
+	var useSeparateClient bool
+	proxyReqCtx = httptrace.WithClientTrace(proxyReqCtx, &httptrace.ClientTrace{
+		GetConn: func(hostPort string) {
+			getConnStart = time.Now()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			proxy.poolStats.gotConn(info.Reused)
+			f.Stats.ServerLocalAddr = info.Conn.LocalAddr()
+			f.Stats.ServerRemoteAddr = info.Conn.RemoteAddr()
+			f.Stats.Reused = info.Reused
+			f.Stats.ServerTlsInfo = connTlsInfo(info.Conn)
+			// 共享的 client 的连接与 ServerConn 无关
+			if serverConn := f.ConnContext.ServerConn; serverConn != nil && !useSeparateClient {
+				serverConn.setAddr(info.Conn.LocalAddr(), info.Conn.RemoteAddr(), info.Reused)
+			}
+			if !info.Reused {
+				f.Stats.Connect = time.Since(getConnStart)
+			}
+		},
+		GotFirstResponseByte: func() {
+			f.Stats.TTFB = time.Since(upstreamStart)
+		},
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			// 100 Continue 由 proxy.server 自行处理
+			if code == 100 {
+				return nil
+			}
+			h := http.Header(header)
+			for _, addon := range proxy.Addons {
+				// dry run 时传入副本，对 header 的修改不转发给客户端
+				header := h
+				if proxy.dryRun(addon) {
+					header = h.Clone()
+				}
+				proxy.invokeAddon(f, addon, "Informational", func() { addon.Informational(f, code, header) })
+			}
+			for key, value := range h {
+				res.Header()[key] = value
+			}
+			res.WriteHeader(code)
+			for key := range h {
+				res.Header().Del(key)
+			}
+			return nil
+		},
+	})
+	retryable := proxy.retryable(f)
+	if retryable {
+		body, err := replayableBody(reqBody)
+		if err != nil {
+			log.Error(err)
+			res.WriteHeader(requestErrorStatus(err))
+			return
+		}
+		reqBody = body
+	}
+	if r, ok := reqBody.(*bytes.Reader); ok {
+		f.Stats.RequestBytes = int64(r.Len())
+	} else if reqBody != nil {
+		reqBody = &countReader{r: reqBody, n: &f.Stats.RequestBytes}
+	}
 	proxyReq, err := http.NewRequestWithContext(proxyReqCtx, f.Request.Method, f.Request.URL.String(), reqBody)
 	if err != nil {
 		log.Error(err)
 		res.WriteHeader(502)
 		return
 	}
+	if reqContentLength > 0 {
+		proxyReq.ContentLength = reqContentLength
+	}
 
 	for key, value := range f.Request.Header {
 		for _, v := range value {
 			proxyReq.Header.Add(key, v)
 		}
 	}
+	proxyReq.Host = proxy.upstreamHost(f.Request)
+	if f.Request.URL.Host != rawReqUrlHost {
+		// addon 将请求指向其他 host，客户端的 Host header 不再适用，除非 addon 重新设置
+		if f.KeepHostHeader {
+			proxyReq.Host = rawUpstreamHost
+		} else if f.Request.Header.Get("Host") == rawHostHeader {
+			proxyReq.Host = f.Request.URL.Host
+		}
+	}
+	proxyReq.Header.Del("Host")
+	proxy.preserveHeaders.removeRequestHopHeaders(proxyReq.Header)
 
 	f.ConnContext.initHttpServerConn()
 
-	useSeparateClient := f.UseSeparateClient
-	if !useSeparateClient {
-		if rawReqUrlHost != f.Request.URL.Host || rawReqUrlScheme != f.Request.URL.Scheme {
-			useSeparateClient = true
-		}
+	switch {
+	case f.UseSeparateClient:
+		f.SeparateClientReason = SeparateClientForced
+	case rawReqUrlHost != f.Request.URL.Host || rawReqUrlScheme != f.Request.URL.Scheme:
+		f.SeparateClientReason = SeparateClientHostChanged
+	case f.UpstreamProxy != nil && f.ConnContext.ClientConn.Tls:
+		// 拦截的 https 连接已建立至上游的连接
+		f.SeparateClientReason = SeparateClientUpstreamProxy
+	}
+	useSeparateClient = f.SeparateClientReason != ""
+
+	// 仅支持记录当前连接对应的 ServerConn
+	var recordServerConn *ServerConn
+	if f.CaptureChunks && !useSeparateClient {
+		recordServerConn = f.ConnContext.ServerConn
+		recordServerConn.startRecord()
+		defer recordServerConn.stopRecord()
+	}
+
+	// Options.UpstreamTimeout 超时时响应 504，addon 可在 Addon.Error、Addon.Response 中通过 Flow.Err 获取原因
+	timer := newUpstreamTimer(proxy.Opts.UpstreamTimeout, cancel)
+	defer timer.stop()
+	replyUpstreamError := func(err error) {
+		proxy.upstreamError(f, err)
+		reply(f.Response, nil)
 	}
 
 	var proxyRes *http.Response
-	if useSeparateClient {
+	upstreamStart = time.Now()
+	if f.ConnContext.loopback != nil {
+		proxyRes, err = f.ConnContext.loopback.RoundTrip(proxyReq)
+	} else if useSeparateClient {
 		proxyRes, err = proxy.client.Do(proxyReq)
 	} else {
 		proxyRes, err = f.ConnContext.ServerConn.client.Do(proxyReq)
 	}
+	if err != nil && retryable {
+		proxyRes, err = proxy.retryUpstream(f, proxyReq, err)
+	}
 	if err != nil {
+		// 客户端上传 body 时断开由上面的 defer 以 ClientAbortError 触发 Addon.Error
+		if clientGone() || (clientBody != nil && clientBody.abortErr() != nil) {
+			log.Debugf("client gone before upstream response: %v", err)
+			return
+		}
+		err = timer.wrap(err)
 		logErr(log, err)
-		res.WriteHeader(502)
+		replyUpstreamError(err)
 		return
 	}
 
@@ -318,15 +956,23 @@ func (proxy *Proxy) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 
 	defer proxyRes.Body.Close()
 
+	proxy.preserveHeaders.removeResponseHopHeaders(proxyRes.StatusCode, proxyRes.Header)
 	f.Response = &Response{
 		StatusCode: proxyRes.StatusCode,
+		Proto:      proxyRes.Proto,
 		Header:     proxyRes.Header,
 		close:      proxyRes.Close,
+
+		maxDecodedSize: proxy.Opts.MaxDecompressedSize,
 	}
 
 	// trigger addon event Responseheaders
 	for _, addon := range proxy.Addons {
-		addon.Responseheaders(f)
+		proxy.invokeAddon(f, addon, "Responseheaders", func() { addon.Responseheaders(f) })
+		if f.aborted != nil {
+			proxy.abortFlow(log, f, res)
+			return
+		}
 		if f.Response.Body != nil {
 			reply(f.Response, nil)
 			return
@@ -335,31 +981,212 @@ func (proxy *Proxy) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 
 	// Read response body
 	var resBody io.Reader = proxyRes.Body
+	if !f.Stream && proxyReq.Method != "HEAD" && bodyAllowedForStatus(proxyRes.StatusCode) && proxyRes.ContentLength >= proxy.streamLargeBodies(f) {
+		log.Warnf("response body size >= %v\n", proxy.streamLargeBodies(f))
+		f.Stream = true
+	}
 	if !f.Stream {
-		resBuf, r, err := readerToBuffer(proxyRes.Body, proxy.Opts.StreamLargeBodies)
+		resBuf, r, err := readerToBuffer(proxyRes.Body, proxy.streamLargeBodies(f))
 		resBody = r
+		if resBuf != nil {
+			f.Stats.ResponseBytes = int64(len(resBuf))
+			f.Stats.Total = time.Since(f.Stats.Start)
+		}
 		if err != nil {
+			err = timer.wrap(err)
 			log.Error(err)
-			res.WriteHeader(502)
+			replyUpstreamError(err)
 			return
 		}
 		if resBuf == nil {
-			log.Warnf("response body size >= %v\n", proxy.Opts.StreamLargeBodies)
+			log.Warnf("response body size >= %v\n", proxy.streamLargeBodies(f))
 			f.Stream = true
 		} else {
 			f.Response.Body = resBuf
+			f.Response.Trailer = proxyRes.Trailer
+			if f.CaptureChunks {
+				f.captureChunks(recordServerConn, proxyRes)
+			}
 
 			// trigger addon event Response
 			for _, addon := range proxy.Addons {
-				addon.Response(f)
+				proxy.invokeAddon(f, addon, "Response", func() { addon.Response(f) })
+				if f.aborted != nil {
+					proxy.abortFlow(log, f, res)
+					return
+				}
 			}
 		}
 	}
+	// 已读取完整的响应 body，或转为 stream 模式，stream 的 body 不受 Options.UpstreamTimeout 限制
+	timer.stop()
+	if f.Stream {
+		resBody = &countReader{r: resBody, n: &f.Stats.ResponseBytes}
+		defer func() {
+			f.Stats.Total = time.Since(f.Stats.Start)
+		}()
+	}
 	for _, addon := range proxy.Addons {
-		resBody = addon.StreamResponseModifier(f, resBody)
+		if proxy.dryRun(addon) {
+			log.Debugf("dry run, skip %T StreamResponseModifier\n", addon)
+			continue
+		}
+		proxy.invokeAddon(f, addon, "StreamResponseModifier", func() { resBody = addon.StreamResponseModifier(f, resBody) })
+	}
+	if IsGrpc(f.Response.Header) {
+		if resBody != nil {
+			resBody = proxy.newGrpcMessageReader(f, false, resBody)
+		} else {
+			msgs, err := ParseGrpcMessages(f.Response.Body)
+			if err != nil {
+				log.Debugf("grpc: %v", err)
+			}
+			for _, msg := range msgs {
+				proxy.grpcMessage(f, false, msg)
+			}
+		}
+	}
+
+	if f.Stream && len(proxyRes.Trailer) > 0 {
+		// 上游在 header 中声明的 trailer，值在 body 读取完毕后填充
+		f.Response.Trailer = proxyRes.Trailer
+	}
+	if resBody != nil && !f.Stream {
+		// addon 基于已读取的 body 返回了 reader（如限速），以其替代 Response.Body 发送，Response.Body 保留供其他 addon 使用
+		response := *f.Response
+		response.Body = nil
+		reply(&response, resBody)
+	} else {
+		reply(f.Response, resBody)
+	}
+	if replyErr != nil {
+		proxy.replyBodyError(log, f, res, replyErr)
+		return
+	}
+	if f.Stream {
+		// body 读取完毕后才有 trailer，上游声明的 trailer 已在 reply 中发送
+		if f.Response.Trailer == nil {
+			writeTrailer(res, proxyRes.Trailer)
+		}
+		f.Response.Trailer = proxyRes.Trailer
+	}
+	if f.Stream && f.CaptureChunks {
+		f.captureChunks(recordServerConn, proxyRes)
 	}
+}
 
-	reply(f.Response, resBody)
+// Flow.StreamLargeBodies 优先于 Options.StreamLargeBodies
+func (proxy *Proxy) streamLargeBodies(f *Flow) int64 {
+	if f.StreamLargeBodies > 0 {
+		return f.StreamLargeBodies
+	}
+	return proxy.Opts.StreamLargeBodies
+}
+
+// 记录 Flow.Abort 的原因并通知所有 addon，不响应客户端
+func (proxy *Proxy) flowAborted(log *log.Entry, f *Flow) {
+	err := f.aborted
+	f.Err = err
+	log.Infof("aborted: %v", err.Reason)
+	for _, addon := range proxy.Addons {
+		proxy.invokeAddon(f, addon, "Error", func() { addon.Error(f, err) })
+	}
+}
+
+// addon 调用了 Flow.Abort，通知所有 addon 后响应状态码并关闭客户端连接，或直接断开
+func (proxy *Proxy) abortFlow(log *log.Entry, f *Flow, res http.ResponseWriter) {
+	proxy.flowAborted(log, f)
+	err := f.aborted
+	if _, ok := res.(*transparentResponse); ok {
+		// 透明代理模式下由 serveTransparentTLS 关闭连接
+		return
+	}
+	if err.StatusCode <= 0 {
+		abortClientConn(res)
+		return
+	}
+	if f.Request.raw.ProtoMajor < 2 {
+		res.Header().Set("Connection", "close")
+	}
+	res.WriteHeader(err.StatusCode)
+}
+
+// 已发送响应 header 后读取 body（上游或 addon 返回的 reader）或写入客户端失败: 触发 Addon.Error 后中断与客户端的连接，避免客户端误以为已接收到完整的 body
+// addon 在 reader 中调用了 Flow.Abort 时 f.Err 为其 *AbortError
+func (proxy *Proxy) replyBodyError(log *log.Entry, f *Flow, res http.ResponseWriter, err error) {
+	if f.aborted != nil {
+		err = f.aborted
+	}
+	logErr(log, err)
+	f.Err = err
+	for _, addon := range proxy.Addons {
+		proxy.invokeAddon(f, addon, "Error", func() { addon.Error(f, err) })
+	}
+	abortClientConn(res)
+}
+
+// 中断与客户端的连接: http/1.x 劫持后直接关闭（chunked body 缺少结束块）
+// http2 及不支持劫持的 ResponseWriter 只能通过 panic(http.ErrAbortHandler) 由 net/http 重置 stream
+func abortClientConn(res http.ResponseWriter) {
+	if hijacker, ok := res.(http.Hijacker); ok {
+		if conn, _, err := hijacker.Hijack(); err == nil {
+			conn.Close()
+			return
+		}
+	}
+	panic(http.ErrAbortHandler)
+}
+
+// 请求上游或读取响应 body 失败: 依次触发 Addon.Error、Addon.ServerError、Addon.Response
+// f.Response 为 ServerError 返回的响应，均返回 nil 时为 proxy 生成的 502/504 响应，之后由调用方发送给客户端
+func (proxy *Proxy) upstreamError(f *Flow, err error) {
+	f.Err = err
+	for _, addon := range proxy.Addons {
+		proxy.invokeAddon(f, addon, "Error", func() { addon.Error(f, err) })
+	}
+	if !proxy.serverError(f, err) {
+		f.Response = upstreamErrorResponse(err)
+	}
+	for _, addon := range proxy.Addons {
+		proxy.invokeAddon(f, addon, "Response", func() { addon.Response(f) })
+	}
+}
+
+// 请求上游或读取响应 body 失败时触发 Addon.ServerError，以首个返回的非 nil 响应替换 f.Response
+// 所有 addon 均返回 nil 时 f.Response 不变并返回 false
+func (proxy *Proxy) serverError(f *Flow, err error) bool {
+	f.Err = err
+	prev := f.Response
+	f.Response = nil
+	for _, addon := range proxy.Addons {
+		proxy.invokeAddon(f, addon, "ServerError", func() {
+			if response := addon.ServerError(f, err); response != nil {
+				f.Response = response
+			}
+		})
+		if f.Response != nil {
+			if f.Response.StatusCode == 0 {
+				f.Response.StatusCode = requestErrorStatus(err)
+			}
+			return true
+		}
+	}
+	f.Response = prev
+	return false
+}
+
+// net/http 按 RFC 7230 以绝对 URI 中的 host 为准，并从 req.Header 中移除客户端的 Host header
+// 因此 Request.Header 中的 Host 仅当 addon 设置时存在，与 URL 不一致时根据 Options.PreferHostHeader 决定
+func (proxy *Proxy) upstreamHost(req *Request) string {
+	host := req.Header.Get("Host")
+	if host == "" || host == req.URL.Host {
+		return req.URL.Host
+	}
+	if proxy.Opts.PreferHostHeader {
+		return host
+	}
+	log.Debugf("host header %v differs from url host %v, use url host", host, req.URL.Host)
+	return req.URL.Host
 }
 
 func (proxy *Proxy) handleConnect(res http.ResponseWriter, req *http.Request) {
@@ -368,49 +1195,97 @@ func (proxy *Proxy) handleConnect(res http.ResponseWriter, req *http.Request) {
 		"host": req.Host,
 	})
 
-	shouldIntercept := proxy.shouldIntercept == nil || proxy.shouldIntercept(req)
+	if proxy.blockHosts.match(req.Host) {
+		log.Info("blocked host")
+		res.WriteHeader(proxy.blockStatus())
+		return
+	}
+
+	connCtx := req.Context().Value(connContextKey).(*ConnContext)
+
+	// 设置了 JA3 规则时先返回 200 Connection Established 并读取 ClientHello，在决定是否拦截及连接上游之前按规则处理
+	var cconn net.Conn
+	var ja3Rule *JA3Rule
+	if len(proxy.ja3Rules) > 0 {
+		var err error
+		cconn, err = acceptConnect(res)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		defer cconn.Close()
+		cconn = captureJA3(connCtx.ClientConn, cconn)
+		if ja3Rule = proxy.ja3Rules[connCtx.ClientConn.JA3]; ja3Rule != nil && ja3Rule.Action == JA3ActionBlock {
+			log.WithField("ja3", connCtx.ClientConn.JA3).Info("ja3 blocked")
+			return
+		}
+	}
+
+	// JA3 规则为 route、passthrough 时不拦截
+	shouldIntercept := ja3Rule == nil && (proxy.shouldIntercept == nil || proxy.shouldIntercept(req))
 	f := newFlow()
 	f.Request = newRequest(req)
-	f.ConnContext = req.Context().Value(connContextKey).(*ConnContext)
+	f.ConnContext = connCtx
 	f.ConnContext.Intercept = shouldIntercept
-	defer f.finish()
+	// 按 SNI 决定时先进入 middle 读取 ClientHello，见 SetShouldInterceptBySNI
+	if proxy.shouldInterceptBySNI != nil && ja3Rule == nil {
+		shouldIntercept = true
+	}
+	proxy.flows.add(f)
+	defer proxy.finishFlow(f)
+	log = log.WithField("flow", f.Id).WithField("conn", f.ConnContext.Id())
 
 	// trigger addon event Requestheaders
 	for _, addon := range proxy.Addons {
-		addon.Requestheaders(f)
+		proxy.invokeAddon(f, addon, "Requestheaders", func() { addon.Requestheaders(f) })
+		if f.aborted != nil {
+			if cconn != nil {
+				// 已返回 200，只能关闭隧道
+				proxy.flowAborted(log, f)
+				return
+			}
+			proxy.abortFlow(log, f, res)
+			return
+		}
+	}
+	if f.UpstreamProxy != nil {
+		req = req.WithContext(context.WithValue(req.Context(), flowUpstreamProxyCtxKey, f.UpstreamProxy))
 	}
 
 	var conn net.Conn
 	var err error
-	if shouldIntercept {
+	connectStart := time.Now()
+	if ja3Rule != nil && ja3Rule.Action == JA3ActionRoute {
+		log.WithField("ja3", connCtx.ClientConn.JA3).Infof("ja3 route to %v", ja3Rule.Addr)
+		conn, err = proxy.dialUpstream(req.Context(), "tcp", ja3Rule.Addr)
+	} else if shouldIntercept {
 		log.Debugf("begin intercept %v", req.Host)
-		conn, err = proxy.interceptor.dial(req)
+		conn, err = proxy.interceptor.dial(f, req)
 	} else {
 		log.Debugf("begin transpond %v", req.Host)
 		conn, err = proxy.getUpstreamConn(req)
 	}
+	f.Stats.Connect = time.Since(connectStart)
+	// 确认上游可达后才返回 200 Connection Established，已返回时只能关闭隧道
 	if err != nil {
 		log.Error(err)
-		res.WriteHeader(502)
+		f.Err = err
+		if cconn == nil {
+			res.WriteHeader(connectErrorStatus(err))
+		}
 		return
 	}
 	defer conn.Close()
 
-	cconn, _, err := res.(http.Hijacker).Hijack()
-	if err != nil {
-		log.Error(err)
-		res.WriteHeader(502)
-		return
-	}
-
-	// cconn.(*net.TCPConn).SetLinger(0) // send RST other than FIN when finished, to avoid TIME_WAIT state
-	// cconn.(*net.TCPConn).SetKeepAlive(false)
-	defer cconn.Close()
-
-	_, err = io.WriteString(cconn, "HTTP/1.1 200 Connection Established\r\n\r\n")
-	if err != nil {
-		log.Error(err)
-		return
+	if cconn == nil {
+		cconn, err = acceptConnect(res)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		// cconn.(*net.TCPConn).SetLinger(0) // send RST other than FIN when finished, to avoid TIME_WAIT state
+		// cconn.(*net.TCPConn).SetKeepAlive(false)
+		defer cconn.Close()
 	}
 
 	f.Response = &Response{
@@ -420,22 +1295,60 @@ func (proxy *Proxy) handleConnect(res http.ResponseWriter, req *http.Request) {
 
 	// trigger addon event Responseheaders
 	for _, addon := range proxy.Addons {
-		addon.Responseheaders(f)
+		proxy.invokeAddon(f, addon, "Responseheaders", func() { addon.Responseheaders(f) })
 	}
 	defer func(f *Flow) {
 		// trigger addon event Response
 		for _, addon := range proxy.Addons {
-			addon.Response(f)
+			proxy.invokeAddon(f, addon, "Response", func() { addon.Response(f) })
 		}
 	}(f)
 
-	transfer(log, conn, cconn)
+	var timedOut bool
+	f.Stats.RequestBytes, f.Stats.ResponseBytes, timedOut = transfer(log, conn, cconn, proxy.Opts.TunnelIdleTimeout)
+	if timedOut {
+		log.Debugf("tunnel idle for %v, closed", proxy.Opts.TunnelIdleTimeout)
+		f.Err = ErrTunnelIdleTimeout
+	}
+	f.Stats.Total = time.Since(f.Stats.Start)
+}
+
+// 取得客户端连接并返回 200 Connection Established，透明代理模式下客户端未发送 CONNECT，无需响应
+// 失败时已向客户端返回 502
+func acceptConnect(res http.ResponseWriter) (net.Conn, error) {
+	if tres, ok := res.(*transparentResponse); ok {
+		return tres.conn, nil
+	}
+	cconn, _, err := res.(http.Hijacker).Hijack()
+	if err != nil {
+		res.WriteHeader(502)
+		return nil, err
+	}
+	if _, err := io.WriteString(cconn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		cconn.Close()
+		return nil, err
+	}
+	return cconn, nil
 }
 
 func (proxy *Proxy) GetCertificate() x509.Certificate {
 	return proxy.interceptor.ca.RootCert
 }
 
+// 所有 CA 的根证书，第一个为默认 CA，之后依次为 Options.CAs
+func (proxy *Proxy) GetCertificates() []x509.Certificate {
+	certs := []x509.Certificate{proxy.interceptor.ca.RootCert}
+	for _, ca := range proxy.interceptor.cas {
+		certs = append(certs, ca.RootCert)
+	}
+	return certs
+}
+
+// 正在等待握手名额的 tls 握手数，仅当 Options.MaxConcurrentHandshakes > 0 时有意义
+func (proxy *Proxy) QueuedHandshakes() int64 {
+	return atomic.LoadInt64(&proxy.interceptor.queuedHandshakes)
+}
+
 func (proxy *Proxy) SetShouldInterceptRule(rule func(req *http.Request) bool) {
 	proxy.shouldIntercept = rule
 }
@@ -446,32 +1359,294 @@ func (proxy *Proxy) SetUpstreamProxy(fn func(req *http.Request) (*url.URL, error
 
 func (proxy *Proxy) realUpstreamProxy() func(*http.Request) (*url.URL, error) {
 	return func(cReq *http.Request) (*url.URL, error) {
+		if proxyUrl, ok := cReq.Context().Value(flowUpstreamProxyCtxKey).(*url.URL); ok {
+			return proxyUrl, nil
+		}
 		req := cReq.Context().Value(proxyReqCtxKey).(*http.Request)
-		return proxy.getUpstreamProxyUrl(req)
+		proxyUrl, err := proxy.getUpstreamProxyUrl(req)
+		return proxyUrl, err
 	}
 }
 
 func (proxy *Proxy) getUpstreamProxyUrl(req *http.Request) (*url.URL, error) {
+	if proxyUrl, ok := req.Context().Value(flowUpstreamProxyCtxKey).(*url.URL); ok {
+		return proxyUrl, nil
+	}
+	if proxy.noProxy.match(req.Host) {
+		return nil, nil
+	}
 	if proxy.upstreamProxy != nil {
 		return proxy.upstreamProxy(req)
 	}
 	if len(proxy.Opts.Upstream) > 0 {
 		return url.Parse(proxy.Opts.Upstream)
 	}
+	if proxy.pacUpstream != nil {
+		return proxy.pacUpstream.proxyFor(req)
+	}
 	cReq := &http.Request{URL: &url.URL{Scheme: "https", Host: req.Host}}
 	return http.ProxyFromEnvironment(cReq)
 }
 
+// 建立 CONNECT 隧道的上游连接，临时错误时按 Options.MaxConnectRetries 退避重试
 func (proxy *Proxy) getUpstreamConn(req *http.Request) (net.Conn, error) {
+	backoff := connectRetryBackoff
+	for retry := 0; ; retry++ {
+		conn, err := proxy.dialConnectUpstream(req)
+		if err == nil || retry >= proxy.Opts.MaxConnectRetries || !isTransientDialError(err) {
+			return conn, err
+		}
+		log.Debugf("connect %v failed: %v, retry %v after %v", req.Host, err, retry+1, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-req.Context().Done():
+			return nil, err
+		}
+		if backoff *= 2; backoff > maxConnectRetryBackoff {
+			backoff = maxConnectRetryBackoff
+		}
+	}
+}
+
+var (
+	connectRetryBackoff    = 100 * time.Millisecond
+	maxConnectRetryBackoff = 2 * time.Second
+)
+
+// 连接被拒绝、重置、超时等可能在重试后恢复的错误
+func isTransientDialError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func (proxy *Proxy) dialConnectUpstream(req *http.Request) (net.Conn, error) {
 	proxyUrl, err := proxy.getUpstreamProxyUrl(req)
 	if err != nil {
 		return nil, err
 	}
 	var conn net.Conn
 	if proxyUrl != nil {
-		conn, err = getProxyConn(proxyUrl, req.Host)
+		conn, err = getProxyConn(proxyUrl, req.Host, proxy.dialUpstream, proxy.lookupIPAddr)
 	} else {
-		conn, err = (&net.Dialer{}).DialContext(context.Background(), "tcp", req.Host)
+		conn, err = proxy.dialUpstream(req.Context(), "tcp", req.Host)
 	}
 	return conn, err
 }
+
+// Options.DialUpstream 返回此错误时，使用默认的 dialer 连接
+var ErrUseDefaultDialer = errors.New("use default dialer")
+
+// 建立至上游（目标服务器或上游代理）的 tcp 连接
+func (proxy *Proxy) dialUpstream(ctx context.Context, network, addr string) (net.Conn, error) {
+	if proxy.Opts.DialUpstream != nil {
+		conn, err := proxy.Opts.DialUpstream(ctx, network, addr)
+		if !errors.Is(err, ErrUseDefaultDialer) {
+			return conn, err
+		}
+	}
+	dialer := &net.Dialer{Timeout: proxy.Opts.ConnectTimeout, Resolver: proxy.Opts.Resolver}
+	var conn net.Conn
+	var err error
+	if proxy.dnsCache != nil {
+		conn, err = proxy.dnsCache.dial(ctx, dialer, network, addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, network, addr)
+	}
+	var dnsErr *net.DNSError
+	if err != nil && errors.As(err, &dnsErr) {
+		host, _, _ := net.SplitHostPort(addr)
+		return nil, &ResolveError{Host: host, Err: dnsErr}
+	}
+	return conn, err
+}
+
+// 建立至目标服务器的 tcp 连接，请求经 socksTransport 使用 socks 上游代理时通过上游代理连接
+func (proxy *Proxy) dialTarget(ctx context.Context, network, addr string) (net.Conn, error) {
+	if proxyUrl, ok := ctx.Value(socksUpstreamCtxKey).(*url.URL); ok {
+		return dialSocksUpstream(ctx, proxyUrl, addr, proxy.dialUpstream, proxy.lookupIPAddr)
+	}
+	return proxy.dialUpstream(ctx, network, addr)
+}
+
+type resolveFunc func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+// 使用 Options.Resolver 及 dns 缓存解析上游 host，与 dialUpstream 一致，解析失败或没有结果时返回 ResolveError
+func (proxy *Proxy) lookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	var addrs []net.IPAddr
+	var err error
+	if proxy.dnsCache != nil {
+		addrs, err = proxy.dnsCache.lookupIPAddr(ctx, host)
+	} else {
+		resolver := proxy.Opts.Resolver
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		addrs, err = resolver.LookupIPAddr(ctx, host)
+	}
+	if err == nil && len(addrs) == 0 {
+		err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	var dnsErr *net.DNSError
+	if err != nil && errors.As(err, &dnsErr) {
+		return nil, &ResolveError{Host: host, Err: dnsErr}
+	}
+	return addrs, err
+}
+
+// 解析上游 host 失败，proxy 将响应 502（解析超时时响应 504），body 为错误信息
+// 可在 Addon.ServerError 中通过 errors.As 获取
+type ResolveError struct {
+	Host string
+	Err  *net.DNSError
+}
+
+func (e *ResolveError) Error() string {
+	return fmt.Sprintf("resolve upstream host %v: %v", e.Host, e.Err)
+}
+
+func (e *ResolveError) Unwrap() error {
+	return e.Err
+}
+
+// Options.DNSCacheTTL 启用时的 dns 缓存统计
+func (proxy *Proxy) DNSCacheStats() DNSCacheStats {
+	return proxy.dnsCache.snapshot()
+}
+
+// 实现 golang.org/x/net/proxy.Dialer
+type dialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f dialerFunc) Dial(network, addr string) (net.Conn, error) {
+	return f(context.Background(), network, addr)
+}
+
+func (f dialerFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+const defaultReadHeaderTimeout = 10 * time.Second
+
+// 同时用于 proxy.server 及拦截 https 的 middle.server，hijack 的 CONNECT、websocket 连接不受 ReadTimeout、WriteTimeout 限制
+func (proxy *Proxy) setServerTimeouts(server *http.Server) {
+	server.ReadHeaderTimeout = proxy.Opts.ReadHeaderTimeout
+	if server.ReadHeaderTimeout == 0 {
+		server.ReadHeaderTimeout = defaultReadHeaderTimeout
+	} else if server.ReadHeaderTimeout < 0 {
+		server.ReadHeaderTimeout = 0
+	}
+	server.ReadTimeout = proxy.Opts.ReadTimeout
+	server.WriteTimeout = proxy.Opts.WriteTimeout
+}
+
+// 连接上游失败时返回给客户端的状态码
+func connectErrorStatus(err error) int {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// 是否跳过 host 的上游证书校验
+func (proxy *Proxy) insecureSkipVerify(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if fn := proxy.Opts.InsecureSkipVerifyForHost; fn != nil {
+		return fn(host)
+	}
+	if proxy.Opts.SslInsecure {
+		return true
+	}
+	for _, pattern := range proxy.Opts.InsecureHosts {
+		if match.Match(host, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// 用于连接上游的 tls 配置
+// 当设置了 InsecureHosts 或 InsecureSkipVerifyForHost 时，关闭默认的证书校验，在 VerifyConnection 中根据 host 决定是否校验
+// 直接连接上游时由 dialTlsUpstream 按连接的 host 生成配置，此配置仅用于经上游代理时由 http.Transport 完成的 tls 握手
+func (proxy *Proxy) newTlsClientConfig() *tls.Config {
+	cfg := &tls.Config{
+		InsecureSkipVerify: proxy.Opts.SslInsecure,
+		KeyLogWriter:       proxy.keyLogWriter,
+	}
+	if proxy.Opts.InsecureSkipVerifyForHost != nil || (!proxy.Opts.SslInsecure && len(proxy.Opts.InsecureHosts) > 0) {
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = proxy.verifyConnection
+	}
+	proxy.setTransportClientCertificate(cfg)
+	return cfg
+}
+
+// 连接 host（不含端口）的 tls 配置，按 host 决定是否校验证书
+func (proxy *Proxy) newTlsClientConfigForHost(host string) *tls.Config {
+	cfg := &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: proxy.insecureSkipVerify(host),
+		KeyLogWriter:       proxy.keyLogWriter,
+	}
+	proxy.setClientCertificate(cfg, host)
+	return cfg
+}
+
+// 用于 http.Transport.DialTLSContext，在 conn 上与 addr 进行 tls 握手，conn 为 nil 时先连接 addr
+// 经上游代理时 http.Transport 不调用此方法
+func (proxy *Proxy) dialTlsUpstream(ctx context.Context, conn net.Conn, addr string) (net.Conn, error) {
+	if conn == nil {
+		var err error
+		if conn, err = proxy.dialTarget(ctx, "tcp", addr); err != nil {
+			return nil, err
+		}
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	cfg := proxy.newTlsClientConfigForHost(host)
+	if proxy.Opts.EnableHTTP2 {
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func (proxy *Proxy) verifyConnection(cs tls.ConnectionState) error {
+	// 经上游代理连接 ip 时不发送 SNI，无法得知 host，不能按 host 跳过校验，也无法校验证书是否属于该 host
+	if cs.ServerName == "" {
+		return errors.New("tls: cannot verify upstream certificate without server name")
+	}
+	if proxy.insecureSkipVerify(cs.ServerName) {
+		return nil
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("tls: no peer certificates")
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       cs.ServerName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, c := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
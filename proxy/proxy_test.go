@@ -1,20 +1,46 @@
 package proxy
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
 	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"testing/iotest"
 	"time"
 
+	"github.com/andybalholm/brotli"
+	"github.com/armon/go-socks5"
+	"github.com/gorilla/websocket"
 	"github.com/lqqyt2423/go-mitmproxy/cert"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/http2"
+	xproxy "golang.org/x/net/proxy"
 )
 
 func handleError(t *testing.T, err error) {
@@ -24,6 +50,23 @@ func handleError(t *testing.T, err error) {
 	}
 }
 
+// 等待 addr 开始监听，负载较高时固定的 sleep 可能不够
+func waitListening(t *testing.T, addr string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v not listening: %v", addr, err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
 func testSendRequest(t *testing.T, endpoint string, client *http.Client, bodyWant string) {
 	t.Helper()
 	req, err := http.NewRequest("GET", endpoint, nil)
@@ -721,3 +764,6945 @@ func TestOffUpstreamCert(t *testing.T) {
 		testOrderAddonInstance.contains(t, "TlsEstablishedServer")
 	})
 }
+
+// addon for test capture chunks
+type captureChunksAddon struct {
+	BaseAddon
+	flows chan *Flow
+}
+
+func (addon *captureChunksAddon) Requestheaders(f *Flow) {
+	f.CaptureChunks = true
+	f.Stream = f.Request.URL.Path == "/stream"
+}
+
+func (addon *captureChunksAddon) FlowDone(f *Flow) {
+	addon.flows <- f
+}
+
+func TestCaptureChunks(t *testing.T) {
+	// hand-crafted chunked response
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	handleError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					if _, err := http.ReadRequest(br); err != nil {
+						return
+					}
+					// 1xx 的中间响应不影响解析
+					io.WriteString(conn, "HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload\r\n\r\n"+
+						"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n"+
+						"5;foo=bar\r\nhello\r\n"+
+						"6\r\n world\r\n"+
+						"0\r\nX-Checksum: abc\r\n\r\n")
+				}
+			}(conn)
+		}
+	}()
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr: ":29087",
+	})
+	handleError(t, err)
+	addon := &captureChunksAddon{flows: make(chan *Flow, 2)}
+	testProxy.AddAddon(addon)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29087")
+			},
+		},
+	}
+	for _, path := range []string{"/", "/stream"} {
+		res, err := proxyClient.Get("http://" + ln.Addr().String() + path)
+		handleError(t, err)
+		body, err := ioutil.ReadAll(res.Body)
+		handleError(t, err)
+		res.Body.Close()
+		if string(body) != "hello world" {
+			t.Fatalf("%v: expected hello world, but got %s", path, body)
+		}
+		// trailer 转发给客户端
+		if res.Trailer.Get("X-Checksum") != "abc" {
+			t.Fatalf("%v: expected client trailer abc, but got %v", path, res.Trailer)
+		}
+
+		f := <-addon.flows
+		want := []*Chunk{{Size: 5, Extensions: "foo=bar"}, {Size: 6}, {Size: 0}}
+		if len(f.Response.Chunks) != len(want) {
+			t.Fatalf("%v: expected %v chunks, but got %v", path, len(want), len(f.Response.Chunks))
+		}
+		for i, c := range want {
+			if *f.Response.Chunks[i] != *c {
+				t.Fatalf("%v: expected chunk %v, but got %v", path, *c, *f.Response.Chunks[i])
+			}
+		}
+		if f.Response.Trailer.Get("X-Checksum") != "abc" {
+			t.Fatalf("%v: expected trailer abc, but got %v", path, f.Response.Trailer.Get("X-Checksum"))
+		}
+	}
+}
+
+func TestChunkParser(t *testing.T) {
+	raw := "HTTP/1.1 100 Continue\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"a;name=\"x\"\r\n0123456789\r\n" +
+		"0\r\nX-Checksum: abc\r\n\r\n"
+	want := []*Chunk{{Size: 10, Extensions: `name="x"`}, {Size: 0}}
+
+	// 逐字节写入，模拟任意的读取边界
+	p := new(chunkParser)
+	for i := 0; i < len(raw); i++ {
+		p.write([]byte{raw[i]})
+	}
+	chunks, err := p.result()
+	handleError(t, err)
+	if len(chunks) != len(want) {
+		t.Fatalf("expected %v chunks, but got %v", len(want), len(chunks))
+	}
+	for i, c := range want {
+		if *chunks[i] != *c {
+			t.Fatalf("expected chunk %v, but got %v", *c, *chunks[i])
+		}
+	}
+
+	// 未读取到 last-chunk
+	p = new(chunkParser)
+	p.write([]byte("HTTP/1.1 200 OK\r\n\r\n5\r\nhel"))
+	if chunks, err := p.result(); err != errChunkMalformed || len(chunks) != 1 {
+		t.Fatalf("expected 1 chunk and errChunkMalformed, but got %v %v", len(chunks), err)
+	}
+	p = new(chunkParser)
+	p.write([]byte("HTTP/1.1 200 OK\r\n\r\n5\r\nhelloXX"))
+	if _, err := p.result(); err != errChunkMalformed {
+		t.Fatalf("expected errChunkMalformed, but got %v", err)
+	}
+}
+
+func TestInsecureHosts(t *testing.T) {
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}),
+	}
+	tlsPlainLn, err := net.Listen("tcp", "127.0.0.1:0")
+	handleError(t, err)
+	defer tlsPlainLn.Close()
+	ca, err := cert.NewCAMemory()
+	handleError(t, err)
+	localhostCert, err := ca.GetCert("localhost")
+	handleError(t, err)
+	go server.Serve(tls.NewListener(tlsPlainLn, &tls.Config{
+		Certificates: []tls.Certificate{*localhostCert},
+	}))
+	httpsPort := strconv.Itoa(tlsPlainLn.Addr().(*net.TCPAddr).Port)
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:      ":29088",
+		InsecureHosts: []string{"local*"},
+	})
+	handleError(t, err)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29088")
+			},
+		},
+	}
+
+	t.Run("insecure host", func(t *testing.T) {
+		testSendRequest(t, "https://localhost:"+httpsPort+"/", proxyClient, "ok")
+	})
+
+	t.Run("other host should verify", func(t *testing.T) {
+		_, err := proxyClient.Get("https://127.0.0.1:" + httpsPort + "/")
+		if err == nil {
+			t.Fatal("should have error")
+		}
+	})
+}
+
+// addon for test informational response
+type informationalAddon struct {
+	BaseAddon
+	mu    sync.Mutex
+	codes []int
+}
+
+func (addon *informationalAddon) Informational(f *Flow, statusCode int, header http.Header) {
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	addon.codes = append(addon.codes, statusCode)
+}
+
+func TestInformationalResponse(t *testing.T) {
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+			w.WriteHeader(103)
+			w.Header().Del("Link")
+			w.Write([]byte("ok"))
+		}),
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	handleError(t, err)
+	defer ln.Close()
+	go server.Serve(ln)
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr: ":29089",
+	})
+	handleError(t, err)
+	addon := &informationalAddon{}
+	testProxy.AddAddon(addon)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29089")
+			},
+		},
+	}
+
+	var events []string
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			events = append(events, strconv.Itoa(code)+" "+header.Get("Link"))
+			return nil
+		},
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), "GET", "http://"+ln.Addr().String()+"/", nil)
+	handleError(t, err)
+	resp, err := proxyClient.Do(req)
+	handleError(t, err)
+	defer resp.Body.Close()
+	events = append(events, strconv.Itoa(resp.StatusCode)+" "+resp.Header.Get("Link"))
+
+	want := []string{"103 </style.css>; rel=preload; as=style", "200 "}
+	if strings.Join(events, "|") != strings.Join(want, "|") {
+		t.Fatalf("expected %v, but got %v", want, events)
+	}
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	if len(addon.codes) != 1 || addon.codes[0] != 103 {
+		t.Fatalf("expected Informational called with 103, but got %v", addon.codes)
+	}
+}
+
+func TestStreamTransform(t *testing.T) {
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for i := 0; i < 3; i++ {
+				io.WriteString(w, "hello "+strconv.Itoa(i)+"\nwor")
+				w.(http.Flusher).Flush()
+				io.WriteString(w, "ld\n")
+				w.(http.Flusher).Flush()
+			}
+			io.WriteString(w, "end")
+		}),
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	handleError(t, err)
+	defer ln.Close()
+	go server.Serve(ln)
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:          ":29090",
+		StreamLargeBodies: 16,
+	})
+	handleError(t, err)
+	testProxy.AddAddon(&StreamTransform{
+		ResponseTransformer: func(f *Flow) io.ReadWriteCloser {
+			return NewLineTransformer(bytes.ToUpper)
+		},
+	})
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29090")
+			},
+		},
+	}
+	testSendRequest(t, "http://"+ln.Addr().String()+"/", proxyClient, "HELLO 0\nWORLD\nHELLO 1\nWORLD\nHELLO 2\nWORLD\nEND")
+}
+
+type closeRecorder struct {
+	io.ReadWriteCloser
+	closed int32
+}
+
+func (c *closeRecorder) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return c.ReadWriteCloser.Close()
+}
+
+// flow 结束时停止读取原始 body，并等待转换的 goroutine 结束
+func TestStreamTransformFlowDone(t *testing.T) {
+	transformer := &closeRecorder{ReadWriteCloser: NewLineTransformer(bytes.ToUpper)}
+	st := &StreamTransform{
+		RequestTransformer: func(f *Flow) io.ReadWriteCloser { return transformer },
+	}
+	f := newFlow()
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	st.StreamRequestModifier(f, pr)
+
+	// 转换结果未被读取，写入转换器阻塞
+	_, err := pw.Write([]byte("hello\n"))
+	handleError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		st.FlowDone(f)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 2):
+		t.Fatal("expected FlowDone return")
+	}
+	if atomic.LoadInt32(&transformer.closed) != 1 {
+		t.Fatal("expected transformer closed before FlowDone return")
+	}
+}
+
+// burst of new https hosts, each handshake signs a new leaf cert
+func benchmarkInterceptorHandshake(b *testing.B, workers int) {
+	testProxy, err := NewProxy(&Options{
+		HandshakeWorkers: workers,
+		HandshakeBacklog: 64,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	go testProxy.interceptor.start()
+	defer testProxy.interceptor.close()
+
+	var count int64
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := atomic.AddInt64(&count, 1)
+			client, srv := net.Pipe()
+			connCtx := newConnContext(srv, testProxy)
+			connCtx.ClientConn.UpstreamCert = false
+			pipeServerConn := &pipeConn{
+				Conn:        srv,
+				r:           bufio.NewReader(srv),
+				remoteAddr:  "benchmark",
+				connContext: connCtx,
+			}
+			connCtx.pipeConn = pipeServerConn
+			go testProxy.interceptor.intercept(pipeServerConn)
+
+			tlsConn := tls.Client(client, &tls.Config{
+				ServerName:         "host" + strconv.FormatInt(i, 10) + ".benchmark.test",
+				InsecureSkipVerify: true,
+			})
+			if err := tlsConn.Handshake(); err != nil {
+				b.Error(err)
+			}
+			client.Close()
+		}
+	})
+}
+
+func BenchmarkInterceptorHandshakeWorkers1(b *testing.B)  { benchmarkInterceptorHandshake(b, 1) }
+func BenchmarkInterceptorHandshakeWorkers4(b *testing.B)  { benchmarkInterceptorHandshake(b, 4) }
+func BenchmarkInterceptorHandshakeWorkers16(b *testing.B) { benchmarkInterceptorHandshake(b, 16) }
+
+// addon for test dry run
+type rewriteBodyAddon struct {
+	BaseAddon
+}
+
+func (addon *rewriteBodyAddon) Requestheaders(f *Flow) {
+	if f.Request.Method == "CONNECT" {
+		f.Abort(403, "connect blocked")
+		return
+	}
+	f.Stream = true
+	f.StreamLargeBodies = 1
+	f.KeepHostHeader = true
+	// 实际生效时请求失败
+	f.UpstreamProxy = &url.URL{Scheme: "http", Host: "127.0.0.1:1"}
+	f.SetTag("type", "api")
+}
+
+func (addon *rewriteBodyAddon) Response(f *Flow) {
+	f.Response.Body = []byte("rewrited")
+	f.Response.Header.Set("X-Rewrited", "1")
+	f.Response.Trailer = http.Header{"X-Checksum": []string{"1"}}
+}
+
+func TestDryRun(t *testing.T) {
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}),
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	handleError(t, err)
+	defer ln.Close()
+	go server.Serve(ln)
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr: ":29091",
+		DryRun:   true,
+	})
+	handleError(t, err)
+	testProxy.AddAddon(&rewriteBodyAddon{})
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	logHook := logtest.NewGlobal()
+	defer logHook.Reset()
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29091")
+			},
+		},
+	}
+	resp, err := proxyClient.Get("http://" + ln.Addr().String() + "/")
+	handleError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	handleError(t, err)
+	if string(body) != "ok" {
+		t.Fatalf("expected original body ok, but got %s", body)
+	}
+	if resp.Header.Get("X-Rewrited") != "" {
+		t.Fatal("expected no X-Rewrited header")
+	}
+
+	found := false
+	for _, entry := range logHook.AllEntries() {
+		if strings.Contains(entry.Message, "dry run, would modify") &&
+			strings.Contains(entry.Message, "response body 2 bytes -> 8 bytes") &&
+			strings.Contains(entry.Message, "response header add X-Rewrited: 1") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("expected dry run log of intended modification")
+	}
+
+	found = false
+	for _, entry := range logHook.AllEntries() {
+		if strings.Contains(entry.Message, "dry run, would modify: stream false -> true") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("expected dry run log of stream mode")
+	}
+	for _, change := range []string{
+		"stream large bodies 0 -> 1",
+		"keep host header false -> true",
+		"upstream proxy none -> http://127.0.0.1:1",
+		"tag add type=api",
+		"response trailer header add X-Checksum: 1",
+	} {
+		found = false
+		for _, entry := range logHook.AllEntries() {
+			if strings.Contains(entry.Message, "dry run, would modify") && strings.Contains(entry.Message, change) {
+				found = true
+			}
+		}
+		if !found {
+			t.Fatalf("expected dry run log of %v", change)
+		}
+	}
+	if len(resp.Trailer) > 0 {
+		t.Fatalf("expected no trailer, but got %v", resp.Trailer)
+	}
+
+	// CONNECT 的 Abort 同样只记录，隧道仍建立
+	conn, err := net.Dial("tcp", "127.0.0.1:29091")
+	handleError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(conn, "CONNECT "+ln.Addr().String()+" HTTP/1.1\r\nHost: "+ln.Addr().String()+"\r\n\r\n")
+	handleError(t, err)
+	reader := bufio.NewReader(conn)
+	connectRes, err := http.ReadResponse(reader, nil)
+	handleError(t, err)
+	if connectRes.StatusCode != 200 {
+		t.Fatalf("expected tunnel established, but got %v", connectRes.StatusCode)
+	}
+	req, _ := http.NewRequest("GET", "http://"+ln.Addr().String()+"/", nil)
+	handleError(t, req.Write(conn))
+	tunnelRes, err := http.ReadResponse(reader, req)
+	handleError(t, err)
+	body, err = ioutil.ReadAll(tunnelRes.Body)
+	tunnelRes.Body.Close()
+	handleError(t, err)
+	if string(body) != "ok" {
+		t.Fatalf("expected ok through tunnel, but got %s", body)
+	}
+	found = false
+	for _, entry := range logHook.AllEntries() {
+		if strings.Contains(entry.Message, "dry run, would modify: abort with status 403: connect blocked") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("expected dry run log of connect abort")
+	}
+}
+
+func TestDecodedBodyLimit(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(make([]byte, 10*1024*1024))
+	handleError(t, err)
+	handleError(t, zw.Close())
+	compressed := buf.Bytes()
+
+	res := &Response{
+		StatusCode:     200,
+		Header:         http.Header{"Content-Encoding": []string{"gzip"}},
+		Body:           compressed,
+		maxDecodedSize: 1024 * 1024,
+	}
+	body, err := res.DecodedBody()
+	if !errors.Is(err, ErrDecompressedTooLarge) {
+		t.Fatalf("expected ErrDecompressedTooLarge, but got %v", err)
+	}
+	if body != nil {
+		t.Fatal("expected nil decoded body")
+	}
+	if !bytes.Equal(res.Body, compressed) {
+		t.Fatal("expected raw body untouched")
+	}
+	res.ReplaceToDecodedBody()
+	if res.Header.Get("Content-Encoding") != "gzip" || !bytes.Equal(res.Body, compressed) {
+		t.Fatal("expected raw body kept when decode failed")
+	}
+
+	req := &Request{
+		Method:         "POST",
+		Header:         http.Header{"Content-Encoding": []string{"gzip"}},
+		Body:           compressed,
+		maxDecodedSize: 1024 * 1024,
+	}
+	if _, err := req.DecodedBody(); !errors.Is(err, ErrDecompressedTooLarge) {
+		t.Fatalf("expected ErrDecompressedTooLarge, but got %v", err)
+	}
+
+	req = &Request{
+		Method:         "POST",
+		Header:         http.Header{"Content-Encoding": []string{"gzip"}},
+		Body:           compressed,
+		maxDecodedSize: 20 * 1024 * 1024,
+	}
+	body, err = req.DecodedBody()
+	handleError(t, err)
+	if len(body) != 10*1024*1024 {
+		t.Fatalf("expected 10mb decoded body, but got %v", len(body))
+	}
+}
+
+func TestDecodedBodyDictionaryEncoding(t *testing.T) {
+	raw := []byte{0xff, 'D', 'C', 'B', 0x01, 0x02, 0x03}
+	res := &Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Encoding": []string{"dcb"}},
+		Body:       raw,
+	}
+	body, err := res.DecodedBody()
+	if !errors.Is(err, ErrDictionaryEncoding) {
+		t.Fatalf("expected ErrDictionaryEncoding, but got %v", err)
+	}
+	if !bytes.Equal(body, raw) {
+		t.Fatalf("expected raw body returned, but got %v", body)
+	}
+	res.ReplaceToDecodedBody()
+	if res.Header.Get("Content-Encoding") != "dcb" || !bytes.Equal(res.Body, raw) {
+		t.Fatal("expected dictionary encoded body kept")
+	}
+
+	req := &Request{
+		Method: "POST",
+		Header: http.Header{"Content-Encoding": []string{"gzip, DCZ"}},
+		Body:   raw,
+	}
+	body, err = req.DecodedBody()
+	if !errors.Is(err, ErrDictionaryEncoding) {
+		t.Fatalf("expected ErrDictionaryEncoding, but got %v", err)
+	}
+	if !bytes.Equal(body, raw) {
+		t.Fatalf("expected raw body returned, but got %v", body)
+	}
+}
+
+func TestDecodedBodyEncodings(t *testing.T) {
+	want := []byte(strings.Repeat("hello zstd ", 50))
+	// strings.Repeat("hello zstd ", 50) | zstd -19
+	zstdBody := []byte{
+		0x28, 0xb5, 0x2f, 0xfd, 0x04, 0x68, 0x95, 0x00, 0x00, 0x58, 0x68, 0x65,
+		0x6c, 0x6c, 0x6f, 0x20, 0x7a, 0x73, 0x74, 0x64, 0x20, 0x01, 0x00, 0x18,
+		0x5c, 0x15, 0x2f, 0x29, 0xf8, 0xed, 0xe5,
+	}
+	var brBuf bytes.Buffer
+	bw := brotli.NewWriter(&brBuf)
+	_, err := bw.Write(want)
+	handleError(t, err)
+	handleError(t, bw.Close())
+	var gzBuf bytes.Buffer
+	zw := gzip.NewWriter(&gzBuf)
+	_, err = zw.Write(brBuf.Bytes())
+	handleError(t, err)
+	handleError(t, zw.Close())
+
+	cases := []struct {
+		enc  string
+		body []byte
+	}{
+		{"zstd", zstdBody},
+		{"ZSTD", zstdBody},
+		{"br", brBuf.Bytes()},
+		{"br, gzip", gzBuf.Bytes()},
+	}
+	for _, c := range cases {
+		res := &Response{
+			StatusCode: 200,
+			Header:     http.Header{"Content-Encoding": []string{c.enc}},
+			Body:       c.body,
+		}
+		body, err := res.DecodedBody()
+		handleError(t, err)
+		if !bytes.Equal(body, want) {
+			t.Fatalf("%v: unexpected decoded body %q", c.enc, body)
+		}
+
+		req := &Request{
+			Method: "POST",
+			Header: http.Header{"Content-Encoding": []string{c.enc}},
+			Body:   c.body,
+		}
+		body, err = req.DecodedBody()
+		handleError(t, err)
+		if !bytes.Equal(body, want) {
+			t.Fatalf("%v: unexpected decoded request body %q", c.enc, body)
+		}
+	}
+
+	raw := []byte("compressed by unknown")
+	res := &Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Encoding": []string{"gzip, foo"}},
+		Body:       raw,
+	}
+	body, err := res.DecodedBody()
+	if !errors.Is(err, ErrUnsupportedEncoding) {
+		t.Fatalf("expected ErrUnsupportedEncoding, but got %v", err)
+	}
+	if !bytes.Equal(body, raw) {
+		t.Fatalf("expected raw body returned, but got %v", body)
+	}
+	res.ReplaceToDecodedBody()
+	if res.Header.Get("Content-Encoding") != "gzip, foo" || !bytes.Equal(res.Body, raw) {
+		t.Fatal("expected unsupported encoded body kept")
+	}
+
+	// 无 Content-Encoding 时直接返回 Body
+	res = &Response{StatusCode: 200, Header: http.Header{}, Body: want}
+	body, err = res.DecodedBody()
+	handleError(t, err)
+	if &body[0] != &want[0] {
+		t.Fatal("expected body returned without copy")
+	}
+}
+
+func TestReplaceBody(t *testing.T) {
+	data := []byte(strings.Repeat("replaced body ", 20))
+	cases := []struct {
+		enc         string
+		expectedEnc string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"deflate", "deflate"},
+		{"br, gzip", "br, gzip"},
+		{"zstd", ""}, // 不支持压缩，移除 Content-Encoding
+	}
+	for _, c := range cases {
+		header := http.Header{"Transfer-Encoding": {"chunked"}, "Content-Type": {"text/plain"}}
+		if c.enc != "" {
+			header.Set("Content-Encoding", c.enc)
+		}
+		res := &Response{StatusCode: 200, Header: header, Body: []byte("old")}
+		handleError(t, res.ReplaceBody("application/json", data))
+
+		if enc := res.Header.Get("Content-Encoding"); enc != c.expectedEnc {
+			t.Fatalf("%v: expected content-encoding %q, but got %q", c.enc, c.expectedEnc, enc)
+		}
+		if cl := res.Header.Get("Content-Length"); cl != strconv.Itoa(len(res.Body)) {
+			t.Fatalf("%v: content-length %v mismatch body length %v", c.enc, cl, len(res.Body))
+		}
+		if res.Header.Get("Transfer-Encoding") != "" {
+			t.Fatalf("%v: expected transfer-encoding removed", c.enc)
+		}
+		if ct := res.Header.Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("%v: unexpected content-type %v", c.enc, ct)
+		}
+		body := res.Body
+		if c.expectedEnc != "" {
+			var err error
+			body, err = decode(c.expectedEnc, res.Body, 0)
+			handleError(t, err)
+		}
+		if !bytes.Equal(body, data) {
+			t.Fatalf("%v: unexpected body %q", c.enc, body)
+		}
+		decoded, err := res.DecodedBody()
+		handleError(t, err)
+		if !bytes.Equal(decoded, data) {
+			t.Fatalf("%v: unexpected decoded body %q", c.enc, decoded)
+		}
+	}
+
+	var gzBuf bytes.Buffer
+	zw := gzip.NewWriter(&gzBuf)
+	_, err := zw.Write([]byte("hello world"))
+	handleError(t, err)
+	handleError(t, zw.Close())
+	res := &Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Encoding": {"gzip"}},
+		Body:       gzBuf.Bytes(),
+	}
+	handleError(t, res.DecodeAndReplace(func(body []byte) []byte {
+		return bytes.Replace(body, []byte("world"), []byte("proxy"), 1)
+	}))
+	body, err := decode("gzip", res.Body, 0)
+	handleError(t, err)
+	if string(body) != "hello proxy" || res.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("unexpected body %q", body)
+	}
+
+	// 解压失败时不修改
+	res = &Response{StatusCode: 200, Header: http.Header{"Content-Encoding": {"gzip"}}, Body: []byte("not gzip")}
+	if err := res.DecodeAndReplace(func(body []byte) []byte { return nil }); err == nil {
+		t.Fatal("expected decode error")
+	}
+	if string(res.Body) != "not gzip" {
+		t.Fatalf("expected body kept, but got %q", res.Body)
+	}
+}
+
+type fakeASNLookup map[string]uint
+
+func (l fakeASNLookup) ASN(ip net.IP) (uint, error) {
+	return l[ip.String()], nil
+}
+
+func TestIPRule(t *testing.T) {
+	resolver := func(ctx context.Context, host string) ([]net.IP, error) {
+		switch host {
+		case "internal.example.com":
+			return []net.IP{net.ParseIP("10.1.2.3")}, nil
+		case "cloud.example.com":
+			return []net.IP{net.ParseIP("203.0.113.9")}, nil
+		case "other.example.com":
+			return []net.IP{net.ParseIP("198.51.100.1")}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	asns := fakeASNLookup{
+		"203.0.113.9":  16509,
+		"198.51.100.1": 64500,
+	}
+
+	rule, err := NewIPRule([]string{"10.0.0.0/8"}, []uint{16509}, asns)
+	handleError(t, err)
+	rule.Resolver = resolver
+
+	cases := map[string]bool{
+		"internal.example.com:443": true,  // cidr
+		"cloud.example.com:443":    true,  // asn
+		"other.example.com:443":    false, // asn not match
+		"unknown.example.com:443":  false, // resolve error
+		"10.9.9.9:443":             true,  // ip literal
+	}
+	for host, should := range cases {
+		req := &http.Request{Host: host}
+		if got := rule.Match(req.WithContext(context.Background())); got != should {
+			t.Errorf("%v expected %v, but got %v", host, should, got)
+		}
+	}
+
+	if _, err := NewIPRule([]string{"10.0.0.0"}, nil, nil); err == nil {
+		t.Error("expected invalid cidr error")
+	}
+	if _, err := NewIPRule(nil, []uint{16509}, nil); err == nil {
+		t.Error("expected asn lookup required error")
+	}
+}
+
+func TestMaxConcurrentHandshakes(t *testing.T) {
+	testProxy, err := NewProxy(&Options{
+		MaxConcurrentHandshakes: 2,
+	})
+	handleError(t, err)
+	m := testProxy.interceptor
+	defer m.close()
+
+	var active, maxActive, maxQueued int64
+	getCertificate := m.tlsConfig.GetCertificate
+	m.tlsConfig.GetCertificate = func(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		n := atomic.AddInt64(&active, 1)
+		defer atomic.AddInt64(&active, -1)
+		for {
+			old := atomic.LoadInt64(&maxActive)
+			if n <= old || atomic.CompareAndSwapInt64(&maxActive, old, n) {
+				break
+			}
+		}
+		if queued := testProxy.QueuedHandshakes(); queued > atomic.LoadInt64(&maxQueued) {
+			atomic.StoreInt64(&maxQueued, queued)
+		}
+		time.Sleep(time.Millisecond * 20)
+		return getCertificate(clientHello)
+	}
+
+	// drain handshaked conns
+	go func() {
+		for {
+			select {
+			case c := <-m.listener.connChan:
+				c.Close()
+			case <-m.listener.doneChan:
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client, srv := net.Pipe()
+			defer client.Close()
+			connCtx := newConnContext(srv, testProxy)
+			connCtx.ClientConn.UpstreamCert = false
+			pipeServerConn := &pipeConn{
+				Conn:        srv,
+				r:           bufio.NewReader(srv),
+				remoteAddr:  "burst",
+				connContext: connCtx,
+			}
+			connCtx.pipeConn = pipeServerConn
+			go m.handshake(pipeServerConn)
+
+			tlsConn := tls.Client(client, &tls.Config{
+				ServerName:         "host" + strconv.Itoa(i) + ".burst.test",
+				InsecureSkipVerify: true,
+			})
+			if err := tlsConn.Handshake(); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt64(&maxActive); got > 2 {
+		t.Fatalf("expected at most 2 concurrent handshakes, but got %v", got)
+	}
+	if atomic.LoadInt64(&maxQueued) == 0 {
+		t.Fatal("expected queued handshakes under burst")
+	}
+	if got := testProxy.QueuedHandshakes(); got != 0 {
+		t.Fatalf("expected no queued handshakes after burst, but got %v", got)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	testProxy, err := NewProxy(&Options{
+		MaxConcurrentHandshakes: 1,
+		HandshakeTimeout:        time.Millisecond * 50,
+	})
+	handleError(t, err)
+	m := testProxy.interceptor
+	defer m.close()
+
+	// drain handshaked conns
+	go func() {
+		for {
+			select {
+			case c := <-m.listener.connChan:
+				c.Close()
+			case <-m.listener.doneChan:
+				return
+			}
+		}
+	}()
+
+	newConn := func() net.Conn {
+		client, srv := net.Pipe()
+		connCtx := newConnContext(srv, testProxy)
+		connCtx.ClientConn.UpstreamCert = false
+		pipeServerConn := &pipeConn{
+			Conn:        srv,
+			r:           bufio.NewReader(srv),
+			remoteAddr:  "slow",
+			connContext: connCtx,
+		}
+		connCtx.pipeConn = pipeServerConn
+		go m.handshake(pipeServerConn)
+		return client
+	}
+
+	// 只发送部分 ClientHello 后停止，占用唯一的握手名额
+	slow := newConn()
+	defer slow.Close()
+	_, err = slow.Write([]byte{0x16, 0x03, 0x01})
+	handleError(t, err)
+
+	client := newConn()
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(time.Second * 2))
+	tlsConn := tls.Client(client, &tls.Config{
+		ServerName:         "example.com",
+		InsecureSkipVerify: true,
+	})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("expected handshake after slow one timeout, but got %v", err)
+	}
+}
+
+func TestConnectUnreachable(t *testing.T) {
+	// get a closed port
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	handleError(t, err)
+	unreachable := ln.Addr().String()
+	ln.Close()
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr: ":29092",
+	})
+	handleError(t, err)
+	intercept := false
+	testProxy.SetShouldInterceptRule(func(req *http.Request) bool {
+		return intercept
+	})
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	connect := func() int {
+		conn, err := net.Dial("tcp", "127.0.0.1:29092")
+		handleError(t, err)
+		defer conn.Close()
+		_, err = io.WriteString(conn, "CONNECT "+unreachable+" HTTP/1.1\r\nHost: "+unreachable+"\r\n\r\n")
+		handleError(t, err)
+		res, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+		handleError(t, err)
+		return res.StatusCode
+	}
+
+	t.Run("transpond", func(t *testing.T) {
+		intercept = false
+		if code := connect(); code != 502 {
+			t.Fatalf("expected 502, but got %v", code)
+		}
+	})
+
+	t.Run("intercept", func(t *testing.T) {
+		intercept = true
+		if code := connect(); code != 502 {
+			t.Fatalf("expected 502, but got %v", code)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		if code := connectErrorStatus(context.DeadlineExceeded); code != 504 {
+			t.Fatalf("expected 504, but got %v", code)
+		}
+	})
+}
+
+func TestDialUpstream(t *testing.T) {
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}),
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	handleError(t, err)
+	defer ln.Close()
+	go server.Serve(ln)
+
+	// 将虚拟的 upstream.test 连接至测试服务器，其他地址使用默认 dialer
+	var mu sync.Mutex
+	var dialed []string
+	testProxy, err := NewProxy(&Options{
+		HttpAddr: ":29097",
+		DialUpstream: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			mu.Lock()
+			dialed = append(dialed, addr)
+			mu.Unlock()
+			if strings.HasPrefix(addr, "upstream.test:") {
+				return (&net.Dialer{}).DialContext(ctx, network, ln.Addr().String())
+			}
+			return nil, ErrUseDefaultDialer
+		},
+	})
+	handleError(t, err)
+	testProxy.SetShouldInterceptRule(func(req *http.Request) bool {
+		return false
+	})
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29097")
+			},
+		},
+	}
+	get := func(t *testing.T, rawurl string) {
+		resp, err := proxyClient.Get(rawurl)
+		handleError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		handleError(t, err)
+		if resp.StatusCode != 200 || string(body) != "ok" {
+			t.Fatalf("expected 200 ok, but got %v %s", resp.StatusCode, body)
+		}
+	}
+	lastDialed := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(dialed) == 0 {
+			return ""
+		}
+		return dialed[len(dialed)-1]
+	}
+
+	t.Run("http", func(t *testing.T) {
+		get(t, "http://upstream.test/")
+		if addr := lastDialed(); addr != "upstream.test:80" {
+			t.Fatalf("expected dial upstream.test:80, but got %v", addr)
+		}
+	})
+
+	t.Run("connect", func(t *testing.T) {
+		conn, err := net.Dial("tcp", "127.0.0.1:29097")
+		handleError(t, err)
+		defer conn.Close()
+		_, err = io.WriteString(conn, "CONNECT upstream.test:443 HTTP/1.1\r\nHost: upstream.test:443\r\n\r\n")
+		handleError(t, err)
+		reader := bufio.NewReader(conn)
+		res, err := http.ReadResponse(reader, &http.Request{Method: "CONNECT"})
+		handleError(t, err)
+		if res.StatusCode != 200 {
+			t.Fatalf("expected 200, but got %v", res.StatusCode)
+		}
+		if addr := lastDialed(); addr != "upstream.test:443" {
+			t.Fatalf("expected dial upstream.test:443, but got %v", addr)
+		}
+
+		// 隧道另一端即测试服务器
+		_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: upstream.test\r\n\r\n")
+		handleError(t, err)
+		res, err = http.ReadResponse(reader, nil)
+		handleError(t, err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		handleError(t, err)
+		if string(body) != "ok" {
+			t.Fatalf("expected ok, but got %s", body)
+		}
+	})
+
+	t.Run("fallback to default dialer", func(t *testing.T) {
+		get(t, "http://"+ln.Addr().String()+"/")
+		if addr := lastDialed(); addr != ln.Addr().String() {
+			t.Fatalf("expected dial %v, but got %v", ln.Addr().String(), addr)
+		}
+	})
+}
+
+// addon for test client abort
+type errorAddon struct {
+	BaseAddon
+	errs chan error
+}
+
+func (addon *errorAddon) Error(f *Flow, err error) {
+	addon.errs <- err
+}
+
+func TestClientAbortUpload(t *testing.T) {
+	received := make(chan struct{})
+	upstreamErr := make(chan error, 1)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			buf := make([]byte, 1)
+			_, err := io.ReadFull(r.Body, buf)
+			close(received)
+			if err == nil {
+				_, err = io.Copy(ioutil.Discard, r.Body)
+			}
+			upstreamErr <- err
+		}),
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	handleError(t, err)
+	defer ln.Close()
+	go server.Serve(ln)
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:          ":29098",
+		StreamLargeBodies: 1024,
+	})
+	handleError(t, err)
+	addon := &errorAddon{errs: make(chan error, 1)}
+	testProxy.AddAddon(addon)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	conn, err := net.Dial("tcp", "127.0.0.1:29098")
+	handleError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "POST http://"+ln.Addr().String()+"/upload HTTP/1.1\r\nHost: "+ln.Addr().String()+"\r\nContent-Length: 10000\r\n\r\n")
+	handleError(t, err)
+	_, err = conn.Write(make([]byte, 5000))
+	handleError(t, err)
+
+	select {
+	case <-received:
+	case <-time.After(time.Second * 2):
+		t.Fatal("upstream not received request")
+	}
+	conn.Close()
+
+	select {
+	case err := <-upstreamErr:
+		if err == nil {
+			t.Fatal("expected upstream request canceled, but body read completed")
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("upstream request not canceled")
+	}
+
+	select {
+	case err := <-addon.errs:
+		var abortErr *ClientAbortError
+		if !errors.As(err, &abortErr) {
+			t.Fatalf("expected ClientAbortError, but got %v", err)
+		}
+		if abortErr.BytesSent != 5000 {
+			t.Fatalf("expected 5000 bytes sent, but got %v", abortErr.BytesSent)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("expected Error event")
+	}
+}
+
+func TestParseJA3(t *testing.T) {
+	ext := func(typ uint16, data []byte) []byte {
+		return append([]byte{byte(typ >> 8), byte(typ), byte(len(data) >> 8), byte(len(data))}, data...)
+	}
+	var exts []byte
+	exts = append(exts, ext(0x0a0a, nil)...)                                // GREASE
+	exts = append(exts, ext(0, []byte{0, 0})...)                            // server_name
+	exts = append(exts, ext(10, []byte{0, 6, 0x1a, 0x1a, 0, 29, 0, 23})...) // supported_groups
+	exts = append(exts, ext(11, []byte{1, 0})...)                           // ec_point_formats
+	exts = append(exts, ext(65281, []byte{0})...)                           // renegotiation_info
+
+	var hello []byte
+	hello = append(hello, 0x03, 0x03)                               // version
+	hello = append(hello, make([]byte, 32)...)                      // random
+	hello = append(hello, 0)                                        // session id
+	hello = append(hello, 0, 6, 0x2a, 0x2a, 0xc0, 0x2b, 0xc0, 0x2f) // cipher suites
+	hello = append(hello, 1, 0)                                     // compression methods
+	hello = append(hello, byte(len(exts)>>8), byte(len(exts)))
+	hello = append(hello, exts...)
+
+	handshake := append([]byte{1, 0, byte(len(hello) >> 8), byte(len(hello))}, hello...)
+	record := append([]byte{0x16, 0x03, 0x01, byte(len(handshake) >> 8), byte(len(handshake))}, handshake...)
+
+	ja3, hash, err := parseJA3(record)
+	handleError(t, err)
+	want := "771,49195-49199,0-10-11-65281,29-23,0"
+	if ja3 != want {
+		t.Fatalf("expected %v, but got %v", want, ja3)
+	}
+	if len(hash) != 32 {
+		t.Fatalf("unexpected hash %v", hash)
+	}
+
+	if _, _, err := parseJA3([]byte("GET / HTTP/1.1\r\n")); err == nil {
+		t.Fatal("expected error for non tls record")
+	}
+	if _, _, err := parseJA3(record[:len(record)-3]); err == nil {
+		t.Fatal("expected error for truncated record")
+	}
+}
+
+// addon for test ja3 rules
+type ja3Addon struct {
+	BaseAddon
+	mu  sync.Mutex
+	ja3 string
+}
+
+func (addon *ja3Addon) Requestheaders(f *Flow) {
+	if f.Request.Method != "CONNECT" {
+		return
+	}
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	addon.ja3 = f.ConnContext.ClientConn.JA3
+}
+
+func TestJA3Rules(t *testing.T) {
+	var dials int32
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}),
+		ConnState: func(c net.Conn, state http.ConnState) {
+			if state == http.StateNew {
+				atomic.AddInt32(&dials, 1)
+			}
+		},
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	handleError(t, err)
+	defer ln.Close()
+	ca, err := cert.NewCAMemory()
+	handleError(t, err)
+	serverCert, err := ca.GetCert("localhost")
+	handleError(t, err)
+	go server.Serve(tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{*serverCert}}))
+	endpoint := "https://localhost:" + strconv.Itoa(ln.Addr().(*net.TCPAddr).Port) + "/"
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr: ":29099",
+	})
+	handleError(t, err)
+	var ruleJA3 atomic.Value
+	testProxy.SetShouldInterceptRule(func(req *http.Request) bool {
+		ruleJA3.Store(JA3FromRequest(req))
+		return false
+	})
+	addon := &ja3Addon{}
+	testProxy.AddAddon(addon)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	get := func(tlsConfig *tls.Config) error {
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig:   tlsConfig,
+				DisableKeepAlives: true,
+				Proxy: func(r *http.Request) (*url.URL, error) {
+					return url.Parse("http://127.0.0.1:29099")
+				},
+			},
+		}
+		resp, err := client.Get(endpoint)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		_, err = ioutil.ReadAll(resp.Body)
+		return err
+	}
+	scraper := func() *tls.Config {
+		return &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}}
+	}
+	browser := func() *tls.Config {
+		return &tls.Config{InsecureSkipVerify: true}
+	}
+
+	// 任意规则均会开启 ja3 采集
+	testProxy.SetJA3Rules([]*JA3Rule{{Hash: "00000000000000000000000000000000", Action: JA3ActionBlock}})
+	handleError(t, get(scraper()))
+	addon.mu.Lock()
+	scraperJA3 := addon.ja3
+	addon.mu.Unlock()
+	if scraperJA3 == "" {
+		t.Fatal("expected ja3 captured")
+	}
+	// 决定是否拦截时已可获取
+	if ja3 := ruleJA3.Load(); ja3 != scraperJA3 {
+		t.Fatalf("expected ja3 %v in intercept rule, but got %v", scraperJA3, ja3)
+	}
+
+	testProxy.SetJA3Rules([]*JA3Rule{{Hash: scraperJA3, Action: JA3ActionBlock}})
+	t.Run("block", func(t *testing.T) {
+		before := atomic.LoadInt32(&dials)
+		if err := get(scraper()); err == nil {
+			t.Fatal("expected blocked")
+		}
+		// 不连接上游
+		if after := atomic.LoadInt32(&dials); after != before {
+			t.Fatalf("expected no upstream connection, but got %v", after-before)
+		}
+	})
+	t.Run("pass", func(t *testing.T) {
+		handleError(t, get(browser()))
+		addon.mu.Lock()
+		defer addon.mu.Unlock()
+		if addon.ja3 == "" || addon.ja3 == scraperJA3 {
+			t.Fatalf("expected different ja3, but got %v", addon.ja3)
+		}
+	})
+
+	t.Run("route", func(t *testing.T) {
+		honeypot := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("honeypot"))
+		}))
+		defer honeypot.Close()
+		testProxy.SetJA3Rules([]*JA3Rule{{Hash: scraperJA3, Action: JA3ActionRoute, Addr: honeypot.Listener.Addr().String()}})
+		defer testProxy.SetJA3Rules([]*JA3Rule{{Hash: scraperJA3, Action: JA3ActionBlock}})
+
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig:   scraper(),
+				DisableKeepAlives: true,
+				Proxy: func(r *http.Request) (*url.URL, error) {
+					return url.Parse("http://127.0.0.1:29099")
+				},
+			},
+		}
+		resp, err := client.Get(endpoint)
+		handleError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		handleError(t, err)
+		if string(body) != "honeypot" {
+			t.Fatalf("expected routed to honeypot, but got %v", string(body))
+		}
+	})
+
+	// 服务端先发送数据的协议，客户端不发送 ClientHello
+	t.Run("server first", func(t *testing.T) {
+		greeter, err := net.Listen("tcp", "127.0.0.1:0")
+		handleError(t, err)
+		defer greeter.Close()
+		go func() {
+			for {
+				c, err := greeter.Accept()
+				if err != nil {
+					return
+				}
+				c.Write([]byte("220 ready\r\n"))
+				c.Close()
+			}
+		}()
+
+		conn, err := net.Dial("tcp", "127.0.0.1:29099")
+		handleError(t, err)
+		defer conn.Close()
+		start := time.Now()
+		fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", greeter.Addr(), greeter.Addr())
+		conn.SetReadDeadline(time.Now().Add(clientHelloPeekTimeout))
+		r := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(r, nil)
+		handleError(t, err)
+		if resp.StatusCode != 200 {
+			t.Fatalf("expected 200, but got %v", resp.StatusCode)
+		}
+		line, err := r.ReadString('\n')
+		handleError(t, err)
+		if line != "220 ready\r\n" {
+			t.Fatalf("unexpected greeting %q", line)
+		}
+		if elapsed := time.Since(start); elapsed >= clientHelloPeekTimeout {
+			t.Fatalf("expected greeting before %v, but took %v", clientHelloPeekTimeout, elapsed)
+		}
+	})
+}
+
+// addon for test http2
+type protoAddon struct {
+	BaseAddon
+	mu      sync.Mutex
+	flows   int
+	conns   map[string]bool
+	protos  map[string]bool
+	upProto map[string]bool
+}
+
+func (addon *protoAddon) Response(f *Flow) {
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	addon.flows++
+	addon.conns[f.ConnContext.Id().String()] = true
+	addon.protos[f.Request.Proto] = true
+	addon.upProto[f.Response.Proto] = true
+}
+
+func TestHTTP2(t *testing.T) {
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Proto))
+		}),
+	}
+	handleError(t, http2.ConfigureServer(server, nil))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	handleError(t, err)
+	defer ln.Close()
+	ca, err := cert.NewCAMemory()
+	handleError(t, err)
+	serverCert, err := ca.GetCert("localhost")
+	handleError(t, err)
+	go server.Serve(tls.NewListener(ln, &tls.Config{
+		Certificates: []tls.Certificate{*serverCert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}))
+	endpoint := "https://localhost:" + strconv.Itoa(ln.Addr().(*net.TCPAddr).Port) + "/"
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:    ":29101",
+		SslInsecure: true,
+		EnableHTTP2: true,
+	})
+	handleError(t, err)
+	addon := &protoAddon{conns: make(map[string]bool), protos: make(map[string]bool), upProto: make(map[string]bool)}
+	testProxy.AddAddon(addon)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			ForceAttemptHTTP2: true,
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29101")
+			},
+		},
+	}
+	get := func() error {
+		resp, err := proxyClient.Get(endpoint)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if resp.Proto != "HTTP/2.0" || string(body) != "HTTP/2.0" {
+			return fmt.Errorf("expected http2 for client and upstream, but got %v %s", resp.Proto, body)
+		}
+		return nil
+	}
+
+	// 首个请求建立连接，之后的请求复用同一 tls 连接
+	handleError(t, get())
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := get(); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	if addon.flows != 11 {
+		t.Fatalf("expected 11 flows, but got %v", addon.flows)
+	}
+	if len(addon.conns) != 1 {
+		t.Fatalf("expected multiplexed over 1 client connection, but got %v", len(addon.conns))
+	}
+	if !addon.protos["HTTP/2.0"] || len(addon.protos) != 1 || !addon.upProto["HTTP/2.0"] || len(addon.upProto) != 1 {
+		t.Fatalf("unexpected protos %v %v", addon.protos, addon.upProto)
+	}
+}
+
+// 上游只支持 http/1.1 时，即使开启 EnableHTTP2 也不能向客户端提供 h2
+func TestHTTP2UpstreamHTTP1(t *testing.T) {
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond * 5)
+		w.Write([]byte(r.Proto + " " + r.URL.Path))
+	}))
+	origin.EnableHTTP2 = false
+	origin.StartTLS()
+	defer origin.Close()
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:    ":29160",
+		SslInsecure: true,
+		EnableHTTP2: true,
+	})
+	handleError(t, err)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			ForceAttemptHTTP2: true,
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29160")
+			},
+		},
+	}
+	get := func(i int) error {
+		path := "/" + strconv.Itoa(i)
+		resp, err := proxyClient.Get(origin.URL + path)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if resp.Proto != "HTTP/1.1" || string(body) != "HTTP/1.1 "+path {
+			return fmt.Errorf("expected http/1.1 response of %v, but got %v %s", path, resp.Proto, body)
+		}
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := get(i); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+// addon for test upstream conn addr
+type serverAddrAddon struct {
+	BaseAddon
+	mu     sync.Mutex
+	local  net.Addr
+	remote net.Addr
+}
+
+func (addon *serverAddrAddon) Response(f *Flow) {
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	addon.local = f.ConnContext.ServerConn.LocalAddr()
+	addon.remote = f.ConnContext.ServerConn.RemoteAddr()
+}
+
+func TestServerConnAddr(t *testing.T) {
+	var clientAddr string
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			clientAddr = r.RemoteAddr
+			w.Write([]byte("ok"))
+		}),
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	handleError(t, err)
+	defer ln.Close()
+	go server.Serve(ln)
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr: ":29102",
+	})
+	handleError(t, err)
+	addon := &serverAddrAddon{}
+	testProxy.AddAddon(addon)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29102")
+			},
+		},
+	}
+	testSendRequest(t, "http://"+ln.Addr().String()+"/", proxyClient, "ok")
+
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	if addon.remote == nil || addon.remote.String() != ln.Addr().String() {
+		t.Fatalf("expected remote addr %v, but got %v", ln.Addr(), addon.remote)
+	}
+	if addon.local == nil || addon.local.String() != clientAddr {
+		t.Fatalf("expected local addr %v, but got %v", clientAddr, addon.local)
+	}
+}
+
+// addon for test rewrite request method
+type methodAddon struct {
+	BaseAddon
+}
+
+func (addon *methodAddon) Requestheaders(f *Flow) {
+	// stream 模式不触发 Request，在此改写
+	if f.Request.Header.Get("X-Stream") != "" {
+		f.Stream = true
+		addon.Request(f)
+	}
+}
+
+func (addon *methodAddon) Request(f *Flow) {
+	if method := f.Request.Header.Get("X-Rewrite-Method"); method != "" {
+		f.Request.Method = method
+	}
+}
+
+// X-Wrap-Body 时替换为长度未知的 reader
+func (addon *methodAddon) StreamRequestModifier(f *Flow, in io.Reader) io.Reader {
+	if in != nil && f.Request.Header.Get("X-Wrap-Body") != "" {
+		return io.MultiReader(in)
+	}
+	return in
+}
+
+func TestRewriteMethod(t *testing.T) {
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			received := r.Method + " " + strconv.FormatInt(r.ContentLength, 10) + " " + string(body)
+			// HEAD 的响应没有 body，通过 header 返回
+			w.Header().Set("X-Received", received)
+			w.Header().Set("Content-Length", strconv.Itoa(len(received)))
+			io.WriteString(w, received)
+		}),
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	handleError(t, err)
+	defer ln.Close()
+	go server.Serve(ln)
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr: ":29103",
+	})
+	handleError(t, err)
+	testProxy.AddAddon(&methodAddon{})
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29103")
+			},
+		},
+	}
+	// 上游收到的请求
+	var received string
+	// flags 为设置为 1 的请求 header，如 X-Stream
+	do := func(t *testing.T, method, rewrite, body string, flags ...string) string {
+		t.Helper()
+		var reqBody io.Reader
+		if body != "" {
+			reqBody = strings.NewReader(body)
+		}
+		req, err := http.NewRequest(method, "http://"+ln.Addr().String()+"/", reqBody)
+		handleError(t, err)
+		req.Header.Set("X-Rewrite-Method", rewrite)
+		for _, flag := range flags {
+			req.Header.Set(flag, "1")
+		}
+		resp, err := proxyClient.Do(req)
+		handleError(t, err)
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		handleError(t, err)
+		received = resp.Header.Get("X-Received")
+		return string(b)
+	}
+
+	t.Run("post to put", func(t *testing.T) {
+		if got := do(t, "POST", "PUT", "hello"); got != "PUT 5 hello" {
+			t.Fatalf("expected PUT 5 hello, but got %v", got)
+		}
+	})
+
+	t.Run("post to get with body", func(t *testing.T) {
+		if got := do(t, "POST", "GET", "hello"); got != "GET 5 hello" {
+			t.Fatalf("expected GET 5 hello, but got %v", got)
+		}
+	})
+
+	t.Run("get to post without body", func(t *testing.T) {
+		if got := do(t, "GET", "POST", ""); got != "POST 0 " {
+			t.Fatalf("expected POST 0, but got %v", got)
+		}
+	})
+
+	t.Run("get to head", func(t *testing.T) {
+		if got := do(t, "GET", "HEAD", ""); got != "" {
+			t.Fatalf("expected empty body, but got %v", got)
+		}
+	})
+
+	t.Run("trace drops body", func(t *testing.T) {
+		if got := do(t, "POST", "TRACE", "hello"); got != "TRACE 0 " {
+			t.Fatalf("expected TRACE 0, but got %v", got)
+		}
+	})
+
+	// GET、HEAD 的 body 以 Content-Length 发送，而不是 chunked
+	t.Run("post to head with body", func(t *testing.T) {
+		if got := do(t, "POST", "HEAD", "hello"); got != "" || received != "HEAD 5 hello" {
+			t.Fatalf("expected HEAD 5 hello received, but got %q %q", received, got)
+		}
+	})
+
+	t.Run("get with body", func(t *testing.T) {
+		if got := do(t, "GET", "", "hello"); got != "GET 5 hello" {
+			t.Fatalf("expected GET 5 hello, but got %v", got)
+		}
+	})
+
+	t.Run("stream get with body", func(t *testing.T) {
+		if got := do(t, "GET", "", "hello", "X-Stream"); got != "GET 5 hello" {
+			t.Fatalf("expected GET 5 hello, but got %v", got)
+		}
+	})
+
+	t.Run("stream post to get with replaced body", func(t *testing.T) {
+		if got := do(t, "POST", "GET", "hello", "X-Stream", "X-Wrap-Body"); got != "GET 5 hello" {
+			t.Fatalf("expected GET 5 hello, but got %v", got)
+		}
+	})
+
+	t.Run("stream post keeps chunked body", func(t *testing.T) {
+		if got := do(t, "POST", "", "hello", "X-Stream", "X-Wrap-Body"); got != "POST -1 hello" {
+			t.Fatalf("expected POST -1 hello, but got %v", got)
+		}
+	})
+}
+
+// addon for test websocket message
+type webSocketAddon struct {
+	BaseAddon
+	mu       sync.Mutex
+	messages []string
+}
+
+func (addon *webSocketAddon) WebSocketMessage(f *Flow, msg *WebSocketMessage) {
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	direction := "server"
+	if msg.FromClient {
+		direction = "client"
+	}
+	addon.messages = append(addon.messages, fmt.Sprintf("%v %v %v %v", f.Request.URL.Path, direction, msg.Type, len(msg.Payload)))
+	if msg.FromClient && msg.Type == WebSocketTextMessage {
+		msg.Payload = bytes.ToUpper(msg.Payload)
+	}
+}
+
+func TestWebSocketMessage(t *testing.T) {
+	upgrader := &websocket.Upgrader{}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			for {
+				msgType, data, err := c.ReadMessage()
+				if err != nil {
+					return
+				}
+				if err := c.WriteMessage(msgType, data); err != nil {
+					return
+				}
+			}
+		}),
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	handleError(t, err)
+	defer ln.Close()
+	ca, err := cert.NewCAMemory()
+	handleError(t, err)
+	serverCert, err := ca.GetCert("localhost")
+	handleError(t, err)
+	go server.Serve(tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{*serverCert}}))
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:    ":29104",
+		SslInsecure: true,
+	})
+	handleError(t, err)
+	addon := &webSocketAddon{}
+	testProxy.AddAddon(addon)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	dialer := &websocket.Dialer{
+		Proxy: func(r *http.Request) (*url.URL, error) {
+			return url.Parse("http://127.0.0.1:29104")
+		},
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		WriteBufferSize:   1024,
+		EnableCompression: true,
+	}
+	c, _, err := dialer.Dial("wss://localhost:"+strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)+"/ws", nil)
+	handleError(t, err)
+	defer c.Close()
+
+	pong := make(chan struct{}, 1)
+	c.SetPongHandler(func(string) error {
+		pong <- struct{}{}
+		return nil
+	})
+
+	handleError(t, c.WriteMessage(websocket.TextMessage, []byte("hello")))
+	_, data, err := c.ReadMessage()
+	handleError(t, err)
+	if string(data) != "HELLO" {
+		t.Fatalf("expected HELLO, but got %s", data)
+	}
+
+	// 超过 WriteBufferSize 的消息会被分片发送
+	large := bytes.Repeat([]byte{0x01}, 5000)
+	handleError(t, c.WriteMessage(websocket.BinaryMessage, large))
+	_, data, err = c.ReadMessage()
+	handleError(t, err)
+	if !bytes.Equal(data, large) {
+		t.Fatalf("expected echo binary message of %v bytes, but got %v", len(large), len(data))
+	}
+
+	// 控制帧直接转发
+	handleError(t, c.WriteControl(websocket.PingMessage, []byte("ping"), time.Now().Add(time.Second)))
+	go c.ReadMessage()
+	select {
+	case <-pong:
+	case <-time.After(time.Second * 2):
+		t.Fatal("expected pong")
+	}
+
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	want := []string{"/ws client 1 5", "/ws server 1 5", "/ws client 2 5000", "/ws server 2 5000"}
+	if strings.Join(addon.messages, "|") != strings.Join(want, "|") {
+		t.Fatalf("expected %v, but got %v", want, addon.messages)
+	}
+}
+
+// 记录 websocket 事件，丢弃客户端发送的 drop 消息
+type webSocketHooksAddon struct {
+	BaseAddon
+	mu     sync.Mutex
+	events []string
+	end    chan struct{}
+}
+
+func (addon *webSocketHooksAddon) record(event string) {
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	addon.events = append(addon.events, event)
+}
+
+func (addon *webSocketHooksAddon) WebSocketStart(f *Flow) {
+	addon.record("start " + f.Request.URL.String())
+}
+
+func (addon *webSocketHooksAddon) WebSocketMessage(f *Flow, msg *WebSocketMessage) {
+	addon.record(fmt.Sprintf("message %v %s", msg.FromClient, msg.Payload))
+	if msg.FromClient && string(msg.Payload) == "drop" {
+		msg.Drop()
+		return
+	}
+	if msg.FromClient {
+		msg.Payload = append(msg.Payload, "!"...)
+	}
+}
+
+func (addon *webSocketHooksAddon) WebSocketEnd(f *Flow) {
+	addon.record("end")
+	close(addon.end)
+}
+
+func TestPlainWebSocket(t *testing.T) {
+	upgrader := &websocket.Upgrader{}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			// 客户端发送的帧未 mask 时 ReadMessage 返回错误
+			msgType, data, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := c.WriteMessage(msgType, data); err != nil {
+				return
+			}
+		}
+	}))
+	defer origin.Close()
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr: ":29159",
+	})
+	handleError(t, err)
+	addon := &webSocketHooksAddon{end: make(chan struct{})}
+	testProxy.AddAddon(addon)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	// gorilla/websocket 通过 CONNECT 隧道连接 ws 地址
+	dialer := &websocket.Dialer{
+		Proxy: func(r *http.Request) (*url.URL, error) {
+			return url.Parse("http://127.0.0.1:29159")
+		},
+	}
+	wsURL := "ws" + strings.TrimPrefix(origin.URL, "http") + "/ws"
+	c, _, err := dialer.Dial(wsURL, nil)
+	handleError(t, err)
+
+	handleError(t, c.WriteMessage(websocket.TextMessage, []byte("drop")))
+	handleError(t, c.WriteMessage(websocket.TextMessage, []byte("hello")))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := c.ReadMessage()
+	handleError(t, err)
+	if string(data) != "hello!" {
+		t.Fatalf("expected hello!, but got %s", data)
+	}
+	c.Close()
+
+	select {
+	case <-addon.end:
+	case <-time.After(time.Second * 5):
+		t.Fatal("expected WebSocketEnd")
+	}
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	want := []string{"start " + origin.URL + "/ws", "message true drop", "message true hello", "message false hello!", "end"}
+	if strings.Join(addon.events, "|") != strings.Join(want, "|") {
+		t.Fatalf("expected %v, but got %v", want, addon.events)
+	}
+}
+
+// 按路径在 Requestheaders 中中止 flow 或直接响应
+type webSocketRejectAddon struct {
+	BaseAddon
+}
+
+func (addon *webSocketRejectAddon) Requestheaders(f *Flow) {
+	switch f.Request.URL.Path {
+	case "/abort":
+		f.Abort(403, "forbidden")
+	case "/mock":
+		f.Response = &Response{StatusCode: 401, Body: []byte("mock")}
+	}
+}
+
+// 升级前 addon 中止 flow 或设置 f.Response 时不连接上游，连接上游失败时响应 502
+func TestWebSocketReject(t *testing.T) {
+	var upgrades int32
+	upgrader := &websocket.Upgrader{}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upgrades, 1)
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		c.Close()
+	}))
+	defer origin.Close()
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr: ":29163",
+	})
+	handleError(t, err)
+	testProxy.AddAddon(&upstreamCertAddon{})
+	testProxy.AddAddon(&webSocketRejectAddon{})
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	dialer := &websocket.Dialer{
+		Proxy: func(r *http.Request) (*url.URL, error) {
+			return url.Parse("http://127.0.0.1:29163")
+		},
+	}
+	dial := func(t *testing.T, wsURL string) (int, string) {
+		t.Helper()
+		c, res, err := dialer.Dial(wsURL, nil)
+		if err == nil {
+			c.Close()
+			t.Fatalf("%v: expected handshake error", wsURL)
+		}
+		if res == nil {
+			t.Fatalf("%v: expected response, but got %v", wsURL, err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(origin.URL, "http")
+	if status, _ := dial(t, wsURL+"/abort"); status != 403 {
+		t.Fatalf("expected 403, but got %v", status)
+	}
+	if status, body := dial(t, wsURL+"/mock"); status != 401 || body != "mock" {
+		t.Fatalf("expected 401 mock, but got %v %v", status, body)
+	}
+	if n := atomic.LoadInt32(&upgrades); n != 0 {
+		t.Fatalf("expected no upstream upgrade, but got %v", n)
+	}
+
+	// 上游不是 tls 服务，拦截 wss 时收到升级请求后才与上游握手，握手失败
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	handleError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	if status, _ := dial(t, "wss://"+ln.Addr().String()+"/ws"); status != 502 {
+		t.Fatalf("expected 502, but got %v", status)
+	}
+}
+
+// dry run 时两个方向的消息并发调用 WebSocketMessage，不能快照及还原 flow
+func TestWebSocketMessageDryRun(t *testing.T) {
+	testProxy, err := NewProxy(&Options{
+		HttpAddr: ":0",
+		DryRun:   true,
+	})
+	handleError(t, err)
+	addon := &webSocketHooksAddon{end: make(chan struct{})}
+	testProxy.AddAddon(addon)
+	s := &webSocket{proxy: testProxy}
+
+	req, err := http.NewRequest("GET", "http://example.com/ws", nil)
+	handleError(t, err)
+	f := newFlow()
+	f.Request = newRequest(req)
+	f.Response = &Response{StatusCode: 101, Header: make(http.Header)}
+
+	const count = 100
+	var wg sync.WaitGroup
+	for _, fromClient := range []bool{true, false} {
+		wg.Add(1)
+		go func(fromClient bool) {
+			defer wg.Done()
+			for i := 0; i < count; i++ {
+				msg := &WebSocketMessage{FromClient: fromClient, Type: WebSocketTextMessage, Payload: []byte("drop")}
+				if !s.message(f, msg, false) || string(msg.Payload) != "drop" {
+					t.Errorf("expected drop unmodified, but got %s %v", msg.Payload, msg.Dropped())
+					return
+				}
+			}
+		}(fromClient)
+	}
+	wg.Wait()
+
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	if n := len(addon.events); n != count*2 {
+		t.Fatalf("expected %v events, but got %v", count*2, n)
+	}
+}
+
+// addon for test addon stats
+type slowAddon struct {
+	BaseAddon
+}
+
+func (addon *slowAddon) Request(f *Flow) {
+	time.Sleep(time.Millisecond * 30)
+}
+
+type fastAddon struct {
+	BaseAddon
+}
+
+func TestAddonStats(t *testing.T) {
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Link", "</style.css>; rel=preload")
+			w.WriteHeader(103)
+			w.Write([]byte("ok"))
+		}),
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	handleError(t, err)
+	defer ln.Close()
+	go server.Serve(ln)
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:   ":29094",
+		AddonStats: true,
+	})
+	handleError(t, err)
+	testProxy.AddAddon(&fastAddon{})
+	testProxy.AddAddon(&slowAddon{})
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29094")
+			},
+		},
+	}
+	for i := 0; i < 2; i++ {
+		resp, err := proxyClient.Get("http://" + ln.Addr().String() + "/")
+		handleError(t, err)
+		resp.Body.Close()
+	}
+
+	var slow, fast *AddonStat
+	for _, stat := range testProxy.AddonStats() {
+		stat := stat
+		if stat.Event != "Request" {
+			continue
+		}
+		switch stat.Addon {
+		case "*proxy.slowAddon":
+			slow = &stat
+		case "*proxy.fastAddon":
+			fast = &stat
+		}
+	}
+	if slow == nil || fast == nil {
+		t.Fatal("expected Request stats of slowAddon and fastAddon")
+	}
+	if slow.Calls != 2 || fast.Calls != 2 {
+		t.Fatalf("expected 2 calls, but got slow %v fast %v", slow.Calls, fast.Calls)
+	}
+	if slow.Total < time.Millisecond*60 || slow.Max < time.Millisecond*30 {
+		t.Fatalf("unexpected slow addon duration total %v max %v", slow.Total, slow.Max)
+	}
+	if slow.Avg() <= fast.Avg() {
+		t.Fatalf("expected slow addon avg %v > fast addon avg %v", slow.Avg(), fast.Avg())
+	}
+
+	// 连接事件、1xx 响应及 stream modifier 也计入统计
+	events := make(map[string]int64)
+	for _, stat := range testProxy.AddonStats() {
+		if stat.Addon == "*proxy.fastAddon" {
+			events[stat.Event] = stat.Calls
+		}
+	}
+	for _, event := range []string{"ClientConnected", "ServerConnected", "Informational", "StreamRequestModifier", "StreamResponseModifier"} {
+		if events[event] == 0 {
+			t.Fatalf("expected %v stats, but got %v", event, events)
+		}
+	}
+}
+
+// addon for test addon budget
+type countAddon struct {
+	BaseAddon
+	mu     sync.Mutex
+	events map[string]int
+}
+
+func (addon *countAddon) count(event string) {
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	if addon.events == nil {
+		addon.events = make(map[string]int)
+	}
+	addon.events[event]++
+}
+
+func (addon *countAddon) Requestheaders(*Flow)  { addon.count("Requestheaders") }
+func (addon *countAddon) Request(*Flow)         { addon.count("Request") }
+func (addon *countAddon) Responseheaders(*Flow) { addon.count("Responseheaders") }
+func (addon *countAddon) Response(*Flow)        { addon.count("Response") }
+
+func TestAddonBudget(t *testing.T) {
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}),
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	handleError(t, err)
+	defer ln.Close()
+	go server.Serve(ln)
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:          ":29100",
+		AddonHeaderBudget: time.Second,
+		AddonBodyBudget:   time.Millisecond * 10,
+	})
+	handleError(t, err)
+	testProxy.AddAddon(&slowAddon{})
+	counter := &countAddon{}
+	testProxy.AddAddon(counter)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29100")
+			},
+		},
+	}
+	testSendRequest(t, "http://"+ln.Addr().String()+"/", proxyClient, "ok")
+
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	// slowAddon.Request 耗尽 body 阶段预算
+	if counter.events["Request"] != 0 || counter.events["Response"] != 0 {
+		t.Fatalf("expected body phase callbacks skipped, but got %v", counter.events)
+	}
+	if counter.events["Requestheaders"] != 1 || counter.events["Responseheaders"] != 1 {
+		t.Fatalf("expected header phase callbacks called, but got %v", counter.events)
+	}
+}
+
+func TestRunWithSignals(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("signal not supported")
+	}
+
+	entered := make(chan struct{})
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(entered)
+			time.Sleep(time.Millisecond * 200)
+			w.Write([]byte("ok"))
+		}),
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	handleError(t, err)
+	defer ln.Close()
+	go server.Serve(ln)
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:      ":29096",
+		ShutdownGrace: time.Second * 5,
+	})
+	handleError(t, err)
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- testProxy.RunWithSignals(context.Background())
+	}()
+	// RunWithSignals 在监听前已注册信号，之后发送 SIGTERM 不会终止测试进程
+	waitListening(t, "127.0.0.1:29096")
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29096")
+			},
+		},
+	}
+	type result struct {
+		body string
+		err  error
+	}
+	resChan := make(chan result, 1)
+	go func() {
+		resp, err := proxyClient.Get("http://" + ln.Addr().String() + "/")
+		if err != nil {
+			resChan <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		resChan <- result{body: string(body), err: err}
+	}()
+
+	<-entered
+	p, err := os.FindProcess(os.Getpid())
+	handleError(t, err)
+	handleError(t, p.Signal(syscall.SIGTERM))
+
+	res := <-resChan
+	if res.err != nil {
+		t.Fatalf("in-flight flow should complete, but got %v", res.err)
+	}
+	if res.body != "ok" {
+		t.Fatalf("expected ok, but got %v", res.body)
+	}
+
+	select {
+	case err := <-runErr:
+		if err != nil {
+			t.Fatalf("expected graceful shutdown, but got %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("RunWithSignals should return after shutdown")
+	}
+
+	if _, err := net.Dial("tcp", "127.0.0.1:29096"); err == nil {
+		t.Fatal("should not accept new connections after shutdown")
+	}
+}
+
+// addon for test host header precedence
+type hostHeaderAddon struct {
+	BaseAddon
+}
+
+func (addon *hostHeaderAddon) Requestheaders(f *Flow) {
+	if host := f.Request.Header.Get("X-Set-Host"); host != "" {
+		f.Request.Header.Set("Host", host)
+	}
+}
+
+func TestUpstreamHost(t *testing.T) {
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.Host)
+		}),
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	handleError(t, err)
+	defer ln.Close()
+	go server.Serve(ln)
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr: ":29106",
+	})
+	handleError(t, err)
+	testProxy.AddAddon(&hostHeaderAddon{})
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	// 直接发送原始请求，避免客户端补充 Host header
+	rawRequest := func(t *testing.T, head string) string {
+		t.Helper()
+		conn, err := net.Dial("tcp", "127.0.0.1:29106")
+		handleError(t, err)
+		defer conn.Close()
+		_, err = io.WriteString(conn, head)
+		handleError(t, err)
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		handleError(t, err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		handleError(t, err)
+		return string(body)
+	}
+	target := ln.Addr().String()
+
+	t.Run("host header absent", func(t *testing.T) {
+		got := rawRequest(t, "GET http://"+target+"/ HTTP/1.0\r\n\r\n")
+		if got != target {
+			t.Fatalf("expected %v, but got %v", target, got)
+		}
+	})
+
+	t.Run("client host header mismatch", func(t *testing.T) {
+		got := rawRequest(t, "GET http://"+target+"/ HTTP/1.1\r\nHost: other.example.com\r\nConnection: close\r\n\r\n")
+		if got != target {
+			t.Fatalf("expected %v, but got %v", target, got)
+		}
+	})
+
+	t.Run("addon host header mismatch", func(t *testing.T) {
+		head := "GET http://" + target + "/ HTTP/1.1\r\nHost: " + target + "\r\nX-Set-Host: other.example.com\r\nConnection: close\r\n\r\n"
+		if got := rawRequest(t, head); got != target {
+			t.Fatalf("expected %v, but got %v", target, got)
+		}
+
+		testProxy.Opts.PreferHostHeader = true
+		defer func() { testProxy.Opts.PreferHostHeader = false }()
+		if got := rawRequest(t, head); got != "other.example.com" {
+			t.Fatalf("expected other.example.com, but got %v", got)
+		}
+	})
+}
+
+func TestRoutingUpstream(t *testing.T) {
+	r, err := NewRoutingUpstream(map[string]string{
+		"api.internal.example.com": "direct",
+		"*.internal.example.com":   "http://corp:8080",
+		".corp.example.com":        "socks5://127.0.0.1:1080",
+		"exact.example.com":        "http://exact:8080",
+	})
+	handleError(t, err)
+
+	cases := map[string]string{
+		"a.internal.example.com:443": "http://corp:8080",
+		"A.Internal.Example.com":     "http://corp:8080",
+		"api.internal.example.com":   "",
+		"internal.example.com":       "",
+		"corp.example.com":           "socks5://127.0.0.1:1080",
+		"x.y.corp.example.com:80":    "socks5://127.0.0.1:1080",
+		"exact.example.com:8443":     "http://exact:8080",
+		"sub.exact.example.com":      "",
+		"other.com":                  "",
+	}
+	for host, expected := range cases {
+		u, err := r.Proxy(&http.Request{Host: host})
+		handleError(t, err)
+		got := ""
+		if u != nil {
+			got = u.String()
+		}
+		if got != expected {
+			t.Fatalf("%v: expected %q, but got %q", host, expected, got)
+		}
+	}
+}
+
+func TestSetUpstreamProxyForHost(t *testing.T) {
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "ok")
+		}),
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	handleError(t, err)
+	defer ln.Close()
+	go server.Serve(ln)
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	// 记录经过的请求的上游代理
+	var mu sync.Mutex
+	var routed []string
+	upstream := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			routed = append(routed, r.Method+" "+r.Host)
+			mu.Unlock()
+			if r.Method == "CONNECT" {
+				conn, err := net.Dial("tcp", r.Host)
+				if err != nil {
+					w.WriteHeader(502)
+					return
+				}
+				defer conn.Close()
+				cconn, _, err := w.(http.Hijacker).Hijack()
+				if err != nil {
+					return
+				}
+				defer cconn.Close()
+				io.WriteString(cconn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+				go io.Copy(conn, cconn)
+				io.Copy(cconn, conn)
+				return
+			}
+			r.RequestURI = ""
+			res, err := http.DefaultTransport.RoundTrip(r)
+			if err != nil {
+				w.WriteHeader(502)
+				return
+			}
+			defer res.Body.Close()
+			w.WriteHeader(res.StatusCode)
+			io.Copy(w, res.Body)
+		}),
+	}
+	upstreamLn, err := net.Listen("tcp", "127.0.0.1:0")
+	handleError(t, err)
+	defer upstreamLn.Close()
+	go upstream.Serve(upstreamLn)
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:      ":29107",
+		ProxyLoopback: true,
+	})
+	handleError(t, err)
+	testProxy.SetShouldInterceptRule(func(req *http.Request) bool {
+		return false
+	})
+	err = testProxy.SetUpstreamProxyForHost(map[string]string{
+		"localhost": "http://" + upstreamLn.Addr().String(),
+	})
+	handleError(t, err)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29107")
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	takeRouted := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		got := routed
+		routed = nil
+		return got
+	}
+
+	t.Run("http matched", func(t *testing.T) {
+		testSendRequest(t, "http://localhost:"+port+"/", proxyClient, "ok")
+		if got := takeRouted(); len(got) != 1 || got[0] != "GET localhost:"+port {
+			t.Fatalf("expected request through upstream, but got %v", got)
+		}
+	})
+
+	t.Run("http direct", func(t *testing.T) {
+		testSendRequest(t, "http://127.0.0.1:"+port+"/", proxyClient, "ok")
+		if got := takeRouted(); len(got) != 0 {
+			t.Fatalf("expected direct request, but got %v", got)
+		}
+	})
+
+	tunnel := func(t *testing.T, host string) {
+		t.Helper()
+		conn, err := net.Dial("tcp", "127.0.0.1:29107")
+		handleError(t, err)
+		defer conn.Close()
+		_, err = io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+		handleError(t, err)
+		br := bufio.NewReader(conn)
+		res, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+		handleError(t, err)
+		if res.StatusCode != 200 {
+			t.Fatalf("expected 200, but got %v", res.StatusCode)
+		}
+		_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: "+host+"\r\nConnection: close\r\n\r\n")
+		handleError(t, err)
+		res, err = http.ReadResponse(br, nil)
+		handleError(t, err)
+		body, err := ioutil.ReadAll(res.Body)
+		handleError(t, err)
+		if string(body) != "ok" {
+			t.Fatalf("expected ok, but got %v", string(body))
+		}
+	}
+
+	t.Run("tunnel matched", func(t *testing.T) {
+		tunnel(t, "localhost:"+port)
+		if got := takeRouted(); len(got) != 1 || got[0] != "CONNECT localhost:"+port {
+			t.Fatalf("expected tunnel through upstream, but got %v", got)
+		}
+	})
+
+	t.Run("tunnel direct", func(t *testing.T) {
+		tunnel(t, "127.0.0.1:"+port)
+		if got := takeRouted(); len(got) != 0 {
+			t.Fatalf("expected direct tunnel, but got %v", got)
+		}
+	})
+}
+
+// addon for test loopback round trip
+type loopbackAddon struct {
+	BaseAddon
+}
+
+func (addon *loopbackAddon) Request(f *Flow) {
+	f.Request.Header.Set("X-Addon", "request")
+}
+
+func (addon *loopbackAddon) Response(f *Flow) {
+	f.Response.Body = append(f.Response.Body, []byte(" modified")...)
+	f.Response.Header.Del("Content-Length")
+}
+
+func newLoopbackProxy(t testing.TB) *Proxy {
+	testProxy, err := NewProxy(&Options{
+		StreamLargeBodies: 1024 * 1024 * 5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testProxy.AddAddon(&loopbackAddon{})
+	testProxy.SetLoopbackUpstream(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Upstream-Host", r.Host)
+		io.WriteString(w, r.Method+" "+r.URL.RequestURI()+" "+r.Header.Get("X-Addon")+" "+string(body))
+	}))
+	return testProxy
+}
+
+func TestLoopbackRoundTrip(t *testing.T) {
+	testProxy := newLoopbackProxy(t)
+	client := &http.Client{Transport: testProxy}
+
+	res, err := client.Post("http://example.com/path?q=1", "text/plain", strings.NewReader("hello"))
+	handleError(t, err)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	handleError(t, err)
+
+	if res.StatusCode != 200 {
+		t.Fatalf("expected 200, but got %v", res.StatusCode)
+	}
+	if got := res.Header.Get("X-Upstream-Host"); got != "example.com" {
+		t.Fatalf("expected upstream host example.com, but got %v", got)
+	}
+	if expected := "POST /path?q=1 request hello modified"; string(body) != expected {
+		t.Fatalf("expected %q, but got %q", expected, string(body))
+	}
+}
+
+func BenchmarkLoopbackRoundTrip(b *testing.B) {
+	testProxy := newLoopbackProxy(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		res, err := testProxy.RoundTrip(req)
+		if err != nil {
+			b.Fatal(err)
+		}
+		res.Body.Close()
+	}
+}
+
+func TestSocksAuth(t *testing.T) {
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "ok")
+		}),
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	handleError(t, err)
+	defer ln.Close()
+	go server.Serve(ln)
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:  ":29108",
+		SocksAddr: "127.0.0.1:29109",
+		SocksAuth: map[string]string{"user": "secret"},
+	})
+	handleError(t, err)
+	testProxy.SetShouldInterceptRule(func(req *http.Request) bool {
+		return false
+	})
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 50) // wait for test proxy startup
+
+	get := func(auth *xproxy.Auth) (string, error) {
+		dialer, err := xproxy.SOCKS5("tcp", "127.0.0.1:29109", auth, xproxy.Direct)
+		handleError(t, err)
+		client := &http.Client{
+			Transport: &http.Transport{
+				Dial:              dialer.Dial,
+				DisableKeepAlives: true,
+			},
+		}
+		res, err := client.Get("http://" + ln.Addr().String() + "/")
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		return string(body), err
+	}
+
+	t.Run("valid credentials", func(t *testing.T) {
+		body, err := get(&xproxy.Auth{User: "user", Password: "secret"})
+		handleError(t, err)
+		if body != "ok" {
+			t.Fatalf("expected ok, but got %v", body)
+		}
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		if _, err := get(&xproxy.Auth{User: "user", Password: "wrong"}); err == nil {
+			t.Fatal("expected auth error")
+		}
+	})
+
+	t.Run("no credentials", func(t *testing.T) {
+		if _, err := get(nil); err == nil {
+			t.Fatal("expected auth error")
+		}
+	})
+}
+
+func TestUpstreamClientCertificate(t *testing.T) {
+	ca, err := cert.NewCAMemory()
+	handleError(t, err)
+	fileCert, err := ca.DummyCert("file-client")
+	handleError(t, err)
+	callbackCert, err := ca.DummyCert("callback-client")
+	handleError(t, err)
+
+	// 写入 Options.ClientCertFile
+	dir := t.TempDir()
+	certFile := dir + "/client.crt"
+	keyFile := dir + "/client.key"
+	key, err := x509.MarshalPKCS8PrivateKey(fileCert.PrivateKey)
+	handleError(t, err)
+	handleError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: fileCert.Certificate[0]}), 0600))
+	handleError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600))
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			io.WriteString(w, "none")
+			return
+		}
+		io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:          ":29111",
+		SslInsecure:       true,
+		ClientCertFile:    certFile,
+		ClientCertKeyFile: keyFile,
+		GetClientCertificate: func(host string, info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if host == "127.0.0.1" {
+				return callbackCert, nil
+			}
+			return nil, nil
+		},
+	})
+	handleError(t, err)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29111")
+			},
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			DisableKeepAlives: true,
+		},
+	}
+
+	t.Run("intercept per host callback", func(t *testing.T) {
+		testSendRequest(t, "https://127.0.0.1:"+port+"/", proxyClient, "callback-client")
+	})
+
+	t.Run("intercept fallback to file", func(t *testing.T) {
+		testSendRequest(t, "https://localhost:"+port+"/", proxyClient, "file-client")
+	})
+
+	// 绝对 https URL 经由 http 代理直接发送，使用 http.Transport 握手
+	t.Run("absolute https url", func(t *testing.T) {
+		for host, expected := range map[string]string{"127.0.0.1": "callback-client", "localhost": "file-client"} {
+			conn, err := net.Dial("tcp", "127.0.0.1:29111")
+			handleError(t, err)
+			_, err = io.WriteString(conn, "GET https://"+host+":"+port+"/ HTTP/1.1\r\nHost: "+host+":"+port+"\r\nConnection: close\r\n\r\n")
+			handleError(t, err)
+			res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			handleError(t, err)
+			body, err := ioutil.ReadAll(res.Body)
+			handleError(t, err)
+			conn.Close()
+			if string(body) != expected {
+				t.Fatalf("%v: expected %v, but got %v", host, expected, string(body))
+			}
+		}
+	})
+
+	t.Run("invalid cert file", func(t *testing.T) {
+		if _, err := NewProxy(&Options{HttpAddr: ":29112", ClientCertFile: dir + "/missing.crt"}); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
+
+func TestSocksShutdown(t *testing.T) {
+	// echo server
+	echoLn, err := net.Listen("tcp", "127.0.0.1:0")
+	handleError(t, err)
+	defer echoLn.Close()
+	go func() {
+		for {
+			conn, err := echoLn.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	startProxy := func() *Proxy {
+		p, err := NewProxy(&Options{
+			HttpAddr:  ":29113",
+			SocksAddr: "127.0.0.1:29114",
+		})
+		handleError(t, err)
+		p.SetShouldInterceptRule(func(req *http.Request) bool {
+			return false
+		})
+		go p.Start()
+		time.Sleep(time.Millisecond * 50) // wait for test proxy startup
+		return p
+	}
+	dialTunnel := func() (net.Conn, error) {
+		dialer, err := xproxy.SOCKS5("tcp", "127.0.0.1:29114", nil, xproxy.Direct)
+		handleError(t, err)
+		conn, err := dialer.Dial("tcp", echoLn.Addr().String())
+		if err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		buf := make([]byte, 4)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Time{})
+		return conn, nil
+	}
+
+	t.Run("drain in-flight tunnel", func(t *testing.T) {
+		testProxy := startProxy()
+		defer testProxy.Close()
+		conn, err := dialTunnel()
+		handleError(t, err)
+
+		shutdownErr := make(chan error, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+			defer cancel()
+			shutdownErr <- testProxy.Shutdown(ctx)
+		}()
+		time.Sleep(time.Millisecond * 50)
+
+		select {
+		case err := <-shutdownErr:
+			t.Fatalf("expected shutdown to wait for tunnel, but returned %v", err)
+		default:
+		}
+		if _, err := dialTunnel(); err == nil {
+			t.Fatal("expected new socks5 connection refused")
+		}
+		// 进行中的隧道仍可用
+		if _, err := conn.Write([]byte("pong")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "pong" {
+			t.Fatalf("unexpected tunnel read %q %v", buf, err)
+		}
+
+		conn.Close()
+		select {
+		case err := <-shutdownErr:
+			handleError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("shutdown not returned after tunnel closed")
+		}
+	})
+
+	t.Run("force close after deadline", func(t *testing.T) {
+		testProxy := startProxy()
+		defer testProxy.Close()
+		conn, err := dialTunnel()
+		handleError(t, err)
+		defer conn.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+		defer cancel()
+		if err := testProxy.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected deadline exceeded, but got %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("expected tunnel closed, but got %v", err)
+		}
+	})
+
+	t.Run("rebind after shutdown", func(t *testing.T) {
+		testProxy := startProxy()
+		defer testProxy.Close()
+		conn, err := dialTunnel()
+		handleError(t, err)
+		conn.Close()
+	})
+}
+
+type clientConnCountAddon struct {
+	BaseAddon
+	mu           sync.Mutex
+	connected    map[*ClientConn]int
+	disconnected map[*ClientConn]int
+}
+
+func (addon *clientConnCountAddon) ClientConnected(client *ClientConn) {
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	addon.connected[client]++
+}
+
+func (addon *clientConnCountAddon) ClientDisconnected(client *ClientConn) {
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	addon.disconnected[client]++
+}
+
+func (addon *clientConnCountAddon) check(t *testing.T) {
+	t.Helper()
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	if len(addon.connected) != 1 {
+		t.Fatalf("expected 1 client connection, but got %v", len(addon.connected))
+	}
+	for client, n := range addon.connected {
+		if n != 1 || addon.disconnected[client] != 1 {
+			t.Fatalf("expected ClientConnected and ClientDisconnected once, but got %v and %v", n, addon.disconnected[client])
+		}
+	}
+	addon.connected = make(map[*ClientConn]int)
+	addon.disconnected = make(map[*ClientConn]int)
+}
+
+func TestClientDisconnected(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+	plainServer := httptest.NewServer(server.Config.Handler)
+	defer plainServer.Close()
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr: ":29115",
+	})
+	handleError(t, err)
+	testProxy.SetShouldInterceptRule(func(req *http.Request) bool {
+		return false
+	})
+	addon := &clientConnCountAddon{
+		connected:    make(map[*ClientConn]int),
+		disconnected: make(map[*ClientConn]int),
+	}
+	testProxy.AddAddon(addon)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	newClient := func() (*http.Client, *http.Transport) {
+		transport := &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29115")
+			},
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		return &http.Client{Transport: transport}, transport
+	}
+
+	t.Run("keep-alive connection with multiple flows", func(t *testing.T) {
+		client, transport := newClient()
+		for i := 0; i < 3; i++ {
+			testSendRequest(t, plainServer.URL, client, "ok")
+		}
+		transport.CloseIdleConnections()
+		time.Sleep(time.Millisecond * 50)
+		addon.check(t)
+	})
+
+	t.Run("connect tunnel", func(t *testing.T) {
+		client, transport := newClient()
+		for i := 0; i < 3; i++ {
+			testSendRequest(t, server.URL, client, "ok")
+		}
+		transport.CloseIdleConnections()
+		time.Sleep(time.Millisecond * 50)
+		addon.check(t)
+	})
+
+	t.Run("upstream error", func(t *testing.T) {
+		client, transport := newClient()
+		res, err := client.Get("http://127.0.0.1:1/")
+		handleError(t, err)
+		res.Body.Close()
+		if res.StatusCode != 502 {
+			t.Fatalf("expected 502, but got %v", res.StatusCode)
+		}
+		transport.CloseIdleConnections()
+		time.Sleep(time.Millisecond * 50)
+		addon.check(t)
+	})
+}
+
+func TestConnectRetry(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	// 每个地址的前 failures[host] 次连接失败
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	failures := map[string]int{
+		"localhost":     1,
+		"127.0.0.1":     1,
+		"always.test":   100,
+		"notfound.test": 100,
+	}
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:          ":29116",
+		SslInsecure:       true,
+		MaxConnectRetries: 2,
+		DialUpstream: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, _, _ := net.SplitHostPort(addr)
+			mu.Lock()
+			attempts[host]++
+			n := attempts[host]
+			mu.Unlock()
+			if n <= failures[host] {
+				if host == "notfound.test" {
+					return nil, &net.OpError{Op: "dial", Net: network, Err: &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}}
+				}
+				return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ECONNREFUSED}
+			}
+			if host != "localhost" && host != "127.0.0.1" {
+				return nil, errors.New("unexpected host")
+			}
+			return nil, ErrUseDefaultDialer
+		},
+	})
+	handleError(t, err)
+	// 仅拦截 localhost
+	testProxy.SetShouldInterceptRule(func(req *http.Request) bool {
+		return strings.HasPrefix(req.Host, "localhost:")
+	})
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29116")
+			},
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			DisableKeepAlives: true,
+		},
+	}
+	attemptsOf := func(host string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return attempts[host]
+	}
+
+	t.Run("pass-through retry succeeds", func(t *testing.T) {
+		testSendRequest(t, "https://127.0.0.1:"+port+"/", client, "ok")
+		if n := attemptsOf("127.0.0.1"); n != 2 {
+			t.Fatalf("expected 2 dial attempts, but got %v", n)
+		}
+	})
+
+	t.Run("intercept retry succeeds", func(t *testing.T) {
+		testSendRequest(t, "https://localhost:"+port+"/", client, "ok")
+		if n := attemptsOf("localhost"); n != 2 {
+			t.Fatalf("expected 2 dial attempts, but got %v", n)
+		}
+	})
+
+	t.Run("retries exhausted", func(t *testing.T) {
+		if _, err := client.Get("https://always.test/"); err == nil {
+			t.Fatal("expected connect error")
+		}
+		if n := attemptsOf("always.test"); n != 3 {
+			t.Fatalf("expected 3 dial attempts, but got %v", n)
+		}
+	})
+
+	t.Run("permanent error not retried", func(t *testing.T) {
+		if _, err := client.Get("https://notfound.test/"); err == nil {
+			t.Fatal("expected connect error")
+		}
+		if n := attemptsOf("notfound.test"); n != 1 {
+			t.Fatalf("expected 1 dial attempt, but got %v", n)
+		}
+	})
+}
+
+func TestServerTimeouts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:          ":29117",
+		ReadHeaderTimeout: time.Millisecond * 200,
+		ReadTimeout:       time.Millisecond * 200,
+	})
+	handleError(t, err)
+	testProxy.SetShouldInterceptRule(func(req *http.Request) bool {
+		return false
+	})
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	t.Run("slow header dropped", func(t *testing.T) {
+		conn, err := net.Dial("tcp", "127.0.0.1:29117")
+		handleError(t, err)
+		defer conn.Close()
+
+		start := time.Now()
+		header := "GET " + server.URL + "/ HTTP/1.1\r\nHost: " + server.Listener.Addr().String() + "\r\n"
+		var writeErr error
+		for i := 0; i < len(header) && writeErr == nil; i++ {
+			_, writeErr = conn.Write([]byte{header[i]})
+			time.Sleep(time.Millisecond * 20)
+			if time.Since(start) > time.Second {
+				break
+			}
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1024))
+		if err == nil && writeErr == nil {
+			t.Fatal("expected connection dropped")
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("expected connection dropped after timeout, but took %v", elapsed)
+		}
+	})
+
+	t.Run("connect tunnel not limited", func(t *testing.T) {
+		conn, err := net.Dial("tcp", "127.0.0.1:29117")
+		handleError(t, err)
+		defer conn.Close()
+		host := server.Listener.Addr().String()
+		_, err = io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+		handleError(t, err)
+		br := bufio.NewReader(conn)
+		res, err := http.ReadResponse(br, nil)
+		handleError(t, err)
+		if res.StatusCode != 200 {
+			t.Fatalf("expected 200, but got %v", res.StatusCode)
+		}
+
+		// 超过 ReadTimeout 后隧道仍可用
+		time.Sleep(time.Millisecond * 300)
+		_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+		handleError(t, err)
+		res, err = http.ReadResponse(br, nil)
+		handleError(t, err)
+		body, err := ioutil.ReadAll(io.LimitReader(res.Body, 2))
+		handleError(t, err)
+		if string(body) != "ok" {
+			t.Fatalf("expected ok, but got %s", body)
+		}
+	})
+}
+
+type upstreamTimeoutAddon struct {
+	BaseAddon
+	mu   sync.Mutex
+	errs []error
+}
+
+func (addon *upstreamTimeoutAddon) Requestheaders(f *Flow) {
+	if f.Request.URL.Query().Get("stream") != "" {
+		f.Stream = true
+	}
+}
+
+func (addon *upstreamTimeoutAddon) Response(f *Flow) {
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	addon.errs = append(addon.errs, f.Err)
+}
+
+func (addon *upstreamTimeoutAddon) lastErr() error {
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	if len(addon.errs) == 0 {
+		return nil
+	}
+	return addon.errs[len(addon.errs)-1]
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	wait := func(r *http.Request, d time.Duration) {
+		select {
+		case <-time.After(d):
+		case <-r.Context().Done():
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hang":
+			wait(r, time.Second)
+		case "/slowbody":
+			io.WriteString(w, "o")
+			w.(http.Flusher).Flush()
+			wait(r, time.Millisecond*400)
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:        ":29118",
+		UpstreamTimeout: time.Millisecond * 200,
+	})
+	handleError(t, err)
+	addon := &upstreamTimeoutAddon{}
+	testProxy.AddAddon(addon)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29118")
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	get := func(t *testing.T, path string) (int, string) {
+		res, err := client.Get(server.URL + path)
+		handleError(t, err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		handleError(t, err)
+		return res.StatusCode, string(body)
+	}
+
+	t.Run("fast response", func(t *testing.T) {
+		if code, body := get(t, "/"); code != 200 || body != "ok" {
+			t.Fatalf("expected 200 ok, but got %v %v", code, body)
+		}
+		if err := addon.lastErr(); err != nil {
+			t.Fatalf("expected no error, but got %v", err)
+		}
+	})
+
+	t.Run("response headers timeout", func(t *testing.T) {
+		start := time.Now()
+		if code, _ := get(t, "/hang"); code != 504 {
+			t.Fatalf("expected 504, but got %v", code)
+		}
+		if elapsed := time.Since(start); elapsed > time.Millisecond*800 {
+			t.Fatalf("expected timeout after 200ms, but took %v", elapsed)
+		}
+		if err := addon.lastErr(); !errors.Is(err, ErrUpstreamTimeout) {
+			t.Fatalf("expected ErrUpstreamTimeout in Response hook, but got %v", err)
+		}
+	})
+
+	t.Run("buffered body timeout", func(t *testing.T) {
+		if code, _ := get(t, "/slowbody"); code != 504 {
+			t.Fatalf("expected 504, but got %v", code)
+		}
+		if err := addon.lastErr(); !errors.Is(err, ErrUpstreamTimeout) {
+			t.Fatalf("expected ErrUpstreamTimeout in Response hook, but got %v", err)
+		}
+	})
+
+	t.Run("streamed body not limited", func(t *testing.T) {
+		if code, body := get(t, "/slowbody?stream=1"); code != 200 || body != "ook" {
+			t.Fatalf("expected 200 ook, but got %v %v", code, body)
+		}
+	})
+}
+
+func TestResponseByteRanges(t *testing.T) {
+	body := "--THIS_STRING_SEPARATES\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Content-Range: bytes 0-4/20\r\n" +
+		"\r\n" +
+		"hello\r\n" +
+		"--THIS_STRING_SEPARATES\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"Content-Range: bytes 15-19/20\r\n" +
+		"\r\n" +
+		"world\r\n" +
+		"--THIS_STRING_SEPARATES--\r\n"
+	res := &Response{
+		StatusCode: 206,
+		Header: http.Header{
+			"Content-Type":   []string{"multipart/byteranges; boundary=THIS_STRING_SEPARATES"},
+			"Content-Length": []string{strconv.Itoa(len(body))},
+		},
+		Body: []byte(body),
+	}
+
+	parts, err := res.ByteRanges()
+	handleError(t, err)
+	if len(parts) != 2 {
+		t.Fatalf("expected 2 parts, but got %v", len(parts))
+	}
+	if p := parts[0]; p.Start != 0 || p.End != 4 || p.Size != 20 || string(p.Body) != "hello" || p.Header.Get("Content-Type") != "text/plain" {
+		t.Fatalf("unexpected part %+v", p)
+	}
+	if p := parts[1]; p.Start != 15 || p.End != 19 || p.Size != 20 || string(p.Body) != "world" {
+		t.Fatalf("unexpected part %+v", p)
+	}
+
+	// 修改第二个分段后重新编码
+	parts[1].Body = []byte("WORLD")
+	parts[1].Size = -1
+	handleError(t, res.SetByteRanges(parts))
+	if res.Header.Get("Content-Length") != strconv.Itoa(len(res.Body)) {
+		t.Fatalf("unexpected Content-Length %v", res.Header.Get("Content-Length"))
+	}
+	if !strings.Contains(string(res.Body), "Content-Range: bytes 15-19/*\r\nContent-Type: text/plain\r\n\r\nWORLD\r\n--THIS_STRING_SEPARATES--\r\n") {
+		t.Fatalf("unexpected body %q", res.Body)
+	}
+	parts, err = res.ByteRanges()
+	handleError(t, err)
+	if len(parts) != 2 || string(parts[0].Body) != "hello" || string(parts[1].Body) != "WORLD" || parts[1].Size != -1 {
+		t.Fatalf("unexpected parts after re-encoding %+v", parts)
+	}
+
+	t.Run("not byteranges", func(t *testing.T) {
+		res := &Response{Header: http.Header{"Content-Type": []string{"text/plain"}}, Body: []byte("a")}
+		if _, err := res.ByteRanges(); !errors.Is(err, ErrNotByteRanges) {
+			t.Fatalf("expected ErrNotByteRanges, but got %v", err)
+		}
+	})
+
+	t.Run("malformed content range", func(t *testing.T) {
+		res := &Response{
+			Header: http.Header{"Content-Type": []string{"multipart/byteranges; boundary=b"}},
+			Body:   []byte("--b\r\nContent-Range: bytes 5-1/20\r\n\r\nx\r\n--b--\r\n"),
+		}
+		if _, err := res.ByteRanges(); err == nil {
+			t.Fatal("expected malformed Content-Range error")
+		}
+	})
+}
+
+func TestCaFromMemory(t *testing.T) {
+	ca, err := cert.NewCAMemory()
+	handleError(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.RootCert.Raw})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(&ca.PrivateKey)})
+
+	testProxy, err := NewProxy(&Options{HttpAddr: ":0", CaRootPath: "/nonexistent/should-not-be-created", CaCert: certPEM, CaKey: keyPEM})
+	handleError(t, err)
+	root := testProxy.GetCertificate()
+	if !root.Equal(&ca.RootCert) {
+		t.Fatal("should use ca from memory")
+	}
+	if _, err := os.Stat("/nonexistent/should-not-be-created"); !os.IsNotExist(err) {
+		t.Fatal("should not touch CaRootPath")
+	}
+
+	if _, err := NewProxy(&Options{HttpAddr: ":0", CaCert: certPEM}); err == nil {
+		t.Fatal("should fail without CaKey")
+	}
+	if _, err := NewProxy(&Options{HttpAddr: ":0", CaCert: certPEM, CaKey: []byte("malformed")}); err == nil {
+		t.Fatal("should fail with malformed CaKey")
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	port := strconv.Itoa(server.Listener.Addr().(*net.TCPAddr).Port)
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:       ":29121",
+		DNSCacheTTL:    time.Minute,
+		DNSNegativeTTL: 200 * time.Millisecond,
+	})
+	handleError(t, err)
+	var lookups int32
+	testProxy.dnsCache.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		atomic.AddInt32(&lookups, 1)
+		if host == "cached.test" {
+			return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29121")
+			},
+			DisableKeepAlives: true,
+		},
+	}
+
+	t.Run("repeated lookup served from cache", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			testSendRequest(t, "http://cached.test:"+port+"/", proxyClient, "ok")
+		}
+		if n := atomic.LoadInt32(&lookups); n != 1 {
+			t.Fatalf("expected 1 lookup, but got %v", n)
+		}
+		stats := testProxy.DNSCacheStats()
+		if stats.Hits != 2 || stats.Misses != 1 || stats.Entries != 1 {
+			t.Fatalf("unexpected stats %+v", stats)
+		}
+	})
+
+	t.Run("failed lookup negatively cached", func(t *testing.T) {
+		atomic.StoreInt32(&lookups, 0)
+		for i := 0; i < 3; i++ {
+			res, err := proxyClient.Get("http://notfound.test:" + port + "/")
+			handleError(t, err)
+			res.Body.Close()
+			if res.StatusCode != 502 {
+				t.Fatalf("expected 502, but got %v", res.StatusCode)
+			}
+		}
+		if n := atomic.LoadInt32(&lookups); n != 1 {
+			t.Fatalf("expected 1 lookup, but got %v", n)
+		}
+		if stats := testProxy.DNSCacheStats(); stats.NegativeHits != 2 {
+			t.Fatalf("unexpected stats %+v", stats)
+		}
+
+		time.Sleep(250 * time.Millisecond) // wait for negative ttl expired
+		res, err := proxyClient.Get("http://notfound.test:" + port + "/")
+		handleError(t, err)
+		res.Body.Close()
+		if n := atomic.LoadInt32(&lookups); n != 2 {
+			t.Fatalf("expected lookup again after negative ttl, but got %v lookups", n)
+		}
+	})
+}
+
+func TestDNSCacheSingleflightAndLimit(t *testing.T) {
+	cache := newDNSCache(time.Minute, time.Minute, nil)
+	var lookups int32
+	release := make(chan struct{})
+	cache.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		atomic.AddInt32(&lookups, 1)
+		if host == "slow.test" {
+			<-release
+		}
+		return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, nil
+	}
+
+	// 并发解析同一 host 只发起一次解析
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addrs, err := cache.lookupIPAddr(context.Background(), "slow.test")
+			if err != nil || len(addrs) != 1 {
+				t.Errorf("unexpected result %v %v", addrs, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&lookups); n != 1 {
+		t.Fatalf("expected 1 lookup, but got %v", n)
+	}
+	if stats := cache.snapshot(); stats.Misses != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// 未过期的缓存超过上限时移除最早过期的
+	for i := 0; i < maxDNSCacheEntries+100; i++ {
+		_, err := cache.lookupIPAddr(context.Background(), fmt.Sprintf("host%v.test", i))
+		handleError(t, err)
+	}
+	if stats := cache.snapshot(); stats.Entries != maxDNSCacheEntries {
+		t.Fatalf("expected %v entries, but got %+v", maxDNSCacheEntries, stats)
+	}
+}
+
+// addon for test reverse proxy mode
+type reverseProxyAddon struct {
+	BaseAddon
+	mu     sync.Mutex
+	events []string
+}
+
+func (addon *reverseProxyAddon) record(event string, f *Flow) {
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	addon.events = append(addon.events, event+" "+f.Request.URL.String())
+}
+
+func (addon *reverseProxyAddon) Requestheaders(f *Flow) { addon.record("Requestheaders", f) }
+func (addon *reverseProxyAddon) Request(f *Flow)        { addon.record("Request", f) }
+func (addon *reverseProxyAddon) Response(f *Flow) {
+	addon.record("Response", f)
+	f.Response.Header.Set("X-Reverse", "1")
+}
+
+func TestReverseProxyUpstream(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host + " " + r.URL.RequestURI()))
+	}))
+	defer server.Close()
+	backendHost := server.Listener.Addr().String()
+
+	_, err := NewProxy(&Options{HttpAddr: ":0", ReverseProxyUpstream: "127.0.0.1:8080"})
+	if err == nil {
+		t.Fatal("should fail with invalid upstream")
+	}
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:             ":29122",
+		ReverseProxyUpstream: server.URL + "/api/",
+	})
+	handleError(t, err)
+	addon := &reverseProxyAddon{}
+	testProxy.AddAddon(addon)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	res, err := http.Get("http://127.0.0.1:29122/users?id=1")
+	handleError(t, err)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	handleError(t, err)
+	if string(body) != backendHost+" /api/users?id=1" {
+		t.Fatalf("unexpected body %s", body)
+	}
+	if res.Header.Get("X-Reverse") != "1" {
+		t.Fatal("response should be modified by addon")
+	}
+
+	target := server.URL + "/api/users?id=1"
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	expected := []string{"Requestheaders " + target, "Request " + target, "Response " + target}
+	if strings.Join(addon.events, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected events %v", addon.events)
+	}
+}
+
+// addon for test per flow upstream proxy
+type flowUpstreamProxyAddon struct {
+	BaseAddon
+	proxyUrl *url.URL
+}
+
+func (addon *flowUpstreamProxyAddon) Requestheaders(f *Flow) {
+	if f.Request.URL.Path == "/override" || f.Request.Method == "CONNECT" {
+		f.UpstreamProxy = addon.proxyUrl
+	}
+}
+
+func TestFlowUpstreamProxy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+
+	// 记录经过的请求，CONNECT 直接拒绝
+	var mu sync.Mutex
+	var routed []string
+	newUpstream := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			routed = append(routed, name+" "+r.Method)
+			mu.Unlock()
+			if r.Method == "CONNECT" {
+				w.WriteHeader(502)
+				return
+			}
+			io.WriteString(w, name)
+		}))
+	}
+	defaultUpstream := newUpstream("default")
+	defer defaultUpstream.Close()
+	overrideUpstream := newUpstream("override")
+	defer overrideUpstream.Close()
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:      ":29123",
+		ProxyLoopback: true,
+		Upstream:      defaultUpstream.URL,
+	})
+	handleError(t, err)
+	testProxy.SetShouldInterceptRule(func(req *http.Request) bool {
+		return false
+	})
+	overrideUrl, _ := url.Parse(overrideUpstream.URL)
+	testProxy.AddAddon(&flowUpstreamProxyAddon{proxyUrl: overrideUrl})
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29123")
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	testSendRequest(t, server.URL+"/default", proxyClient, "default")
+	testSendRequest(t, server.URL+"/override", proxyClient, "override")
+	testSendRequest(t, server.URL+"/default", proxyClient, "default")
+	if _, err := proxyClient.Get("https://localhost:1/"); err == nil {
+		t.Fatal("should fail as upstream proxy rejects CONNECT")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := "default GET,override GET,default GET,override CONNECT"
+	if strings.Join(routed, ",") != expected {
+		t.Fatalf("expected %v, but got %v", expected, routed)
+	}
+}
+
+// addon for test transparent mode
+type transparentAddon struct {
+	BaseAddon
+	mu   sync.Mutex
+	urls []string
+	dsts []string
+}
+
+func (addon *transparentAddon) Request(f *Flow) {
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	addon.urls = append(addon.urls, f.Request.URL.String())
+	addon.dsts = append(addon.dsts, f.ConnContext.ClientConn.OriginalDst)
+}
+
+func TestTransparent(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host+r.URL.Path)
+	})
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+	httpsServer := httptest.NewTLSServer(handler)
+	defer httpsServer.Close()
+	httpPort := strconv.Itoa(httpServer.Listener.Addr().(*net.TCPAddr).Port)
+	httpsPort := strconv.Itoa(httpsServer.Listener.Addr().(*net.TCPAddr).Port)
+
+	// 模拟 iptables REDIRECT，所有连接的原始目标地址为 dst
+	var dst atomic.Value
+	originalDst = func(conn net.Conn) (string, error) {
+		return dst.Load().(string), nil
+	}
+	defer func() {
+		originalDst = getOriginalDst
+	}()
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:    ":29124",
+		Transparent: true,
+		SslInsecure: true,
+	})
+	handleError(t, err)
+	addon := &transparentAddon{}
+	testProxy.AddAddon(addon)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "tcp", "127.0.0.1:29124")
+			},
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			DisableKeepAlives: true,
+		},
+	}
+
+	dst.Store(httpServer.Listener.Addr().String())
+	testSendRequest(t, "http://localhost:"+httpPort+"/plain", client, "localhost:"+httpPort+"/plain")
+
+	dst.Store(httpsServer.Listener.Addr().String())
+	testSendRequest(t, "https://localhost:"+httpsPort+"/tls", client, "localhost:"+httpsPort+"/tls")
+
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	expected := []string{"http://localhost:" + httpPort + "/plain", "https://localhost:" + httpsPort + "/tls"}
+	if strings.Join(addon.urls, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected %v, but got %v", expected, addon.urls)
+	}
+	if addon.dsts[0] != httpServer.Listener.Addr().String() || addon.dsts[1] != httpsServer.Listener.Addr().String() {
+		t.Fatalf("unexpected original dst %v", addon.dsts)
+	}
+}
+
+// addon for test flow and connection id
+type flowIdAddon struct {
+	BaseAddon
+	mu  sync.Mutex
+	ids []string
+}
+
+func (addon *flowIdAddon) record(event string, f *Flow) {
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	addon.ids = append(addon.ids, event+" "+f.Id.String()+" "+f.ConnContext.Id().String())
+}
+
+func (addon *flowIdAddon) Requestheaders(f *Flow) { addon.record("Requestheaders", f) }
+func (addon *flowIdAddon) Request(f *Flow)        { addon.record("Request", f) }
+func (addon *flowIdAddon) Response(f *Flow)       { addon.record("Response", f) }
+
+func TestFlowId(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer server.Close()
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:          ":29126",
+		StreamLargeBodies: 5,
+	})
+	handleError(t, err)
+	addon := &flowIdAddon{}
+	testProxy.AddAddon(addon)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	logHook := logtest.NewGlobal()
+	defer logHook.Reset()
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29126")
+			},
+		},
+	}
+	testSendRequest(t, server.URL+"/1", proxyClient, "hello")
+	testSendRequest(t, server.URL+"/2", proxyClient, "hello")
+
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	if len(addon.ids) != 4 {
+		t.Fatalf("unexpected events %v", addon.ids)
+	}
+	// 响应 body 达到 StreamLargeBodies 转为 stream 模式，不触发 Response，ServeHTTP 记录警告日志
+	first := strings.Fields(addon.ids[0])
+	second := strings.Fields(addon.ids[2])
+	if addon.ids[1] != "Request "+first[1]+" "+first[2] || addon.ids[3] != "Request "+second[1]+" "+second[2] {
+		t.Fatalf("flow id should be stable across callbacks %v", addon.ids)
+	}
+	if first[1] == second[1] || first[2] != second[2] {
+		t.Fatalf("expected distinct flow id and same conn id %v", addon.ids)
+	}
+
+	found := false
+	for _, entry := range logHook.AllEntries() {
+		if entry.Data["flow"] != nil && entry.Data["flow"].(fmt.Stringer).String() == first[1] && entry.Data["conn"].(fmt.Stringer).String() == first[2] {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("ServeHTTP log should have flow and conn fields")
+	}
+}
+
+func TestResponseFraming(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/chunked", "/large":
+			// 分多次 flush，上游以 chunked 发送
+			n := 2
+			if r.URL.Path == "/large" {
+				n = 1000 // 超过 net/http 的缓冲区，否则会自动计算 Content-Length
+			}
+			for i := 0; i < n; i++ {
+				io.WriteString(w, "hello")
+				w.(http.Flusher).Flush()
+			}
+		default:
+			w.Header().Set("Content-Length", "5")
+			io.WriteString(w, "hello")
+		}
+	}))
+	defer server.Close()
+
+	get := func(proxyAddr, path string) (*http.Response, string) {
+		client := &http.Client{
+			Transport: &http.Transport{
+				Proxy: func(r *http.Request) (*url.URL, error) {
+					return url.Parse("http://" + proxyAddr)
+				},
+				DisableKeepAlives: true,
+			},
+		}
+		res, err := client.Get(server.URL + path)
+		handleError(t, err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		handleError(t, err)
+		return res, string(body)
+	}
+	isChunked := func(res *http.Response) bool {
+		return len(res.TransferEncoding) == 1 && res.TransferEncoding[0] == "chunked" && res.ContentLength == -1
+	}
+
+	t.Run("content-length", func(t *testing.T) {
+		testProxy, err := NewProxy(&Options{
+			HttpAddr:          ":29127",
+			StreamLargeBodies: 50,
+			ResponseFraming:   FramingContentLength,
+		})
+		handleError(t, err)
+		go testProxy.Start()
+		defer testProxy.Close()
+		time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+		res, body := get("127.0.0.1:29127", "/chunked")
+		if body != "hellohello" || res.ContentLength != 10 || len(res.TransferEncoding) != 0 {
+			t.Fatalf("expected Content-Length framing, but got %v %v %q", res.ContentLength, res.TransferEncoding, body)
+		}
+		res, body = get("127.0.0.1:29127", "/large")
+		if len(body) != 5000 || !isChunked(res) {
+			t.Fatalf("expected large body stays chunked, but got %v %v", res.ContentLength, res.TransferEncoding)
+		}
+	})
+
+	t.Run("chunked", func(t *testing.T) {
+		testProxy, err := NewProxy(&Options{
+			HttpAddr:        ":29128",
+			ResponseFraming: FramingChunked,
+		})
+		handleError(t, err)
+		go testProxy.Start()
+		defer testProxy.Close()
+		time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+		res, body := get("127.0.0.1:29128", "/length")
+		if body != "hello" || !isChunked(res) {
+			t.Fatalf("expected chunked framing, but got %v %v", res.ContentLength, res.TransferEncoding)
+		}
+	})
+}
+
+type serverErrorAddon struct {
+	BaseAddon
+	mu     sync.Mutex
+	errs   []error
+	events []string // 请求 /broken?bare=1 时的事件顺序
+}
+
+func (addon *serverErrorAddon) record(f *Flow, event string) {
+	if f.Request.URL.Query().Get("bare") == "" {
+		return
+	}
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	addon.events = append(addon.events, event)
+}
+
+func (addon *serverErrorAddon) Error(f *Flow, err error) {
+	addon.record(f, "error")
+}
+
+func (addon *serverErrorAddon) Response(f *Flow) {
+	addon.record(f, fmt.Sprintf("response %v %v", f.Response.StatusCode, f.Err != nil))
+}
+
+func (addon *serverErrorAddon) ServerError(f *Flow, err error) *Response {
+	addon.record(f, "server_error")
+	addon.mu.Lock()
+	addon.errs = append(addon.errs, err)
+	addon.mu.Unlock()
+	if f.Request.URL.Query().Get("bare") != "" {
+		return nil
+	}
+	return &Response{
+		Header: http.Header{"Content-Type": []string{"text/html"}},
+		Body:   []byte("<h1>maintenance</h1> " + f.Request.URL.Path),
+	}
+}
+
+func TestServerError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/broken":
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		case "/truncated":
+			w.Header().Set("Content-Length", "100")
+			io.WriteString(w, "hello")
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		default:
+			io.WriteString(w, "ok")
+		}
+	}))
+	defer server.Close()
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr: ":29129",
+	})
+	handleError(t, err)
+	addon := &serverErrorAddon{}
+	testProxy.AddAddon(addon)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29129")
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	get := func(t *testing.T, path string) (int, string) {
+		res, err := client.Get(server.URL + path)
+		handleError(t, err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		handleError(t, err)
+		return res.StatusCode, string(body)
+	}
+
+	if code, body := get(t, "/"); code != 200 || body != "ok" {
+		t.Fatalf("unexpected response %v %q", code, body)
+	}
+	if code, body := get(t, "/broken"); code != 502 || body != "<h1>maintenance</h1> /broken" {
+		t.Fatalf("expected custom 502 page, but got %v %q", code, body)
+	}
+	if code, body := get(t, "/truncated"); code != 502 || body != "<h1>maintenance</h1> /truncated" {
+		t.Fatalf("expected custom 502 page, but got %v %q", code, body)
+	}
+	if code, body := get(t, "/broken?bare=1"); code != 502 || body != "" {
+		t.Fatalf("expected bare 502, but got %v %q", code, body)
+	}
+
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	if len(addon.errs) != 3 {
+		t.Fatalf("expected 3 server errors, but got %v", addon.errs)
+	}
+	// 与超时相同，依次触发 Error、ServerError、Response
+	if got := strings.Join(addon.events, "|"); got != "error|server_error|response 502 true" {
+		t.Fatalf("unexpected events %v", got)
+	}
+	for _, err := range addon.errs {
+		if err == nil {
+			t.Fatal("expected non nil error")
+		}
+	}
+}
+
+func TestBlockHosts(t *testing.T) {
+	hosts := newBlockHosts([]string{"ads.example.com", "*.tracker.io", ".Doubleclick.net"})
+	for host, expected := range map[string]bool{
+		"ads.example.com:443":      true,
+		"www.example.com":          false,
+		"a.tracker.io":             true,
+		"tracker.io":               false,
+		"doubleclick.net":          true,
+		"x.y.doubleclick.net:8080": true,
+		"notdoubleclick.net":       false,
+	} {
+		if hosts.match(host) != expected {
+			t.Fatalf("%v: expected %v", host, expected)
+		}
+	}
+
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+	port := server.Listener.Addr().(*net.TCPAddr).Port
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:   ":29130",
+		BlockHosts: []string{"localhost"},
+		BlockBody:  []byte("blocked"),
+	})
+	handleError(t, err)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29130")
+			},
+		},
+	}
+	res, err := proxyClient.Get("http://localhost:" + strconv.Itoa(port) + "/")
+	handleError(t, err)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	handleError(t, err)
+	if res.StatusCode != 403 || string(body) != "blocked" {
+		t.Fatalf("expected 403 blocked, but got %v %q", res.StatusCode, body)
+	}
+	testSendRequest(t, server.URL, proxyClient, "ok")
+
+	conn, err := net.Dial("tcp", "127.0.0.1:29130")
+	handleError(t, err)
+	defer conn.Close()
+	target := "localhost:" + strconv.Itoa(port)
+	_, err = io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+	handleError(t, err)
+	res, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	handleError(t, err)
+	if res.StatusCode != 403 {
+		t.Fatalf("expected CONNECT refused with 403, but got %v", res.StatusCode)
+	}
+
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Fatalf("expected only unblocked request reach upstream, but got %v", n)
+	}
+}
+
+type retryAddon struct {
+	BaseAddon
+	requests int32
+}
+
+func (addon *retryAddon) Request(f *Flow) {
+	atomic.AddInt32(&addon.requests, 1)
+}
+
+func TestRetry(t *testing.T) {
+	var mu sync.Mutex
+	calls := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls[r.URL.Path]++
+		n := calls[r.URL.Path]
+		mu.Unlock()
+		// 前两次请求直接断开连接
+		if n <= 2 {
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		io.WriteString(w, r.Method+" "+string(body))
+	}))
+	defer server.Close()
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:     ":29131",
+		MaxRetries:   2,
+		RetryBackoff: time.Millisecond,
+	})
+	handleError(t, err)
+	addon := &retryAddon{}
+	testProxy.AddAddon(addon)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29131")
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	do := func(method, path, body string) (int, string) {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		handleError(t, err)
+		res, err := client.Do(req)
+		handleError(t, err)
+		defer res.Body.Close()
+		resBody, err := ioutil.ReadAll(res.Body)
+		handleError(t, err)
+		return res.StatusCode, string(resBody)
+	}
+
+	if code, body := do("PUT", "/put", "hello"); code != 200 || body != "PUT hello" {
+		t.Fatalf("expected retried PUT succeed, but got %v %q", code, body)
+	}
+	if n := atomic.LoadInt32(&addon.requests); n != 1 {
+		t.Fatalf("expected Request addon called once, but got %v", n)
+	}
+	if code, _ := do("POST", "/post", "hello"); code != 502 {
+		t.Fatalf("expected POST not retried, but got %v", code)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls["/put"] != 3 || calls["/post"] != 1 {
+		t.Fatalf("unexpected upstream calls %v", calls)
+	}
+}
+
+func TestRetryExhausted(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer server.Close()
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:     ":29132",
+		MaxRetries:   2,
+		RetryBackoff: time.Millisecond,
+	})
+	handleError(t, err)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29132")
+			},
+		},
+	}
+	res, err := client.Get(server.URL)
+	handleError(t, err)
+	res.Body.Close()
+	if res.StatusCode != 502 {
+		t.Fatalf("expected 502, but got %v", res.StatusCode)
+	}
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Fatalf("expected 3 upstream calls, but got %v", n)
+	}
+}
+
+func TestSslKeyLogFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+
+	keyLogFile := filepath.Join(t.TempDir(), "keys.log")
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:      ":29133",
+		SslInsecure:   true,
+		SslKeyLogFile: keyLogFile,
+	})
+	handleError(t, err)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29133")
+			},
+		},
+	}
+	testSendRequest(t, server.URL, proxyClient, "ok")
+
+	data, err := ioutil.ReadFile(keyLogFile)
+	handleError(t, err)
+	// 客户端至 proxy 及 proxy 至上游两个 tls 连接
+	randoms := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			t.Fatalf("unexpected key log line %q", line)
+		}
+		randoms[fields[1]] = true
+	}
+	if len(randoms) != 2 {
+		t.Fatalf("expected keys of 2 tls connections, but got %v", len(randoms))
+	}
+}
+
+type flowStatsAddon struct {
+	BaseAddon
+	mu    sync.Mutex
+	stats map[string]FlowStats // 在 Response 事件中获取
+	done  map[string]FlowStats // flow 结束后获取
+}
+
+func (addon *flowStatsAddon) Requestheaders(f *Flow) {
+	go func() {
+		<-f.Done()
+		addon.mu.Lock()
+		defer addon.mu.Unlock()
+		addon.done[f.Request.Method+" "+f.Request.URL.Path] = f.Stats
+	}()
+}
+
+func (addon *flowStatsAddon) Response(f *Flow) {
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	addon.stats[f.Request.Method+" "+f.Request.URL.Path] = f.Stats
+}
+
+func TestFlowStats(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		time.Sleep(time.Millisecond * 20)
+		if r.URL.Path == "/large" {
+			w.Write(make([]byte, 5000))
+			return
+		}
+		w.Write(make([]byte, 100))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	tlsServer := httptest.NewTLSServer(handler)
+	defer tlsServer.Close()
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:          ":29134",
+		StreamLargeBodies: 1000,
+	})
+	handleError(t, err)
+	testProxy.SetShouldInterceptRule(func(req *http.Request) bool { return false })
+	addon := &flowStatsAddon{stats: make(map[string]FlowStats), done: make(map[string]FlowStats)}
+	testProxy.AddAddon(addon)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29134")
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	post := func(rawURL string) {
+		res, err := proxyClient.Post(rawURL, "text/plain", strings.NewReader("0123456789"))
+		handleError(t, err)
+		_, err = ioutil.ReadAll(res.Body)
+		handleError(t, err)
+		res.Body.Close()
+	}
+	post(server.URL + "/small")
+	post(server.URL + "/large")
+	post(tlsServer.URL + "/small")
+	time.Sleep(time.Millisecond * 20) // wait for flows done
+
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+
+	small := addon.stats["POST /small"]
+	if small.RequestBytes != 10 || small.ResponseBytes != 100 {
+		t.Fatalf("unexpected bytes %+v", small)
+	}
+	if small.TTFB < time.Millisecond*20 || small.Total < small.TTFB || small.Start.IsZero() {
+		t.Fatalf("unexpected timings %+v", small)
+	}
+	if small != addon.done["POST /small"] {
+		t.Fatalf("expected stats final in Response, but got %+v and %+v", small, addon.done["POST /small"])
+	}
+
+	// stream 模式不触发 Response
+	if _, ok := addon.stats["POST /large"]; ok {
+		t.Fatal("expected no Response event for stream flow")
+	}
+	large := addon.done["POST /large"]
+	if large.RequestBytes != 10 || large.ResponseBytes != 5000 || large.Total < large.TTFB {
+		t.Fatalf("unexpected stream stats %+v", large)
+	}
+
+	tunnel, ok := addon.stats["CONNECT "]
+	if !ok {
+		t.Fatalf("expected CONNECT flow stats, but got %v", addon.stats)
+	}
+	// tunnel 中包含 tls 握手
+	if tunnel.RequestBytes <= 10 || tunnel.ResponseBytes <= 100 || tunnel.Total <= 0 {
+		t.Fatalf("unexpected tunnel stats %+v", tunnel)
+	}
+}
+
+type abortAddon struct {
+	BaseAddon
+}
+
+func (addon *abortAddon) Requestheaders(f *Flow) {
+	switch {
+	case f.Request.Method == "CONNECT" && f.Request.URL.Host == "blocked.test:443":
+		f.Abort(403, "connect policy")
+	case f.Request.URL.Path == "/deny":
+		f.Abort(403, "header policy")
+	case f.Request.URL.Path == "/drop":
+		f.Abort(0, "drop policy")
+	}
+}
+
+func (addon *abortAddon) Request(f *Flow) {
+	if string(f.Request.Body) == "secret" {
+		f.Abort(451, "body policy")
+	}
+}
+
+type abortRecorder struct {
+	BaseAddon
+	mu      sync.Mutex
+	headers int
+	reasons []string
+}
+
+func (addon *abortRecorder) Requestheaders(f *Flow) {
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	addon.headers++
+}
+
+func (addon *abortRecorder) Error(f *Flow, err error) {
+	var abortErr *AbortError
+	if errors.As(err, &abortErr) && f.Aborted() && f.Err == err {
+		addon.mu.Lock()
+		defer addon.mu.Unlock()
+		addon.reasons = append(addon.reasons, abortErr.Reason)
+	}
+}
+
+func TestAbortFlow(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr: ":29135",
+	})
+	handleError(t, err)
+	recorder := &abortRecorder{}
+	testProxy.AddAddon(&abortAddon{})
+	testProxy.AddAddon(recorder)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29135")
+			},
+		},
+	}
+
+	res, err := proxyClient.Get(server.URL + "/deny")
+	handleError(t, err)
+	res.Body.Close()
+	if res.StatusCode != 403 || !res.Close {
+		t.Fatalf("expected 403 and connection close, but got %v %v", res.StatusCode, res.Close)
+	}
+
+	res, err = proxyClient.Post(server.URL+"/upload", "text/plain", strings.NewReader("secret"))
+	handleError(t, err)
+	res.Body.Close()
+	if res.StatusCode != 451 {
+		t.Fatalf("expected 451, but got %v", res.StatusCode)
+	}
+
+	if _, err := proxyClient.Get(server.URL + "/drop"); err == nil {
+		t.Fatal("expected connection dropped")
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:29135")
+	handleError(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "CONNECT blocked.test:443 HTTP/1.1\r\nHost: blocked.test:443\r\n\r\n")
+	handleError(t, err)
+	res, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	handleError(t, err)
+	if res.StatusCode != 403 {
+		t.Fatalf("expected CONNECT aborted with 403, but got %v", res.StatusCode)
+	}
+
+	testSendRequest(t, server.URL+"/", proxyClient, "ok")
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Fatalf("expected only not aborted request reach upstream, but got %v", n)
+	}
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	// 在 Requestheaders 中中止的 flow 跳过之后的 addon
+	if recorder.headers != 2 {
+		t.Fatalf("expected 2 Requestheaders reach recorder, but got %v", recorder.headers)
+	}
+	expected := []string{"header policy", "body policy", "drop policy", "connect policy"}
+	if strings.Join(recorder.reasons, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected abort reasons %v, but got %v", expected, recorder.reasons)
+	}
+}
+
+type streamLargeBodiesAddon struct {
+	BaseAddon
+	mu       sync.Mutex
+	buffered map[string]int
+}
+
+func (addon *streamLargeBodiesAddon) Responseheaders(f *Flow) {
+	if strings.Contains(f.Response.Header.Get("Content-Type"), "json") {
+		f.StreamLargeBodies = 1024 * 1024
+	}
+}
+
+func (addon *streamLargeBodiesAddon) Response(f *Flow) {
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	addon.buffered[f.Request.URL.Path] = len(f.Response.Body)
+}
+
+func TestFlowStreamLargeBodies(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(bytes.Repeat([]byte("a"), 5000))
+		case "/download":
+			w.Header().Set("Content-Length", "5000")
+			w.Write(bytes.Repeat([]byte("a"), 5000))
+		case "/head":
+			w.Header().Set("Content-Length", "5000")
+		}
+	}))
+	defer server.Close()
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:          ":29136",
+		StreamLargeBodies: 100,
+	})
+	handleError(t, err)
+	addon := &streamLargeBodiesAddon{buffered: make(map[string]int)}
+	testProxy.AddAddon(addon)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29136")
+			},
+		},
+	}
+	for _, path := range []string{"/api", "/download"} {
+		res, err := proxyClient.Get(server.URL + path)
+		handleError(t, err)
+		body, err := ioutil.ReadAll(res.Body)
+		handleError(t, err)
+		res.Body.Close()
+		if len(body) != 5000 {
+			t.Fatalf("%v: expected 5000 bytes, but got %v", path, len(body))
+		}
+	}
+	res, err := proxyClient.Head(server.URL + "/head")
+	handleError(t, err)
+	res.Body.Close()
+
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	if addon.buffered["/api"] != 5000 {
+		t.Fatalf("expected json response buffered by per flow threshold, but got %v", addon.buffered)
+	}
+	if _, ok := addon.buffered["/download"]; ok {
+		t.Fatal("expected large download streamed")
+	}
+	// HEAD 响应的 Content-Length 不代表 body 大小
+	if _, ok := addon.buffered["/head"]; !ok {
+		t.Fatal("expected HEAD response not streamed")
+	}
+}
+
+type countResolver struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (r *countResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	r.mu.Lock()
+	r.names = append(r.names, name)
+	r.mu.Unlock()
+	return ctx, net.ParseIP("127.0.0.1"), nil
+}
+
+func (r *countResolver) reset() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := r.names
+	r.names = nil
+	return names
+}
+
+func TestSocksUpstream(t *testing.T) {
+	resolver := &countResolver{}
+	socksServer, err := socks5.New(&socks5.Config{
+		Credentials: socks5.StaticCredentials{"user": "pass"},
+		Resolver:    resolver,
+	})
+	handleError(t, err)
+	socksLn, err := net.Listen("tcp", "127.0.0.1:0")
+	handleError(t, err)
+	defer socksLn.Close()
+	go socksServer.Serve(socksLn)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+	tlsServer := httptest.NewTLSServer(handler)
+	defer tlsServer.Close()
+	httpURL := strings.Replace(httpServer.URL, "127.0.0.1", "localhost", 1)
+	tlsURL := strings.Replace(tlsServer.URL, "127.0.0.1", "localhost", 1)
+
+	dnsAddr := startTestDNSServer(t)
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:      ":29137",
+		ProxyLoopback: true,
+		Resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "udp", dnsAddr)
+			},
+		},
+	})
+	handleError(t, err)
+	var upstream atomic.Value
+	testProxy.SetUpstreamProxy(func(req *http.Request) (*url.URL, error) {
+		return url.Parse(upstream.Load().(string))
+	})
+	// https 请求不解密，直接通过上游代理建立隧道
+	testProxy.SetShouldInterceptRule(func(req *http.Request) bool {
+		return false
+	})
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29137")
+			},
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	get := func(t *testing.T, rawURL string) {
+		t.Helper()
+		res, err := proxyClient.Get(rawURL)
+		handleError(t, err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		handleError(t, err)
+		if res.StatusCode != 200 || string(body) != "ok" {
+			t.Fatalf("expected 200 ok, but got %v %s", res.StatusCode, body)
+		}
+	}
+	socksHost := socksLn.Addr().String()
+
+	t.Run("http request via socks", func(t *testing.T) {
+		upstream.Store("socks://user:pass@" + socksHost)
+		get(t, httpURL)
+		if names := resolver.reset(); len(names) != 1 || names[0] != "localhost" {
+			t.Fatalf("expected host resolved by upstream, but got %v", names)
+		}
+	})
+
+	t.Run("http request via socks5 resolves locally", func(t *testing.T) {
+		upstream.Store("socks5://user:pass@" + socksHost)
+		get(t, httpURL)
+		get(t, "http://web.test:"+strconv.Itoa(httpServer.Listener.Addr().(*net.TCPAddr).Port))
+		if names := resolver.reset(); len(names) != 0 {
+			t.Fatalf("expected host resolved locally, but got %v", names)
+		}
+	})
+
+	t.Run("tunnel via socks5 resolves locally", func(t *testing.T) {
+		upstream.Store("socks5://user:pass@" + socksHost)
+		get(t, tlsURL)
+		if names := resolver.reset(); len(names) != 0 {
+			t.Fatalf("expected host resolved locally, but got %v", names)
+		}
+	})
+
+	t.Run("tunnel via socks5 uses proxy resolver", func(t *testing.T) {
+		upstream.Store("socks5://user:pass@" + socksHost)
+		get(t, "https://web.test:"+strconv.Itoa(tlsServer.Listener.Addr().(*net.TCPAddr).Port))
+		if names := resolver.reset(); len(names) != 0 {
+			t.Fatalf("expected host resolved locally, but got %v", names)
+		}
+	})
+
+	t.Run("tunnel via socks5h resolves remotely", func(t *testing.T) {
+		upstream.Store("socks5h://user:pass@" + socksHost)
+		get(t, tlsURL)
+		if names := resolver.reset(); len(names) != 1 || names[0] != "localhost" {
+			t.Fatalf("expected host resolved by upstream, but got %v", names)
+		}
+	})
+
+	t.Run("wrong credentials", func(t *testing.T) {
+		upstream.Store("socks5h://user:wrong@" + socksHost)
+		res, err := proxyClient.Get(tlsURL)
+		if err == nil {
+			res.Body.Close()
+			t.Fatal("expected tunnel failed")
+		}
+	})
+}
+
+func TestClientCancelUpstream(t *testing.T) {
+	canceled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/download" {
+			w.Write(bytes.Repeat([]byte("a"), 64*1024))
+			w.(http.Flusher).Flush()
+		}
+		select {
+		case <-r.Context().Done():
+			close(canceled)
+		case <-time.After(time.Second * 3):
+		}
+	}))
+	defer server.Close()
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:          ":29138",
+		StreamLargeBodies: 1,
+	})
+	handleError(t, err)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	waitCanceled := func(t *testing.T, start time.Time) {
+		t.Helper()
+		select {
+		case <-canceled:
+		case <-time.After(time.Second * 2):
+			t.Fatal("expected upstream request canceled after client gone")
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("upstream canceled too late: %v", elapsed)
+		}
+		canceled = make(chan struct{})
+	}
+
+	t.Run("waiting for response headers", func(t *testing.T) {
+		conn, err := net.Dial("tcp", "127.0.0.1:29138")
+		handleError(t, err)
+		fmt.Fprintf(conn, "GET %v/slow HTTP/1.1\r\nHost: %v\r\n\r\n", server.URL, server.Listener.Addr())
+		time.Sleep(time.Millisecond * 100)
+		start := time.Now()
+		conn.Close()
+		waitCanceled(t, start)
+	})
+
+	t.Run("streaming response body", func(t *testing.T) {
+		conn, err := net.Dial("tcp", "127.0.0.1:29138")
+		handleError(t, err)
+		fmt.Fprintf(conn, "GET %v/download HTTP/1.1\r\nHost: %v\r\n\r\n", server.URL, server.Listener.Addr())
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		handleError(t, err)
+		if _, err := io.ReadFull(res.Body, make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		conn.Close()
+		waitCanceled(t, start)
+	})
+}
+
+type clientAddrAddon struct {
+	BaseAddon
+	mu    sync.Mutex
+	addrs []string
+}
+
+func (addon *clientAddrAddon) ClientConnected(client *ClientConn) {
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	addon.addrs = append(addon.addrs, client.Conn.RemoteAddr().String())
+}
+
+func TestUnixSocket(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	tlsServer := httptest.NewTLSServer(handler)
+	defer tlsServer.Close()
+
+	sockPath := filepath.Join(t.TempDir(), "proxy.sock")
+	// 模拟上次未正常退出遗留的 socket 文件
+	staleLn, err := net.Listen("unix", sockPath)
+	handleError(t, err)
+	staleLn.(*net.UnixListener).SetUnlinkOnClose(false)
+	staleLn.Close()
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:    "unix:" + sockPath,
+		SocksAddr:   "127.0.0.1:29164", // 与命令行的默认值一样设置了 socks5 地址，跳过
+		SslInsecure: true,
+	})
+	handleError(t, err)
+	addon := &clientAddrAddon{}
+	testProxy.AddAddon(addon)
+	go testProxy.Start()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://proxy.sock")
+			},
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", sockPath)
+			},
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+		},
+	}
+	for _, rawURL := range []string{server.URL, tlsServer.URL} {
+		res, err := proxyClient.Get(rawURL)
+		handleError(t, err)
+		body, err := ioutil.ReadAll(res.Body)
+		handleError(t, err)
+		res.Body.Close()
+		if res.StatusCode != 200 || string(body) != "ok" {
+			t.Fatalf("%v: expected 200 ok, but got %v %s", rawURL, res.StatusCode, body)
+		}
+	}
+
+	if conn, err := net.Dial("tcp", "127.0.0.1:29164"); err == nil {
+		conn.Close()
+		t.Fatal("expected socks5 proxy not listening")
+	}
+
+	addon.mu.Lock()
+	if len(addon.addrs) != 2 || addon.addrs[0] != "unix:"+sockPath {
+		t.Fatalf("unexpected client addrs %v", addon.addrs)
+	}
+	addon.mu.Unlock()
+
+	// 已有进程监听时不删除 socket 文件
+	busyProxy, err := NewProxy(&Options{
+		HttpAddr: "unix:" + sockPath,
+	})
+	handleError(t, err)
+	if err := busyProxy.Start(); err == nil || !strings.Contains(err.Error(), "address already in use") {
+		t.Fatalf("expected address already in use, but got %v", err)
+	}
+
+	handleError(t, testProxy.Close())
+	if _, err := os.Stat(sockPath); !os.IsNotExist(err) {
+		t.Fatalf("expected socket file removed on close, but got %v", err)
+	}
+}
+
+type separateClientAddon struct {
+	BaseAddon
+}
+
+func (addon *separateClientAddon) Requestheaders(f *Flow) {
+	f.UseSeparateClient = f.Request.URL.Query().Get("separate") == "1"
+}
+
+func TestInsecureSkipVerifyForHost(t *testing.T) {
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}),
+	}
+	tlsPlainLn, err := net.Listen("tcp", "127.0.0.1:0")
+	handleError(t, err)
+	defer tlsPlainLn.Close()
+	ca, err := cert.NewCAMemory()
+	handleError(t, err)
+	localhostCert, err := ca.GetCert("localhost")
+	handleError(t, err)
+	go server.Serve(tls.NewListener(tlsPlainLn, &tls.Config{
+		Certificates: []tls.Certificate{*localhostCert},
+	}))
+	httpsPort := strconv.Itoa(tlsPlainLn.Addr().(*net.TCPAddr).Port)
+
+	var mu sync.Mutex
+	var hosts []string
+	testProxy, err := NewProxy(&Options{
+		HttpAddr: ":29139",
+		// 回调返回 false 时仍需校验
+		SslInsecure: true,
+		InsecureSkipVerifyForHost: func(host string) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			hosts = append(hosts, host)
+			return host == "localhost"
+		},
+	})
+	handleError(t, err)
+	testProxy.AddAddon(&separateClientAddon{})
+	// 不在握手时连接上游，?separate=1 的请求由 proxy.client 连接上游并校验
+	testProxy.AddAddon(&upstreamCertAddon{})
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29139")
+			},
+			DisableKeepAlives: true,
+		},
+	}
+
+	for _, query := range []string{"", "?separate=1"} {
+		testSendRequest(t, "https://localhost:"+httpsPort+"/"+query, proxyClient, "ok")
+		res, err := proxyClient.Get("https://127.0.0.1:" + httpsPort + "/" + query)
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode != 502 {
+				t.Fatalf("%q: expected verify failed, but got %v", query, res.StatusCode)
+			}
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	found, foundIp := false, false
+	for _, host := range hosts {
+		found = found || host == "localhost"
+		foundIp = foundIp || host == "127.0.0.1"
+		// 连接 ip 时按连接的地址判断，不能以空 host 调用
+		if host == "" {
+			t.Fatalf("expected callback not called with empty host, but got %v", hosts)
+		}
+	}
+	if !found || !foundIp {
+		t.Fatalf("expected callback called with localhost and 127.0.0.1, but got %v", hosts)
+	}
+}
+
+type tunnelErrAddon struct {
+	BaseAddon
+	errs chan error
+}
+
+func (addon *tunnelErrAddon) Response(f *Flow) {
+	if f.ConnContext.ClientConn.Tls || f.Request.Method != "CONNECT" {
+		return
+	}
+	addon.errs <- f.Err
+}
+
+func TestTunnelIdleTimeout(t *testing.T) {
+	echoLn, err := net.Listen("tcp", "127.0.0.1:0")
+	handleError(t, err)
+	defer echoLn.Close()
+	go func() {
+		for {
+			conn, err := echoLn.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:          ":29140",
+		TunnelIdleTimeout: time.Millisecond * 200,
+	})
+	handleError(t, err)
+	testProxy.SetShouldInterceptRule(func(req *http.Request) bool {
+		return false
+	})
+	addon := &tunnelErrAddon{errs: make(chan error, 1)}
+	testProxy.AddAddon(addon)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	conn, err := net.Dial("tcp", "127.0.0.1:29140")
+	handleError(t, err)
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", echoLn.Addr(), echoLn.Addr())
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	handleError(t, err)
+	if res.StatusCode != 200 {
+		t.Fatalf("expected 200, but got %v", res.StatusCode)
+	}
+
+	// 持续传输数据时不超时
+	buf := make([]byte, 4)
+	for i := 0; i < 6; i++ {
+		_, err := conn.Write([]byte("ping"))
+		handleError(t, err)
+		_, err = io.ReadFull(br, buf)
+		handleError(t, err)
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("expected tunnel closed, but got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("tunnel closed too late: %v", elapsed)
+	}
+	select {
+	case err := <-addon.errs:
+		if !errors.Is(err, ErrTunnelIdleTimeout) {
+			t.Fatalf("expected ErrTunnelIdleTimeout, but got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected Response addon called")
+	}
+}
+
+func TestCertKeyType(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	if _, err := NewProxy(&Options{HttpAddr: ":0", CertKeyType: "dsa"}); err == nil {
+		t.Fatal("expected unknown key type error")
+	}
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:    ":29141",
+		SslInsecure: true,
+		CertKeyType: "ecdsa-p256",
+	})
+	handleError(t, err)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	get := func(t *testing.T, tlsConfig *tls.Config) x509.PublicKeyAlgorithm {
+		t.Helper()
+		proxyClient := &http.Client{
+			Transport: &http.Transport{
+				Proxy: func(r *http.Request) (*url.URL, error) {
+					return url.Parse("http://127.0.0.1:29141")
+				},
+				TLSClientConfig: tlsConfig,
+			},
+		}
+		res, err := proxyClient.Get(server.URL)
+		handleError(t, err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		handleError(t, err)
+		if string(body) != "ok" {
+			t.Fatalf("expected ok, but got %s", body)
+		}
+		return res.TLS.PeerCertificates[0].PublicKeyAlgorithm
+	}
+
+	if algo := get(t, &tls.Config{InsecureSkipVerify: true}); algo != x509.ECDSA {
+		t.Fatalf("expected ecdsa cert, but got %v", algo)
+	}
+	// 仅支持 rsa 证书的客户端
+	rsaOnly := &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+		CipherSuites:       []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+	}
+	if algo := get(t, rsaOnly); algo != x509.RSA {
+		t.Fatalf("expected rsa cert for rsa only client, but got %v", algo)
+	}
+}
+
+type tlsInfoAddon struct {
+	BaseAddon
+	mu     sync.Mutex
+	client map[string]TlsInfo
+	server map[string]TlsInfo
+	flow   map[string]TlsInfo
+}
+
+func (a *tlsInfoAddon) Responseheaders(f *Flow) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := f.Request.URL.Scheme
+	if f.SeparateClientReason != "" {
+		key = "separate"
+	}
+	a.client[key] = f.ConnContext.ClientConn.TlsInfo
+	if f.ConnContext.ServerConn != nil {
+		a.server[key] = f.ConnContext.ServerConn.TlsInfo
+	}
+	a.flow[key] = f.Stats.ServerTlsInfo
+}
+
+func TestTlsInfo(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	tlsServer := httptest.NewTLSServer(handler)
+	defer tlsServer.Close()
+	plainServer := httptest.NewServer(handler)
+	defer plainServer.Close()
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:    ":29142",
+		SslInsecure: true,
+	})
+	handleError(t, err)
+	addon := &tlsInfoAddon{client: make(map[string]TlsInfo), server: make(map[string]TlsInfo), flow: make(map[string]TlsInfo)}
+	testProxy.AddAddon(&rewriteDestinationAddon{})
+	testProxy.AddAddon(addon)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29142")
+			},
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+				MaxVersion:         tls.VersionTLS12,
+				CipherSuites:       []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+			},
+		},
+	}
+	tlsURL := strings.Replace(tlsServer.URL, "127.0.0.1", "localhost", 1)
+	for _, u := range []string{tlsURL, plainServer.URL} {
+		res, err := proxyClient.Get(u)
+		handleError(t, err)
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		handleError(t, err)
+		if string(body) != "ok" {
+			t.Fatalf("expected ok, but got %s", body)
+		}
+	}
+	// http 请求被 addon 指向 https 上游，由共享的 client 请求
+	req, err := http.NewRequest("GET", plainServer.URL, nil)
+	handleError(t, err)
+	req.Header.Set("X-Rewrite-To", tlsURL)
+	res, err := proxyClient.Do(req)
+	handleError(t, err)
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	client := addon.client["https"]
+	if client.Version != tls.VersionTLS12 || client.CipherSuite != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Fatalf("unexpected client tls info: %+v", client)
+	}
+	if client.ServerName != "localhost" {
+		t.Fatalf("unexpected client sni: %+v", client)
+	}
+	server := addon.server["https"]
+	if server.Version == 0 || server.CipherSuite == 0 {
+		t.Fatalf("unexpected server tls info: %+v", server)
+	}
+	if server.ServerName != "localhost" {
+		t.Fatalf("unexpected server sni: %+v", server)
+	}
+	if addon.flow["https"] != server {
+		t.Fatalf("expected flow tls info %+v, but got %+v", server, addon.flow["https"])
+	}
+	if addon.client["http"] != (TlsInfo{}) || addon.server["http"] != (TlsInfo{}) || addon.flow["http"] != (TlsInfo{}) {
+		t.Fatalf("expected empty tls info for http flow, but got %+v %+v %+v", addon.client["http"], addon.server["http"], addon.flow["http"])
+	}
+	// ServerConn 为客户端 http 连接对应的上游连接，没有 tls 参数
+	if addon.server["separate"] != (TlsInfo{}) {
+		t.Fatalf("expected empty server conn tls info, but got %+v", addon.server["separate"])
+	}
+	separate := addon.flow["separate"]
+	if separate.Version == 0 || separate.CipherSuite == 0 || separate.ServerName != "localhost" {
+		t.Fatalf("unexpected separate client flow tls info: %+v", separate)
+	}
+}
+
+// 按请求 header 将请求指向其他 origin
+type rewriteDestinationAddon struct {
+	BaseAddon
+}
+
+func (a *rewriteDestinationAddon) Request(f *Flow) {
+	target := f.Request.Header.Get("X-Rewrite-To")
+	if target == "" {
+		return
+	}
+	u, _ := url.Parse(target)
+	f.Request.URL.Scheme = u.Scheme
+	f.Request.URL.Host = u.Host
+	f.KeepHostHeader = f.Request.Header.Get("X-Keep-Host") != ""
+}
+
+func TestRewriteDestination(t *testing.T) {
+	echo := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name + " " + r.Host + " " + r.URL.Path))
+		})
+	}
+	origin := httptest.NewServer(echo("origin"))
+	defer origin.Close()
+	tlsOrigin := httptest.NewTLSServer(echo("tls-origin"))
+	defer tlsOrigin.Close()
+	staging := httptest.NewServer(echo("staging"))
+	defer staging.Close()
+	tlsStaging := httptest.NewTLSServer(echo("tls-staging"))
+	defer tlsStaging.Close()
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:    ":29143",
+		SslInsecure: true,
+	})
+	handleError(t, err)
+	testProxy.AddAddon(&rewriteDestinationAddon{})
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29143")
+			},
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	get := func(t *testing.T, rawURL string, header http.Header) string {
+		t.Helper()
+		req, err := http.NewRequest("GET", rawURL, nil)
+		handleError(t, err)
+		req.Header = header
+		res, err := proxyClient.Do(req)
+		handleError(t, err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		handleError(t, err)
+		return string(body)
+	}
+	host := func(server *httptest.Server) string {
+		return strings.TrimPrefix(strings.TrimPrefix(server.URL, "http://"), "https://")
+	}
+
+	cases := []struct {
+		name     string
+		url      string
+		header   http.Header
+		expected string
+	}{
+		{"http without rewrite", origin.URL + "/a", http.Header{}, "origin " + host(origin) + " /a"},
+		{"http to http", origin.URL + "/a", http.Header{"X-Rewrite-To": {staging.URL}}, "staging " + host(staging) + " /a"},
+		{"http to https", origin.URL + "/a", http.Header{"X-Rewrite-To": {tlsStaging.URL}}, "tls-staging " + host(tlsStaging) + " /a"},
+		{"https to http", tlsOrigin.URL + "/b", http.Header{"X-Rewrite-To": {staging.URL}}, "staging " + host(staging) + " /b"},
+		{"https to https", tlsOrigin.URL + "/b", http.Header{"X-Rewrite-To": {tlsStaging.URL}}, "tls-staging " + host(tlsStaging) + " /b"},
+		{"keep host header", tlsOrigin.URL + "/c", http.Header{"X-Rewrite-To": {staging.URL}, "X-Keep-Host": {"1"}}, "staging " + host(tlsOrigin) + " /c"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := get(t, c.url, c.header); got != c.expected {
+				t.Fatalf("expected %q, but got %q", c.expected, got)
+			}
+		})
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:       ":29144",
+		MaxConnections: 2,
+	})
+	handleError(t, err)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	head := "GET " + server.URL + "/ HTTP/1.1\r\nHost: " + strings.TrimPrefix(server.URL, "http://") + "\r\n\r\n"
+	// 发送请求后在 timeout 内读取响应，连接保持 keep-alive
+	request := func(t *testing.T, conn net.Conn, timeout time.Duration) error {
+		t.Helper()
+		conn.SetDeadline(time.Now().Add(timeout))
+		defer conn.SetDeadline(time.Time{})
+		if _, err := io.WriteString(conn, head); err != nil {
+			return err
+		}
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		_, err = ioutil.ReadAll(res.Body)
+		return err
+	}
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", "127.0.0.1:29144")
+		handleError(t, err)
+		defer conn.Close()
+		handleError(t, request(t, conn, time.Second))
+		conns = append(conns, conn)
+	}
+	if n := testProxy.connLimiter.count(); n != 2 {
+		t.Fatalf("expected 2 connections, but got %v", n)
+	}
+
+	// 达到上限，第三个连接不被处理
+	blocked, err := net.Dial("tcp", "127.0.0.1:29144")
+	handleError(t, err)
+	defer blocked.Close()
+	if _, err := io.WriteString(blocked, head); err != nil {
+		t.Fatal(err)
+	}
+	blocked.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+	reader := bufio.NewReader(blocked)
+	if _, err := http.ReadResponse(reader, nil); err == nil {
+		t.Fatal("expected blocked connection")
+	} else if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("expected timeout, but got %v", err)
+	}
+
+	// 关闭一个连接后，等待中的连接被处理
+	conns[0].Close()
+	blocked.SetReadDeadline(time.Now().Add(time.Second))
+	res, err := http.ReadResponse(reader, nil)
+	handleError(t, err)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	handleError(t, err)
+	if string(body) != "ok" {
+		t.Fatalf("expected ok, but got %s", body)
+	}
+	if n := testProxy.connLimiter.count(); n != 2 {
+		t.Fatalf("expected 2 connections, but got %v", n)
+	}
+}
+
+// 将客户端发送的首行改为大写后发往上游
+type tcpStreamAddon struct {
+	BaseAddon
+	upperHost string
+	hosts     chan string
+}
+
+func (a *tcpStreamAddon) TcpStream(f *Flow, client, server io.ReadWriter) {
+	a.hosts <- f.Request.Method + " " + f.Request.URL.Host
+	if f.Request.URL.Host != a.upperHost {
+		return
+	}
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := client.Read(b); err != nil {
+			return
+		}
+		line = append(line, b[0])
+		if b[0] == '\n' {
+			break
+		}
+	}
+	server.Write(bytes.ToUpper(line))
+}
+
+func TestTcpStream(t *testing.T) {
+	// echo server，banner 不为空时连接后先发送
+	echoServer := func(banner string) net.Listener {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		handleError(t, err)
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					if banner != "" {
+						io.WriteString(conn, banner)
+					}
+					io.Copy(conn, conn)
+				}()
+			}
+		}()
+		return ln
+	}
+	echo := echoServer("")
+	defer echo.Close()
+	bannerEcho := echoServer("220 ready\n")
+	defer bannerEcho.Close()
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr: ":29145",
+	})
+	handleError(t, err)
+	addon := &tcpStreamAddon{upperHost: echo.Addr().String(), hosts: make(chan string, 2)}
+	testProxy.AddAddon(addon)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	connect := func(t *testing.T, host string) (net.Conn, *bufio.Reader) {
+		t.Helper()
+		conn, err := net.Dial("tcp", "127.0.0.1:29145")
+		handleError(t, err)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+		handleError(t, err)
+		reader := bufio.NewReader(conn)
+		res, err := http.ReadResponse(reader, nil)
+		handleError(t, err)
+		if res.StatusCode != 200 {
+			t.Fatalf("expected 200, but got %v", res.StatusCode)
+		}
+		return conn, reader
+	}
+	readLine := func(t *testing.T, reader *bufio.Reader) string {
+		t.Helper()
+		line, err := reader.ReadString('\n')
+		handleError(t, err)
+		return line
+	}
+
+	t.Run("client first", func(t *testing.T) {
+		conn, reader := connect(t, echo.Addr().String())
+		defer conn.Close()
+		_, err := io.WriteString(conn, "hello\n")
+		handleError(t, err)
+		if line := readLine(t, reader); line != "HELLO\n" {
+			t.Fatalf("expected rewritten line, but got %q", line)
+		}
+		if host := <-addon.hosts; host != "CONNECT "+echo.Addr().String() {
+			t.Fatalf("unexpected flow %v", host)
+		}
+		// addon 返回后原样转发
+		_, err = io.WriteString(conn, "second\n")
+		handleError(t, err)
+		if line := readLine(t, reader); line != "second\n" {
+			t.Fatalf("expected second, but got %q", line)
+		}
+	})
+
+	t.Run("server first", func(t *testing.T) {
+		conn, reader := connect(t, bannerEcho.Addr().String())
+		defer conn.Close()
+		if line := readLine(t, reader); line != "220 ready\n" {
+			t.Fatalf("expected banner, but got %q", line)
+		}
+		if host := <-addon.hosts; host != "CONNECT "+bannerEcho.Addr().String() {
+			t.Fatalf("unexpected flow %v", host)
+		}
+		_, err := io.WriteString(conn, "quit\n")
+		handleError(t, err)
+		if line := readLine(t, reader); line != "quit\n" {
+			t.Fatalf("expected quit, but got %q", line)
+		}
+	})
+}
+
+func TestParsePacResult(t *testing.T) {
+	cases := map[string]string{
+		"DIRECT":                                  "",
+		"PROXY proxy:8080":                        "http://proxy:8080",
+		"proxy proxy:8080; DIRECT":                "http://proxy:8080",
+		"HTTPS secure:443; SOCKS 127.0.0.1:1080":  "socks5://127.0.0.1:1080",
+		"SOCKS4 127.0.0.1:1080;SOCKS5 [::1]:1080": "socks5://[::1]:1080",
+		" ; DIRECT; PROXY proxy:8080":             "",
+		"PROXY":                                   "",
+		"HTTP proxy:3128":                         "http://proxy:3128",
+		"unknown value":                           "",
+	}
+	for result, expected := range cases {
+		got := ""
+		if u := parsePacResult(result); u != nil {
+			got = u.String()
+		}
+		if got != expected {
+			t.Fatalf("%q: expected %q, but got %q", result, expected, got)
+		}
+	}
+}
+
+func TestPacUpstream(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("origin"))
+	}))
+	defer origin.Close()
+	// 作为上游 http 代理，直接响应收到的绝对 URL
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream " + r.URL.String()))
+	}))
+	defer upstream.Close()
+	upstreamAddr := strings.TrimPrefix(upstream.URL, "http://")
+
+	var pacMu sync.Mutex
+	pacProxy := "PROXY " + upstreamAddr
+	pacServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/proxy.pac" {
+			w.WriteHeader(404)
+			return
+		}
+		pacMu.Lock()
+		defer pacMu.Unlock()
+		fmt.Fprintf(w, `function FindProxyForURL(url, host) {
+	if (url.indexOf("/broken") >= 0) return notDefined();
+	if (isInNet(host, "127.0.0.0", "255.0.0.0")) return "DIRECT";
+	return "HTTPS skipped:443; %v; DIRECT";
+}`, pacProxy)
+	}))
+	defer pacServer.Close()
+	badPacServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("function FindProxyForURL(url, host) {"))
+	}))
+	defer badPacServer.Close()
+
+	if _, err := NewProxy(&Options{HttpAddr: ":0", PacUrl: "ftp://example.com/proxy.pac"}); err == nil {
+		t.Fatal("expected invalid pac url error")
+	}
+	// 获取或解析失败时 Start 返回错误，不会直连
+	for _, pacUrl := range []string{pacServer.URL + "/missing.pac", badPacServer.URL + "/proxy.pac"} {
+		p, err := NewProxy(&Options{HttpAddr: ":29161", PacUrl: pacUrl})
+		handleError(t, err)
+		if err := p.Start(); err == nil {
+			t.Fatalf("%v: expected start error", pacUrl)
+		}
+	}
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:           ":29146",
+		PacUrl:             pacServer.URL + "/proxy.pac",
+		PacRefreshInterval: time.Millisecond * 50,
+		ProxyLoopback:      true, // 由 PAC 决定 loopback 地址是否直连
+	})
+	handleError(t, err)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29146")
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	get := func(t *testing.T, rawURL string) (int, string) {
+		t.Helper()
+		res, err := proxyClient.Get(rawURL)
+		handleError(t, err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		handleError(t, err)
+		return res.StatusCode, string(body)
+	}
+
+	if _, body := get(t, origin.URL+"/a"); body != "origin" {
+		t.Fatalf("expected direct, but got %v", body)
+	}
+	if _, body := get(t, "http://proxied.example.com/b?c=1"); body != "upstream http://proxied.example.com/b?c=1" {
+		t.Fatalf("expected via upstream, but got %v", body)
+	}
+	// 执行出错时直连
+	if _, body := get(t, origin.URL+"/broken"); body != "origin" {
+		t.Fatalf("expected direct for pac error, but got %v", body)
+	}
+
+	// PAC 文件更新后使用新的结果
+	pacMu.Lock()
+	pacProxy = "DIRECT"
+	pacMu.Unlock()
+	deadline := time.Now().Add(time.Second)
+	for {
+		status, body := get(t, "http://proxied.example.com/b")
+		if status == 502 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected pac refreshed, but got %v %v", status, body)
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+}
+
+func TestSocksTunnelTarget(t *testing.T) {
+	cases := map[string]string{
+		":9080":             "127.0.0.1:9080",
+		"0.0.0.0:9080":      "127.0.0.1:9080",
+		"[::]:9080":         "[::1]:9080",
+		"127.0.0.1:9080":    "127.0.0.1:9080",
+		"[::1]:9080":        "[::1]:9080",
+		"[fe80::1%lo]:9080": "[fe80::1%lo]:9080",
+		"localhost:9080":    "localhost:9080",
+	}
+	for addr, expected := range cases {
+		host, port, err := socksTunnelTarget(addr)
+		if err != nil {
+			t.Fatalf("%v: %v", addr, err)
+		}
+		if got := fmt.Sprintf("%s:%d", host, port); got != expected {
+			t.Fatalf("%v: expected %v, but got %v", addr, expected, got)
+		}
+	}
+	for _, addr := range []string{"::1:9080", "127.0.0.1", ":0", ":http"} {
+		if _, _, err := socksTunnelTarget(addr); err == nil {
+			t.Fatalf("%v: expected error", addr)
+		}
+	}
+}
+
+func TestShouldInterceptBySNI(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("origin"))
+	}))
+	defer origin.Close()
+	_, port, _ := net.SplitHostPort(origin.Listener.Addr().String())
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:    ":29147",
+		SslInsecure: true,
+	})
+	handleError(t, err)
+	// CONNECT 至 localhost 时拦截
+	testProxy.SetShouldInterceptRule(func(req *http.Request) bool {
+		return strings.HasPrefix(req.Host, "localhost:")
+	})
+	var snis []string
+	var snisMu sync.Mutex
+	testProxy.SetShouldInterceptBySNI(func(connCtx *ConnContext, sni string) bool {
+		snisMu.Lock()
+		snis = append(snis, sni)
+		snisMu.Unlock()
+		return sni == "intercept.example.com"
+	})
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	caName := testProxy.GetCertificate().Subject.CommonName
+	// 返回证书是否由 proxy 签发
+	requestTLS := func(t *testing.T, host string, cfg *tls.Config) bool {
+		t.Helper()
+		conn, err := net.Dial("tcp", "127.0.0.1:29147")
+		handleError(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.WriteString(conn, "CONNECT "+host+" HTTP/1.1\r\nHost: "+host+"\r\n\r\n")
+		handleError(t, err)
+		reader := bufio.NewReader(conn)
+		res, err := http.ReadResponse(reader, nil)
+		handleError(t, err)
+		if res.StatusCode != 200 {
+			t.Fatalf("expected 200, but got %v", res.StatusCode)
+		}
+
+		tlsConn := tls.Client(conn, cfg)
+		handleError(t, tlsConn.Handshake())
+		req, _ := http.NewRequest("GET", "https://"+host+"/", nil)
+		handleError(t, req.Write(tlsConn))
+		res, err = http.ReadResponse(bufio.NewReader(tlsConn), req)
+		handleError(t, err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		handleError(t, err)
+		if string(body) != "origin" {
+			t.Fatalf("expected origin, but got %v", string(body))
+		}
+		return tlsConn.ConnectionState().PeerCertificates[0].Issuer.CommonName == caName
+	}
+	request := func(t *testing.T, host, sni string) bool {
+		t.Helper()
+		return requestTLS(t, host, &tls.Config{ServerName: sni, InsecureSkipVerify: true})
+	}
+
+	if !request(t, "127.0.0.1:"+port, "intercept.example.com") {
+		t.Fatal("expected intercepted by sni")
+	}
+	if request(t, "localhost:"+port, "other.example.com") {
+		t.Fatal("expected passthrough by sni")
+	}
+	// 没有 SNI 时使用 SetShouldInterceptRule
+	if request(t, "127.0.0.1:"+port, "") {
+		t.Fatal("expected passthrough by host rule")
+	}
+	if !request(t, "localhost:"+port, "") {
+		t.Fatal("expected intercepted by host rule")
+	}
+	// ClientHello 超过 bufio 默认的 4096 字节缓冲
+	var protos []string
+	for i := 0; i < 30; i++ {
+		protos = append(protos, strings.Repeat("x", 200)+strconv.Itoa(i))
+	}
+	protos = append(protos, "http/1.1")
+	if !requestTLS(t, "127.0.0.1:"+port, &tls.Config{ServerName: "intercept.example.com", NextProtos: protos, InsecureSkipVerify: true}) {
+		t.Fatal("expected large client hello intercepted by sni")
+	}
+
+	snisMu.Lock()
+	defer snisMu.Unlock()
+	if strings.Join(snis, ",") != "intercept.example.com,other.example.com,intercept.example.com" {
+		t.Fatalf("unexpected snis %v", snis)
+	}
+}
+
+func TestParseSNI(t *testing.T) {
+	for _, sni := range []string{"example.com", ""} {
+		client, server := net.Pipe()
+		go func() {
+			tls.Client(client, &tls.Config{ServerName: sni, InsecureSkipVerify: true}).Handshake()
+			client.Close()
+		}()
+		got, err := peekSNI(bufio.NewReaderSize(server, maxTLSRecordSize))
+		server.Close()
+		handleError(t, err)
+		if got != sni {
+			t.Fatalf("expected %q, but got %q", sni, got)
+		}
+	}
+	if _, err := peekSNI(bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n"))); err != errNotClientHello {
+		t.Fatalf("expected errNotClientHello, but got %v", err)
+	}
+}
+
+type flowDoneAddon struct {
+	BaseAddon
+	mu     sync.Mutex
+	events []string
+	done   chan *Flow
+}
+
+func (addon *flowDoneAddon) record(f *Flow, event string) {
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	addon.events = append(addon.events, f.Request.Method+" "+f.Request.URL.Path+" "+event)
+}
+
+func (addon *flowDoneAddon) Response(f *Flow) {
+	addon.record(f, "Response")
+}
+
+func (addon *flowDoneAddon) FlowDone(f *Flow) {
+	select {
+	case <-f.Done():
+	default:
+		panic("f.Done() should be closed")
+	}
+	addon.record(f, fmt.Sprintf("FlowDone %v", f.Stats.ResponseBytes))
+	addon.done <- f
+}
+
+func TestFlowDone(t *testing.T) {
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/stream" {
+			for i := 0; i < 3; i++ {
+				w.Write([]byte("0123456789"))
+				w.(http.Flusher).Flush()
+				time.Sleep(time.Millisecond * 20)
+			}
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	origin.EnableHTTP2 = false
+	origin.StartTLS()
+	defer origin.Close()
+	plain := httptest.NewServer(origin.Config.Handler)
+	defer plain.Close()
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:          ":29148",
+		SslInsecure:       true,
+		StreamLargeBodies: 16,
+	})
+	handleError(t, err)
+	// CONNECT 不拦截，作为隧道
+	testProxy.SetShouldInterceptRule(func(req *http.Request) bool { return false })
+	addon := &flowDoneAddon{done: make(chan *Flow, 10)}
+	testProxy.AddAddon(addon)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29148")
+			},
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			DisableKeepAlives: true,
+		},
+	}
+	waitDone := func(t *testing.T) {
+		t.Helper()
+		select {
+		case <-addon.done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("FlowDone not called")
+		}
+	}
+
+	for _, u := range []string{plain.URL + "/small", plain.URL + "/stream", origin.URL + "/small"} {
+		res, err := client.Get(u)
+		handleError(t, err)
+		_, err = ioutil.ReadAll(res.Body)
+		handleError(t, err)
+		res.Body.Close()
+		waitDone(t)
+	}
+
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	expected := []string{
+		"GET /small Response",
+		"GET /small FlowDone 2",
+		// stream 的 flow 不触发 Response，FlowDone 时 body 已全部写入客户端
+		"GET /stream FlowDone 30",
+		"CONNECT  Response",
+	}
+	got := addon.events
+	if len(got) != 5 || !strings.HasPrefix(got[4], "CONNECT  FlowDone ") {
+		t.Fatalf("unexpected events %v", got)
+	}
+	for i, e := range expected {
+		if got[i] != e {
+			t.Fatalf("expected %v, but got %v", expected, got)
+		}
+	}
+}
+
+func TestNoProxyMatch(t *testing.T) {
+	p, err := newNoProxy([]string{"corp.example.com", ".internal", "*.dev.example.org", "10.0.0.0/8", "192.168.1.1", "[2001:db8::1]"}, false)
+	handleError(t, err)
+	cases := map[string]bool{
+		"corp.example.com":     true,
+		"a.corp.example.com:8": true,
+		"xcorp.example.com":    false,
+		"db.internal":          true,
+		"api.dev.example.org":  true,
+		"dev.example.org":      false,
+		"10.1.2.3:443":         true,
+		"11.1.2.3":             false,
+		"192.168.1.1":          true,
+		"[2001:db8::1]:443":    true,
+		"localhost:8080":       true,
+		"app.localhost":        true,
+		"127.0.0.1:80":         true,
+		"[::1]:80":             true,
+		"169.254.169.254":      true,
+		"[fe80::1%25lo]:80":    true,
+		"example.com":          false,
+	}
+	for host, expected := range cases {
+		if got := p.match(host); got != expected {
+			t.Fatalf("%v: expected %v, but got %v", host, expected, got)
+		}
+	}
+
+	p, err = newNoProxy(nil, true)
+	handleError(t, err)
+	if p.match("localhost") || p.match("127.0.0.1:80") {
+		t.Fatal("expected loopback to use upstream with ProxyLoopback")
+	}
+	p, err = newNoProxy([]string{"*"}, true)
+	handleError(t, err)
+	if !p.match("example.com") {
+		t.Fatal("expected * to match all")
+	}
+	if _, err := newNoProxy([]string{"10.0.0.0/33"}, false); err == nil {
+		t.Fatal("expected invalid cidr error")
+	}
+}
+
+func TestNoProxy(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("origin"))
+	}))
+	defer origin.Close()
+
+	// 记录经过的请求，CONNECT 直接拒绝
+	var mu sync.Mutex
+	var routed []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		routed = append(routed, r.Method+" "+r.Host)
+		mu.Unlock()
+		if r.Method == "CONNECT" {
+			w.WriteHeader(502)
+			return
+		}
+		w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr: ":29149",
+		Upstream: upstream.URL,
+		NoProxy:  []string{"corp.invalid"},
+	})
+	handleError(t, err)
+	testProxy.SetShouldInterceptRule(func(req *http.Request) bool {
+		return false
+	})
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29149")
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	// loopback 默认直连
+	testSendRequest(t, origin.URL, proxyClient, "origin")
+	testSendRequest(t, "http://example.com/", proxyClient, "upstream")
+	// 直连无法解析的域名
+	res, err := proxyClient.Get("http://api.corp.invalid/")
+	handleError(t, err)
+	res.Body.Close()
+	if res.StatusCode != 502 {
+		t.Fatalf("expected 502, but got %v", res.StatusCode)
+	}
+	if _, err := proxyClient.Get("https://api.corp.invalid/"); err == nil {
+		t.Fatal("should fail as direct connection can not resolve host")
+	}
+	if _, err := proxyClient.Get("https://example.com/"); err == nil {
+		t.Fatal("should fail as upstream proxy rejects CONNECT")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := "GET example.com,CONNECT example.com:443"
+	if strings.Join(routed, ",") != expected {
+		t.Fatalf("expected %v, but got %v", expected, routed)
+	}
+}
+
+// 仅解析 *.test 的 dns 服务器，A 记录为 127.0.0.1
+func startTestDNSServer(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	handleError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			header, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+			name := q.Name.String()
+			b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: header.ID, Response: true, Authoritative: true})
+			b.EnableCompression()
+			if strings.HasSuffix(name, ".test.") && strings.Count(name, ".") == 2 && name != "missing.test." {
+				b.StartQuestions()
+				b.Question(q)
+				if q.Type == dnsmessage.TypeA {
+					b.StartAnswers()
+					b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}, dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}})
+				}
+			} else {
+				b = dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: header.ID, Response: true, RCode: dnsmessage.RCodeNameError})
+				b.StartQuestions()
+				b.Question(q)
+			}
+			msg, err := b.Finish()
+			if err != nil {
+				continue
+			}
+			conn.WriteTo(msg, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// addon for test resolve error
+type resolveErrorAddon struct {
+	BaseAddon
+	mu    sync.Mutex
+	hosts []string
+}
+
+func (addon *resolveErrorAddon) ServerError(f *Flow, err error) *Response {
+	var resolveErr *ResolveError
+	if errors.As(err, &resolveErr) {
+		addon.mu.Lock()
+		addon.hosts = append(addon.hosts, resolveErr.Host)
+		addon.mu.Unlock()
+	}
+	return nil
+}
+
+func TestResolver(t *testing.T) {
+	dnsAddr := startTestDNSServer(t)
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", dnsAddr)
+		},
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.Host)
+		if r.TLS != nil {
+			host += " " + r.TLS.ServerName
+		}
+		io.WriteString(w, host)
+	})
+	httpServer := httptest.NewServer(handler)
+	defer httpServer.Close()
+	tlsServer := httptest.NewTLSServer(handler)
+	defer tlsServer.Close()
+	httpPort := strconv.Itoa(httpServer.Listener.Addr().(*net.TCPAddr).Port)
+	tlsPort := strconv.Itoa(tlsServer.Listener.Addr().(*net.TCPAddr).Port)
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:    ":29150",
+		SslInsecure: true,
+		Resolver:    resolver,
+		DNSCacheTTL: time.Minute,
+	})
+	handleError(t, err)
+	addon := &resolveErrorAddon{}
+	testProxy.AddAddon(addon)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29150")
+			},
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+			},
+			DisableKeepAlives: true,
+		},
+	}
+
+	testSendRequest(t, "http://api.test:"+httpPort+"/", proxyClient, "api.test")
+	// 拦截的 https 连接上游时 SNI 仍为原始的 host
+	testSendRequest(t, "https://web.test:"+tlsPort+"/", proxyClient, "web.test web.test")
+	if stats := testProxy.DNSCacheStats(); stats.Misses != 2 {
+		t.Fatalf("expected 2 dns cache misses, but got %+v", stats)
+	}
+
+	res, err := proxyClient.Get("http://missing.test:" + httpPort + "/")
+	handleError(t, err)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	handleError(t, err)
+	if res.StatusCode != 502 || !strings.Contains(string(body), "resolve upstream host missing.test") {
+		t.Fatalf("expected 502 with resolve error, but got %v %s", res.StatusCode, body)
+	}
+	if _, err := proxyClient.Get("https://missing.test:" + tlsPort + "/"); err == nil || !strings.Contains(err.Error(), "Bad Gateway") {
+		t.Fatalf("expected CONNECT 502, but got %v", err)
+	}
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	if strings.Join(addon.hosts, ",") != "missing.test" {
+		t.Fatalf("unexpected resolve error hosts %v", addon.hosts)
+	}
+
+	// 未设置 IPRule.Resolver 时使用 proxy 的解析器
+	rule, err := NewIPRule([]string{"127.0.0.0/8"}, nil, nil)
+	handleError(t, err)
+	ctx := context.WithValue(context.Background(), connContextKey, &ConnContext{proxy: testProxy})
+	if !rule.Match((&http.Request{Host: "rule.test:443"}).WithContext(ctx)) {
+		t.Fatal("expected ip rule match host resolved by proxy resolver")
+	}
+}
+
+// 按行收集 logger 的输出
+type accessLogWriter struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (w *accessLogWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lines = append(w.lines, strings.TrimSpace(string(p)))
+	return len(p), nil
+}
+
+func (w *accessLogWriter) entries() []map[string]interface{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var entries []map[string]interface{}
+	for _, line := range w.lines {
+		entry := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAccessLog(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer origin.Close()
+	originPort := origin.Listener.Addr().(*net.TCPAddr).Port
+
+	// 用于 CONNECT 连接失败
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	handleError(t, err)
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	_, err = NewProxy(&Options{HttpAddr: ":29151", AccessLogFormat: "xml"})
+	if err == nil {
+		t.Fatal("should reject invalid log format")
+	}
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:             ":29151",
+		AccessLogFormat:      AccessLogFormatJSON,
+		AccessLogLevel:       "info",
+		AccessLog:            true,
+		AccessLogIgnoreHosts: []string{"localhost"},
+		AccessLogFilter: func(f *Flow) bool {
+			return f.Request.URL.Path != "/healthz"
+		},
+	})
+	handleError(t, err)
+	if testProxy.AccessLogger() == log.StandardLogger() {
+		t.Fatal("should not use the global logger")
+	}
+	out := new(accessLogWriter)
+	testProxy.AccessLogger().SetOutput(out)
+	testProxy.SetShouldInterceptRule(func(req *http.Request) bool { return false })
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29151")
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	for _, u := range []string{
+		origin.URL + "/hello",
+		origin.URL + "/healthz",
+		fmt.Sprintf("http://localhost:%v/hello", originPort),
+	} {
+		res, err := client.Get(u)
+		handleError(t, err)
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+
+	conn, err := net.Dial("tcp", "127.0.0.1:29151")
+	handleError(t, err)
+	fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", closedAddr, closedAddr)
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	handleError(t, err)
+	res.Body.Close()
+	conn.Close()
+	if res.StatusCode != 502 {
+		t.Fatalf("expected status 502, got %v", res.StatusCode)
+	}
+
+	// 访问日志在 flow 结束后记录
+	for i := 0; i < 100 && len(out.entries()) < 2; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	time.Sleep(time.Millisecond * 50)
+	entries := out.entries()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 access log entries, got %v", entries)
+	}
+
+	byMethod := make(map[interface{}]map[string]interface{})
+	for _, entry := range entries {
+		byMethod[entry["method"]] = entry
+	}
+	get := byMethod["GET"]
+	if get == nil || get["msg"] != "access" || get["level"] != "info" || get["method"] != "GET" ||
+		get["host"] != origin.Listener.Addr().String() || get["status"] != float64(200) ||
+		get["res_bytes"] != float64(5) {
+		t.Fatalf("unexpected access log %v", get)
+	}
+	for _, key := range []string{"flow", "conn", "url", "req_bytes", "duration_ms"} {
+		if _, ok := get[key]; !ok {
+			t.Fatalf("access log should have %v: %v", key, get)
+		}
+	}
+
+	connect := byMethod["CONNECT"]
+	if connect == nil || connect["level"] != "warning" || connect["status"] != float64(502) ||
+		connect["host"] != closedAddr || connect["error"] == nil {
+		t.Fatalf("unexpected access log %v", connect)
+	}
+}
+
+func grpcFrame(compressed bool, data string) []byte {
+	frame := make([]byte, 5, 5+len(data))
+	if compressed {
+		frame[0] = 1
+	}
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(data)))
+	return append(frame, data...)
+}
+
+func readGrpcFrame(r io.Reader) (bool, string, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return false, "", err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(header[1:]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return false, "", err
+	}
+	return header[0] == 1, string(data), nil
+}
+
+type grpcAddon struct {
+	BaseAddon
+	mu       sync.Mutex
+	messages []string
+	statuses []string
+	done     chan struct{}
+}
+
+func (addon *grpcAddon) Requestheaders(f *Flow) {
+	if f.Request.Header.Get("X-Buffer") != "" {
+		f.Stream = false
+	}
+}
+
+func (addon *grpcAddon) GrpcMessage(f *Flow, isFromClient bool, msg *GrpcMessage) {
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	addon.messages = append(addon.messages, fmt.Sprintf("%v %v %v %s", f.Request.URL.Path, isFromClient, msg.Compressed, msg.Data))
+}
+
+func (addon *grpcAddon) FlowDone(f *Flow) {
+	if f.Response == nil {
+		return
+	}
+	code, message, ok := f.Response.GrpcStatus()
+	addon.mu.Lock()
+	addon.statuses = append(addon.statuses, fmt.Sprintf("%v %v %v %v %v", f.Request.URL.Path, f.Stream, code, message, ok))
+	addon.mu.Unlock()
+	addon.done <- struct{}{}
+}
+
+func (addon *grpcAddon) reset() ([]string, []string) {
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	messages, statuses := addon.messages, addon.statuses
+	addon.messages, addon.statuses = nil, nil
+	return messages, statuses
+}
+
+func TestGrpc(t *testing.T) {
+	// 逐个回复收到的消息
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc+proto")
+		w.WriteHeader(200)
+		w.(http.Flusher).Flush()
+		for {
+			compressed, data, err := readGrpcFrame(r.Body)
+			if err != nil {
+				break
+			}
+			w.Write(grpcFrame(compressed, "echo "+data))
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "all%20done")
+	}))
+	origin.EnableHTTP2 = true
+	origin.StartTLS()
+	defer origin.Close()
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:    ":29152",
+		SslInsecure: true,
+		EnableHTTP2: true,
+	})
+	handleError(t, err)
+	addon := &grpcAddon{done: make(chan struct{}, 1)}
+	testProxy.AddAddon(addon)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			ForceAttemptHTTP2: true,
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29152")
+			},
+		},
+	}
+	waitDone := func(t *testing.T) {
+		t.Helper()
+		select {
+		case <-addon.done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("FlowDone not called")
+		}
+	}
+
+	t.Run("bidi streaming", func(t *testing.T) {
+		pr, pw := io.Pipe()
+		req, err := http.NewRequest("POST", origin.URL+"/echo.Echo/Chat", pr)
+		handleError(t, err)
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("Te", "trailers")
+		go pw.Write(grpcFrame(false, "hello"))
+		res, err := client.Do(req)
+		handleError(t, err)
+		defer res.Body.Close()
+		if res.ProtoMajor != 2 {
+			t.Fatalf("expected http2, got %v", res.Proto)
+		}
+
+		// 收到上一个回复后才发送下一个消息
+		for i, msg := range []string{"hello", "world"} {
+			if i > 0 {
+				go pw.Write(grpcFrame(true, msg))
+			}
+			compressed, data, err := readGrpcFrame(res.Body)
+			handleError(t, err)
+			if compressed != (i > 0) || data != "echo "+msg {
+				t.Fatalf("unexpected message %v %v", compressed, data)
+			}
+		}
+		pw.Close()
+		if _, err := ioutil.ReadAll(res.Body); err != nil {
+			t.Fatal(err)
+		}
+		if res.Trailer.Get("Grpc-Status") != "0" {
+			t.Fatalf("expected grpc-status trailer, got %v", res.Trailer)
+		}
+		waitDone(t)
+
+		messages, statuses := addon.reset()
+		expected := []string{
+			"/echo.Echo/Chat true false hello",
+			"/echo.Echo/Chat false false echo hello",
+			"/echo.Echo/Chat true true world",
+			"/echo.Echo/Chat false true echo world",
+		}
+		if strings.Join(messages, ",") != strings.Join(expected, ",") {
+			t.Fatalf("expected messages %v, got %v", expected, messages)
+		}
+		if strings.Join(statuses, ",") != "/echo.Echo/Chat true 0 all done true" {
+			t.Fatalf("unexpected grpc status %v", statuses)
+		}
+	})
+
+	t.Run("unary buffered", func(t *testing.T) {
+		body := append(grpcFrame(false, "a"), grpcFrame(false, "b")...)
+		req, err := http.NewRequest("POST", origin.URL+"/echo.Echo/Unary", bytes.NewReader(body))
+		handleError(t, err)
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("X-Buffer", "1")
+		res, err := client.Do(req)
+		handleError(t, err)
+		resBody, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		handleError(t, err)
+		if !bytes.Equal(resBody, append(grpcFrame(false, "echo a"), grpcFrame(false, "echo b")...)) {
+			t.Fatalf("unexpected response body %q", resBody)
+		}
+		if res.Trailer.Get("Grpc-Status") != "0" {
+			t.Fatalf("expected grpc-status trailer, got %v", res.Trailer)
+		}
+		waitDone(t)
+
+		messages, statuses := addon.reset()
+		expected := []string{
+			"/echo.Echo/Unary true false a",
+			"/echo.Echo/Unary true false b",
+			"/echo.Echo/Unary false false echo a",
+			"/echo.Echo/Unary false false echo b",
+		}
+		if strings.Join(messages, ",") != strings.Join(expected, ",") {
+			t.Fatalf("expected messages %v, got %v", expected, messages)
+		}
+		if strings.Join(statuses, ",") != "/echo.Echo/Unary false 0 all done true" {
+			t.Fatalf("unexpected grpc status %v", statuses)
+		}
+	})
+}
+
+func TestGrpcMessageReader(t *testing.T) {
+	body := append(grpcFrame(false, "first"), grpcFrame(true, "too large message")...)
+	body = append(body, grpcFrame(false, "")...)
+	body = append(body, grpcFrame(true, "last")...)
+
+	var got []string
+	r := &grpcMessageReader{
+		r:     iotest.OneByteReader(bytes.NewReader(body)),
+		limit: 8,
+		onMessage: func(msg *GrpcMessage) {
+			got = append(got, fmt.Sprintf("%v %s", msg.Compressed, msg.Data))
+		},
+	}
+	forwarded, err := ioutil.ReadAll(r)
+	handleError(t, err)
+	if !bytes.Equal(forwarded, body) {
+		t.Fatal("body should be forwarded unchanged")
+	}
+	if strings.Join(got, ",") != "false first,false ,true last" {
+		t.Fatalf("unexpected messages %v", got)
+	}
+
+	msgs, err := ParseGrpcMessages(body[:len(body)-2])
+	if err != ErrGrpcFrameTruncated || len(msgs) != 3 || string(msgs[1].Data) != "too large message" {
+		t.Fatalf("unexpected parse result %v %v", msgs, err)
+	}
+	if !IsGrpc(http.Header{"Content-Type": {"application/grpc+proto"}}) || IsGrpc(http.Header{"Content-Type": {"application/grpc-web"}}) {
+		t.Fatal("unexpected IsGrpc result")
+	}
+}
+
+func TestCookies(t *testing.T) {
+	req := &Request{Header: http.Header{"Cookie": {"a=1; b=2", "c=3"}}}
+	req.SetCookie(&http.Cookie{Name: "b", Value: "20", Path: "/ignored"})
+	req.SetCookie(&http.Cookie{Name: "d", Value: "4"})
+	if got := req.Header.Values("Cookie"); len(got) != 1 || got[0] != "a=1; b=20; c=3; d=4" {
+		t.Fatalf("unexpected Cookie header %v", got)
+	}
+	if cookies := req.Cookies(); len(cookies) != 4 || cookies[1].Name != "b" || cookies[1].Value != "20" {
+		t.Fatalf("unexpected cookies %v", cookies)
+	}
+
+	res := &Response{Header: http.Header{"Set-Cookie": {
+		"session=abc; Path=/; Domain=.example.com; Secure; HttpOnly; SameSite=Strict",
+		"theme=dark; Max-Age=0",
+		"id=1; Expires=Wed, 21 Oct 2037 07:28:00 GMT; SameSite=None; Secure",
+	}}}
+	cookies := res.Cookies()
+	if len(cookies) != 3 {
+		t.Fatalf("expected 3 cookies, got %v", cookies)
+	}
+	session, theme, id := cookies[0], cookies[1], cookies[2]
+	if strings.TrimPrefix(session.Domain, ".") != "example.com" || !session.Secure || !session.HttpOnly || session.SameSite != http.SameSiteStrictMode || session.Path != "/" {
+		t.Fatalf("unexpected cookie %#v", session)
+	}
+	if theme.MaxAge != -1 {
+		t.Fatalf("expected MaxAge -1, got %v", theme.MaxAge)
+	}
+	if id.Expires.Year() != 2037 || id.SameSite != http.SameSiteNoneMode || !id.Secure {
+		t.Fatalf("unexpected cookie %#v", id)
+	}
+
+	res.SetCookie(&http.Cookie{Name: "session", Value: "xyz", Path: "/", Domain: "example.com", HttpOnly: true})
+	res.SetCookie(&http.Cookie{Name: "session", Value: "other", Path: "/admin"})
+	got := res.Header.Values("Set-Cookie")
+	expected := []string{
+		"theme=dark; Max-Age=0",
+		"id=1; Expires=Wed, 21 Oct 2037 07:28:00 GMT; SameSite=None; Secure",
+		"session=xyz; Path=/; Domain=example.com; HttpOnly",
+		"session=other; Path=/admin",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected Set-Cookie %q, got %q", expected, got)
+	}
+}
+
+type tagClassifier struct {
+	BaseAddon
+}
+
+func (*tagClassifier) Requestheaders(f *Flow) {
+	if strings.HasPrefix(f.Request.URL.Path, "/api/") {
+		f.SetTag("type", "api")
+	}
+}
+
+type tagConsumer struct {
+	BaseAddon
+}
+
+func (*tagConsumer) Response(f *Flow) {
+	if f.Tag("type") == "api" {
+		f.Response.Header.Set("X-Type", "api")
+	}
+}
+
+func TestFlowTags(t *testing.T) {
+	f := newFlow()
+	if f.HasTag("type") || f.Tag("type") != "" {
+		t.Fatal("new flow should have no tags")
+	}
+	f.SetTag("cached", "")
+	if !f.HasTag("cached") {
+		t.Fatal("empty tag value should still be present")
+	}
+	f.DeleteTag("cached")
+	if f.HasTag("cached") {
+		t.Fatal("tag should be deleted")
+	}
+
+	testProxy, err := NewProxy(&Options{})
+	handleError(t, err)
+	testProxy.AddAddon(&tagClassifier{})
+	testProxy.AddAddon(&tagConsumer{})
+	testProxy.SetLoopbackUpstream(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	for _, path := range []string{"/api/user", "/static/app.js"} {
+		req, err := http.NewRequest("GET", "http://example.com"+path, nil)
+		handleError(t, err)
+		res, err := testProxy.RoundTrip(req)
+		handleError(t, err)
+		res.Body.Close()
+		expected := ""
+		if path == "/api/user" {
+			expected = "api"
+		}
+		if res.Header.Get("X-Type") != expected {
+			t.Fatalf("expected X-Type %q for %v, got %q", expected, path, res.Header.Get("X-Type"))
+		}
+	}
+
+	f.SetTag("type", "api")
+	data, err := json.Marshal(f)
+	handleError(t, err)
+	if !strings.Contains(string(data), `"tags":{"type":"api"}`) {
+		t.Fatalf("flow json should contain tags: %s", data)
+	}
+}
+
+func TestSelectCA(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	other, err := cert.NewCAMemory()
+	handleError(t, err)
+	cacheDir := t.TempDir()
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:     ":29154",
+		SslInsecure:  true,
+		CertCacheDir: cacheDir,
+		CAs:          []*cert.CA{other},
+		SelectCA: func(sni string) *cert.CA {
+			if strings.HasSuffix(sni, ".other.test") {
+				return other
+			}
+			return nil
+		},
+	})
+	handleError(t, err)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	root := testProxy.GetCertificate()
+	roots := testProxy.GetCertificates()
+	if len(roots) != 2 || !roots[0].Equal(&root) || !roots[1].Equal(&other.RootCert) {
+		t.Fatalf("unexpected roots %v", roots)
+	}
+
+	// 按 sni 选择 CA，以对应的根证书校验
+	get := func(t *testing.T, sni string, root *x509.Certificate) *x509.Certificate {
+		t.Helper()
+		pool := x509.NewCertPool()
+		pool.AddCert(root)
+		proxyClient := &http.Client{
+			Transport: &http.Transport{
+				Proxy: func(r *http.Request) (*url.URL, error) {
+					return url.Parse("http://127.0.0.1:29154")
+				},
+				TLSClientConfig:   &tls.Config{RootCAs: pool, ServerName: sni},
+				DisableKeepAlives: true,
+			},
+		}
+		res, err := proxyClient.Get(server.URL)
+		handleError(t, err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		handleError(t, err)
+		if string(body) != "ok" {
+			t.Fatalf("expected ok, but got %s", body)
+		}
+		return res.TLS.PeerCertificates[0]
+	}
+
+	leaf := get(t, "api.example.test", &roots[0])
+	otherLeaf := get(t, "api.other.test", &roots[1])
+	if leaf.CheckSignatureFrom(&roots[0]) != nil || otherLeaf.CheckSignatureFrom(&roots[1]) != nil {
+		t.Fatal("expected certs issued by selected ca")
+	}
+
+	// 同一 host 由不同 CA 签发的证书分别缓存
+	testProxy.Opts.SelectCA = func(sni string) *cert.CA { return other }
+	if c := get(t, "api.example.test", &roots[1]); c.CheckSignatureFrom(&roots[1]) != nil {
+		t.Fatal("expected cert issued by other ca")
+	}
+	testProxy.Opts.SelectCA = nil
+	if c := get(t, "api.example.test", &roots[0]); !c.Equal(leaf) {
+		t.Fatal("expected cached cert of default ca")
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, caCacheSubdir(other), "api.other.test.pem")); err != nil {
+		t.Fatalf("expected cert of other ca saved in subdir: %v", err)
+	}
+}
+
+type replayRecorder struct {
+	BaseAddon
+	flows []*Flow
+}
+
+func (r *replayRecorder) Response(f *Flow) {
+	r.flows = append(r.flows, f)
+}
+
+func TestReplay(t *testing.T) {
+	testProxy := newLoopbackProxy(t)
+	recorder := &replayRecorder{}
+	testProxy.AddAddon(recorder)
+
+	f, res := func() (*Flow, *http.Response) {
+		req, _ := http.NewRequest("POST", "http://example.com/path?q=1", strings.NewReader("hello"))
+		res, err := testProxy.RoundTrip(req)
+		handleError(t, err)
+		return recorder.flows[0], res
+	}()
+	res.Body.Close()
+	if f.IsReplay {
+		t.Fatal("captured flow should not be replay")
+	}
+
+	// 修改后重发，不修改原 flow
+	f.Request.Body = []byte("world")
+	response, err := testProxy.Replay(f)
+	handleError(t, err)
+	if expected := "POST /path?q=1 request world modified"; string(response.Body) != expected {
+		t.Fatalf("expected %q, but got %q", expected, string(response.Body))
+	}
+	if len(recorder.flows) != 2 || !recorder.flows[1].IsReplay || recorder.flows[1] == f {
+		t.Fatal("replay should run addons with new flow")
+	}
+	if f.Request.Header.Get("X-Addon") != "request" || recorder.flows[1].Request.Header.Get("X-Addon") != "request" {
+		t.Fatal("expected Request addon called")
+	}
+
+	// 没有 body 的 flow，如反序列化得到的 flow
+	loaded := &Flow{Request: &Request{Method: "GET", URL: f.Request.URL, Header: http.Header{"Host": {"other.example.com"}}}}
+	response, err = testProxy.Replay(loaded)
+	handleError(t, err)
+	if expected := "GET /path?q=1 request  modified"; string(response.Body) != expected {
+		t.Fatalf("expected %q, but got %q", expected, string(response.Body))
+	}
+	if response.Header.Get("X-Upstream-Host") != "example.com" {
+		t.Fatalf("expected url host, but got %v", response.Header.Get("X-Upstream-Host"))
+	}
+
+	if _, err := testProxy.Replay(&Flow{Request: &Request{Method: "CONNECT", URL: &url.URL{Host: "example.com:443"}}}); err == nil {
+		t.Fatal("expected error for CONNECT flow")
+	}
+
+	// 请求上游失败
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	handleError(t, err)
+	closed.Close()
+	errProxy, err := NewProxy(&Options{})
+	handleError(t, err)
+	u, _ := url.Parse("http://" + closed.Addr().String() + "/")
+	if _, err := errProxy.Replay(&Flow{Request: &Request{Method: "GET", URL: u, Header: http.Header{}}}); err == nil {
+		t.Fatal("expected upstream error")
+	}
+}
+
+func TestHopHeaders(t *testing.T) {
+	newProxy := func(preserve []string) (*Proxy, *http.Header) {
+		testProxy, err := NewProxy(&Options{PreserveHeaders: preserve})
+		handleError(t, err)
+		received := new(http.Header)
+		testProxy.SetLoopbackUpstream(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			*received = r.Header.Clone()
+			w.Header().Set("Keep-Alive", "timeout=5")
+			w.Header().Set("Connection", "X-Hop")
+			w.Header().Set("X-Hop", "1")
+			w.Header().Set("X-End", "1")
+			w.Write([]byte("ok"))
+		}))
+		return testProxy, received
+	}
+	newRequest := func() *http.Request {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		req.Header.Set("Proxy-Connection", "keep-alive")
+		req.Header.Set("Proxy-Authorization", "Basic dXNlcjpwYXNz")
+		req.Header.Set("Connection", "keep-alive, X-Custom")
+		req.Header.Set("X-Custom", "1")
+		req.Header.Set("Keep-Alive", "timeout=5")
+		req.Header.Set("Te", "trailers, deflate")
+		req.Header.Set("X-End", "1")
+		return req
+	}
+
+	testProxy, received := newProxy(nil)
+	res, err := testProxy.RoundTrip(newRequest())
+	handleError(t, err)
+	res.Body.Close()
+	for _, name := range []string{"Proxy-Connection", "Proxy-Authorization", "Connection", "X-Custom", "Keep-Alive"} {
+		if v := received.Get(name); v != "" {
+			t.Fatalf("%v should not reach upstream, but got %v", name, v)
+		}
+	}
+	if received.Get("X-End") != "1" || received.Get("Te") != "trailers" {
+		t.Fatalf("unexpected upstream header %v", *received)
+	}
+	for _, name := range []string{"Keep-Alive", "Connection", "X-Hop"} {
+		if v := res.Header.Get(name); v != "" {
+			t.Fatalf("%v should not reach client, but got %v", name, v)
+		}
+	}
+	if res.Header.Get("X-End") != "1" {
+		t.Fatalf("unexpected response header %v", res.Header)
+	}
+
+	testProxy, received = newProxy([]string{"proxy-authorization", "X-Custom"})
+	res, err = testProxy.RoundTrip(newRequest())
+	handleError(t, err)
+	res.Body.Close()
+	if received.Get("Proxy-Authorization") == "" || received.Get("X-Custom") != "1" || received.Get("Proxy-Connection") != "" {
+		t.Fatalf("unexpected upstream header with PreserveHeaders %v", *received)
+	}
+
+	// 协议升级保留 Connection、Upgrade
+	h := http.Header{"Connection": {"keep-alive, Upgrade"}, "Upgrade": {"websocket"}, "Proxy-Connection": {"keep-alive"}}
+	newPreserveHeaders(nil).removeRequestHopHeaders(h)
+	if h.Get("Connection") != "Upgrade" || h.Get("Upgrade") != "websocket" || h.Get("Proxy-Connection") != "" {
+		t.Fatalf("unexpected upgrade header %v", h)
+	}
+}
+
+func TestUpstreamPool(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	testProxy, err := NewProxy(&Options{
+		HttpAddr:            ":29156",
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     time.Minute,
+	})
+	handleError(t, err)
+	transport := testProxy.client.Transport.(*socksTransport)
+	if transport.MaxIdleConns != 100 || transport.MaxIdleConnsPerHost != 10 || transport.IdleConnTimeout != time.Minute {
+		t.Fatal("expected pool options applied to transport")
+	}
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29156")
+			},
+		},
+	}
+	for i := 0; i < 3; i++ {
+		res, err := proxyClient.Get(server.URL)
+		handleError(t, err)
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	if stats := testProxy.UpstreamPoolStats(); stats.NewConns != 1 || stats.ReusedConns != 2 {
+		t.Fatalf("expected 1 new conn and 2 reused, but got %+v", stats)
+	}
+}
+
+type separateClientReasonAddon struct {
+	BaseAddon
+	target  string
+	mu      sync.Mutex
+	reasons []string
+	reused  []bool
+
+	flowAddrs []string // FlowStats.ServerRemoteAddr
+	connAddrs []string // ServerConn.RemoteAddr
+}
+
+func (a *separateClientReasonAddon) Requestheaders(f *Flow) {
+	switch f.Request.URL.Path {
+	case "/forced":
+		f.UseSeparateClient = true
+	case "/redirect":
+		f.Request.URL.Host = a.target
+	}
+}
+
+func (a *separateClientReasonAddon) Response(f *Flow) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.reasons = append(a.reasons, f.Request.URL.Path+":"+f.SeparateClientReason)
+	a.reused = append(a.reused, f.ConnContext.ServerConn.Reused())
+	a.flowAddrs = append(a.flowAddrs, f.Stats.ServerRemoteAddr.String())
+	a.connAddrs = append(a.connAddrs, f.ConnContext.ServerConn.RemoteAddr().String())
+}
+
+func TestSeparateClientReason(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("target"))
+	}))
+	defer target.Close()
+
+	testProxy, err := NewProxy(&Options{HttpAddr: ":29157"})
+	handleError(t, err)
+	addon := &separateClientReasonAddon{target: target.Listener.Addr().String()}
+	testProxy.AddAddon(addon)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29157")
+			},
+		},
+	}
+	for _, path := range []string{"/", "/", "/forced", "/redirect"} {
+		res, err := proxyClient.Get(server.URL + path)
+		handleError(t, err)
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if path == "/redirect" && string(body) != "target" {
+			t.Fatalf("expected request redirected to target, but got %s", body)
+		}
+	}
+
+	addon.mu.Lock()
+	defer addon.mu.Unlock()
+	expected := "/:,/:,/forced:forced,/redirect:host_changed"
+	if got := strings.Join(addon.reasons, ","); got != expected {
+		t.Fatalf("expected %v, but got %v", expected, got)
+	}
+	if addon.reused[0] || !addon.reused[1] {
+		t.Fatalf("expected second request reuse server conn, but got %v", addon.reused)
+	}
+	// 共享的 client 使用的连接只记录在 flow 上
+	serverAddr, targetAddr := server.Listener.Addr().String(), target.Listener.Addr().String()
+	expected = strings.Join([]string{serverAddr, serverAddr, serverAddr, targetAddr}, ",")
+	if got := strings.Join(addon.flowAddrs, ","); got != expected {
+		t.Fatalf("expected flow addrs %v, but got %v", expected, got)
+	}
+	expected = strings.Join([]string{serverAddr, serverAddr, serverAddr, serverAddr}, ",")
+	if got := strings.Join(addon.connAddrs, ","); got != expected {
+		t.Fatalf("expected server conn addrs %v, but got %v", expected, got)
+	}
+}
+
+func TestShutdownDrainFlows(t *testing.T) {
+	echoLn, err := net.Listen("tcp", "127.0.0.1:0")
+	handleError(t, err)
+	defer echoLn.Close()
+	go func() {
+		for {
+			conn, err := echoLn.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	startProxy := func() *Proxy {
+		p, err := NewProxy(&Options{HttpAddr: ":29158"})
+		handleError(t, err)
+		p.SetShouldInterceptRule(func(req *http.Request) bool {
+			return false
+		})
+		go p.Start()
+		time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+		return p
+	}
+	// 经 CONNECT 隧道连接 echo server，proxy.server.Shutdown 不等待 hijack 的连接
+	dialTunnel := func() net.Conn {
+		conn, err := net.Dial("tcp", "127.0.0.1:29158")
+		handleError(t, err)
+		fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", echoLn.Addr(), echoLn.Addr())
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		handleError(t, err)
+		if res.StatusCode != 200 {
+			t.Fatalf("expected 200, but got %v", res.StatusCode)
+		}
+		return conn
+	}
+	echo := func(conn net.Conn, msg string) error {
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			return err
+		}
+		buf := make([]byte, len(msg))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		defer conn.SetReadDeadline(time.Time{})
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return err
+		}
+		if string(buf) != msg {
+			return fmt.Errorf("expected %q, but got %q", msg, buf)
+		}
+		return nil
+	}
+
+	t.Run("wait in-flight tunnel", func(t *testing.T) {
+		testProxy := startProxy()
+		defer testProxy.Close()
+		conn := dialTunnel()
+		handleError(t, echo(conn, "ping"))
+
+		shutdownErr := make(chan error, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+			defer cancel()
+			shutdownErr <- testProxy.Shutdown(ctx)
+		}()
+		time.Sleep(time.Millisecond * 50)
+		select {
+		case err := <-shutdownErr:
+			t.Fatalf("expected shutdown to wait for tunnel, but returned %v", err)
+		default:
+		}
+		if _, err := net.Dial("tcp", "127.0.0.1:29158"); err == nil {
+			t.Fatal("expected new connection refused")
+		}
+		handleError(t, echo(conn, "pong"))
+
+		conn.Close()
+		select {
+		case err := <-shutdownErr:
+			handleError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("shutdown not returned after tunnel closed")
+		}
+	})
+
+	t.Run("force close after deadline", func(t *testing.T) {
+		testProxy := startProxy()
+		defer testProxy.Close()
+		conn := dialTunnel()
+		defer conn.Close()
+		handleError(t, echo(conn, "ping"))
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+		defer cancel()
+		if err := testProxy.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected deadline exceeded, but got %v", err)
+		}
+		if err := echo(conn, "pong"); err == nil {
+			t.Fatal("expected tunnel closed")
+		}
+	})
+}
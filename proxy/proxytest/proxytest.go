@@ -0,0 +1,48 @@
+// Package proxytest 提供 addon 测试工具，不需要监听端口及启动真实的上游服务器
+package proxytest
+
+import (
+	"net/http"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+)
+
+// 记录经过 addon 流程的 flow
+type flowRecorder struct {
+	proxy.BaseAddon
+	flow *proxy.Flow
+}
+
+func (r *flowRecorder) Requestheaders(f *proxy.Flow) {
+	r.flow = f
+}
+
+// 通过进程内回环模式的 proxy 发送 req，经过 addon 的完整流程后由 upstream 处理
+// req 需为绝对 URL，如 http://example.com/path，upstream 为 nil 时返回 404
+// 返回 addon 处理过的 flow 及客户端收到的响应，请求失败时响应为 nil
+func RunAddon(addon proxy.Addon, req *http.Request, upstream http.Handler) (*proxy.Flow, *http.Response) {
+	return RunAddons([]proxy.Addon{addon}, req, upstream)
+}
+
+// 与 RunAddon 相同，addons 按顺序添加
+func RunAddons(addons []proxy.Addon, req *http.Request, upstream http.Handler) (*proxy.Flow, *http.Response) {
+	p, err := proxy.NewProxy(&proxy.Options{})
+	if err != nil {
+		panic(err)
+	}
+	recorder := &flowRecorder{}
+	p.AddAddon(recorder)
+	for _, addon := range addons {
+		p.AddAddon(addon)
+	}
+	if upstream == nil {
+		upstream = http.NotFoundHandler()
+	}
+	p.SetLoopbackUpstream(upstream)
+
+	res, err := p.RoundTrip(req)
+	if err != nil {
+		return recorder.flow, nil
+	}
+	return recorder.flow, res
+}
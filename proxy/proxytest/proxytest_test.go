@@ -0,0 +1,63 @@
+package proxytest
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+)
+
+type headerAddon struct {
+	proxy.BaseAddon
+}
+
+func (a *headerAddon) Request(f *proxy.Flow) {
+	f.Request.Header.Set("X-Addon", "request")
+}
+
+func (a *headerAddon) Response(f *proxy.Flow) {
+	f.Response.Body = append(f.Response.Body, []byte(" modified")...)
+}
+
+func TestRunAddon(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://example.com/path", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, res := RunAddon(&headerAddon{}, req, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host+" "+r.URL.Path+" "+r.Header.Get("X-Addon"))
+	}))
+	if res == nil {
+		t.Fatal("expected response")
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "example.com /path request modified"; string(body) != expected {
+		t.Fatalf("expected %q, but got %q", expected, string(body))
+	}
+	if f == nil || f.Response == nil || f.Response.StatusCode != 200 {
+		t.Fatalf("unexpected flow %+v", f)
+	}
+	if f.Request.Header.Get("X-Addon") != "request" {
+		t.Fatal("expected flow request modified by addon")
+	}
+}
+
+func TestRunAddonNilUpstream(t *testing.T) {
+	req, err := http.NewRequest("GET", "http://example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, res := RunAddon(&proxy.BaseAddon{}, req, nil)
+	if res == nil || res.StatusCode != 404 {
+		t.Fatalf("expected 404 response, but got %v", res)
+	}
+	if f.Response.StatusCode != 404 {
+		t.Fatalf("expected flow response 404, but got %v", f.Response.StatusCode)
+	}
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// 重新发送已捕获的 flow（可在发送前修改 Request），用于复现问题或实现工具中的重发功能
+// 以 f.Request 构造请求，通过进程内回环模式（见 Proxy.RoundTrip）交给 ServeHTTP 处理，与客户端发出的请求经过相同的上游选择及 addon 流程
+// 重发的请求生成新的 flow，Flow.IsReplay 为 true，原 flow 不会被修改
+
+// Proxy.Replay 记录重发生成的 flow，与 upstreamHostCtxKey 相同，不能使用 new(struct{})
+type replayCtxKeyType struct{}
+
+var replayCtxKey = replayCtxKeyType{}
+
+type replayResult struct {
+	flow *Flow
+}
+
+// 重发 f.Request 并返回上游的响应，触发 Requestheaders、Request、Response 等 addon 事件
+// f.Request.Body 为 nil 时不发送 body，stream 模式的 flow 未保存 body，重发时同样没有 body
+// 请求上游失败或被 addon Abort 时返回新 flow 的 Flow.Err
+func (proxy *Proxy) Replay(f *Flow) (*Response, error) {
+	if f == nil || f.Request == nil || f.Request.URL == nil {
+		return nil, errors.New("replay: flow has no request")
+	}
+	if f.Request.Method == "CONNECT" {
+		return nil, errors.New("replay: cannot replay CONNECT flow")
+	}
+
+	var body io.Reader
+	if len(f.Request.Body) > 0 {
+		body = bytes.NewReader(f.Request.Body)
+	}
+	result := &replayResult{}
+	ctx := context.WithValue(context.Background(), replayCtxKey, result)
+	req, err := http.NewRequestWithContext(ctx, f.Request.Method, f.Request.URL.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = f.Request.Header.Clone()
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+	}
+
+	res, err := proxy.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if result.flow != nil && result.flow.Err != nil {
+		return nil, result.flow.Err
+	}
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	response := &Response{
+		StatusCode: res.StatusCode,
+		Proto:      res.Proto,
+		Header:     res.Header,
+		Body:       resBody,
+
+		maxDecodedSize: proxy.Opts.MaxDecompressedSize,
+	}
+	if result.flow != nil && result.flow.Response != nil {
+		response.Proto = result.flow.Response.Proto
+		response.Trailer = result.flow.Response.Trailer
+	}
+	return response, nil
+}
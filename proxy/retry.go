@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Options.MaxRetries: 幂等请求遇到连接被拒绝、重置等临时错误时重新连接上游并重试
+// 仅当请求 body 已读取（非 stream 模式）时可重放，重试不会再次触发 addon 事件
+
+// https://datatracker.ietf.org/doc/html/rfc7231#section-4.2.2
+func isIdempotentMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+func (proxy *Proxy) retryable(f *Flow) bool {
+	return proxy.Opts.MaxRetries > 0 && !f.Stream && isIdempotentMethod(f.Request.Method)
+}
+
+// StreamRequestModifier 可能返回任意 reader，读取至内存以便 http.NewRequest 设置 GetBody 用于重放
+func replayableBody(body io.Reader) (io.Reader, error) {
+	if body == nil {
+		return nil, nil
+	}
+	if _, ok := body.(*bytes.Reader); ok {
+		return body, nil
+	}
+	buf, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(buf), nil
+}
+
+// 首次请求失败后按 Options.RetryBackoff 退避重试，重试使用新的上游连接
+// 返回最后一次的结果
+func (proxy *Proxy) retryUpstream(f *Flow, req *http.Request, err error) (*http.Response, error) {
+	backoff := proxy.Opts.RetryBackoff
+	if backoff <= 0 {
+		backoff = connectRetryBackoff
+	}
+	// 请求被取消（如 Options.UpstreamTimeout 超时）时不重试
+	for retry := 0; retry < proxy.Opts.MaxRetries && isTransientDialError(err) && req.Context().Err() == nil; retry++ {
+		log.Debugf("%v %v failed: %v, retry %v after %v", req.Method, req.URL, err, retry+1, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-req.Context().Done():
+			return nil, err
+		}
+		if backoff *= 2; backoff > maxConnectRetryBackoff {
+			backoff = maxConnectRetryBackoff
+		}
+
+		retryReq := req.Clone(req.Context())
+		if req.GetBody != nil {
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return nil, err
+			}
+			retryReq.Body = body
+		}
+		var res *http.Response
+		if f.ConnContext.loopback != nil {
+			res, err = f.ConnContext.loopback.RoundTrip(retryReq)
+		} else {
+			res, err = proxy.client.Do(retryReq)
+		}
+		if err == nil {
+			return res, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// 反向代理模式: 客户端直接请求 proxy，相对 URL 的请求转发至 Options.ReverseProxyUpstream，经过完整的 addon 流程
+
+func parseReverseProxyUpstream(upstream string) (*url.URL, error) {
+	if upstream == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("parse reverse proxy upstream: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid reverse proxy upstream %v, should be like http://host:port", upstream)
+	}
+	return u, nil
+}
+
+// 将相对 URL 的请求改写为指向上游，保留 path 及 query
+// 客户端的 Host 记录在 Header 中，发往上游的 Host 由 Options.PreferHostHeader 决定
+func (proxy *Proxy) rewriteReverseRequest(req *http.Request) {
+	target := proxy.reverseUpstream
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	if target.Path != "" && target.Path != "/" {
+		req.URL.Path = strings.TrimSuffix(target.Path, "/") + "/" + strings.TrimPrefix(req.URL.Path, "/")
+		if req.URL.RawPath != "" {
+			req.URL.RawPath = strings.TrimSuffix(target.EscapedPath(), "/") + "/" + strings.TrimPrefix(req.URL.RawPath, "/")
+		}
+	}
+	if req.Host != "" && req.Host != target.Host {
+		req.Header.Set("Host", req.Host)
+	}
+}
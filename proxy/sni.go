@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 按 tls ClientHello 中的 SNI 决定是否拦截，SNI 可能与 CONNECT 的 host 不同（如 CONNECT 使用 ip）
+// 设置后 CONNECT 隧道都先进入 middle，预读 ClientHello 后调用 rule，返回 true 时拦截，返回 false 时将原始连接直接转发至上游
+// 没有 SNI（包括不是 tls 的流量）时使用 SetShouldInterceptRule 的结果
+func (proxy *Proxy) SetShouldInterceptBySNI(rule func(connCtx *ConnContext, sni string) bool) {
+	proxy.shouldInterceptBySNI = rule
+}
+
+// 返回 ClientHello 中的 SNI，不消耗数据，没有 SNI 时返回空字符串
+func peekSNI(r *bufio.Reader) (string, error) {
+	hello, err := peekClientHello(r)
+	if err != nil {
+		return "", err
+	}
+	return hello.serverName, nil
+}
+
+// 设置了 SetShouldInterceptBySNI 时，决定 middle 中的连接是否拦截
+// tls 为 false 时不读取 SNI，直接使用 SetShouldInterceptRule 的结果
+func (m *middle) shouldIntercept(pipeServerConn *pipeConn, tls bool) bool {
+	connCtx := pipeServerConn.connContext
+	if !tls {
+		return connCtx.Intercept
+	}
+	pipeServerConn.SetReadDeadline(time.Now().Add(clientHelloPeekTimeout))
+	sni, err := peekSNI(pipeServerConn.r)
+	pipeServerConn.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Debugf("peek sni error: %v", err)
+	}
+	if sni == "" {
+		return connCtx.Intercept
+	}
+	intercept := m.proxy.shouldInterceptBySNI(connCtx, sni)
+	log.Debugf("sni %v intercept: %v", sni, intercept)
+	connCtx.Intercept = intercept
+	return intercept
+}
+
+// 不拦截，将客户端的原始连接转发至上游
+func (m *middle) passthrough(pipeServerConn *pipeConn) {
+	connCtx := pipeServerConn.connContext
+	log := log.WithField("in", "middle.passthrough").WithField("host", pipeServerConn.host)
+	defer pipeServerConn.Close()
+
+	// Options.UpstreamCert 为 true 时已在 middle.dial 中连接上游
+	var serverConn net.Conn
+	if connCtx.ServerConn != nil && connCtx.ServerConn.Conn != nil {
+		serverConn = connCtx.ServerConn.Conn
+	} else {
+		conn, err := m.proxy.getUpstreamConn(pipeServerConn.connectReq)
+		if err != nil {
+			logErr(log, err)
+			return
+		}
+		serverConn = conn
+	}
+	defer serverConn.Close()
+
+	log.Debugf("begin transpond %v", pipeServerConn.host)
+	transfer(log, serverConn, pipeServerConn, 0)
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 基于 StreamRequestModifier/StreamResponseModifier 的流式 body 转换
+// 转换器为 io.ReadWriteCloser：proxy 将原始 body 写入（Write），写入完毕后调用 Close，并从 Read 读取转换后的 body
+
+// 返回 nil 时表示不转换此 flow
+type StreamTransformerFactory func(f *Flow) io.ReadWriteCloser
+
+// 请求 body 在非 stream 模式下同样会转换（转换的是发送给上游的 body，f.Request.Body 不变）
+// 响应 body 仅在 stream 模式下转换
+type StreamTransform struct {
+	BaseAddon
+	RequestTransformer  StreamTransformerFactory
+	ResponseTransformer StreamTransformerFactory
+
+	mu   sync.Mutex
+	jobs map[*Flow][]*transformJob
+}
+
+func (st *StreamTransform) StreamRequestModifier(f *Flow, in io.Reader) io.Reader {
+	return st.transform(f, in, st.RequestTransformer)
+}
+
+func (st *StreamTransform) StreamResponseModifier(f *Flow, in io.Reader) io.Reader {
+	return st.transform(f, in, st.ResponseTransformer)
+}
+
+// 在 ServeHTTP 返回前停止读取原始 body，并等待写入转换器的 goroutine 结束
+func (st *StreamTransform) FlowDone(f *Flow) {
+	st.mu.Lock()
+	jobs := st.jobs[f]
+	delete(st.jobs, f)
+	st.mu.Unlock()
+	for _, job := range jobs {
+		job.stop()
+	}
+}
+
+func (st *StreamTransform) transform(f *Flow, in io.Reader, factory StreamTransformerFactory) io.Reader {
+	if in == nil || factory == nil {
+		return in
+	}
+	t := factory(f)
+	if t == nil {
+		return in
+	}
+
+	job := &transformJob{
+		in:   &cancelReader{r: in},
+		out:  &transformReader{t: t},
+		done: make(chan struct{}),
+	}
+	st.mu.Lock()
+	if st.jobs == nil {
+		st.jobs = make(map[*Flow][]*transformJob)
+	}
+	st.jobs[f] = append(st.jobs[f], job)
+	st.mu.Unlock()
+
+	go func() {
+		defer close(job.done)
+		_, err := io.Copy(t, job.in)
+		if err != nil {
+			log.Debugf("stream transform copy: %v", err)
+		}
+		if err := t.Close(); err != nil {
+			log.Debugf("stream transform close: %v", err)
+		}
+	}()
+	return job.out
+}
+
+type transformJob struct {
+	in   *cancelReader
+	out  *transformReader
+	done chan struct{}
+}
+
+// 转换结果可能仍未读取完毕（如客户端已断开），继续读取并丢弃，避免转换器阻塞写入
+// 正在进行的读取返回后不再读取原始 body
+func (job *transformJob) stop() {
+	job.in.cancel()
+	job.out.drain()
+	<-job.done
+}
+
+var errStreamTransformCanceled = errors.New("stream transform canceled")
+
+type cancelReader struct {
+	r        io.Reader
+	canceled int32
+}
+
+func (r *cancelReader) Read(p []byte) (int, error) {
+	if atomic.LoadInt32(&r.canceled) == 1 {
+		return 0, errStreamTransformCanceled
+	}
+	return r.r.Read(p)
+}
+
+func (r *cancelReader) cancel() {
+	atomic.StoreInt32(&r.canceled, 1)
+}
+
+type transformReader struct {
+	t    io.Reader
+	mu   sync.Mutex
+	done bool
+}
+
+func (r *transformReader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n, err := r.t.Read(p)
+	if err != nil {
+		r.done = true
+	}
+	return n, err
+}
+
+func (r *transformReader) drain() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done {
+		return
+	}
+	io.Copy(io.Discard, r.t)
+	r.done = true
+}
+
+// 按行转换，fn 的参数包含行尾的 '\n'（最后一行可能没有）
+func NewLineTransformer(fn func(line []byte) []byte) io.ReadWriteCloser {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	go func() {
+		r := bufio.NewReader(inR)
+		for {
+			line, err := r.ReadBytes('\n')
+			if len(line) > 0 {
+				if _, werr := outW.Write(fn(line)); werr != nil {
+					inR.CloseWithError(werr)
+					return
+				}
+			}
+			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				outW.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	return &lineTransformer{in: inW, out: outR}
+}
+
+type lineTransformer struct {
+	in  *io.PipeWriter
+	out *io.PipeReader
+}
+
+func (t *lineTransformer) Write(p []byte) (int, error) { return t.in.Write(p) }
+func (t *lineTransformer) Read(p []byte) (int, error)  { return t.out.Read(p) }
+func (t *lineTransformer) Close() error                { return t.in.Close() }
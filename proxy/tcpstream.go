@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 拦截的 CONNECT 隧道中不是 tls 的流量（如 mqtt、数据库协议，明文的 ws 见 webSocket.ws），以原始字节流交给 Addon.TcpStream
+// addon 处理完成后，proxy 转发两个方向剩余的数据
+
+// 等待客户端发送首个数据的时间，超时视为服务端先发送数据的协议（如 smtp、mysql），按 tcp 流处理
+const tcpPeekTimeout = time.Second
+
+// 读取客户端的前 n 个字节，不消耗数据，超过 tcpPeekTimeout 未读取到时返回 timeout 为 true
+func peekClient(pipeServerConn *pipeConn, n int) (buf []byte, timeout bool, err error) {
+	pipeServerConn.SetReadDeadline(time.Now().Add(tcpPeekTimeout))
+	defer pipeServerConn.SetReadDeadline(time.Time{})
+	buf, err = pipeServerConn.Peek(n)
+	var netErr net.Error
+	if err != nil && errors.As(err, &netErr) && netErr.Timeout() {
+		return buf, true, nil
+	}
+	return buf, false, err
+}
+
+func (m *middle) tcpStream(pipeServerConn *pipeConn) {
+	f := pipeServerConn.flow
+	connCtx := pipeServerConn.connContext
+	log := log.WithField("in", "middle.tcpStream").WithField("host", pipeServerConn.host)
+	defer pipeServerConn.Close()
+
+	// Options.UpstreamCert 为 true 时已在 middle.dial 中连接上游
+	if connCtx.ServerConn == nil || connCtx.ServerConn.Conn == nil {
+		if err := connCtx.initServerTcpConn(pipeServerConn.connectReq); err != nil {
+			logErr(log, err)
+			return
+		}
+	}
+	serverConn := connCtx.ServerConn.Conn
+	defer serverConn.Close()
+
+	// addon 可能在其中读写整个连接，耗时统计包括读写的时间
+	for _, addon := range m.proxy.Addons {
+		m.proxy.invokeAddon(f, addon, "TcpStream", func() { addon.TcpStream(f, pipeServerConn, serverConn) })
+	}
+	transfer(log, serverConn, pipeServerConn, 0)
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// 请求上游超过 Options.UpstreamTimeout 时返回此错误，proxy 将响应 504
+var ErrUpstreamTimeout = errors.New("upstream timeout")
+
+// Options.UpstreamTimeout 的计时器，超时后取消上游请求
+// 从发送请求开始计时，至读取完整的响应 body 或转为 stream 模式时停止，stream 的响应 body 不受限制
+type upstreamTimer struct {
+	timeout time.Duration
+	timer   *time.Timer
+	expired int32
+}
+
+// d 为 0 时返回 nil，nil 的 upstreamTimer 可直接调用
+func newUpstreamTimer(d time.Duration, cancel context.CancelFunc) *upstreamTimer {
+	if d <= 0 {
+		return nil
+	}
+	t := &upstreamTimer{timeout: d}
+	t.timer = time.AfterFunc(d, func() {
+		atomic.StoreInt32(&t.expired, 1)
+		cancel()
+	})
+	return t
+}
+
+func (t *upstreamTimer) stop() {
+	if t != nil {
+		t.timer.Stop()
+	}
+}
+
+// 超时导致请求失败时，将 err 包装为 ErrUpstreamTimeout
+func (t *upstreamTimer) wrap(err error) error {
+	if t == nil || atomic.LoadInt32(&t.expired) == 0 {
+		return err
+	}
+	return fmt.Errorf("%w after %v: %v", ErrUpstreamTimeout, t.timeout, err)
+}
+
+// 请求上游失败且 Addon.ServerError 均返回 nil 时响应客户端，超时及解析上游 host 失败时 body 为错误信息
+func upstreamErrorResponse(err error) *Response {
+	var resolveErr *ResolveError
+	if !errors.Is(err, ErrUpstreamTimeout) && !errors.As(err, &resolveErr) {
+		return &Response{StatusCode: requestErrorStatus(err), Header: make(http.Header)}
+	}
+	return &Response{
+		StatusCode: requestErrorStatus(err),
+		Header: http.Header{
+			"Content-Type": []string{"text/plain; charset=utf-8"},
+		},
+		Body: []byte(err.Error()),
+	}
+}
+
+// CONNECT 隧道超过 Options.TunnelIdleTimeout 未传输数据时关闭，addon 可在 Addon.Response 中通过 Flow.Err 获取
+var ErrTunnelIdleTimeout = errors.New("tunnel idle timeout")
+
+// Options.TunnelIdleTimeout 的读取 deadline，任一方向读取到数据时顺延两端连接的 deadline
+// 超时后读取返回 os.ErrDeadlineExceeded，transfer 随之结束
+type idleDeadline struct {
+	timeout time.Duration
+	conns   []interface{ SetReadDeadline(time.Time) error }
+	expired int32
+}
+
+// d 为 0 或连接不支持 deadline 时返回 nil，nil 的 idleDeadline 可直接调用
+func newIdleDeadline(d time.Duration, conns ...io.ReadWriteCloser) *idleDeadline {
+	if d <= 0 {
+		return nil
+	}
+	t := &idleDeadline{timeout: d}
+	for _, c := range conns {
+		dc, ok := c.(interface{ SetReadDeadline(time.Time) error })
+		if !ok {
+			return nil
+		}
+		t.conns = append(t.conns, dc)
+	}
+	t.extend()
+	return t
+}
+
+func (t *idleDeadline) extend() {
+	deadline := time.Now().Add(t.timeout)
+	for _, c := range t.conns {
+		c.SetReadDeadline(deadline)
+	}
+}
+
+func (t *idleDeadline) reader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &idleReader{r: r, t: t}
+}
+
+func (t *idleDeadline) timedOut() bool {
+	return t != nil && atomic.LoadInt32(&t.expired) == 1
+}
+
+type idleReader struct {
+	r io.Reader
+	t *idleDeadline
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.t.extend()
+	}
+	if err != nil && errors.Is(err, os.ErrDeadlineExceeded) {
+		atomic.StoreInt32(&r.t.expired, 1)
+	}
+	return n, err
+}
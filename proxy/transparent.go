@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 透明代理模式: iptables REDIRECT 至 proxy 端口，客户端不发送 CONNECT 及绝对 URL
+// 通过 SO_ORIGINAL_DST 获取连接的原始目标地址:
+//   1. 首个字节为 tls handshake 时，视为 CONNECT 至原始目标地址，进入 handleConnect
+//   2. 否则作为普通 http 连接交给 proxy.server，相对 URL 的请求指向原始目标地址
+
+// 可在测试中替换
+var originalDst = getOriginalDst
+
+// tls record type handshake
+const tlsRecordTypeHandshake = 0x16
+
+type transparentListener struct {
+	net.Listener // *wrapListener
+	proxy        *Proxy
+
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	startOnce sync.Once
+	closeOnce sync.Once
+}
+
+func newTransparentListener(ln net.Listener, proxy *Proxy) *transparentListener {
+	return &transparentListener{
+		Listener: ln,
+		proxy:    proxy,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+func (l *transparentListener) Accept() (net.Conn, error) {
+	l.startOnce.Do(func() {
+		go l.acceptLoop()
+	})
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *transparentListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return l.Listener.Close()
+}
+
+func (l *transparentListener) acceptLoop() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go l.handle(c.(*wrapClientConn))
+	}
+}
+
+// 识别连接类型，读取首个字节时受 ReadHeaderTimeout 限制
+func (l *transparentListener) handle(c *wrapClientConn) {
+	dst, err := originalDst(c.Conn)
+	if err != nil {
+		log.Warnf("transparent: %v from %v", err, c.RemoteAddr())
+		c.Conn.Close()
+		c.releaseLimit()
+		return
+	}
+	c.originalDst = dst
+
+	if timeout := l.proxy.server.ReadHeaderTimeout; timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	first := make([]byte, 1)
+	if _, err := c.Conn.Read(first); err != nil {
+		log.Debugf("transparent: read first byte from %v: %v", c.RemoteAddr(), err)
+		c.Conn.Close()
+		c.releaseLimit()
+		return
+	}
+	c.Conn.SetReadDeadline(time.Time{})
+	c.peeked = first
+
+	if first[0] == tlsRecordTypeHandshake {
+		l.proxy.serveTransparentTLS(c)
+		return
+	}
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		c.Conn.Close()
+		c.releaseLimit()
+	}
+}
+
+// 与 proxy.server 的 ConnContext 相同，为不经过 proxy.server 的 tls 连接创建 ConnContext 后，按 CONNECT 处理
+func (proxy *Proxy) serveTransparentTLS(c *wrapClientConn) {
+	connCtx := newConnContext(c, proxy)
+	connCtx.ClientConn.OriginalDst = c.originalDst
+	for _, addon := range proxy.Addons {
+		proxy.invokeConnAddon(addon, "ClientConnected", func() { addon.ClientConnected(connCtx.ClientConn) })
+	}
+	c.connCtx = connCtx
+	defer c.Close()
+
+	ctx := context.WithValue(context.Background(), connContextKey, connCtx)
+	req := (&http.Request{
+		Method:     "CONNECT",
+		URL:        &url.URL{Host: c.originalDst},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       c.originalDst,
+		RemoteAddr: c.RemoteAddr().String(),
+	}).WithContext(ctx)
+	proxy.handleConnect(&transparentResponse{conn: c}, req)
+}
+
+// 透明代理模式下的 CONNECT 不需要响应客户端，出错时 handleConnect 写入的状态码被忽略
+type transparentResponse struct {
+	conn   net.Conn
+	header http.Header
+}
+
+func (r *transparentResponse) Header() http.Header {
+	if r.header == nil {
+		r.header = make(http.Header)
+	}
+	return r.header
+}
+
+func (r *transparentResponse) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (r *transparentResponse) WriteHeader(statusCode int) {
+	log.Debugf("transparent: connect %v to %v failed with status %v", r.conn.RemoteAddr(), r.conn.(*wrapClientConn).originalDst, statusCode)
+}
+
+// 将透明代理模式下相对 URL 的请求指向原始目标地址，优先使用 Host header 中的域名
+func rewriteTransparentRequest(req *http.Request, dst string) {
+	req.URL.Scheme = "http"
+	host := req.Host
+	if host == "" {
+		req.URL.Host = dst
+		return
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		if _, port, err := net.SplitHostPort(dst); err == nil && port != "80" {
+			host = net.JoinHostPort(strings.Trim(host, "[]"), port)
+		}
+	}
+	req.URL.Host = host
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// linux/netfilter_ipv4.h SO_ORIGINAL_DST，linux/netfilter_ipv6/ip6_tables.h IP6T_SO_ORIGINAL_DST
+const soOriginalDst = 80
+
+// 读取被 iptables REDIRECT 的连接的原始目标地址
+func getOriginalDst(conn net.Conn) (string, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", errors.New("original dst: not a tcp connection")
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+
+	isIPv4 := true
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		isIPv4 = false
+	}
+
+	var dst string
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if isIPv4 {
+			// struct sockaddr_in 的长度不超过 IPv6Mreq
+			mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			b := mreq.Multiaddr
+			ip := net.IPv4(b[4], b[5], b[6], b[7])
+			port := int(b[2])<<8 | int(b[3])
+			dst = net.JoinHostPort(ip.String(), strconv.Itoa(port))
+			return
+		}
+		// struct sockaddr_in6 的长度不超过 IPv6MTUInfo
+		info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		p := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+		port := int(p[0])<<8 | int(p[1])
+		dst = net.JoinHostPort(net.IP(info.Addr.Addr[:]).String(), strconv.Itoa(port))
+	})
+	if err != nil {
+		return "", err
+	}
+	if sockErr != nil {
+		return "", sockErr
+	}
+	return dst, nil
+}
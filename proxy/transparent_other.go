@@ -0,0 +1,12 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+func getOriginalDst(conn net.Conn) (string, error) {
+	return "", errors.New("original dst: transparent mode is only supported on linux")
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Options.HttpAddr 以 unix: 开头时监听 unix socket，如 unix:/var/run/go-mitmproxy.sock
+// 启动时删除上次未正常退出遗留的 socket 文件，Close、Shutdown 时由 net.UnixListener 删除
+
+const unixAddrPrefix = "unix:"
+
+func unixSocketPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, unixAddrPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, unixAddrPrefix), true
+}
+
+func listenHttp(addr string) (net.Listener, error) {
+	path, ok := unixSocketPath(addr)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
+
+// 仍有进程监听的 socket 文件不删除
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("listen unix %v: file exists and is not a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("listen unix %v: address already in use", path)
+	}
+	return os.Remove(path)
+}
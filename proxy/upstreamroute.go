@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/tidwall/match"
+)
+
+// 根据目标 host 选择上游代理，未匹配时直连
+// 规则支持:
+//
+//	api.example.com          精确匹配
+//	*.internal.example.com   通配符，同 Options.InsecureHosts
+//	.example.com             后缀，匹配 example.com 及其子域名
+//
+// 多条规则匹配时，精确匹配优先，其次为更长的规则
+type RoutingUpstream struct {
+	routes []*upstreamRoute
+}
+
+type upstreamRoute struct {
+	pattern  string
+	exact    bool
+	proxyUrl *url.URL // 为 nil 时直连
+}
+
+// routes 的 key 为 host 规则，value 为上游代理地址，如 http://corp-proxy:8080、socks5://127.0.0.1:1080，为空或 direct 时直连
+func NewRoutingUpstream(routes map[string]string) (*RoutingUpstream, error) {
+	r := &RoutingUpstream{routes: make([]*upstreamRoute, 0, len(routes))}
+	for pattern, addr := range routes {
+		route := &upstreamRoute{
+			pattern: strings.ToLower(pattern),
+			exact:   !strings.HasPrefix(pattern, ".") && !match.IsPattern(pattern),
+		}
+		if addr != "" && addr != "direct" {
+			proxyUrl, err := url.Parse(addr)
+			if err != nil {
+				return nil, fmt.Errorf("upstream for %v: %w", pattern, err)
+			}
+			route.proxyUrl = proxyUrl
+		}
+		r.routes = append(r.routes, route)
+	}
+	sort.SliceStable(r.routes, func(i, j int) bool {
+		if r.routes[i].exact != r.routes[j].exact {
+			return r.routes[i].exact
+		}
+		if len(r.routes[i].pattern) != len(r.routes[j].pattern) {
+			return len(r.routes[i].pattern) > len(r.routes[j].pattern)
+		}
+		return r.routes[i].pattern < r.routes[j].pattern
+	})
+	return r, nil
+}
+
+func (route *upstreamRoute) match(host string) bool {
+	if route.exact {
+		return host == route.pattern
+	}
+	if strings.HasPrefix(route.pattern, ".") {
+		return host == route.pattern[1:] || strings.HasSuffix(host, route.pattern)
+	}
+	return match.Match(host, route.pattern)
+}
+
+// 用于 Proxy.SetUpstreamProxy
+func (r *RoutingUpstream) Proxy(req *http.Request) (*url.URL, error) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for _, route := range r.routes {
+		if route.match(host) {
+			return route.proxyUrl, nil
+		}
+	}
+	return nil, nil
+}
+
+// 按目标 host 设置上游代理，同时作用于拦截的请求及未拦截的 CONNECT 隧道，见 RoutingUpstream
+func (proxy *Proxy) SetUpstreamProxyForHost(routes map[string]string) error {
+	r, err := NewRoutingUpstream(routes)
+	if err != nil {
+		return err
+	}
+	proxy.SetUpstreamProxy(r.Proxy)
+	return nil
+}
@@ -1,67 +1,342 @@
 package proxy
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
-// 当前仅做了转发 websocket 流量
+// 拦截的 wss 及 CONNECT 隧道中明文的 ws 会解析 websocket 消息并交给 Addon.WebSocketMessage 处理
+// 升级成功（101）后触发 Addon.WebSocketStart，连接关闭后触发 Addon.WebSocketEnd
 
-type webSocket struct{}
+type webSocket struct {
+	proxy *Proxy
+}
 
-var defaultWebSocket webSocket
+func (s *webSocket) wss(res http.ResponseWriter, req *http.Request) {
+	log := log.WithField("in", "webSocket.wss").WithField("host", req.Host)
 
-func (s *webSocket) ws(conn net.Conn, host string) {
-	log := log.WithField("in", "webSocket.ws").WithField("host", host)
+	f := newFlow()
+	f.Request = newRequest(req)
+	f.ConnContext = req.Context().Value(connContextKey).(*ConnContext)
+	s.proxy.flows.add(f)
+	defer s.proxy.finishFlow(f)
 
-	defer conn.Close()
-	remoteConn, err := net.Dial("tcp", host)
+	cconn, brw, err := res.(http.Hijacker).Hijack()
 	if err != nil {
-		logErr(log, err)
+		log.Errorf("Hijack: %v\n", err)
+		res.WriteHeader(502)
 		return
 	}
-	defer remoteConn.Close()
-	transfer(log, conn, remoteConn)
+	defer cconn.Close()
+
+	s.serve(log, f, req, cconn, brw.Reader, func() (net.Conn, error) {
+		host := req.Host
+		if !strings.Contains(host, ":") {
+			host = host + ":443"
+		}
+		plainConn, err := s.proxy.dialUpstream(context.Background(), "tcp", host)
+		if err != nil {
+			return nil, err
+		}
+		serverName, _, _ := net.SplitHostPort(host)
+		conn := tls.Client(plainConn, s.proxy.newTlsClientConfigForHost(serverName))
+		if err := conn.HandshakeContext(context.Background()); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("tls handshake: %w", err)
+		}
+		return conn, nil
+	})
 }
 
-func (s *webSocket) wss(res http.ResponseWriter, req *http.Request) {
-	log := log.WithField("in", "webSocket.wss").WithField("host", req.Host)
+// 拦截的 CONNECT 隧道中明文的 ws，req 为 peekWebSocketUpgrade 读取的升级请求，上游与 middle.tcpStream 相同
+func (s *webSocket) ws(pipeServerConn *pipeConn, req *http.Request) {
+	log := log.WithField("in", "webSocket.ws").WithField("host", pipeServerConn.host)
+	connCtx := pipeServerConn.connContext
+	defer pipeServerConn.Close()
+
+	req.RemoteAddr = pipeServerConn.remoteAddr
+	req.URL.Scheme = "http"
+	req.URL.Host = req.Host
+	if req.URL.Host == "" {
+		req.URL.Host = pipeServerConn.host
+	}
+
+	f := newFlow()
+	f.Request = newRequest(req)
+	f.ConnContext = connCtx
+	s.proxy.flows.add(f)
+	defer s.proxy.finishFlow(f)
+
+	s.serve(log, f, req, pipeServerConn, pipeServerConn.r, func() (net.Conn, error) {
+		// Options.UpstreamCert 为 true 时已在 middle.dial 中连接上游
+		if connCtx.ServerConn == nil || connCtx.ServerConn.Conn == nil {
+			if err := connCtx.initServerTcpConn(pipeServerConn.connectReq); err != nil {
+				return nil, err
+			}
+		}
+		return connCtx.ServerConn.Conn, nil
+	})
+}
+
+// Connection 中包含 upgrade 即可，如 Firefox 发送 Connection: keep-alive, Upgrade
+func isWebSocketUpgrade(h http.Header) bool {
+	return strings.EqualFold(upgradeType(h), "websocket")
+}
+
+// 拦截的 CONNECT 隧道中客户端以 GET 开头时，读取请求头判断是否为明文 ws 的升级请求
+// 是时消耗请求头并返回解析的请求，否则不消耗数据并返回 nil，按 tcp 流处理
+// 请求头超过 pipeConn 的缓冲区或 tcpPeekTimeout 内未读取完整时同样按 tcp 流处理
+func peekWebSocketUpgrade(pipeServerConn *pipeConn) *http.Request {
+	r := pipeServerConn.r
+	if r.Buffered() < 3 {
+		return nil
+	}
+	if buf, _ := r.Peek(3); string(buf) != "GET" {
+		return nil
+	}
+
+	pipeServerConn.SetReadDeadline(time.Now().Add(tcpPeekTimeout))
+	defer pipeServerConn.SetReadDeadline(time.Time{})
+	for {
+		buf, _ := r.Peek(r.Buffered())
+		if i := bytes.Index(buf, []byte("\r\n\r\n")); i >= 0 {
+			req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:i+4])))
+			if err != nil || !isWebSocketUpgrade(req.Header) {
+				return nil
+			}
+			r.Discard(i + 4)
+			return req
+		}
+		if r.Buffered() >= r.Size() {
+			return nil
+		}
+		// 等待客户端发送更多数据
+		if _, err := r.Peek(r.Buffered() + 1); err != nil {
+			return nil
+		}
+	}
+}
+
+// 转发升级请求及响应，升级成功后在两个方向解析并转发消息，直到任一方向结束
+// cconn 为客户端连接，clientReader 读取 cconn 中未处理的数据，dial 返回与上游服务器的连接
+func (s *webSocket) serve(log *log.Entry, f *Flow, req *http.Request, cconn net.Conn, clientReader *bufio.Reader, dial func() (net.Conn, error)) {
+	// 不支持 permessage-deflate 等扩展，否则无法解析消息内容
+	req.Header.Del("Sec-WebSocket-Extensions")
+
+	// trigger addon event Requestheaders
+	for _, addon := range s.proxy.Addons {
+		s.proxy.invokeAddon(f, addon, "Requestheaders", func() { addon.Requestheaders(f) })
+		if f.aborted != nil {
+			s.abort(log, f, cconn)
+			return
+		}
+		if f.Response != nil {
+			for _, addon := range s.proxy.Addons {
+				s.proxy.invokeAddon(f, addon, "Response", func() { addon.Response(f) })
+			}
+			s.reply(log, f.Response, cconn)
+			return
+		}
+	}
 
 	upgradeBuf, err := httputil.DumpRequest(req, false)
 	if err != nil {
 		log.Errorf("DumpRequest: %v\n", err)
-		res.WriteHeader(502)
+		s.serverError(log, f, err, cconn)
 		return
 	}
 
-	cconn, _, err := res.(http.Hijacker).Hijack()
+	conn, err := dial()
 	if err != nil {
-		log.Errorf("Hijack: %v\n", err)
-		res.WriteHeader(502)
+		log.Errorf("dial: %v\n", err)
+		s.serverError(log, f, err, cconn)
 		return
 	}
-	defer cconn.Close()
+	defer conn.Close()
 
-	host := req.Host
-	if !strings.Contains(host, ":") {
-		host = host + ":443"
-	}
-	conn, err := tls.Dial("tcp", host, nil)
+	_, err = conn.Write(upgradeBuf)
 	if err != nil {
-		log.Errorf("tls.Dial: %v\n", err)
+		log.Errorf("websocket upgrade: %v\n", err)
+		s.serverError(log, f, err, cconn)
 		return
 	}
-	defer conn.Close()
 
-	_, err = conn.Write(upgradeBuf)
+	serverReader := bufio.NewReader(conn)
+	upgradeRes, err := http.ReadResponse(serverReader, req)
 	if err != nil {
-		log.Errorf("wss upgrade: %v\n", err)
+		log.Errorf("websocket upgrade response: %v\n", err)
+		s.serverError(log, f, err, cconn)
+		return
+	}
+	f.Response = &Response{
+		StatusCode: upgradeRes.StatusCode,
+		Proto:      upgradeRes.Proto,
+		Header:     upgradeRes.Header,
+	}
+
+	// trigger addon event Responseheaders
+	for _, addon := range s.proxy.Addons {
+		s.proxy.invokeAddon(f, addon, "Responseheaders", func() { addon.Responseheaders(f) })
+	}
+
+	if upgradeRes.StatusCode != http.StatusSwitchingProtocols {
+		// 服务器拒绝升级，转发响应后结束
+		if err := upgradeRes.Write(cconn); err != nil {
+			logErr(log, err)
+		}
+		return
+	}
+
+	var head bytes.Buffer
+	fmt.Fprintf(&head, "%v %v\r\n", upgradeRes.Proto, upgradeRes.Status)
+	upgradeRes.Header.Write(&head)
+	head.WriteString("\r\n")
+	if _, err := cconn.Write(head.Bytes()); err != nil {
+		logErr(log, err)
 		return
 	}
-	transfer(log, conn, cconn)
+
+	// trigger addon event WebSocketStart
+	for _, addon := range s.proxy.Addons {
+		s.proxy.invokeAddon(f, addon, "WebSocketStart", func() { addon.WebSocketStart(f) })
+	}
+
+	errChan := make(chan error, 2)
+	go func() {
+		errChan <- s.pump(f, true, clientReader, conn)
+	}()
+	go func() {
+		errChan <- s.pump(f, false, serverReader, cconn)
+	}()
+	// 任一方向结束时关闭两端连接
+	err = <-errChan
+	if err != nil && err != io.EOF {
+		logErr(log, err)
+	}
+	conn.Close()
+	cconn.Close()
+	<-errChan
+
+	// trigger addon event WebSocketEnd
+	for _, addon := range s.proxy.Addons {
+		s.proxy.invokeAddon(f, addon, "WebSocketEnd", func() { addon.WebSocketEnd(f) })
+	}
+}
+
+// 升级前 addon 中止 flow，statusCode > 0 时响应该状态码，之后关闭客户端连接
+func (s *webSocket) abort(log *log.Entry, f *Flow, cconn net.Conn) {
+	err := f.aborted
+	f.Err = err
+	log.Infof("aborted: %v", err.Reason)
+	for _, addon := range s.proxy.Addons {
+		s.proxy.invokeAddon(f, addon, "Error", func() { addon.Error(f, err) })
+	}
+	if err.StatusCode > 0 {
+		s.reply(log, &Response{StatusCode: err.StatusCode}, cconn)
+	}
+}
+
+// 连接上游或升级失败，与 http 请求相同经过 Addon.Error、Addon.ServerError、Addon.Response 后响应客户端
+func (s *webSocket) serverError(log *log.Entry, f *Flow, err error, cconn net.Conn) {
+	s.proxy.upstreamError(f, err)
+	s.reply(log, f.Response, cconn)
+}
+
+// 客户端连接已被接管，直接写入 http/1.1 响应，之后由调用方关闭连接
+func (s *webSocket) reply(log *log.Entry, response *Response, cconn net.Conn) {
+	res := &http.Response{
+		StatusCode: response.StatusCode,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Close:      true,
+	}
+	for key, value := range response.Header {
+		res.Header[key] = value
+	}
+	switch {
+	case response.Body != nil:
+		res.Body = ioutil.NopCloser(bytes.NewReader(response.Body))
+		res.ContentLength = int64(len(response.Body))
+	case response.BodyReader != nil:
+		res.Body = ioutil.NopCloser(response.BodyReader)
+		res.ContentLength = -1
+	}
+	if err := res.Write(cconn); err != nil {
+		logErr(log, err)
+	}
+}
+
+// 从 src 读取消息，交给 addon 处理后写入 dst
+func (s *webSocket) pump(f *Flow, fromClient bool, src *bufio.Reader, dst io.Writer) error {
+	for {
+		m, err := readWsMessage(src, func(fr *wsFrame) error {
+			msg := &WebSocketMessage{FromClient: fromClient, Type: int(fr.opcode), Payload: fr.payload}
+			if !s.message(f, msg, true) {
+				return nil
+			}
+			fr.payload = msg.Payload
+			return writeWsFrame(dst, fr, fromClient)
+		})
+		if err != nil {
+			return err
+		}
+
+		msg := &WebSocketMessage{FromClient: fromClient, Type: m.msgType, Payload: m.data}
+		if !s.message(f, msg, false) {
+			continue
+		}
+		// 合并后的消息作为单个帧发送
+		fr := &wsFrame{fin: true, rsv: m.rsv, opcode: byte(m.msgType), payload: msg.Payload}
+		if err := writeWsFrame(dst, fr, fromClient); err != nil {
+			return err
+		}
+	}
+}
+
+// 返回 false 时丢弃该消息
+func (s *webSocket) message(f *Flow, msg *WebSocketMessage, control bool) bool {
+	for _, addon := range s.proxy.Addons {
+		if control {
+			if ca, ok := addon.(WebSocketControlAddon); !ok || !ca.WebSocketControlFrames() {
+				continue
+			}
+		}
+
+		if s.proxy.dryRun(addon) {
+			// 交给 addon 的是副本，只记录修改
+			dryMsg := &WebSocketMessage{FromClient: msg.FromClient, Type: msg.Type, Payload: cloneBytes(msg.Payload)}
+			s.proxy.invokeAddon(f, addon, "WebSocketMessage", func() { addon.WebSocketMessage(f, dryMsg) })
+			if dryMsg.dropped {
+				log.Infof("dry run, would drop: %T WebSocketMessage", addon)
+			} else if !bytes.Equal(dryMsg.Payload, msg.Payload) {
+				log.Infof("dry run, would modify: %T WebSocketMessage", addon)
+			}
+			continue
+		}
+		s.proxy.invokeAddon(f, addon, "WebSocketMessage", func() { addon.WebSocketMessage(f, msg) })
+		if msg.dropped {
+			log.Debugf("%T dropped websocket message", addon)
+			return false
+		}
+	}
+
+	// 控制帧 payload 不能超过 125 字节
+	if control && len(msg.Payload) > 125 {
+		log.Warnf("websocket control frame payload truncated to 125 bytes")
+		msg.Payload = msg.Payload[:125]
+	}
+	return true
 }
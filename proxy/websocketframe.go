@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// RFC 6455 帧的解析及重新封装，用于将 websocket 消息交给 addon 处理
+
+// 与 github.com/gorilla/websocket 中的消息类型一致
+const (
+	WebSocketTextMessage   = 1
+	WebSocketBinaryMessage = 2
+	WebSocketCloseMessage  = 8
+	WebSocketPingMessage   = 9
+	WebSocketPongMessage   = 10
+)
+
+const wsContinuationFrame = 0
+
+// 单条消息（合并分片后）的最大字节数
+const maxWebSocketMessageSize = 32 * 1024 * 1024
+
+var errWebSocketMessageTooLarge = errors.New("websocket message too large")
+
+// 拦截的 ws、wss 连接中的一条完整消息（已合并分片），见 Addon.WebSocketMessage
+type WebSocketMessage struct {
+	FromClient bool   // true 为客户端发往服务器
+	Type       int    // 消息类型（opcode），如 WebSocketTextMessage，只读
+	Payload    []byte // addon 可修改或替换，发往服务器的帧在 addon 返回后重新 mask
+
+	dropped bool
+}
+
+// 丢弃该消息，不转发，之后的 addon 也不会收到
+func (msg *WebSocketMessage) Drop() {
+	msg.dropped = true
+}
+
+func (msg *WebSocketMessage) Dropped() bool {
+	return msg.dropped
+}
+
+// addon 实现此接口并返回 true 时，Addon.WebSocketMessage 也会收到 ping、pong、close 控制帧
+type WebSocketControlAddon interface {
+	WebSocketControlFrames() bool
+}
+
+type wsFrame struct {
+	fin     bool
+	rsv     byte // RSV1-3，位于首字节的 0x70
+	opcode  byte
+	payload []byte
+}
+
+func (fr *wsFrame) isControl() bool {
+	return fr.opcode&0x08 != 0
+}
+
+func readWsFrame(r *bufio.Reader) (*wsFrame, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	fr := &wsFrame{
+		fin:    header[0]&0x80 != 0,
+		rsv:    header[0] & 0x70,
+		opcode: header[0] & 0x0f,
+	}
+	masked := header[1]&0x80 != 0
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > maxWebSocketMessageSize {
+		return nil, errWebSocketMessageTooLarge
+	}
+
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, key[:]); err != nil {
+			return nil, err
+		}
+	}
+	fr.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, fr.payload); err != nil {
+		return nil, err
+	}
+	if masked {
+		maskBytes(key, fr.payload)
+	}
+	return fr, nil
+}
+
+// 客户端发往服务器的帧必须 mask
+func writeWsFrame(w io.Writer, fr *wsFrame, mask bool) error {
+	var buf bytes.Buffer
+	b0 := fr.rsv | fr.opcode
+	if fr.fin {
+		b0 |= 0x80
+	}
+	buf.WriteByte(b0)
+
+	var b1 byte
+	if mask {
+		b1 = 0x80
+	}
+	length := len(fr.payload)
+	switch {
+	case length <= 125:
+		buf.WriteByte(b1 | byte(length))
+	case length <= 0xffff:
+		buf.WriteByte(b1 | 126)
+		binary.Write(&buf, binary.BigEndian, uint16(length))
+	default:
+		buf.WriteByte(b1 | 127)
+		binary.Write(&buf, binary.BigEndian, uint64(length))
+	}
+
+	payload := fr.payload
+	if mask {
+		var key [4]byte
+		if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+			return err
+		}
+		buf.Write(key[:])
+		payload = append([]byte(nil), payload...)
+		maskBytes(key, payload)
+	}
+	buf.Write(payload)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func maskBytes(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i%4]
+	}
+}
+
+// 合并分片后的消息
+type wsMessage struct {
+	msgType int
+	rsv     byte
+	data    []byte
+}
+
+// 读取下一条完整消息，期间收到的控制帧交给 onControl 处理
+func readWsMessage(r *bufio.Reader, onControl func(fr *wsFrame) error) (*wsMessage, error) {
+	var msg *wsMessage
+	for {
+		fr, err := readWsFrame(r)
+		if err != nil {
+			return nil, err
+		}
+		if fr.isControl() {
+			if err := onControl(fr); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if fr.opcode == wsContinuationFrame {
+			if msg == nil {
+				return nil, fmt.Errorf("websocket continuation frame without start")
+			}
+			msg.data = append(msg.data, fr.payload...)
+		} else {
+			if msg != nil {
+				return nil, fmt.Errorf("websocket new message before previous one finished")
+			}
+			msg = &wsMessage{msgType: int(fr.opcode), rsv: fr.rsv, data: fr.payload}
+		}
+		if len(msg.data) > maxWebSocketMessageSize {
+			return nil, errWebSocketMessageTooLarge
+		}
+		if fr.fin {
+			return msg, nil
+		}
+	}
+}
@@ -0,0 +1,422 @@
+package script
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+	"go.starlark.net/starlark"
+)
+
+// 通过 Starlark 脚本查看及修改 flow，类似 mitmproxy 的 python 脚本
+// 脚本中可定义以下函数，参数为 flow:
+//   requestheaders(flow), request(flow), responseheaders(flow), response(flow)
+//
+// flow 的属性:
+//   flow.id
+//   flow.request.method, flow.request.url, flow.request.headers, flow.request.body
+//   flow.response.status_code, flow.response.headers, flow.response.body
+// 其中 headers 为 dict，多个值以 ", " 连接；body 为解压后的内容，尚未读取时为 None
+//
+// 沙箱: 脚本无法访问文件、网络，不支持 load；全局变量在脚本加载后冻结，不可修改
+//
+// 示例:
+//   def response(flow):
+//       flow.response.headers["X-Script"] = "1"
+//       flow.response.body = flow.response.body.replace("foo", "bar")
+
+var errScriptTimeout = errors.New("script timeout")
+
+type Addon struct {
+	proxy.BaseAddon
+	Timeout time.Duration // 每次回调的执行超时，默认 1s
+
+	path    string
+	globals starlark.StringDict
+}
+
+func NewAddon(path string) (*Addon, error) {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	addon := &Addon{
+		Timeout: time.Second,
+		path:    path,
+	}
+	thread := addon.newThread("load")
+	stop := addon.deadline(thread)
+	globals, err := starlark.ExecFile(thread, path, src, nil)
+	stop()
+	if err != nil {
+		return nil, fmt.Errorf("load script %v: %w", path, err)
+	}
+	// 冻结后可在多个 flow 中并发调用
+	globals.Freeze()
+	addon.globals = globals
+	return addon, nil
+}
+
+func (addon *Addon) newThread(name string) *starlark.Thread {
+	return &starlark.Thread{
+		Name: name,
+		Print: func(thread *starlark.Thread, msg string) {
+			log.Infof("script %v: %v", addon.path, msg)
+		},
+		// Load 为空时脚本中的 load 语句报错
+	}
+}
+
+func (addon *Addon) deadline(thread *starlark.Thread) (stop func() bool) {
+	timeout := addon.Timeout
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	timer := time.AfterFunc(timeout, func() {
+		thread.Cancel(errScriptTimeout.Error())
+	})
+	return timer.Stop
+}
+
+func (addon *Addon) call(name string, f *proxy.Flow) {
+	fn, ok := addon.globals[name].(starlark.Callable)
+	if !ok {
+		return
+	}
+
+	sf := newFlow(f)
+	thread := addon.newThread(name)
+	stop := addon.deadline(thread)
+	_, err := starlark.Call(thread, fn, starlark.Tuple{sf}, nil)
+	stop()
+	if err != nil {
+		log.Errorf("script %v %v error: %v", addon.path, name, err)
+		return
+	}
+	if err := sf.apply(); err != nil {
+		log.Errorf("script %v %v apply error: %v", addon.path, name, err)
+	}
+}
+
+func (addon *Addon) Requestheaders(f *proxy.Flow) {
+	addon.call("requestheaders", f)
+}
+
+func (addon *Addon) Request(f *proxy.Flow) {
+	addon.call("request", f)
+}
+
+func (addon *Addon) Responseheaders(f *proxy.Flow) {
+	addon.call("responseheaders", f)
+}
+
+func (addon *Addon) Response(f *proxy.Flow) {
+	addon.call("response", f)
+}
+
+// 暴露给脚本的 flow
+type flow struct {
+	f        *proxy.Flow
+	request  *message
+	response *message
+}
+
+func newFlow(f *proxy.Flow) *flow {
+	sf := &flow{f: f}
+	if f.Request != nil {
+		sf.request = newRequestMessage(f.Request)
+	}
+	if f.Response != nil {
+		sf.response = newResponseMessage(f.Response)
+	}
+	return sf
+}
+
+func (sf *flow) String() string        { return fmt.Sprintf("<flow %v>", sf.f.Id) }
+func (sf *flow) Type() string          { return "flow" }
+func (sf *flow) Freeze()               {}
+func (sf *flow) Truth() starlark.Bool  { return starlark.True }
+func (sf *flow) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: flow") }
+
+func (sf *flow) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "id":
+		return starlark.String(sf.f.Id.String()), nil
+	case "request":
+		if sf.request == nil {
+			return starlark.None, nil
+		}
+		return sf.request, nil
+	case "response":
+		if sf.response == nil {
+			return starlark.None, nil
+		}
+		return sf.response, nil
+	}
+	return nil, nil
+}
+
+func (sf *flow) AttrNames() []string {
+	return []string{"id", "request", "response"}
+}
+
+func (sf *flow) apply() error {
+	if sf.request != nil {
+		if err := sf.request.apply(); err != nil {
+			return err
+		}
+	}
+	if sf.response != nil {
+		if err := sf.response.apply(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flow.request 或 flow.response，脚本返回后将修改写回 flow
+type message struct {
+	req *proxy.Request
+	res *proxy.Response
+
+	method     starlark.String
+	url        starlark.String
+	statusCode starlark.Int
+	headers    *starlark.Dict
+	origHeader map[string]string
+	body       starlark.Value // 读取时才解压
+	bodySet    bool
+}
+
+func newRequestMessage(req *proxy.Request) *message {
+	msg := &message{
+		req:    req,
+		method: starlark.String(req.Method),
+	}
+	if req.URL != nil {
+		msg.url = starlark.String(req.URL.String())
+	}
+	msg.headers, msg.origHeader = headerToDict(req.Header)
+	return msg
+}
+
+func newResponseMessage(res *proxy.Response) *message {
+	msg := &message{
+		res:        res,
+		statusCode: starlark.MakeInt(res.StatusCode),
+	}
+	msg.headers, msg.origHeader = headerToDict(res.Header)
+	return msg
+}
+
+func (msg *message) String() string {
+	if msg.req != nil {
+		return fmt.Sprintf("<request %v %v>", msg.method.GoString(), msg.url.GoString())
+	}
+	return fmt.Sprintf("<response %v>", msg.statusCode)
+}
+func (msg *message) Type() string {
+	if msg.req != nil {
+		return "request"
+	}
+	return "response"
+}
+func (msg *message) Freeze()               {}
+func (msg *message) Truth() starlark.Bool  { return starlark.True }
+func (msg *message) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: %v", msg.Type()) }
+
+func (msg *message) AttrNames() []string {
+	if msg.req != nil {
+		return []string{"body", "headers", "method", "url"}
+	}
+	return []string{"body", "headers", "status_code"}
+}
+
+func (msg *message) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "headers":
+		return msg.headers, nil
+	case "body":
+		return msg.getBody()
+	}
+	if msg.req != nil {
+		switch name {
+		case "method":
+			return msg.method, nil
+		case "url":
+			return msg.url, nil
+		}
+	} else if name == "status_code" {
+		return msg.statusCode, nil
+	}
+	return nil, nil
+}
+
+func (msg *message) SetField(name string, val starlark.Value) error {
+	switch name {
+	case "headers":
+		dict, ok := val.(*starlark.Dict)
+		if !ok {
+			return fmt.Errorf("headers must be dict, got %v", val.Type())
+		}
+		msg.headers = dict
+		return nil
+	case "body":
+		if _, ok := starlark.AsString(val); !ok && val != starlark.None {
+			return fmt.Errorf("body must be string or None, got %v", val.Type())
+		}
+		msg.body = val
+		msg.bodySet = true
+		return nil
+	}
+	if msg.req != nil {
+		switch name {
+		case "method":
+			s, ok := val.(starlark.String)
+			if !ok {
+				return fmt.Errorf("method must be string, got %v", val.Type())
+			}
+			msg.method = s
+			return nil
+		case "url":
+			s, ok := val.(starlark.String)
+			if !ok {
+				return fmt.Errorf("url must be string, got %v", val.Type())
+			}
+			msg.url = s
+			return nil
+		}
+	} else if name == "status_code" {
+		i, ok := val.(starlark.Int)
+		if !ok {
+			return fmt.Errorf("status_code must be int, got %v", val.Type())
+		}
+		msg.statusCode = i
+		return nil
+	}
+	return starlark.NoSuchAttrError(fmt.Sprintf("%v has no .%v field", msg.Type(), name))
+}
+
+func (msg *message) getBody() (starlark.Value, error) {
+	if msg.body != nil {
+		return msg.body, nil
+	}
+
+	var body []byte
+	var err error
+	if msg.req != nil {
+		if msg.req.Body != nil {
+			body, err = msg.req.DecodedBody()
+		}
+	} else if msg.res.Body != nil {
+		body, err = msg.res.DecodedBody()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		msg.body = starlark.None
+	} else {
+		msg.body = starlark.String(body)
+	}
+	return msg.body, nil
+}
+
+func (msg *message) apply() error {
+	var header http.Header
+	if msg.req != nil {
+		header = msg.req.Header
+	} else {
+		header = msg.res.Header
+	}
+	if header == nil {
+		header = make(http.Header)
+	}
+	if err := applyHeaders(header, msg.headers, msg.origHeader); err != nil {
+		return err
+	}
+
+	if msg.req != nil {
+		msg.req.Header = header
+		msg.req.Method = string(msg.method)
+		if msg.req.URL == nil || string(msg.url) != msg.req.URL.String() {
+			u, err := url.Parse(string(msg.url))
+			if err != nil {
+				return err
+			}
+			msg.req.URL = u
+		}
+	} else {
+		msg.res.Header = header
+		code, err := starlark.AsInt32(msg.statusCode)
+		if err != nil {
+			return err
+		}
+		msg.res.StatusCode = code
+	}
+
+	if !msg.bodySet {
+		return nil
+	}
+	var body []byte
+	if s, ok := starlark.AsString(msg.body); ok {
+		body = []byte(s)
+	}
+	if msg.req != nil {
+		msg.req.Body = body
+	} else {
+		msg.res.Body = body
+	}
+	// 写回的 body 为未压缩的内容
+	header.Del("Content-Encoding")
+	header.Del("Transfer-Encoding")
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+func headerToDict(header http.Header) (*starlark.Dict, map[string]string) {
+	dict := starlark.NewDict(len(header))
+	orig := make(map[string]string, len(header))
+	for key, values := range header {
+		value := strings.Join(values, ", ")
+		orig[key] = value
+		_ = dict.SetKey(starlark.String(key), starlark.String(value))
+	}
+	return dict, orig
+}
+
+// 仅写回脚本修改过的 header，未修改的保留原有的多个值
+func applyHeaders(header http.Header, dict *starlark.Dict, orig map[string]string) error {
+	seen := make(map[string]bool)
+	for _, item := range dict.Items() {
+		k, ok := starlark.AsString(item[0])
+		if !ok {
+			return fmt.Errorf("header key must be string, got %v", item[0].Type())
+		}
+		v, ok := starlark.AsString(item[1])
+		if !ok {
+			return fmt.Errorf("header %v value must be string, got %v", k, item[1].Type())
+		}
+		if ov, ok := orig[k]; ok && ov == v {
+			seen[k] = true
+			continue
+		}
+		key := http.CanonicalHeaderKey(k)
+		seen[key] = true
+		header.Set(key, v)
+	}
+	for key := range orig {
+		if !seen[key] {
+			header.Del(key)
+		}
+	}
+	return nil
+}
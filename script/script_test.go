@@ -0,0 +1,121 @@
+package script
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+)
+
+func writeScript(t *testing.T, src string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "script.star")
+	if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newTestFlow() *proxy.Flow {
+	return &proxy.Flow{
+		Request: &proxy.Request{
+			Method: "GET",
+			URL:    &url.URL{Scheme: "https", Host: "example.com", Path: "/"},
+			Header: http.Header{},
+		},
+		Response: &proxy.Response{
+			StatusCode: 200,
+			Header: http.Header{
+				"Content-Type":   []string{"text/html"},
+				"Content-Length": []string{"11"},
+				"Set-Cookie":     []string{"a=1", "b=2"},
+				"X-Remove":       []string{"1"},
+			},
+			Body: []byte("hello world"),
+		},
+	}
+}
+
+func TestAddonModifyResponse(t *testing.T) {
+	addon, err := NewAddon(writeScript(t, `
+def response(flow):
+    flow.response.headers["X-Script"] = "go-mitmproxy"
+    flow.response.headers.pop("X-Remove")
+    flow.response.body = flow.response.body.replace("world", "starlark")
+    if flow.request.url.startswith("https://example.com"):
+        flow.response.status_code = 201
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := newTestFlow()
+	addon.Response(f)
+	if string(f.Response.Body) != "hello starlark" {
+		t.Fatalf("expected body modified, but got %s", f.Response.Body)
+	}
+	if f.Response.StatusCode != 201 {
+		t.Fatalf("expected status 201, but got %v", f.Response.StatusCode)
+	}
+	header := f.Response.Header
+	if header.Get("X-Script") != "go-mitmproxy" {
+		t.Fatalf("expected X-Script header, but got %v", header)
+	}
+	if header.Get("X-Remove") != "" {
+		t.Fatalf("expected X-Remove removed, but got %v", header)
+	}
+	if header.Get("Content-Length") != "14" {
+		t.Fatalf("expected Content-Length 14, but got %v", header.Get("Content-Length"))
+	}
+	// 未修改的 header 保留多个值
+	if len(header["Set-Cookie"]) != 2 {
+		t.Fatalf("expected Set-Cookie preserved, but got %v", header["Set-Cookie"])
+	}
+}
+
+func TestAddonSandbox(t *testing.T) {
+	if _, err := NewAddon(writeScript(t, `load("os.star", "os")`)); err == nil {
+		t.Fatal("expected load not allowed")
+	}
+
+	addon, err := NewAddon(writeScript(t, `
+count = [0]
+def request(flow):
+    count.append(1)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := newTestFlow()
+	addon.Request(f) // 全局变量已冻结，报错但不影响 flow
+	if f.Request.Method != "GET" {
+		t.Fatalf("unexpected method %v", f.Request.Method)
+	}
+}
+
+func TestAddonTimeout(t *testing.T) {
+	addon, err := NewAddon(writeScript(t, `
+def response(flow):
+    for i in range(100000000):
+        flow.response.body = "changed"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addon.Timeout = time.Millisecond * 50
+
+	f := newTestFlow()
+	start := time.Now()
+	addon.Response(f)
+	if time.Since(start) > time.Second {
+		t.Fatalf("expected script canceled by timeout, took %v", time.Since(start))
+	}
+	if !strings.HasPrefix(string(f.Response.Body), "hello") {
+		t.Fatalf("expected body not modified after timeout, but got %s", f.Response.Body)
+	}
+}
@@ -0,0 +1,207 @@
+package summary
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+)
+
+// 汇总抓包期间的 flow，调用 Close 时输出报告
+// 每个 flow 结束时累加计数，不保留 flow 本身，内存占用仅与 host 数相关:
+//   总 flow 数、请求及响应 body 字节数、状态码分布、失败数（无响应或 Addon.Error）、按 flow 数排序的 host
+// format 为 json 时输出 JSON，否则输出文本
+
+const metadataKey = "summary"
+
+type HostStat struct {
+	Host  string `json:"host"`
+	Flows int64  `json:"flows"`
+	Bytes int64  `json:"bytes"` // 请求及响应 body 字节数
+}
+
+type Report struct {
+	Start         time.Time        `json:"start"`
+	End           time.Time        `json:"end"`
+	Duration      float64          `json:"duration"` // 秒
+	Flows         int64            `json:"flows"`
+	Errors        int64            `json:"errors"`
+	RequestBytes  int64            `json:"requestBytes"`
+	ResponseBytes int64            `json:"responseBytes"`
+	Status        map[string]int64 `json:"status"` // 状态码 => flow 数，不含无响应的 flow
+	TopHosts      []*HostStat      `json:"topHosts"`
+}
+
+type Addon struct {
+	proxy.BaseAddon
+	TopHosts int // 报告中的 host 数，默认 10
+
+	w      io.Writer
+	format string
+	start  time.Time
+
+	mu            sync.Mutex
+	flows         int64
+	errors        int64
+	requestBytes  int64
+	responseBytes int64
+	status        map[int]int64
+	hosts         map[string]*HostStat
+}
+
+// 每个 flow 的失败标记，字节数取自 proxy 记录的 Flow.Stats
+type flowStat struct {
+	failed int32
+}
+
+func NewAddon(w io.Writer, format string) *Addon {
+	return &Addon{
+		TopHosts: 10,
+		w:        w,
+		format:   format,
+		start:    time.Now(),
+		status:   make(map[int]int64),
+		hosts:    make(map[string]*HostStat),
+	}
+}
+
+func (a *Addon) Requestheaders(f *proxy.Flow) {
+	if f.Request.Method == "CONNECT" {
+		return
+	}
+	stat := &flowStat{}
+	f.SetMetadata(metadataKey, stat)
+	go func() {
+		<-f.Done()
+		a.record(f, stat)
+	}()
+}
+
+func (a *Addon) Error(f *proxy.Flow, err error) {
+	if stat := getStat(f); stat != nil {
+		atomic.StoreInt32(&stat.failed, 1)
+	}
+}
+
+func getStat(f *proxy.Flow) *flowStat {
+	if v, ok := f.Metadata(metadataKey); ok {
+		return v.(*flowStat)
+	}
+	return nil
+}
+
+func (a *Addon) record(f *proxy.Flow, stat *flowStat) {
+	// 未发往上游（如 addon 直接设置 Response）时 Flow.Stats 无记录，取 body 长度
+	reqBytes := atomic.LoadInt64(&f.Stats.RequestBytes)
+	if reqBytes == 0 {
+		reqBytes = int64(len(f.Request.Body))
+	}
+	resBytes := atomic.LoadInt64(&f.Stats.ResponseBytes)
+	if f.Response != nil && resBytes == 0 {
+		resBytes = int64(len(f.Response.Body))
+	}
+	failed := f.Response == nil || f.Err != nil || atomic.LoadInt32(&stat.failed) == 1
+	host := f.Request.URL.Hostname()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.flows++
+	a.requestBytes += reqBytes
+	a.responseBytes += resBytes
+	if failed {
+		a.errors++
+	}
+	if f.Response != nil {
+		a.status[f.Response.StatusCode]++
+	}
+	h, ok := a.hosts[host]
+	if !ok {
+		h = &HostStat{Host: host}
+		a.hosts[host] = h
+	}
+	h.Flows++
+	h.Bytes += reqBytes + resBytes
+}
+
+// 当前已完成的 flow 的汇总
+func (a *Addon) Report() *Report {
+	end := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	report := &Report{
+		Start:         a.start,
+		End:           end,
+		Duration:      end.Sub(a.start).Seconds(),
+		Flows:         a.flows,
+		Errors:        a.errors,
+		RequestBytes:  a.requestBytes,
+		ResponseBytes: a.responseBytes,
+		Status:        make(map[string]int64, len(a.status)),
+		TopHosts:      make([]*HostStat, 0, len(a.hosts)),
+	}
+	for code, n := range a.status {
+		report.Status[strconv.Itoa(code)] = n
+	}
+	for _, h := range a.hosts {
+		hc := *h
+		report.TopHosts = append(report.TopHosts, &hc)
+	}
+	sort.Slice(report.TopHosts, func(i, j int) bool {
+		hi, hj := report.TopHosts[i], report.TopHosts[j]
+		if hi.Flows != hj.Flows {
+			return hi.Flows > hj.Flows
+		}
+		return hi.Host < hj.Host
+	})
+	if a.TopHosts > 0 && len(report.TopHosts) > a.TopHosts {
+		report.TopHosts = report.TopHosts[:a.TopHosts]
+	}
+	return report
+}
+
+// 写入报告，进行中的 flow 不包含在内
+func (a *Addon) Close() error {
+	report := a.Report()
+	if a.format == "json" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = a.w.Write(append(data, '\n'))
+		return err
+	}
+	return report.writeText(a.w)
+}
+
+func (r *Report) writeText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "duration:\t%v\n", time.Duration(r.Duration*float64(time.Second)).Round(time.Millisecond))
+	fmt.Fprintf(tw, "flows:\t%v\n", r.Flows)
+	fmt.Fprintf(tw, "errors:\t%v\n", r.Errors)
+	fmt.Fprintf(tw, "request bytes:\t%v\n", r.RequestBytes)
+	fmt.Fprintf(tw, "response bytes:\t%v\n", r.ResponseBytes)
+
+	codes := make([]string, 0, len(r.Status))
+	for code := range r.Status {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	fmt.Fprintln(tw, "status:")
+	for _, code := range codes {
+		fmt.Fprintf(tw, "  %v\t%v\n", code, r.Status[code])
+	}
+
+	fmt.Fprintln(tw, "top hosts:")
+	for _, h := range r.TopHosts {
+		fmt.Fprintf(tw, "  %v\t%v flows\t%v bytes\n", h.Host, h.Flows, h.Bytes)
+	}
+	return tw.Flush()
+}
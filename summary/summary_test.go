@@ -0,0 +1,111 @@
+package summary
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+)
+
+func TestSummary(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/notfound" {
+			w.WriteHeader(404)
+		}
+		io.WriteString(w, "hello")
+	}))
+	defer server.Close()
+	port := strconv.Itoa(server.Listener.Addr().(*net.TCPAddr).Port)
+
+	// 无法连接的端口
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	ln.Close()
+
+	testProxy, err := proxy.NewProxy(&proxy.Options{
+		HttpAddr: ":29125",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := new(bytes.Buffer)
+	addon := NewAddon(out, "json")
+	testProxy.AddAddon(addon)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29125")
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	send := func(method, endpoint, body string) {
+		req, err := http.NewRequest(method, endpoint, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := proxyClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}
+	send("GET", "http://localhost:"+port+"/", "")
+	send("GET", "http://localhost:"+port+"/", "")
+	send("POST", "http://localhost:"+port+"/", "data")
+	send("GET", "http://127.0.0.1:"+port+"/notfound", "")
+	send("GET", "http://127.0.0.1:"+closedPort+"/", "")
+	time.Sleep(time.Millisecond * 10) // wait for flows done
+
+	if err := addon.Close(); err != nil {
+		t.Fatal(err)
+	}
+	report := &Report{}
+	if err := json.Unmarshal(out.Bytes(), report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Flows != 5 || report.Errors != 1 || report.RequestBytes != 4 || report.ResponseBytes != 20 {
+		t.Fatalf("unexpected totals %+v", report)
+	}
+	// 连接失败时 f.Response 为 proxy 生成的 502 响应
+	if report.Status["200"] != 3 || report.Status["404"] != 1 || report.Status["502"] != 1 || len(report.Status) != 3 {
+		t.Fatalf("unexpected status %v", report.Status)
+	}
+	if len(report.TopHosts) != 2 {
+		t.Fatalf("unexpected top hosts %v", report.TopHosts)
+	}
+	if h := report.TopHosts[0]; h.Host != "localhost" || h.Flows != 3 || h.Bytes != 19 {
+		t.Fatalf("unexpected top host %+v", h)
+	}
+	if h := report.TopHosts[1]; h.Host != "127.0.0.1" || h.Flows != 2 || h.Bytes != 5 {
+		t.Fatalf("unexpected second host %+v", h)
+	}
+
+	t.Run("text", func(t *testing.T) {
+		out.Reset()
+		addon.format = "text"
+		if err := addon.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out.String(), "flows:           5\n") || !strings.Contains(out.String(), "  localhost  3 flows  19 bytes\n") {
+			t.Fatalf("unexpected text report:\n%v", out.String())
+		}
+	})
+}
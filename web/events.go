@@ -0,0 +1,192 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/match"
+)
+
+// 通过 websocket 推送 flow 生命周期事件（json），便于实现实时监控界面
+// 连接时可通过 query 过滤:
+//   host:   匹配请求 host，支持通配符，如 *.example.com
+//   status: 匹配响应状态码，如 404、5xx，设置后不推送尚无响应的 new 事件
+
+const (
+	flowEventNew      = "new"
+	flowEventHeaders  = "headers"
+	flowEventComplete = "complete"
+	flowEventError    = "error" // flow 结束时仍没有响应
+)
+
+type flowEvent struct {
+	Type   string    `json:"type"`
+	Id     string    `json:"id"`
+	Method string    `json:"method"`
+	Url    string    `json:"url"`
+	Host   string    `json:"host"`
+	Status int       `json:"status,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+type eventFilter struct {
+	host   string
+	status string
+}
+
+func (filter *eventFilter) match(e *flowEvent) bool {
+	if filter.host != "" && !match.Match(e.Host, filter.host) {
+		return false
+	}
+	if filter.status != "" {
+		if e.Status == 0 {
+			return false
+		}
+		return match.Match(strconv.Itoa(e.Status), strings.ReplaceAll(strings.ToLower(filter.status), "x", "?"))
+	}
+	return true
+}
+
+type eventClient struct {
+	filter  *eventFilter
+	msgs    chan []byte
+	dropped int64
+}
+
+type EventStream struct {
+	proxy.BaseAddon
+	BufferSize int // 每个客户端缓存的事件数，缓存满时丢弃新事件，默认 256
+
+	upgrader *websocket.Upgrader
+	clients  map[*eventClient]bool
+	mu       sync.RWMutex
+}
+
+func NewEventStream() *EventStream {
+	return &EventStream{
+		BufferSize: 256,
+		upgrader: &websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+		},
+		clients: make(map[*eventClient]bool),
+	}
+}
+
+func (es *EventStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c, err := es.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Print("upgrade:", err)
+		return
+	}
+	defer c.Close()
+
+	bufferSize := es.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = 256
+	}
+	client := &eventClient{
+		filter: &eventFilter{
+			host:   r.URL.Query().Get("host"),
+			status: r.URL.Query().Get("status"),
+		},
+		msgs: make(chan []byte, bufferSize),
+	}
+	es.mu.Lock()
+	es.clients[client] = true
+	es.mu.Unlock()
+	defer func() {
+		es.mu.Lock()
+		delete(es.clients, client)
+		es.mu.Unlock()
+	}()
+
+	// 仅用于感知客户端断开
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case msg := <-client.msgs:
+			if err := c.WriteMessage(websocket.TextMessage, msg); err != nil {
+				log.Debugf("event stream write: %v", err)
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+func (es *EventStream) publish(eventType string, f *proxy.Flow) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+	if len(es.clients) == 0 {
+		return
+	}
+
+	e := &flowEvent{
+		Type:   eventType,
+		Id:     f.Id.String(),
+		Method: f.Request.Method,
+		Url:    f.Request.URL.String(),
+		Host:   f.Request.URL.Hostname(),
+		Time:   time.Now(),
+	}
+	if f.Response != nil && eventType != flowEventNew {
+		e.Status = f.Response.StatusCode
+	}
+
+	var msg []byte
+	for client := range es.clients {
+		if !client.filter.match(e) {
+			continue
+		}
+		if msg == nil {
+			var err error
+			if msg, err = json.Marshal(e); err != nil {
+				log.Error(err)
+				return
+			}
+		}
+		select {
+		case client.msgs <- msg:
+		default:
+			// 慢速客户端，丢弃事件，避免阻塞 proxy
+			dropped := atomic.AddInt64(&client.dropped, 1)
+			log.Debugf("event stream client slow, dropped %v events", dropped)
+		}
+	}
+}
+
+func (es *EventStream) Requestheaders(f *proxy.Flow) {
+	es.publish(flowEventNew, f)
+	go func() {
+		<-f.Done()
+		if f.Response == nil {
+			es.publish(flowEventError, f)
+		} else {
+			es.publish(flowEventComplete, f)
+		}
+	}()
+}
+
+func (es *EventStream) Responseheaders(f *proxy.Flow) {
+	es.publish(flowEventHeaders, f)
+}
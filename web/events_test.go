@@ -0,0 +1,111 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lqqyt2423/go-mitmproxy/proxy"
+)
+
+func TestEventStream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	events := NewEventStream()
+	eventServer := httptest.NewServer(events)
+	defer eventServer.Close()
+
+	testProxy, err := proxy.NewProxy(&proxy.Options{
+		HttpAddr: ":29093",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testProxy.AddAddon(events)
+	go testProxy.Start()
+	defer testProxy.Close()
+	time.Sleep(time.Millisecond * 10) // wait for test proxy startup
+
+	wsUrl := "ws" + strings.TrimPrefix(eventServer.URL, "http") + "/?host=127.0.0.1"
+	c, _, err := websocket.DefaultDialer.Dial(wsUrl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < 100; i++ {
+		events.mu.RLock()
+		n := len(events.clients)
+		events.mu.RUnlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	proxyClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy: func(r *http.Request) (*url.URL, error) {
+				return url.Parse("http://127.0.0.1:29093")
+			},
+		},
+	}
+	res, err := proxyClient.Get(upstream.URL + "/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	c.SetReadDeadline(time.Now().Add(time.Second * 5))
+	types := make([]string, 0)
+	for _, should := range []string{flowEventNew, flowEventHeaders, flowEventComplete} {
+		_, data, err := c.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := new(flowEvent)
+		if err := json.Unmarshal(data, e); err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, e.Type)
+		if e.Type != should {
+			t.Fatalf("expected events %v, but got %v", should, types)
+		}
+		if e.Url != upstream.URL+"/hello" {
+			t.Fatalf("unexpected event url %v", e.Url)
+		}
+		if e.Type != flowEventNew && e.Status != 200 {
+			t.Fatalf("expected status 200, but got %v", e.Status)
+		}
+	}
+}
+
+func TestEventFilter(t *testing.T) {
+	e := &flowEvent{Host: "api.example.com", Status: 503}
+	cases := []struct {
+		filter *eventFilter
+		should bool
+	}{
+		{&eventFilter{}, true},
+		{&eventFilter{host: "*.example.com"}, true},
+		{&eventFilter{host: "other.com"}, false},
+		{&eventFilter{status: "5xx"}, true},
+		{&eventFilter{status: "503"}, true},
+		{&eventFilter{status: "4xx"}, false},
+	}
+	for _, c := range cases {
+		if got := c.filter.match(e); got != c.should {
+			t.Errorf("filter %+v expected %v, but got %v", c.filter, c.should, got)
+		}
+	}
+	if (&eventFilter{status: "5xx"}).match(&flowEvent{Host: "api.example.com"}) {
+		t.Error("status filter should not match event without status")
+	}
+}
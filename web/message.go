@@ -96,6 +96,10 @@ func newMessageFlow(mType messageType, f *proxy.Flow) *messageFlow {
 		content, err = json.Marshal(f.Response)
 	} else if mType == messageTypeResponseBody {
 		content, err = f.Response.DecodedBody()
+		if errors.Is(err, proxy.ErrDictionaryEncoding) {
+			// 无法解压，展示原始 body
+			err = nil
+		}
 	} else {
 		panic(errors.New("invalid message type"))
 	}
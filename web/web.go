@@ -20,6 +20,8 @@ type WebAddon struct {
 
 	conns   []*concurrentConn
 	connsMu sync.RWMutex
+
+	events *EventStream
 }
 
 func NewWebAddon(addr string) *WebAddon {
@@ -32,6 +34,8 @@ func NewWebAddon(addr string) *WebAddon {
 
 	serverMux := new(http.ServeMux)
 	serverMux.HandleFunc("/echo", web.echo)
+	web.events = NewEventStream()
+	serverMux.Handle("/events", web.events)
 
 	fsys, err := fs.Sub(assets, "client/build")
 	if err != nil {
@@ -123,6 +127,8 @@ func (web *WebAddon) sendFlow(f *proxy.Flow, msgFn func() *messageFlow) bool {
 }
 
 func (web *WebAddon) Requestheaders(f *proxy.Flow) {
+	web.events.Requestheaders(f)
+
 	if f.ConnContext.ClientConn.Tls {
 		web.forEachConn(func(c *concurrentConn) {
 			c.trySendConnMessage(f)
@@ -141,6 +147,8 @@ func (web *WebAddon) Request(f *proxy.Flow) {
 }
 
 func (web *WebAddon) Responseheaders(f *proxy.Flow) {
+	web.events.Responseheaders(f)
+
 	if !f.ConnContext.ClientConn.Tls {
 		web.forEachConn(func(c *concurrentConn) {
 			c.trySendConnMessage(f)